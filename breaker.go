@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBreakerThreshold = 5
+	defaultBreakerWindow    = time.Minute
+	defaultBreakerCooldown  = 30 * time.Second
+)
+
+// ErrCircuitOpen is returned without contacting Grokipedia while the upstream circuit is open
+var ErrCircuitOpen = errors.New("upstream circuit open")
+
+// RateLimitError is returned when Grokipedia answers 429 Too Many Requests.
+// RetryAfter is its Retry-After delay, zero when it sent none.
+type RateLimitError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("rate limited by upstream, retry after %v", e.RetryAfter)
+	}
+	return "rate limited by upstream"
+}
+
+// parseRetryAfter reads a Retry-After header, given in seconds or as an
+// HTTP date, as a delay from now. Missing or malformed values give 0.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(max(seconds, 0)) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(at.Sub(now), 0)
+	}
+	return 0
+}
+
+// Circuit breaker states as reported by /health
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+// upstreamBreaker guards page fetches and headless searches against Grokipedia
+var upstreamBreaker = &circuitBreaker{
+	threshold: defaultBreakerThreshold,
+	window:    defaultBreakerWindow,
+	cooldown:  defaultBreakerCooldown,
+	state:     breakerClosed,
+}
+
+// circuitBreaker opens after threshold consecutive failures within window,
+// fails fast for cooldown, then lets a single probe through (half-open). The
+// probe's outcome closes the circuit again or restarts the cooldown.
+// An upstream rate limit opens it at once, for at least its Retry-After.
+// A threshold of 0 disables the breaker.
+type circuitBreaker struct {
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+
+	mu           sync.Mutex
+	state        string
+	failures     int
+	firstFailure time.Time
+	openUntil    time.Time
+	probing      bool
+}
+
+// allow reports whether a call may go upstream, returning ErrCircuitOpen if not
+func (b *circuitBreaker) allow() error {
+	if b.threshold <= 0 {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Now().Before(b.openUntil) {
+			return ErrCircuitOpen
+		}
+		b.state = breakerHalfOpen
+		b.probing = true
+		return nil
+	case breakerHalfOpen:
+		if b.probing {
+			return ErrCircuitOpen
+		}
+		b.probing = true
+		return nil
+	}
+
+	return nil
+}
+
+// record updates the breaker with the outcome of a call that allow let through
+func (b *circuitBreaker) record(err error) {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if isBreakerNeutral(err) {
+		// A cancelled or refused probe says nothing about the upstream; let the next call probe
+		if b.state == breakerHalfOpen {
+			b.probing = false
+		}
+		return
+	}
+
+	// A missing article or an oversized page is still an answer from a healthy upstream
+	if !isUpstreamFailure(err) {
+		b.state = breakerClosed
+		b.failures = 0
+		b.probing = false
+		return
+	}
+
+	now := time.Now()
+
+	// Grokipedia asked us to back off; more requests would only prolong that
+	var rateLimit *RateLimitError
+	if errors.As(err, &rateLimit) {
+		b.trip(now.Add(max(b.cooldown, rateLimit.RetryAfter)))
+		return
+	}
+
+	switch b.state {
+	case breakerHalfOpen:
+		b.trip(now.Add(b.cooldown))
+	case breakerClosed:
+		if b.failures == 0 || now.Sub(b.firstFailure) > b.window {
+			b.failures = 0
+			b.firstFailure = now
+		}
+		b.failures++
+		if b.failures >= b.threshold {
+			b.trip(now.Add(b.cooldown))
+		}
+	}
+}
+
+// trip opens the circuit until the given time; the caller holds b.mu
+func (b *circuitBreaker) trip(until time.Time) {
+	b.state = breakerOpen
+	b.openUntil = until
+	b.failures = 0
+	b.probing = false
+}
+
+// State returns the current breaker state
+func (b *circuitBreaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// isUpstreamFailure reports whether err points at Grokipedia being unhealthy.
+// Missing articles, oversized pages and neutral errors do not count.
+func isUpstreamFailure(err error) bool {
+	return err != nil &&
+		!isBreakerNeutral(err) &&
+		!errors.Is(err, ErrArticleNotFound) &&
+		!errors.Is(err, ErrPageTooLarge)
+}
+
+// isBreakerNeutral reports whether err never reached Grokipedia or was
+// abandoned by the client, so it counts neither as a success nor a failure.
+func isBreakerNeutral(err error) bool {
+	return errors.Is(err, context.Canceled) ||
+		errors.Is(err, ErrSearchBusy) ||
+		errors.Is(err, ErrCircuitOpen)
+}
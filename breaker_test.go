@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestBreaker returns a closed breaker with a short cooldown
+func newTestBreaker(threshold int) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		window:    time.Minute,
+		cooldown:  20 * time.Millisecond,
+		state:     breakerClosed,
+	}
+}
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	b := newTestBreaker(3)
+	failure := errors.New("connection refused")
+
+	// call runs one call through the breaker, reporting whether it was let through
+	call := func(err error) bool {
+		if b.allow() != nil {
+			return false
+		}
+		b.record(err)
+		return true
+	}
+	expect := func(step, state string) {
+		t.Helper()
+		if got := b.State(); got != state {
+			t.Fatalf("%s: state = %s, want %s", step, got, state)
+		}
+	}
+
+	call(failure)
+	call(failure)
+	call(nil)
+	expect("a success resets the failure count", breakerClosed)
+
+	call(failure)
+	call(failure)
+	expect("below the threshold", breakerClosed)
+	call(failure)
+	expect("threshold reached", breakerOpen)
+
+	if !errors.Is(b.allow(), ErrCircuitOpen) {
+		t.Fatal("open breaker let a call through")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if err := b.allow(); err != nil {
+		t.Fatalf("breaker refused the probe after the cooldown: %v", err)
+	}
+	expect("cooldown over", breakerHalfOpen)
+	if !errors.Is(b.allow(), ErrCircuitOpen) {
+		t.Fatal("half-open breaker let a second call through while probing")
+	}
+	b.record(failure)
+	expect("failed probe", breakerOpen)
+
+	time.Sleep(30 * time.Millisecond)
+	if !call(nil) {
+		t.Fatal("breaker refused the second probe")
+	}
+	expect("successful probe", breakerClosed)
+}
+
+func TestCircuitBreakerIgnoresClientErrors(t *testing.T) {
+	b := newTestBreaker(2)
+	for _, err := range []error{ErrArticleNotFound, ErrPageTooLarge, ErrSearchBusy, context.Canceled, nil} {
+		for range 3 {
+			if b.allow() != nil {
+				t.Fatalf("breaker opened after %v", err)
+			}
+			b.record(err)
+		}
+	}
+	if got := b.State(); got != breakerClosed {
+		t.Errorf("state = %s, want closed", got)
+	}
+
+	// A cancelled probe lets the next call probe instead
+	b.trip(time.Now())
+	if err := b.allow(); err != nil {
+		t.Fatal(err)
+	}
+	b.record(context.Canceled)
+	if err := b.allow(); err != nil {
+		t.Errorf("breaker refused a probe after a cancelled one: %v", err)
+	}
+
+	// A missing article is an answer, so it closes the breaker and clears failures
+	b.record(ErrArticleNotFound)
+	if got := b.State(); got != breakerClosed {
+		t.Errorf("state after a not-found probe = %s, want closed", got)
+	}
+	b.record(errors.New("upstream down"))
+	b.record(ErrPageTooLarge)
+	b.record(errors.New("upstream down"))
+	if got := b.State(); got != breakerClosed {
+		t.Errorf("state = %s, want closed after an oversized page reset the failures", got)
+	}
+}
+
+func TestCircuitBreakerRateLimit(t *testing.T) {
+	b := newTestBreaker(5)
+	b.allow()
+	b.record(&RateLimitError{RetryAfter: time.Hour})
+
+	if got := b.State(); got != breakerOpen {
+		t.Fatalf("state after a rate limit = %s, want open", got)
+	}
+	// Retry-After outlasts the cooldown
+	time.Sleep(30 * time.Millisecond)
+	if !errors.Is(b.allow(), ErrCircuitOpen) {
+		t.Error("breaker let a call through before Retry-After passed")
+	}
+
+	disabled := newTestBreaker(0)
+	disabled.record(&RateLimitError{RetryAfter: time.Hour})
+	if disabled.allow() != nil {
+		t.Error("a breaker with threshold 0 refused a call")
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 0},
+		{"120", 2 * time.Minute},
+		{" 5 ", 5 * time.Second},
+		{"-3", 0},
+		{"Wed, 01 Jan 2025 12:01:30 GMT", 90 * time.Second},
+		{"Wed, 01 Jan 2025 11:00:00 GMT", 0},
+		{"soon", 0},
+	}
+
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.value, now); got != tt.want {
+			t.Errorf("parseRetryAfter(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestArticleCircuitOpen(t *testing.T) {
+	var hits atomic.Int32
+	stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		http.Error(w, "down", http.StatusInternalServerError)
+	}))
+	setGlobal(t, &upstreamBreaker, newTestBreaker(2))
+
+	for _, want := range []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusServiceUnavailable} {
+		rec := request(t, "GET", "/api/article/Foo?nocache=true", nil)
+		if rec.Code != want {
+			t.Errorf("GET /api/article/Foo = %d, want %d", rec.Code, want)
+		}
+	}
+	if hits.Load() != 2 {
+		t.Errorf("upstream was called %d times, want 2 before the circuit opened", hits.Load())
+	}
+}
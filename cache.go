@@ -0,0 +1,583 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultCacheTTL        = 5 * time.Minute
+	defaultCacheMaxEntries = 500
+
+	defaultCacheDirMaxEntries = 10000
+	defaultCacheDirMaxBytes   = 512 << 20
+	// cacheSweepInterval is how often CACHE_DIR is cleared of expired and surplus files
+	cacheSweepInterval = time.Minute
+)
+
+var (
+	// articleCache holds parsed articles keyed by page URL and language
+	articleCache = newCountedCache[Article](newMemoryCache[Article](defaultCacheTTL, defaultCacheMaxEntries), defaultCacheTTL, defaultCacheMaxEntries)
+	// searchCache holds ranked search results keyed by normalized query
+	searchCache = newCountedCache[[]SearchResult](newMemoryCache[[]SearchResult](defaultCacheTTL, defaultCacheMaxEntries), defaultCacheTTL, defaultCacheMaxEntries)
+	// articleDiskCache is the disk layer of articleCache, nil without CACHE_DIR
+	articleDiskCache *diskCache[Article]
+)
+
+// configureCaches rebuilds the caches from CACHE_TTL, CACHE_MAX_ENTRIES and
+// CACHE_DIR. With a directory, articles are also kept on disk behind the
+// memory cache so they survive restarts, up to dirMaxEntries files and
+// dirMaxBytes bytes (CACHE_DIR_MAX_ENTRIES, CACHE_DIR_MAX_BYTES).
+func configureCaches(ttl time.Duration, maxEntries int, dir string, dirMaxEntries int, dirMaxBytes int64) error {
+	var articles Cache[Article] = newMemoryCache[Article](ttl, maxEntries)
+	articleDiskCache = nil
+	if dir != "" {
+		disk, err := newDiskCache[Article](dir, ttl, dirMaxEntries, dirMaxBytes)
+		if err != nil {
+			return err
+		}
+		articles = &layeredCache[Article]{layers: []Cache[Article]{articles, disk}}
+		articleDiskCache = disk
+	}
+
+	articleCache = newCountedCache(articles, ttl, maxEntries)
+	searchCache = newCountedCache[[]SearchResult](newMemoryCache[[]SearchResult](ttl, maxEntries), ttl, maxEntries)
+	return nil
+}
+
+// Cache stores values under string keys until they are older than the
+// cache's TTL. Get reports when the value was first stored, so layered
+// caches can copy entries between layers without extending their life.
+type Cache[V any] interface {
+	Get(key string) (value V, storedAt time.Time, ok bool)
+	Set(key string, value V, storedAt time.Time)
+	// Len is the number of entries currently held
+	Len() int
+	// Name describes the backend in /api/stats
+	Name() string
+}
+
+// memoryCache is an in-memory Cache. When full, expired entries are dropped
+// first, then the oldest one. A ttl of 0 disables it.
+type memoryCache[V any] struct {
+	ttl        time.Duration
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry[V]
+}
+
+type cacheEntry[V any] struct {
+	value    V
+	storedAt time.Time
+}
+
+func newMemoryCache[V any](ttl time.Duration, maxEntries int) *memoryCache[V] {
+	return &memoryCache[V]{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    make(map[string]cacheEntry[V]),
+	}
+}
+
+func (c *memoryCache[V]) Get(key string) (V, time.Time, bool) {
+	var zero V
+	if c.ttl <= 0 {
+		return zero, time.Time{}, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return zero, time.Time{}, false
+	}
+	if time.Since(entry.storedAt) >= c.ttl {
+		delete(c.entries, key)
+		return zero, time.Time{}, false
+	}
+	return entry.value, entry.storedAt, true
+}
+
+func (c *memoryCache[V]) Set(key string, value V, storedAt time.Time) {
+	if c.ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, exists := c.entries[key]; !exists && len(c.entries) >= c.maxEntries {
+		c.evict(time.Now())
+	}
+	c.entries[key] = cacheEntry[V]{value: value, storedAt: storedAt}
+}
+
+// evict makes room for one entry; the caller holds c.mu
+func (c *memoryCache[V]) evict(now time.Time) {
+	var oldestKey string
+	var oldest time.Time
+	for key, entry := range c.entries {
+		if now.Sub(entry.storedAt) >= c.ttl {
+			delete(c.entries, key)
+			continue
+		}
+		if oldestKey == "" || entry.storedAt.Before(oldest) {
+			oldestKey, oldest = key, entry.storedAt
+		}
+	}
+
+	if len(c.entries) >= c.maxEntries && oldestKey != "" {
+		delete(c.entries, oldestKey)
+	}
+}
+
+func (c *memoryCache[V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+func (c *memoryCache[V]) Name() string {
+	return "memory"
+}
+
+// diskCache is a Cache keeping one JSON file per entry in dir, named after
+// the SHA-256 of the key. Files are read lazily on Get and written on Set;
+// expired or unreadable files are removed when they are next looked up, and
+// by sweep, which also keeps the directory within maxEntries files and
+// maxBytes bytes (0 = no limit).
+type diskCache[V any] struct {
+	dir        string
+	ttl        time.Duration
+	maxEntries int
+	maxBytes   int64
+}
+
+// diskEntry is the file format of diskCache
+type diskEntry[V any] struct {
+	Key      string    `json:"key"`
+	StoredAt time.Time `json:"stored_at"`
+	Value    V         `json:"value"`
+}
+
+// newDiskCache opens dir as a diskCache, sweeping out what earlier runs left expired
+func newDiskCache[V any](dir string, ttl time.Duration, maxEntries int, maxBytes int64) (*diskCache[V], error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	c := &diskCache[V]{dir: dir, ttl: ttl, maxEntries: maxEntries, maxBytes: maxBytes}
+	c.sweep(time.Now())
+	return c, nil
+}
+
+func (c *diskCache[V]) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+func (c *diskCache[V]) Get(key string) (V, time.Time, bool) {
+	var zero V
+	if c.ttl <= 0 {
+		return zero, time.Time{}, false
+	}
+
+	path := c.path(key)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Failed to read cache file %s: %v", path, err)
+		}
+		return zero, time.Time{}, false
+	}
+
+	var entry diskEntry[V]
+	if err := json.Unmarshal(data, &entry); err != nil || entry.Key != key || time.Since(entry.StoredAt) >= c.ttl {
+		os.Remove(path)
+		return zero, time.Time{}, false
+	}
+	return entry.Value, entry.StoredAt, true
+}
+
+func (c *diskCache[V]) Set(key string, value V, storedAt time.Time) {
+	if c.ttl <= 0 {
+		return
+	}
+
+	data, err := json.Marshal(diskEntry[V]{Key: key, StoredAt: storedAt, Value: value})
+	if err != nil {
+		log.Printf("Failed to encode cache entry %q: %v", key, err)
+		return
+	}
+
+	// Write to a temporary file first so readers never see a partial entry
+	tmp, err := os.CreateTemp(c.dir, ".tmp-*")
+	if err != nil {
+		log.Printf("Failed to write cache entry %q: %v", key, err)
+		return
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	// The modification time is the entry's age, so sweep need not read the file
+	if err == nil {
+		err = os.Chtimes(tmp.Name(), storedAt, storedAt)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), c.path(key))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		log.Printf("Failed to write cache entry %q: %v", key, err)
+	}
+}
+
+// diskCacheTempMaxAge is how old a temporary file must be before sweep
+// takes it for the leftover of an interrupted Set
+const diskCacheTempMaxAge = time.Hour
+
+// sweep deletes expired entries and abandoned temporary files, then the
+// oldest entries until at most maxEntries files of at most maxBytes bytes
+// in total remain. It returns the number of files deleted.
+func (c *diskCache[V]) sweep(now time.Time) int {
+	dirEntries, err := os.ReadDir(c.dir)
+	if err != nil {
+		log.Printf("Failed to sweep cache directory %s: %v", c.dir, err)
+		return 0
+	}
+
+	type file struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var live []file
+	var total int64
+	removed := 0
+	remove := func(path string) {
+		if err := os.Remove(path); err == nil {
+			removed++
+		} else if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Failed to remove cache file %s: %v", path, err)
+		}
+	}
+
+	for _, entry := range dirEntries {
+		name := entry.Name()
+		isTemp := strings.HasPrefix(name, ".tmp-")
+		if entry.IsDir() || !isTemp && filepath.Ext(name) != ".json" {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		path := filepath.Join(c.dir, name)
+
+		switch age := now.Sub(info.ModTime()); {
+		case isTemp:
+			if age >= diskCacheTempMaxAge {
+				remove(path)
+			}
+		case age >= c.ttl:
+			remove(path)
+		default:
+			live = append(live, file{path: path, size: info.Size(), modTime: info.ModTime()})
+			total += info.Size()
+		}
+	}
+
+	// Oldest first, so the freshest entries survive the caps
+	slices.SortFunc(live, func(a, b file) int { return a.modTime.Compare(b.modTime) })
+	for len(live) > 0 && (c.maxEntries > 0 && len(live) > c.maxEntries || c.maxBytes > 0 && total > c.maxBytes) {
+		remove(live[0].path)
+		total -= live[0].size
+		live = live[1:]
+	}
+
+	if removed > 0 {
+		log.Printf("Swept %d files from cache directory %s", removed, c.dir)
+	}
+	return removed
+}
+
+// runCacheSweeper sweeps the article cache directory every cacheSweepInterval
+func runCacheSweeper() {
+	ticker := time.NewTicker(cacheSweepInterval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		if disk := articleDiskCache; disk != nil {
+			disk.sweep(now)
+		}
+	}
+}
+
+func (c *diskCache[V]) Len() int {
+	matches, _ := filepath.Glob(filepath.Join(c.dir, "*.json"))
+	return len(matches)
+}
+
+func (c *diskCache[V]) Name() string {
+	return "disk"
+}
+
+// layeredCache checks its layers in order, fastest first. A hit in a lower
+// layer is copied into the layers above it; Set writes to every layer.
+type layeredCache[V any] struct {
+	layers []Cache[V]
+}
+
+func (c *layeredCache[V]) Get(key string) (V, time.Time, bool) {
+	for i, layer := range c.layers {
+		if value, storedAt, ok := layer.Get(key); ok {
+			for _, upper := range c.layers[:i] {
+				upper.Set(key, value, storedAt)
+			}
+			return value, storedAt, true
+		}
+	}
+
+	var zero V
+	return zero, time.Time{}, false
+}
+
+func (c *layeredCache[V]) Set(key string, value V, storedAt time.Time) {
+	for _, layer := range c.layers {
+		layer.Set(key, value, storedAt)
+	}
+}
+
+// Len reports the largest layer, which holds every live entry
+func (c *layeredCache[V]) Len() int {
+	n := 0
+	for _, layer := range c.layers {
+		n = max(n, layer.Len())
+	}
+	return n
+}
+
+func (c *layeredCache[V]) Name() string {
+	names := make([]string, len(c.layers))
+	for i, layer := range c.layers {
+		names[i] = layer.Name()
+	}
+	return strings.Join(names, "+")
+}
+
+// countedCache counts the hits and misses of a Cache for /api/stats
+type countedCache[V any] struct {
+	cache      Cache[V]
+	ttl        time.Duration
+	maxEntries int
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+func newCountedCache[V any](cache Cache[V], ttl time.Duration, maxEntries int) *countedCache[V] {
+	return &countedCache[V]{cache: cache, ttl: ttl, maxEntries: maxEntries}
+}
+
+// get returns the live entry for key, counting a hit or a miss
+func (c *countedCache[V]) get(key string) (V, time.Time, bool) {
+	value, storedAt, ok := c.cache.Get(key)
+	if ok {
+		c.hits.Add(1)
+	} else {
+		c.misses.Add(1)
+	}
+	return value, storedAt, ok
+}
+
+// set stores value under key as of now, returning that time
+func (c *countedCache[V]) set(key string, value V) time.Time {
+	now := time.Now()
+	c.cache.Set(key, value, now)
+	return now
+}
+
+// CacheStats describes one cache in /api/stats
+type CacheStats struct {
+	Backend    string  `json:"backend"`
+	Hits       uint64  `json:"hits"`
+	Misses     uint64  `json:"misses"`
+	HitRatio   float64 `json:"hit_ratio"`
+	Entries    int     `json:"entries"`
+	MaxEntries int     `json:"max_entries"`
+	TTL        string  `json:"ttl"`
+}
+
+func (c *countedCache[V]) stats() CacheStats {
+	hits, misses := c.hits.Load(), c.misses.Load()
+	var ratio float64
+	if hits+misses > 0 {
+		ratio = float64(hits) / float64(hits+misses)
+	}
+
+	return CacheStats{
+		Backend:    c.cache.Name(),
+		Hits:       hits,
+		Misses:     misses,
+		HitRatio:   ratio,
+		Entries:    c.cache.Len(),
+		MaxEntries: c.maxEntries,
+		TTL:        c.ttl.String(),
+	}
+}
+
+// StatsResponse is the body of GET /api/stats
+type StatsResponse struct {
+	Caches map[string]CacheStats `json:"caches"`
+}
+
+// statsHandler reports cache effectiveness, to help tune CACHE_TTL and CACHE_MAX_ENTRIES
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, StatsResponse{
+		Caches: map[string]CacheStats{
+			"article": articleCache.stats(),
+			"search":  searchCache.stats(),
+		},
+	}, wantPretty(r))
+}
+
+// cachedArticle returns the article at articlePath, in the given revision
+// when one is set, from articleCache, fetching and caching it on a miss. With
+// fresh, the cache is not read, but the fetched article still replaces the
+// cached one. The result is a copy the caller may modify; storedAt is when it
+// was fetched, and hit reports whether it came from the cache.
+func cachedArticle(ctx context.Context, articlePath, lang, revision string, fresh bool) (article *Article, storedAt time.Time, hit bool, err error) {
+	key := articleCacheKey(articlePath, lang, revision)
+	if !fresh {
+		if cached, storedAt, ok := articleCache.get(key); ok {
+			return &cached, storedAt, true, nil
+		}
+	}
+
+	article, err = getArticle(ctx, articlePath, lang, revision)
+	if err != nil {
+		return nil, time.Time{}, false, err
+	}
+
+	return article, articleCache.set(key, *article), false, nil
+}
+
+// cachedArticleMetadata is cachedArticle for getArticleMetadata. The
+// metadata is cached under a key of its own, so it never stands in for a
+// full article.
+func cachedArticleMetadata(ctx context.Context, articlePath, lang, revision string, fresh bool) (article *Article, storedAt time.Time, hit bool, err error) {
+	key := articleCacheKey(articlePath, lang, revision) + "|meta"
+	if !fresh {
+		if cached, storedAt, ok := articleCache.get(key); ok {
+			return &cached, storedAt, true, nil
+		}
+	}
+
+	article, err = getArticleMetadata(ctx, articlePath, lang, revision)
+	if err != nil {
+		return nil, time.Time{}, false, err
+	}
+
+	return article, articleCache.set(key, *article), false, nil
+}
+
+// cachedArticleSummary is cachedArticle for getArticleSummary. A cached
+// full article answers too, since its summary is the same; only the
+// summary's own key counts towards the stats.
+func cachedArticleSummary(ctx context.Context, articlePath, lang string, fresh bool) (article *Article, storedAt time.Time, hit bool, err error) {
+	key := articleCacheKey(articlePath, lang, "")
+	if !fresh {
+		if cached, storedAt, ok := articleCache.cache.Get(key); ok {
+			articleCache.hits.Add(1)
+			return &cached, storedAt, true, nil
+		}
+	}
+
+	key += "|summary"
+	if !fresh {
+		if cached, storedAt, ok := articleCache.get(key); ok {
+			return &cached, storedAt, true, nil
+		}
+	}
+
+	article, err = getArticleSummary(ctx, articlePath, lang)
+	if err != nil {
+		return nil, time.Time{}, false, err
+	}
+
+	return article, articleCache.set(key, *article), false, nil
+}
+
+// wantFresh reports whether a request asks for an article fetched anew
+// instead of read from the cache, with ?nocache=true or the standard
+// Cache-Control: no-cache (or Pragma: no-cache from HTTP/1.0 clients)
+func wantFresh(r *http.Request) bool {
+	if r.URL.Query().Get("nocache") == "true" {
+		return true
+	}
+	for _, directive := range strings.Split(r.Header.Get("Cache-Control"), ",") {
+		if strings.EqualFold(strings.TrimSpace(directive), "no-cache") {
+			return true
+		}
+	}
+	return r.Header.Get("Cache-Control") == "" && strings.EqualFold(strings.TrimSpace(r.Header.Get("Pragma")), "no-cache")
+}
+
+// setXCache reports in X-Cache whether a response came from the cache: HIT,
+// MISS, or BYPASS when the client asked to skip it
+func setXCache(w http.ResponseWriter, hit, fresh bool) {
+	switch {
+	case fresh:
+		w.Header().Set("X-Cache", "BYPASS")
+	case hit:
+		w.Header().Set("X-Cache", "HIT")
+	default:
+		w.Header().Set("X-Cache", "MISS")
+	}
+}
+
+// setCacheHeaders lets browsers and CDNs cache an article response for as
+// long as articleCache keeps the entry stored at storedAt: max-age is the
+// cache TTL and Age how long the entry has lived. Nothing is set when the
+// cache is disabled.
+func setCacheHeaders(w http.ResponseWriter, storedAt time.Time) {
+	if articleCache.ttl <= 0 {
+		return
+	}
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(articleCache.ttl.Seconds())))
+	w.Header().Set("Age", strconv.Itoa(int(max(0, time.Since(storedAt)).Seconds())))
+}
+
+// articleCacheKey identifies an article fetch by its normalized path,
+// language and revision
+func articleCacheKey(articlePath, lang, revision string) string {
+	if lang == "" {
+		lang = defaultLang
+	}
+	key := normalizePath(articlePath) + "|" + strings.ToLower(lang)
+	if revision != "" {
+		key += "|" + revision
+	}
+	return key
+}
+
+// searchCacheKey identifies a search by its trimmed, case-folded query
+func searchCacheKey(query string) string {
+	return strings.ToLower(strings.Join(strings.Fields(query), " "))
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDiskCacheReload(t *testing.T) {
+	dir := t.TempDir()
+	storedAt := time.Now().Add(-time.Minute)
+
+	cache, err := newDiskCache[Article](dir, time.Hour, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Set("foo", Article{Title: "Foo", Content: "Café"}, storedAt)
+
+	// A new instance, as after a restart, finds the entry with its age
+	reloaded, err := newDiskCache[Article](dir, time.Hour, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	article, gotStoredAt, ok := reloaded.Get("foo")
+	if !ok || article.Title != "Foo" || article.Content != "Café" {
+		t.Fatalf("Get after reload = %+v, %v", article, ok)
+	}
+	if !gotStoredAt.Equal(storedAt) {
+		t.Errorf("storedAt = %v, want %v", gotStoredAt, storedAt)
+	}
+	if _, _, ok := reloaded.Get("bar"); ok {
+		t.Error("Get found a key that was never set")
+	}
+
+	// Expired entries are neither returned nor kept
+	short, err := newDiskCache[Article](dir, 30*time.Second, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := short.Get("foo"); ok || short.Len() != 0 {
+		t.Errorf("expired entry: found %v, %d files left", ok, short.Len())
+	}
+}
+
+func TestDiskCacheSweep(t *testing.T) {
+	now := time.Now()
+	article := Article{Content: strings.Repeat("x", 1000)}
+
+	tests := []struct {
+		name       string
+		maxEntries int
+		maxBytes   int64
+		want       []string
+	}{
+		{"no limits", 0, 0, []string{"fresh1", "fresh2", "fresh3"}},
+		{"entry cap", 2, 0, []string{"fresh2", "fresh3"}},
+		{"byte cap", 0, 1500, []string{"fresh3"}},
+	}
+
+	for _, tt := range tests {
+		dir := t.TempDir()
+		cache := &diskCache[Article]{dir: dir, ttl: time.Hour, maxEntries: tt.maxEntries, maxBytes: tt.maxBytes}
+		cache.Set("expired", article, now.Add(-2*time.Hour))
+		cache.Set("fresh1", article, now.Add(-30*time.Minute))
+		cache.Set("fresh2", article, now.Add(-20*time.Minute))
+		cache.Set("fresh3", article, now.Add(-10*time.Minute))
+
+		// Leftovers of interrupted writes go once they are old
+		stale := filepath.Join(dir, ".tmp-stale")
+		pending := filepath.Join(dir, ".tmp-pending")
+		for _, path := range []string{stale, pending} {
+			if err := os.WriteFile(path, []byte("{"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		old := now.Add(-2 * diskCacheTempMaxAge)
+		if err := os.Chtimes(stale, old, old); err != nil {
+			t.Fatal(err)
+		}
+		// Files the cache did not write are left alone
+		other := filepath.Join(dir, "README")
+		if err := os.WriteFile(other, []byte("keep"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		cache.sweep(now)
+
+		var kept []string
+		for _, key := range []string{"expired", "fresh1", "fresh2", "fresh3"} {
+			if _, err := os.Stat(cache.path(key)); err == nil {
+				kept = append(kept, key)
+			}
+		}
+		if !slices.Equal(kept, tt.want) {
+			t.Errorf("%s: kept %q, want %q", tt.name, kept, tt.want)
+		}
+		if _, err := os.Stat(stale); !os.IsNotExist(err) {
+			t.Errorf("%s: stale temporary file was not removed", tt.name)
+		}
+		for _, path := range []string{pending, other} {
+			if _, err := os.Stat(path); err != nil {
+				t.Errorf("%s: %s was removed", tt.name, filepath.Base(path))
+			}
+		}
+	}
+}
+
+func TestArticleCacheSurvivesRestart(t *testing.T) {
+	var hits atomic.Int32
+	stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		pages{"/page/Foo": articlePage("", "<h1>Foo</h1><p>"+longParagraph+"</p>")}.ServeHTTP(w, r)
+	}))
+	setGlobal(t, &articleDiskCache, nil)
+	dir := t.TempDir()
+
+	for i, want := range []int32{1, 1} {
+		// Each round starts with an empty memory cache, as after a restart
+		if err := configureCaches(time.Hour, 10, dir, 10, 0); err != nil {
+			t.Fatal(err)
+		}
+		article, _, _, err := cachedArticle(context.Background(), "Foo", "", "", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if article.Title != "Foo" || hits.Load() != want {
+			t.Errorf("round %d: title %q after %d upstream requests, want %d", i, article.Title, hits.Load(), want)
+		}
+	}
+	if articleDiskCache == nil || articleCache.cache.Name() != "memory+disk" {
+		t.Errorf("backend = %q with disk cache %v", articleCache.cache.Name(), articleDiskCache)
+	}
+}
+
+func TestArticleCacheHeaders(t *testing.T) {
+	stubUpstream(t, pages{"/page/Foo": articlePage("", "<h1>Foo</h1><p>"+longParagraph+"</p>")})
+	setGlobal(t, &articleDiskCache, nil)
+	setGlobal(t, &articleCache, articleCache)
+	setGlobal(t, &searchCache, searchCache)
+	if err := configureCaches(time.Hour, 10, "", 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	headers := func(target string) (int, string, string) {
+		rec := request(t, "GET", target, nil)
+		return rec.Code, rec.Header().Get("Cache-Control"), rec.Header().Get("Age")
+	}
+
+	// A fresh fetch has just been stored
+	if code, cacheControl, age := headers("/api/article/Foo"); code != http.StatusOK || cacheControl != "public, max-age=3600" || age != "0" {
+		t.Errorf("miss: %d, Cache-Control %q, Age %q", code, cacheControl, age)
+	}
+
+	// A hit is as old as its cache entry
+	key := articleCacheKey("Foo", "", "")
+	article, _, ok := articleCache.cache.Get(key)
+	if !ok {
+		t.Fatal("article was not cached")
+	}
+	articleCache.cache.Set(key, article, time.Now().Add(-10*time.Minute))
+	if code, cacheControl, age := headers("/api/article/Foo"); code != http.StatusOK || cacheControl != "public, max-age=3600" || age != "600" {
+		t.Errorf("hit: %d, Cache-Control %q, Age %q", code, cacheControl, age)
+	}
+
+	// Errors are never cached
+	if code, cacheControl, age := headers("/api/article/Missing"); code != http.StatusNotFound || cacheControl != "" || age != "" {
+		t.Errorf("error: %d, Cache-Control %q, Age %q", code, cacheControl, age)
+	}
+
+	// Without a cache there is nothing to advertise
+	if err := configureCaches(0, 10, "", 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if code, cacheControl, age := headers("/api/article/Foo"); code != http.StatusOK || cacheControl != "" || age != "" {
+		t.Errorf("cache disabled: %d, Cache-Control %q, Age %q", code, cacheControl, age)
+	}
+}
+
+func TestCacheBypass(t *testing.T) {
+	var version atomic.Int32
+	stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		heading := fmt.Sprintf("Version %d", version.Add(1))
+		pages{"/page/Foo": articlePage("", "<h1>"+heading+"</h1><p>"+longParagraph+"</p>")}.ServeHTTP(w, r)
+	}))
+
+	tests := []struct {
+		name    string
+		target  string
+		headers map[string]string
+		xCache  string
+		title   string
+	}{
+		{"first fetch", "/api/article/Foo", nil, "MISS", "Version 1"},
+		{"cached", "/api/article/Foo", nil, "HIT", "Version 1"},
+		{"query", "/api/article/Foo?nocache=true", nil, "BYPASS", "Version 2"},
+		// The bypass refreshed the cache for everyone
+		{"refreshed", "/api/article/Foo", nil, "HIT", "Version 2"},
+		{"Cache-Control", "/api/article/Foo", map[string]string{"Cache-Control": "max-age=0, no-cache"}, "BYPASS", "Version 3"},
+		{"Pragma", "/api/article/Foo", map[string]string{"Pragma": "no-cache"}, "BYPASS", "Version 4"},
+		// Cache-Control takes precedence over Pragma
+		{"Cache-Control without no-cache", "/api/article/Foo", map[string]string{"Cache-Control": "max-age=60", "Pragma": "no-cache"}, "HIT", "Version 4"},
+		{"summary", "/api/summary/Foo?nocache=true", nil, "BYPASS", "Version 5"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.target, nil)
+		for name, value := range tt.headers {
+			req.Header.Set(name, value)
+		}
+		rec := serve(t, newRouter(""), req)
+		var article Article
+		if err := json.Unmarshal(rec.Body.Bytes(), &article); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("%s: GET %s = %d %s", tt.name, tt.target, rec.Code, rec.Body.String())
+		}
+		if got := rec.Header().Get("X-Cache"); got != tt.xCache || article.Title != tt.title {
+			t.Errorf("%s: X-Cache %q, title %q, want %q, %q", tt.name, got, article.Title, tt.xCache, tt.title)
+		}
+	}
+}
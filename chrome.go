@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/chromedp/cdproto/browser"
+	"github.com/chromedp/chromedp"
+)
+
+const (
+	// chromeCheckTTL is how long a Chrome availability result is reused
+	chromeCheckTTL = 5 * time.Minute
+	// chromeCheckTimeout bounds a single launch attempt
+	chromeCheckTimeout = 15 * time.Second
+)
+
+// chromeCheck reports whether headless Chrome can be launched, for readiness checks
+var chromeCheck = &chromeChecker{launch: launchChrome, ttl: chromeCheckTTL}
+
+// chromeStatus is the outcome of launching Chrome
+type chromeStatus struct {
+	Available bool
+	Version   string
+	Err       string
+	CheckedAt time.Time
+}
+
+// chromeChecker launches Chrome at most once per ttl and caches the outcome,
+// so health checks do not start a browser every time. launch is swappable
+// so the check can run without a real browser.
+type chromeChecker struct {
+	launch func(ctx context.Context) (version string, err error)
+	ttl    time.Duration
+
+	mu   sync.Mutex
+	last chromeStatus
+}
+
+// status returns the cached result, launching Chrome again once it is older
+// than ttl. The launch is not tied to any request, so a client hanging up
+// cannot leave a false negative in the cache.
+func (c *chromeChecker) status() chromeStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.last.CheckedAt.IsZero() && time.Since(c.last.CheckedAt) < c.ttl {
+		return c.last
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), chromeCheckTimeout)
+	defer cancel()
+
+	version, err := c.launch(ctx)
+	c.last = chromeStatus{Available: err == nil, Version: version, CheckedAt: time.Now()}
+	if err != nil {
+		c.last.Err = err.Error()
+		log.Printf("Headless Chrome is not available: %v", err)
+	}
+
+	return c.last
+}
+
+// launchChrome starts headless Chrome with the configured options, loads a
+// blank page and returns the browser's product version
+func launchChrome(ctx context.Context) (string, error) {
+	ctx, cancel := newBrowserContext(ctx)
+	defer cancel()
+
+	var product string
+	err := chromedp.Run(ctx,
+		chromedp.Navigate("about:blank"),
+		chromedp.ActionFunc(func(ctx context.Context) error {
+			var err error
+			_, product, _, _, _, err = browser.GetVersion().Do(ctx)
+			return err
+		}),
+	)
+	return product, err
+}
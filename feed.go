@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/xml"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const defaultFeedSize = 20
+
+var (
+	// feedSize is the number of recently fetched articles listed in /feed.xml
+	feedSize = defaultFeedSize
+
+	recentArticles = &recentList{}
+)
+
+// recentEntry is an article recorded for the feed
+type recentEntry struct {
+	Path      string
+	Title     string
+	Summary   string
+	FetchedAt time.Time
+}
+
+// recentList keeps the most recently fetched articles, newest first.
+// Fetching an article again moves it back to the front.
+type recentList struct {
+	mu      sync.Mutex
+	entries []recentEntry
+}
+
+func (l *recentList) add(entry recentEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entries := make([]recentEntry, 0, feedSize)
+	entries = append(entries, entry)
+	for _, e := range l.entries {
+		if len(entries) == feedSize {
+			break
+		}
+		if e.Path != entry.Path {
+			entries = append(entries, e)
+		}
+	}
+	l.entries = entries
+}
+
+func (l *recentList) list() []recentEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]recentEntry(nil), l.entries...)
+}
+
+// recordFetchedArticle adds a successfully fetched article to the feed
+func recordFetchedArticle(articlePath string, article *Article) {
+	if feedSize <= 0 {
+		return
+	}
+
+	recentArticles.add(recentEntry{
+		Path:      articlePath,
+		Title:     article.Title,
+		Summary:   article.Summary,
+		FetchedAt: time.Now(),
+	})
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	Link        string  `xml:"link"`
+	Description string  `xml:"description"`
+	GUID        rssGUID `xml:"guid"`
+	PubDate     string  `xml:"pubDate"`
+}
+
+type rssGUID struct {
+	Value       string `xml:",chardata"`
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+}
+
+// requestOrigin returns the scheme and host the client used to reach this server
+func requestOrigin(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+func feedHandler(w http.ResponseWriter, r *http.Request) {
+	origin := requestOrigin(r)
+
+	feed := rssFeed{
+		Version: "2.0",
+		Channel: rssChannel{
+			Title:         "Grokipedia API - Recently Fetched Articles",
+			Link:          origin + routePrefix + "/",
+			Description:   "Articles most recently fetched through this Grokipedia API server",
+			LastBuildDate: time.Now().Format(time.RFC1123Z),
+		},
+	}
+
+	for _, entry := range recentArticles.list() {
+		link := origin + routePrefix + "/api/article" + entry.Path
+		feed.Channel.Items = append(feed.Channel.Items, rssItem{
+			Title:       entry.Title,
+			Link:        link,
+			Description: entry.Summary,
+			GUID:        rssGUID{Value: link + "#" + entry.FetchedAt.Format(time.RFC3339), IsPermaLink: false},
+			PubDate:     entry.FetchedAt.Format(time.RFC1123Z),
+		})
+	}
+
+	out, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		log.Printf("Failed to encode feed: %v", err)
+		sendError(w, http.StatusInternalServerError, codeInternalError, "Failed to build feed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	w.Write(out)
+}
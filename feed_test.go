@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/xml"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecentList(t *testing.T) {
+	setGlobal(t, &feedSize, 3)
+	list := &recentList{}
+
+	for _, path := range []string{"/page/A", "/page/B", "/page/C", "/page/A", "/page/D"} {
+		list.add(recentEntry{Path: path})
+	}
+
+	var got []string
+	for _, entry := range list.list() {
+		got = append(got, entry.Path)
+	}
+	// A moved back to the front when fetched again; B fell off the end
+	if want := []string{"/page/D", "/page/A", "/page/C"}; !slices.Equal(got, want) {
+		t.Errorf("recent paths = %q, want %q", got, want)
+	}
+}
+
+func TestFeedHandler(t *testing.T) {
+	stubUpstream(t, pages{
+		"/page/Foo":  articlePage("", "<h1>Foo &amp; Bar</h1><p>Foo &lt;b&gt; is used with bar &amp; baz in examples, as a placeholder name.</p>"),
+		"/page/Quux": articlePage("", "<h1>Quux</h1><p>"+longParagraph+"</p>"),
+	})
+	setGlobal(t, &routePrefix, "")
+
+	for _, path := range []string{"Foo", "Quux", "Missing"} {
+		request(t, "GET", "/api/article/"+path, nil)
+	}
+
+	rec := request(t, "GET", "/feed.xml", nil)
+	if ct := rec.Header().Get("Content-Type"); ct != "application/rss+xml; charset=utf-8" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+
+	var feed rssFeed
+	if err := xml.Unmarshal(rec.Body.Bytes(), &feed); err != nil {
+		t.Fatalf("feed does not parse: %v\n%s", err, rec.Body.String())
+	}
+	if feed.Version != "2.0" || feed.Channel.Link != "http://example.com/" {
+		t.Errorf("feed version %q, channel link %q", feed.Version, feed.Channel.Link)
+	}
+
+	// Newest first; the missing article was never recorded
+	want := []rssItem{
+		{Title: "Quux", Link: "http://example.com/api/article/page/Quux", Description: longParagraph},
+		{Title: "Foo & Bar", Link: "http://example.com/api/article/page/Foo", Description: "Foo <b> is used with bar & baz in examples, as a placeholder name."},
+	}
+	if len(feed.Channel.Items) != len(want) {
+		t.Fatalf("feed has %d items, want %d", len(feed.Channel.Items), len(want))
+	}
+	for i, item := range feed.Channel.Items {
+		if item.Title != want[i].Title || item.Link != want[i].Link || item.Description != want[i].Description {
+			t.Errorf("item %d = %+v, want %+v", i, item, want[i])
+		}
+		if _, err := time.Parse(time.RFC1123Z, item.PubDate); err != nil {
+			t.Errorf("item %d pubDate %q: %v", i, item.PubDate, err)
+		}
+		if item.GUID.IsPermaLink || !strings.HasPrefix(item.GUID.Value, item.Link+"#") {
+			t.Errorf("item %d guid = %+v", i, item.GUID)
+		}
+	}
+
+	// Markup in titles and summaries is escaped, not passed through
+	if strings.Contains(rec.Body.String(), "<b>") {
+		t.Error("feed contains unescaped markup from a summary")
+	}
+}
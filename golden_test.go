@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata/golden")
+
+// goldenBaseURL stands in for the fixture server's address in golden
+// files, which changes with every run
+const goldenBaseURL = "https://grokipedia.test"
+
+// readFixture returns a file from testdata/golden
+func readFixture(t *testing.T, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", "golden", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// TestGoldenResponses compares response bodies served from the fixture
+// pages in testdata/golden with the .json golden files next to them, so
+// renamed fields and changed omitempty tags show up as diffs. Run with
+// -update to rewrite the golden files after an intended change.
+func TestGoldenResponses(t *testing.T) {
+	stubUpstream(t, pages{
+		"/page/Ada_Lovelace": readFixture(t, "article_full.html"),
+		"/page/Stub":         readFixture(t, "article_minimal.html"),
+		"/search":            readFixture(t, "search.html"),
+	})
+	setGlobal(t, &searchStrategy, strategyHTTP)
+
+	tests := []struct {
+		golden string
+		target string
+	}{
+		// An article using every optional field the parser fills by default
+		{"article_full.json", "/api/article/Ada_Lovelace"},
+		// One with none of them, so omitempty fields must be absent
+		{"article_minimal.json", "/api/article/Stub"},
+		{"article_minimal_full_schema.json", "/api/article/Stub?full_schema=true"},
+		{"search.json", "/api/search?q=ada"},
+	}
+
+	for _, tt := range tests {
+		rec := request(t, "GET", tt.target, nil)
+		if rec.Code != http.StatusOK {
+			t.Errorf("GET %s = %d %s", tt.target, rec.Code, rec.Body.String())
+			continue
+		}
+
+		var got bytes.Buffer
+		body := strings.ReplaceAll(rec.Body.String(), baseURL, goldenBaseURL)
+		if err := json.Indent(&got, []byte(body), "", "  "); err != nil {
+			t.Fatalf("GET %s: %v", tt.target, err)
+		}
+		got.WriteByte('\n')
+
+		path := filepath.Join("testdata", "golden", tt.golden)
+		if *update {
+			if err := os.WriteFile(path, got.Bytes(), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+
+		want, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("%v (run go test -run TestGoldenResponses -update to create it)", err)
+		}
+		if !bytes.Equal(got.Bytes(), want) {
+			t.Errorf("GET %s does not match %s; if the change is intended, rerun with -update.\ngot:\n%s\nwant:\n%s", tt.target, path, got.Bytes(), want)
+		}
+	}
+}
@@ -0,0 +1,1303 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// request serves a request through the full router, without the outer middleware
+func request(t *testing.T, method, target string, body io.Reader) *httptest.ResponseRecorder {
+	t.Helper()
+	return serve(t, newRouter(""), httptest.NewRequest(method, target, body))
+}
+
+func TestArticleErrors(t *testing.T) {
+	stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/page/Empty":
+			w.Write([]byte(`<html><head><title>Empty</title></head><body><article></article></body></html>`))
+		case "/page/Broken":
+			http.Error(w, "upstream failure", http.StatusInternalServerError)
+		case "/page/Huge":
+			w.Write([]byte(articlePage("", "<h1>Huge</h1><p>"+strings.Repeat("x", 8192)+"</p>")))
+		case "/page/Limited":
+			w.Header().Set("Retry-After", "120")
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	setGlobal(t, &maxFetchBytes, 4096)
+
+	tests := []struct {
+		path       string
+		wantErr    error
+		wantStatus int
+		wantCode   string
+	}{
+		{"Missing", ErrArticleNotFound, http.StatusNotFound, codeArticleNotFound},
+		{"Empty", ErrEmptyContent, http.StatusBadGateway, codeEmptyContent},
+		{"Broken", nil, http.StatusBadGateway, codeUpstreamError},
+		{"Huge", ErrPageTooLarge, http.StatusBadGateway, codeUpstreamTooLarge},
+		{"%5C%5Cevil.com", ErrInvalidPath, http.StatusBadRequest, codeInvalidPath},
+		// The 429 opens the breaker, so the request after it is not even sent
+		{"Limited", nil, http.StatusTooManyRequests, codeRateLimited},
+		{"Foo", ErrCircuitOpen, http.StatusServiceUnavailable, codeUpstreamUnavailable},
+	}
+
+	for _, tt := range tests {
+		rec := request(t, "GET", "/api/article/"+tt.path, nil)
+		if rec.Code != tt.wantStatus {
+			t.Errorf("GET /api/article/%s = %d, want %d", tt.path, rec.Code, tt.wantStatus)
+		}
+		if body := decodeError(t, rec); body.Code != tt.wantCode {
+			t.Errorf("GET /api/article/%s code = %q, want %q", tt.path, body.Code, tt.wantCode)
+		}
+
+		if tt.wantErr == nil {
+			continue
+		}
+		path, _ := url.PathUnescape(tt.path)
+		if _, err := getArticle(context.Background(), path, "", ""); !errors.Is(err, tt.wantErr) {
+			t.Errorf("getArticle(%q) error = %v, want %v", path, err, tt.wantErr)
+		}
+	}
+}
+
+func TestErrorCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{&RateLimitError{RetryAfter: time.Minute}, codeRateLimited},
+		{fmt.Errorf("fetch: %w", &RateLimitError{}), codeRateLimited},
+		{ErrArticleNotFound, codeArticleNotFound},
+		{ErrInvalidPath, codeInvalidPath},
+		{ErrEmptyContent, codeEmptyContent},
+		{ErrSearchBusy, codeSearchBusy},
+		{ErrCircuitOpen, codeUpstreamUnavailable},
+		{ErrHostNotAllowed, codeHostNotAllowed},
+		{fmt.Errorf("%w: more than 10 bytes", ErrPageTooLarge), codeUpstreamTooLarge},
+		{context.DeadlineExceeded, codeUpstreamTimeout},
+		{&url.Error{Op: "Get", URL: "https://grokipedia.com", Err: context.DeadlineExceeded}, codeUpstreamTimeout},
+		// Errors without a code of their own get the fallback
+		{errors.New("connection reset"), "FALLBACK"},
+		{context.Canceled, "FALLBACK"},
+	}
+
+	for _, tt := range tests {
+		if got := errorCode(tt.err, "FALLBACK"); got != tt.want {
+			t.Errorf("errorCode(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestUpstreamErrorStatus(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{context.DeadlineExceeded, http.StatusGatewayTimeout},
+		{&url.Error{Op: "Get", URL: "https://grokipedia.com", Err: context.DeadlineExceeded}, http.StatusGatewayTimeout},
+		{errors.New("connection reset"), http.StatusBadGateway},
+		{fmt.Errorf("%w: more than 10 bytes", ErrPageTooLarge), http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		if got := upstreamErrorStatus(tt.err); got != tt.want {
+			t.Errorf("upstreamErrorStatus(%v) = %d, want %d", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestSummaryLengthControls(t *testing.T) {
+	paragraph := "Dr. Smith founded the company in 1990. It grew quickly over the following decade. Today it employs thousands."
+	stubUpstream(t, pages{"/page/Foo": articlePage("", "<h1>Foo</h1><p>"+paragraph+"</p>")})
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"", paragraph},
+		{"?summary_sentences=1", "Dr. Smith founded the company in 1990."},
+		{"?summary_sentences=2", "Dr. Smith founded the company in 1990. It grew quickly over the following decade."},
+		{"?summary_max_chars=31", "Dr. Smith founded the company…"},
+		{"?summary_sentences=2&summary_max_chars=50", "Dr. Smith founded the company in 1990. It grew…"},
+	}
+
+	for _, tt := range tests {
+		rec := request(t, "GET", "/api/article/Foo"+tt.query, nil)
+		var article Article
+		if err := json.Unmarshal(rec.Body.Bytes(), &article); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("GET /api/article/Foo%s = %d %s", tt.query, rec.Code, rec.Body.String())
+		}
+		if article.Summary != tt.want {
+			t.Errorf("GET /api/article/Foo%s summary = %q, want %q", tt.query, article.Summary, tt.want)
+		}
+		// The content is never shortened by the summary controls
+		if !strings.Contains(article.Content, paragraph) {
+			t.Errorf("GET /api/article/Foo%s content = %q, want the full paragraph", tt.query, article.Content)
+		}
+	}
+}
+
+// exportTests lists the article formats rendered in headless Chrome
+var exportTests = []struct {
+	format      string
+	contentType string
+	magic       string
+}{
+	{formatPDF, "application/pdf", "%PDF"},
+	{formatPNG, "image/png", "\x89PNG\r\n\x1a\n"},
+}
+
+func TestExportCircuitOpen(t *testing.T) {
+	resetState(t)
+	upstreamBreaker.trip(time.Now().Add(time.Minute))
+
+	for _, tt := range exportTests {
+		rec := request(t, "GET", "/api/article/Foo?format="+tt.format, nil)
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("format=%s with the circuit open = %d, want 503", tt.format, rec.Code)
+		}
+		if body := decodeError(t, rec); body.Code != codeUpstreamUnavailable {
+			t.Errorf("format=%s with the circuit open code = %q, want %q", tt.format, body.Code, codeUpstreamUnavailable)
+		}
+		if n := len(searchSlots); n != 0 {
+			t.Errorf("format=%s left %d search slots held", tt.format, n)
+		}
+	}
+}
+
+func TestExport(t *testing.T) {
+	requireChrome(t)
+	stubUpstream(t, pages{"/page/Foo": articlePage("", "<main><h1>Foo</h1><p>"+longParagraph+"</p></main>")})
+
+	for _, tt := range exportTests {
+		rec := request(t, "GET", "/api/article/Foo?format="+tt.format, nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("format=%s = %d %s", tt.format, rec.Code, rec.Body.String())
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != tt.contentType {
+			t.Errorf("format=%s Content-Type = %q, want %q", tt.format, ct, tt.contentType)
+		}
+		if !strings.HasPrefix(rec.Body.String(), tt.magic) {
+			t.Errorf("format=%s body starts with %q, want %q", tt.format, rec.Body.String()[:min(rec.Body.Len(), 8)], tt.magic)
+		}
+		if n := len(searchSlots); n != 0 {
+			t.Errorf("format=%s left %d search slots held", tt.format, n)
+		}
+	}
+}
+
+func TestExportFilename(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/page/Machine_learning", "Machine_learning.pdf"},
+		{"/page/C%2B%2B", "C++.pdf"},
+		{"/page/", "article.pdf"},
+	}
+
+	for _, tt := range tests {
+		if got := exportFilename(tt.path, ".pdf"); got != tt.want {
+			t.Errorf("exportFilename(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestExportUnsupportedFormat(t *testing.T) {
+	rec := request(t, "GET", "/api/article/Foo?format=docx", nil)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("format=docx = %d, want 400", rec.Code)
+	}
+}
+
+func TestScreenshotWidth(t *testing.T) {
+	for _, width := range []string{"abc", "0", "100", "99999"} {
+		rec := request(t, "GET", "/api/article/Foo?format=png&width="+width, nil)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("format=png&width=%s = %d, want 400", width, rec.Code)
+		}
+	}
+}
+
+func TestArticleMaxBytes(t *testing.T) {
+	stubUpstream(t, pages{"/page/Foo": articlePage("", "<h1>Foo</h1><p>"+longParagraph+"</p>")})
+	full := request(t, "GET", "/api/article/Foo", nil)
+	var article Article
+	if err := json.Unmarshal(full.Body.Bytes(), &article); err != nil {
+		t.Fatal(err)
+	}
+	size := len(article.Content)
+
+	tests := []struct {
+		name          string
+		env           map[string]string
+		query         string
+		wantLen       int
+		wantTruncated bool
+	}{
+		{"unlimited", nil, "", size, false},
+		{"exact fit", nil, fmt.Sprintf("?max_bytes=%d", size), size, false},
+		{"one byte short", nil, fmt.Sprintf("?max_bytes=%d", size-1), size - 1, true},
+		{"configured default", map[string]string{"CONTENT_MAX_BYTES": "20"}, "", 20, true},
+		{"query overrides default", map[string]string{"CONTENT_MAX_BYTES": "20"}, "?max_bytes=0", size, false},
+	}
+
+	for _, tt := range tests {
+		setConfig(t, parserSettings(tt.env))
+		rec := request(t, "GET", "/api/article/Foo"+tt.query, nil)
+
+		var body map[string]any
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("%s: GET /api/article/Foo%s = %d %s", tt.name, tt.query, rec.Code, rec.Body.String())
+		}
+		content, _ := body["content"].(string)
+		_, truncated := body["truncated"]
+		if len(content) != tt.wantLen || truncated != tt.wantTruncated {
+			t.Errorf("%s: content is %d bytes, truncated %v, want %d bytes, truncated %v", tt.name, len(content), truncated, tt.wantLen, tt.wantTruncated)
+		}
+	}
+
+	if rec := request(t, "GET", "/api/article/Foo?max_bytes=lots", nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("max_bytes=lots = %d, want 400", rec.Code)
+	}
+}
+
+func TestPprofRoutes(t *testing.T) {
+	paths := []string{"/debug/pprof/", "/debug/pprof/cmdline", "/debug/pprof/heap", "/debug/pprof/symbol"}
+
+	for _, enabled := range []bool{false, true} {
+		setGlobal(t, &enablePprof, enabled)
+		wantStatus := http.StatusNotFound
+		if enabled {
+			wantStatus = http.StatusOK
+		}
+
+		for _, path := range paths {
+			if rec := request(t, "GET", path, nil); rec.Code != wantStatus {
+				t.Errorf("ENABLE_PPROF=%v GET %s = %d, want %d", enabled, path, rec.Code, wantStatus)
+			}
+		}
+	}
+}
+
+func TestArticleFields(t *testing.T) {
+	stubUpstream(t, pages{"/page/Foo": articlePage("", `<h1>Foo</h1><p>`+longParagraph+`</p><div class="categories"><a href="/category/Tests">Tests</a></div>`)})
+
+	tests := []struct {
+		query      string
+		wantStatus int
+		wantKeys   []string
+	}{
+		{"?fields=title", http.StatusOK, []string{"title"}},
+		{"?fields=title,summary,categories", http.StatusOK, []string{"categories", "summary", "title"}},
+		{"?fields=%20title%20,,url", http.StatusOK, []string{"title", "url"}},
+		{"?fields=title,nonsense", http.StatusOK, []string{"title"}},
+		// Fields that are empty are left out like in the full response
+		{"?fields=title,infobox", http.StatusOK, []string{"title"}},
+		{"?fields=title,nonsense&strict=true", http.StatusBadRequest, nil},
+		{"?fields=title,summary&strict=true", http.StatusOK, []string{"summary", "title"}},
+	}
+
+	for _, tt := range tests {
+		rec := request(t, "GET", "/api/article/Foo"+tt.query, nil)
+		if rec.Code != tt.wantStatus {
+			t.Errorf("GET /api/article/Foo%s = %d, want %d", tt.query, rec.Code, tt.wantStatus)
+			continue
+		}
+		if tt.wantStatus != http.StatusOK {
+			if body := decodeError(t, rec); !strings.Contains(body.Message, "nonsense") {
+				t.Errorf("GET /api/article/Foo%s message %q does not name the unknown field", tt.query, body.Message)
+			}
+			continue
+		}
+
+		var body map[string]json.RawMessage
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if keys := slices.Sorted(maps.Keys(body)); !slices.Equal(keys, tt.wantKeys) {
+			t.Errorf("GET /api/article/Foo%s keys = %q, want %q", tt.query, keys, tt.wantKeys)
+		}
+	}
+}
+
+func TestArticleMaliciousPaths(t *testing.T) {
+	var hits atomic.Int32
+	stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { hits.Add(1) }))
+
+	// The router answers "//" and ".." with a redirect to the cleaned path on
+	// this API, which then has to be refused in turn
+	tests := []string{
+		"/api/article/https://evil.com",
+		"/api/article/https:/evil.com/page/Foo",
+		"/api/article/http:/127.0.0.1:8080/admin",
+		"/api/article/javascript:/alert(1)",
+		"/api/article/%5C%5Cevil.com",
+	}
+
+	for _, target := range tests {
+		rec := request(t, "GET", target, nil)
+		if rec.Code == http.StatusMovedPermanently {
+			location := rec.Header().Get("Location")
+			if !strings.HasPrefix(location, "/api/article/") {
+				t.Errorf("GET %s redirects to %q, off the API", target, location)
+				continue
+			}
+			rec = request(t, "GET", location, nil)
+		}
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("GET %s = %d, want 400", target, rec.Code)
+			continue
+		}
+		if body := decodeError(t, rec); body.Code != codeInvalidPath {
+			t.Errorf("GET %s: code = %q, want %q", target, body.Code, codeInvalidPath)
+		}
+	}
+	if hits.Load() != 0 {
+		t.Errorf("upstream received %d requests for malicious paths", hits.Load())
+	}
+}
+
+func TestPrettyJSON(t *testing.T) {
+	stubUpstream(t, pages{"/page/Foo": articlePage("", "<h1>Foo</h1><p>"+longParagraph+"</p>")})
+
+	tests := []struct {
+		name   string
+		env    string
+		target string
+		pretty bool
+	}{
+		{"compact by default", "", "/api/article/Foo", false},
+		{"pretty on request", "", "/api/article/Foo?pretty=true", true},
+		{"PRETTY_JSON default", "true", "/api/article/Foo", true},
+		{"request overrides PRETTY_JSON", "true", "/api/article/Foo?pretty=false", false},
+		{"invalid value ignored", "", "/api/article/Foo?pretty=maybe", false},
+		{"errors follow PRETTY_JSON", "true", "/api/search", true},
+	}
+
+	// Warm the cache so every response carries the same article
+	request(t, "GET", "/api/article/Foo", nil)
+
+	var compact, pretty []byte
+	for _, tt := range tests {
+		setConfig(t, parserSettings(map[string]string{"PRETTY_JSON": tt.env}))
+
+		rec := request(t, "GET", tt.target, nil)
+		body := rec.Body.Bytes()
+		if !json.Valid(body) {
+			t.Fatalf("%s: invalid JSON %s", tt.name, body)
+		}
+		indented := strings.Contains(string(bytes.TrimSpace(body)), "\n  \"")
+		if indented != tt.pretty {
+			t.Errorf("%s: indented = %v, want %v:\n%s", tt.name, indented, tt.pretty, body)
+		}
+		if strings.HasPrefix(tt.target, "/api/article/") {
+			if tt.pretty {
+				pretty = body
+			} else {
+				compact = body
+			}
+		}
+	}
+
+	// Both spellings carry the same document
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, pretty); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), string(bytes.TrimSpace(compact)); got != want {
+		t.Errorf("compacted pretty output differs from the compact output:\n%s\n%s", got, want)
+	}
+}
+
+func TestExists(t *testing.T) {
+	stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/page/Gone":
+			w.WriteHeader(http.StatusGone)
+		case "/page/Limited":
+			w.Header().Set("Retry-After", "30")
+			w.WriteHeader(http.StatusTooManyRequests)
+		case "/page/Broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			pages{
+				"/page/Foo":      articlePage("", "<h1>Foo</h1><p>"+longParagraph+"</p>"),
+				"/page/Soft_404": articlePage("", "<h1>Page not found</h1><p>This page does not exist.</p>"),
+				"/page/Blank":    "<html><body></body></html>",
+			}.ServeHTTP(w, r)
+		}
+	}))
+
+	tests := []struct {
+		path       string
+		wantStatus int
+		exists     bool
+		upstream   int
+	}{
+		{"Foo", http.StatusOK, true, http.StatusOK},
+		{"page/Foo", http.StatusOK, true, http.StatusOK},
+		{"Missing", http.StatusOK, false, http.StatusNotFound},
+		{"Gone", http.StatusOK, false, http.StatusGone},
+		{"Soft%20404", http.StatusOK, false, http.StatusOK},
+		{"Blank", http.StatusOK, false, http.StatusOK},
+		{"Limited", http.StatusTooManyRequests, false, 0},
+		{"Broken", http.StatusBadGateway, false, 0},
+		{"https:/evil.com", http.StatusBadRequest, false, 0},
+	}
+
+	// A rate limit opens the breaker; every case starts with a closed one
+	setGlobal(t, &upstreamBreaker, newTestBreaker(5))
+	for _, tt := range tests {
+		upstreamBreaker = newTestBreaker(5)
+		rec := request(t, "GET", "/api/exists/"+tt.path, nil)
+		if rec.Code != tt.wantStatus {
+			t.Errorf("GET /api/exists/%s = %d, want %d", tt.path, rec.Code, tt.wantStatus)
+			continue
+		}
+		if tt.wantStatus == http.StatusTooManyRequests && rec.Header().Get("Retry-After") != "30" {
+			t.Errorf("GET /api/exists/%s: Retry-After = %q, want 30", tt.path, rec.Header().Get("Retry-After"))
+		}
+		if tt.wantStatus != http.StatusOK {
+			continue
+		}
+
+		var body struct {
+			Exists bool   `json:"exists"`
+			Status int    `json:"status"`
+			URL    string `json:"url"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Exists != tt.exists || body.Status != tt.upstream {
+			t.Errorf("GET /api/exists/%s = exists %v, status %d, want %v, %d", tt.path, body.Exists, body.Status, tt.exists, tt.upstream)
+		}
+		if !strings.HasPrefix(body.URL, baseURL+"/page/") {
+			t.Errorf("GET /api/exists/%s: url = %q", tt.path, body.URL)
+		}
+	}
+}
+
+func TestArticleByID(t *testing.T) {
+	foo := articlePage("", "<h1>Foo Bar</h1><p>"+longParagraph+"</p>")
+	stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/id/12345", "/articles/12345":
+			http.Redirect(w, r, "/page/Foo_Bar", http.StatusFound)
+		case "/id/abc-7":
+			// Served in place, naming the article only through its canonical link
+			fmt.Fprint(w, articlePage(`<link rel="canonical" href="/page/Foo_Bar">`, "<h1>Foo Bar</h1><p>"+longParagraph+"</p>"))
+		case "/id/unslugged":
+			fmt.Fprint(w, foo)
+		default:
+			pages{"/page/Foo_Bar": foo}.ServeHTTP(w, r)
+		}
+	}))
+
+	tests := []struct {
+		name       string
+		idPath     string
+		id         string
+		wantStatus int
+		wantSlug   string
+	}{
+		{"redirect", "/id/{id}", "12345", http.StatusOK, "Foo_Bar"},
+		{"canonical link", "/id/{id}", "abc-7", http.StatusOK, "Foo_Bar"},
+		{"slug from the title", "/id/{id}", "unslugged", http.StatusOK, "Foo_Bar"},
+		{"custom ARTICLE_ID_PATH", "/articles/{id}", "12345", http.StatusOK, "Foo_Bar"},
+		{"unknown ID", "/id/{id}", "999", http.StatusNotFound, ""},
+		{"invalid ID", "/id/{id}", "a.b", http.StatusBadRequest, ""},
+		{"too long", "/id/{id}", strings.Repeat("1", 129), http.StatusBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+		setGlobal(t, &articleIDPath, tt.idPath)
+		resetState(t)
+
+		rec := request(t, "GET", "/api/article/id/"+tt.id, nil)
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%s: GET /api/article/id/%s = %d, want %d", tt.name, tt.id, rec.Code, tt.wantStatus)
+			continue
+		}
+		if tt.wantStatus != http.StatusOK {
+			continue
+		}
+		var article Article
+		if err := json.Unmarshal(rec.Body.Bytes(), &article); err != nil {
+			t.Fatal(err)
+		}
+		if article.Title != "Foo Bar" || article.Slug != tt.wantSlug {
+			t.Errorf("%s: title %q, slug %q, want Foo Bar and %s", tt.name, article.Title, article.Slug, tt.wantSlug)
+		}
+	}
+}
+
+func TestPostArticle(t *testing.T) {
+	longTitle := strings.Repeat("Very_Long_Title_", 40)
+	stubUpstream(t, pages{
+		"/page/Foo_Bar":      articlePage("", "<h1>Foo Bar</h1><p>"+longParagraph+"</p>"),
+		"/page/" + longTitle: articlePage("", "<h1>Long</h1><p>"+longParagraph+"</p>"),
+	})
+
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantCode   string
+		wantTitle  string
+	}{
+		{"full path", `{"path":"/page/Foo_Bar"}`, http.StatusOK, "", "Foo Bar"},
+		{"bare title", `{"path":" Foo Bar "}`, http.StatusOK, "", "Foo Bar"},
+		{"long path", `{"path":"/page/` + longTitle + `"}`, http.StatusOK, "", "Long"},
+		{"unknown article", `{"path":"Missing"}`, http.StatusNotFound, codeArticleNotFound, ""},
+		{"malformed JSON", `{"path":`, http.StatusBadRequest, codeInvalidRequest, ""},
+		{"wrong type", `{"path":42}`, http.StatusBadRequest, codeInvalidRequest, ""},
+		{"missing path", `{}`, http.StatusBadRequest, codeInvalidRequest, ""},
+		{"blank path", `{"path":"   "}`, http.StatusBadRequest, codeInvalidRequest, ""},
+		{"URL instead of a path", `{"path":"https://evil.com/page/Foo"}`, http.StatusBadRequest, codeInvalidPath, ""},
+	}
+
+	for _, tt := range tests {
+		rec := request(t, "POST", "/api/article", strings.NewReader(tt.body))
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%s: POST /api/article = %d, want %d", tt.name, rec.Code, tt.wantStatus)
+			continue
+		}
+		if tt.wantCode != "" {
+			if body := decodeError(t, rec); body.Code != tt.wantCode {
+				t.Errorf("%s: code = %q, want %q", tt.name, body.Code, tt.wantCode)
+			}
+			continue
+		}
+		var article Article
+		if err := json.Unmarshal(rec.Body.Bytes(), &article); err != nil {
+			t.Fatal(err)
+		}
+		if article.Title != tt.wantTitle {
+			t.Errorf("%s: title = %q, want %q", tt.name, article.Title, tt.wantTitle)
+		}
+	}
+
+	// The body gives the same article as the path parameter
+	get := request(t, "GET", "/api/article/Foo_Bar", nil)
+	post := request(t, "POST", "/api/article", strings.NewReader(`{"path":"Foo_Bar"}`))
+	if get.Body.String() != post.Body.String() {
+		t.Errorf("POST body differs from GET:\n%s\n%s", post.Body.String(), get.Body.String())
+	}
+}
+
+func TestStats(t *testing.T) {
+	stubUpstream(t, pages{
+		"/page/Foo": articlePage("", "<h1>Foo</h1><p>"+longParagraph+"</p>"),
+		"/page/Bar": articlePage("", "<h1>Bar</h1><p>"+longParagraph+"</p>"),
+	})
+	setGlobal(t, &searchStrategy, strategyBrowser)
+	setGlobal(t, &searchMaxRetries, 0)
+	setGlobal(t, &browserSearch, func(ctx context.Context, query string, progress func(stage string)) ([]SearchResult, error) {
+		return []SearchResult{{Title: "Foo", URL: baseURL + "/page/Foo"}}, nil
+	})
+
+	targets := []string{
+		"/api/article/Foo",              // miss
+		"/api/article/Foo",              // hit
+		"/api/article/page/Foo",         // hit, same article
+		"/api/article/Bar",              // miss
+		"/api/article/Foo?nocache=true", // not counted: the cache is not read
+		"/api/article/Missing",          // miss, and errors are not cached
+		"/api/article/Missing",          // miss
+		"/api/search?q=foo",             // miss
+		"/api/search?q=foo",             // hit
+		"/api/search?q=FOO",             // hit, same key
+	}
+	for _, target := range targets {
+		request(t, "GET", target, nil)
+	}
+
+	// Concurrent hits are all counted
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			request(t, "GET", "/api/article/Bar", nil)
+		}()
+	}
+	wg.Wait()
+
+	rec := request(t, "GET", "/api/stats", nil)
+	var stats StatsResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		cache        string
+		hits, misses uint64
+		ratio        float64
+		entries      int
+	}{
+		{"article", 22, 4, 22.0 / 26, 2},
+		{"search", 2, 1, 2.0 / 3, 1},
+	}
+	for _, tt := range tests {
+		got := stats.Caches[tt.cache]
+		if got.Hits != tt.hits || got.Misses != tt.misses || got.Entries != tt.entries {
+			t.Errorf("%s cache: %d hits, %d misses, %d entries, want %d, %d, %d", tt.cache, got.Hits, got.Misses, got.Entries, tt.hits, tt.misses, tt.entries)
+		}
+		if math.Abs(got.HitRatio-tt.ratio) > 1e-9 {
+			t.Errorf("%s cache: hit ratio = %v, want %v", tt.cache, got.HitRatio, tt.ratio)
+		}
+		if got.Backend != "memory" || got.TTL != defaultCacheTTL.String() {
+			t.Errorf("%s cache: backend %q, TTL %q", tt.cache, got.Backend, got.TTL)
+		}
+	}
+}
+
+func TestNegotiateFormat(t *testing.T) {
+	const browser = "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,*/*;q=0.8"
+
+	tests := []struct {
+		name    string
+		query   string
+		accept  string
+		want    string
+		wantErr bool
+	}{
+		{"no Accept", "", "", formatJSON, false},
+		{"browser", "", browser, formatJSON, false},
+		{"anything", "", "*/*", formatJSON, false},
+		{"application wildcard", "", "application/*", formatJSON, false},
+		{"JSON", "", "application/json", formatJSON, false},
+		{"markdown only", "", "text/markdown", formatMarkdown, false},
+		{"HTML only", "", "text/html", formatHTML, false},
+		{"PDF only", "", "application/pdf", formatPDF, false},
+		{"image wildcard", "", "image/*", formatPNG, false},
+		{"text wildcard", "", "text/*", formatText, false},
+		{"markdown preferred, then anything", "", "text/markdown, */*;q=0.1", formatJSON, false},
+		{"ranked above JSON", "", "application/json;q=0.5, text/markdown", formatMarkdown, false},
+		{"ranked below JSON", "", "application/json, text/markdown;q=0.5", formatJSON, false},
+		{"tie with JSON", "", "text/markdown, application/json", formatJSON, false},
+		{"wildcard ranked above JSON", "", "application/json;q=0.2, text/*;q=0.9", formatText, false},
+		{"JSON excluded", "", "application/json;q=0, */*", formatText, false},
+		{"JSON excluded, markdown listed", "", "*/*;q=0.5, application/json;q=0, text/markdown;q=0.4", formatText, false},
+		{"tie goes to the type listed first", "", "application/json;q=0, text/markdown, text/html", formatMarkdown, false},
+		{"exclusion beats the wildcard", "", "text/*, text/plain;q=0, application/json;q=0", formatMarkdown, false},
+		{"malformed ranges skipped", "", "text/markdown;q=abc, text/html;q=2, bogus, text/plain", formatText, false},
+		{"only malformed", "", "bogus;;", formatJSON, false},
+		{"nothing we produce", "", "application/xml, image/gif", "", true},
+		{"everything excluded", "", "*/*;q=0", "", true},
+		{"format wins", "format=markdown", "application/json", formatMarkdown, false},
+		{"unknown format", "format=docx", "", "", true},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/api/article/Foo?"+tt.query, nil)
+		if tt.accept != "" {
+			req.Header.Set("Accept", tt.accept)
+		}
+		got, err := negotiateFormat(req)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("%s: negotiateFormat = %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestArticleNotAcceptable(t *testing.T) {
+	stubUpstream(t, pages{"/page/Foo": articlePage("", "<h1>Foo</h1><p>"+longParagraph+"</p>")})
+
+	req := httptest.NewRequest("GET", "/api/article/Foo", nil)
+	req.Header.Set("Accept", "application/xml")
+	rec := serve(t, newRouter(""), req)
+	if rec.Code != http.StatusNotAcceptable {
+		t.Fatalf("Accept: application/xml = %d, want 406", rec.Code)
+	}
+	if body := decodeError(t, rec); body.Code != codeNotAcceptable {
+		t.Errorf("code = %q, want %q", body.Code, codeNotAcceptable)
+	}
+
+	req.Header.Set("Accept", "text/html,application/xhtml+xml,*/*;q=0.8")
+	rec = serve(t, newRouter(""), req)
+	if ct := rec.Header().Get("Content-Type"); rec.Code != http.StatusOK || !strings.HasPrefix(ct, "application/json") {
+		t.Errorf("browser Accept = %d %s, want JSON", rec.Code, ct)
+	}
+}
+
+func TestArticleRevision(t *testing.T) {
+	var requested []string
+	var mu sync.Mutex
+	stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requested = append(requested, r.URL.RequestURI())
+		mu.Unlock()
+		title := "Foo"
+		if oldid := r.URL.Query().Get("oldid"); oldid != "" {
+			title = "Foo revision " + oldid
+		}
+		w.Write([]byte(articlePage("", "<h1>"+title+"</h1><p>"+longParagraph+"</p>")))
+	}))
+
+	tests := []struct {
+		name          string
+		pattern       string
+		query         string
+		wantStatus    int
+		wantRequested string
+		wantTitle     string
+		wantRevision  string
+		wantHeader    string
+	}{
+		{"latest", "{url}?oldid={revision}", "", http.StatusOK, "/page/Foo", "Foo", "", ""},
+		{"revision", "{url}?oldid={revision}", "?revision=42", http.StatusOK, "/page/Foo?oldid=42", "Foo revision 42", "42", ""},
+		{"other revision", "{url}?oldid={revision}", "?revision=a1.b-c_d", http.StatusOK, "/page/Foo?oldid=a1.b-c_d", "Foo revision a1.b-c_d", "a1.b-c_d", ""},
+		// Without revision support the latest version is served instead
+		{"unsupported", "", "?revision=42", http.StatusOK, "/page/Foo", "Foo", "", "unavailable"},
+		{"bad revision", "{url}?oldid={revision}", "?revision=42%2F..", http.StatusBadRequest, "", "", "", ""},
+		{"off-site pattern", "https://evil.com/{revision}", "?revision=42", http.StatusBadRequest, "", "", "", ""},
+	}
+
+	for _, tt := range tests {
+		resetState(t)
+		setGlobal(t, &articleRevisionURL, tt.pattern)
+		requested = nil
+
+		rec := request(t, "GET", "/api/article/Foo"+tt.query, nil)
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, rec.Code, tt.wantStatus, rec.Body.String())
+			continue
+		}
+		if got := rec.Header().Get("X-Revision"); got != tt.wantHeader {
+			t.Errorf("%s: X-Revision = %q, want %q", tt.name, got, tt.wantHeader)
+		}
+		if tt.wantStatus != http.StatusOK {
+			if len(requested) != 0 {
+				t.Errorf("%s: upstream was asked for %q", tt.name, requested)
+			}
+			continue
+		}
+		if !slices.Equal(requested, []string{tt.wantRequested}) {
+			t.Errorf("%s: upstream was asked for %q, want %q", tt.name, requested, tt.wantRequested)
+		}
+
+		var article Article
+		if err := json.Unmarshal(rec.Body.Bytes(), &article); err != nil {
+			t.Fatal(err)
+		}
+		if article.Title != tt.wantTitle || article.RevisionID != tt.wantRevision {
+			t.Errorf("%s: title %q, revision %q, want %q, %q", tt.name, article.Title, article.RevisionID, tt.wantTitle, tt.wantRevision)
+		}
+	}
+}
+
+func TestUpstreamRateLimit(t *testing.T) {
+	var hits atomic.Int32
+	stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Retry-After", "120")
+		http.Error(w, "slow down", http.StatusTooManyRequests)
+	}))
+	setGlobal(t, &searchStrategy, strategyHTTP)
+
+	targets := []string{
+		"/api/article/Foo",
+		"/api/article/Foo?format=text",
+		"/api/summary/Foo",
+		"/api/exists/Foo",
+		"/api/search?q=foo",
+	}
+
+	setGlobal(t, &upstreamBreaker, newTestBreaker(5))
+	for _, target := range targets {
+		resetState(t)
+		upstreamBreaker = newTestBreaker(5)
+		hits.Store(0)
+
+		rec := request(t, "GET", target, nil)
+		if rec.Code != http.StatusTooManyRequests {
+			t.Errorf("GET %s = %d, want 429", target, rec.Code)
+			continue
+		}
+		if got := rec.Header().Get("Retry-After"); got != "120" {
+			t.Errorf("GET %s: Retry-After = %q, want the upstream's 120", target, got)
+		}
+		if body := decodeError(t, rec); body.Code != codeRateLimited {
+			t.Errorf("GET %s: code %q, want %q", target, body.Code, codeRateLimited)
+		}
+
+		// One 429 opens the breaker until Retry-After has passed
+		rec = request(t, "GET", "/api/article/Bar", nil)
+		if rec.Code != http.StatusServiceUnavailable || hits.Load() != 1 {
+			t.Errorf("after GET %s: next article = %d after %d upstream requests, want 503 after 1", target, rec.Code, hits.Load())
+		}
+	}
+}
+
+func TestArticleMetaOnly(t *testing.T) {
+	head := `<meta name="description" content="Foo is a placeholder name.">` +
+		`<meta property="article:modified_time" content="2024-05-01T12:00:00Z">` +
+		`<meta property="og:image" content="/images/foo.jpg">`
+	stubUpstream(t, pages{"/page/Foo": articlePage(head, categoriesFixture+`<p>See <a href="/page/Bar">Bar</a>.</p>`)})
+
+	get := func(target string) (*httptest.ResponseRecorder, map[string]any) {
+		rec := request(t, "GET", target, nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s = %d %s", target, rec.Code, rec.Body.String())
+		}
+		var body map[string]any
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		return rec, body
+	}
+
+	// Asked for first, so a full fetch must not be served from its cache entry
+	_, meta := get("/api/article/Foo?meta_only=true")
+	fullRec, full := get("/api/article/Foo")
+
+	for _, field := range []string{"title", "url", "last_updated", "lead_image", "categories"} {
+		if meta[field] == nil || fmt.Sprint(meta[field]) != fmt.Sprint(full[field]) {
+			t.Errorf("%s: meta-only %v, full %v", field, meta[field], full[field])
+		}
+	}
+	if meta["summary"] != "Foo is a placeholder name." {
+		t.Errorf("meta-only summary = %v, want the meta description", meta["summary"])
+	}
+	for _, field := range []string{"content", "internal_links", "sections", "infobox"} {
+		if value, ok := meta[field]; ok && value != "" {
+			t.Errorf("meta-only response has %s = %v", field, value)
+		}
+	}
+	if full["content"] == "" || full["internal_links"] == nil {
+		t.Errorf("full response lacks content or links: %v", full)
+	}
+
+	// HEAD has the metadata headers and no body
+	server := httptest.NewServer(newRouter(""))
+	defer server.Close()
+	resp, err := http.Head(server.URL + "/api/article/Foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("HEAD = %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Last-Modified"); got != "Wed, 01 May 2024 12:00:00 GMT" {
+		t.Errorf("HEAD Last-Modified = %q", got)
+	}
+	if resp.Header.Get("Content-Type") != fullRec.Header().Get("Content-Type") {
+		t.Errorf("HEAD Content-Type = %q, GET has %q", resp.Header.Get("Content-Type"), fullRec.Header().Get("Content-Type"))
+	}
+}
+
+func TestParseRoutePrefix(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    string
+		wantErr bool
+	}{
+		{"", "", false},
+		{"/", "", false},
+		{"grok", "/grok", false},
+		{"/grok/", "/grok", false},
+		{" /api/v1 ", "/api/v1", false},
+		{"/grok?x=1", "", true},
+		{"/{name}", "", true},
+		{"/grok//wiki", "", true},
+		{"/grok/../admin", "", true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseRoutePrefix(tt.raw)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("parseRoutePrefix(%q) = %q, %v, want %q, error %v", tt.raw, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestRoutePrefix(t *testing.T) {
+	stubUpstream(t, pages{"/page/Foo": articlePage("", "<h1>Foo</h1><p>"+longParagraph+"</p>")})
+	setGlobal(t, &routePrefix, "/grok")
+	router := newRouter(routePrefix)
+
+	for _, path := range []string{"/health", "/livez", "/version", "/openapi.json", "/docs", "/feed.xml", "/api/stats", "/api/article/Foo", "/api/summary/Foo"} {
+		if rec := serve(t, router, httptest.NewRequest("GET", "/grok"+path, nil)); rec.Code != http.StatusOK {
+			t.Errorf("GET /grok%s = %d, want 200", path, rec.Code)
+		}
+		// Only the prefixed routes exist
+		for _, other := range []string{path, "/grokipedia" + path, "/other" + path} {
+			if rec := serve(t, router, httptest.NewRequest("GET", other, nil)); rec.Code != http.StatusNotFound {
+				t.Errorf("GET %s = %d, want 404", other, rec.Code)
+			}
+		}
+	}
+
+	// Links the server hands out point at the prefixed routes
+	rec := serve(t, router, httptest.NewRequest("GET", "/grok/feed.xml", nil))
+	if body := rec.Body.String(); !strings.Contains(body, "http://example.com/grok/api/article/page/Foo") {
+		t.Errorf("feed links ignore the prefix:\n%s", body)
+	}
+}
+
+func TestMarshalFullSchema(t *testing.T) {
+	article := Article{Title: "Stub", URL: "https://grokipedia.com/page/Stub", Content: "Short."}
+
+	compact, err := json.Marshal(article)
+	if err != nil {
+		t.Fatal(err)
+	}
+	full, err := marshalFullSchema(article)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var compactFields, fullFields map[string]json.RawMessage
+	if err := json.Unmarshal(compact, &compactFields); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(full, &fullFields); err != nil {
+		t.Fatalf("full schema output does not parse: %v\n%s", err, full)
+	}
+
+	// Every encoded field of Article is present, in its empty form
+	articleType := reflect.TypeOf(article)
+	for i := range articleType.NumField() {
+		field := articleType.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" || !field.IsExported() {
+			continue
+		}
+		value, ok := fullFields[name]
+		if !ok {
+			t.Errorf("full schema is missing %s", name)
+			continue
+		}
+		var want string
+		switch field.Type.Kind() {
+		case reflect.Slice:
+			want = "[]"
+		case reflect.Map:
+			want = "{}"
+		case reflect.String:
+			want = `""`
+		case reflect.Pointer:
+			want = "null"
+		}
+		if _, set := compactFields[name]; !set && want != "" && string(value) != want {
+			t.Errorf("full schema %s = %s, want %s", name, value, want)
+		}
+	}
+	if len(compactFields) >= len(fullFields) {
+		t.Errorf("default encoding has %d fields, full schema %d; omitempty is not applied", len(compactFields), len(fullFields))
+	}
+
+	// Both decode to the same article
+	var fromCompact, fromFull Article
+	json.Unmarshal(compact, &fromCompact)
+	json.Unmarshal(full, &fromFull)
+	if fromFull.Title != fromCompact.Title || fromFull.URL != fromCompact.URL || fromFull.Content != fromCompact.Content {
+		t.Errorf("full schema decodes to %+v, default to %+v", fromFull, fromCompact)
+	}
+
+	if _, err := marshalFullSchema([]string{"a"}); err == nil {
+		t.Error("marshalFullSchema accepted a slice")
+	}
+}
+
+func TestFetchByURL(t *testing.T) {
+	var hits atomic.Int32
+	stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		pages{
+			"/page/Foo":  articlePage("", "<h1>Foo</h1><p>"+longParagraph+"</p>"),
+			"/page/Café": articlePage("", "<h1>Café</h1><p>"+longParagraph+"</p>"),
+		}.ServeHTTP(w, r)
+	}))
+	u, _ := url.Parse(baseURL)
+
+	tests := []struct {
+		name       string
+		url        string
+		wantStatus int
+		wantCode   string
+		wantTitle  string
+	}{
+		{"on host", baseURL + "/page/Foo", http.StatusOK, "", "Foo"},
+		{"encoded slug", baseURL + "/page/Caf%C3%A9", http.StatusOK, "", "Café"},
+		{"fragment and query", baseURL + "/page/Foo?utm_source=x#History", http.StatusOK, "", "Foo"},
+		{"upper-case host", "http://" + strings.ToUpper(u.Host) + "/page/Foo", http.StatusOK, "", "Foo"},
+		{"unknown article", baseURL + "/page/Missing", http.StatusNotFound, codeArticleNotFound, ""},
+		{"off host", "https://evil.com/page/Foo", http.StatusBadRequest, codeHostNotAllowed, ""},
+		{"userinfo", "http://" + u.Host + "@evil.com/page/Foo", http.StatusBadRequest, codeHostNotAllowed, ""},
+		{"relative", "/page/Foo", http.StatusBadRequest, codeInvalidRequest, ""},
+		{"other scheme", "ftp://" + u.Host + "/page/Foo", http.StatusBadRequest, codeInvalidRequest, ""},
+		{"no path", baseURL + "/", http.StatusBadRequest, codeInvalidPath, ""},
+		{"missing", "", http.StatusBadRequest, codeInvalidRequest, ""},
+	}
+
+	for _, tt := range tests {
+		hits.Store(0)
+		rec := request(t, "GET", "/api/fetch?url="+url.QueryEscape(tt.url), nil)
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, rec.Code, tt.wantStatus, rec.Body.String())
+			continue
+		}
+		if tt.wantStatus != http.StatusOK {
+			if body := decodeError(t, rec); body.Code != tt.wantCode {
+				t.Errorf("%s: code %q, want %q", tt.name, body.Code, tt.wantCode)
+			}
+			if tt.wantStatus == http.StatusBadRequest && hits.Load() != 0 {
+				t.Errorf("%s: rejected URL still reached the upstream", tt.name)
+			}
+			continue
+		}
+		var article Article
+		if err := json.Unmarshal(rec.Body.Bytes(), &article); err != nil {
+			t.Fatal(err)
+		}
+		if article.Title != tt.wantTitle {
+			t.Errorf("%s: title %q, want %q", tt.name, article.Title, tt.wantTitle)
+		}
+	}
+}
+
+func TestContentSeparator(t *testing.T) {
+	const one, two, three = "First paragraph of the article.", "Second paragraph of the article.", "Third paragraph of the article."
+	stubUpstream(t, pages{"/page/Foo": articlePage("", "<h1>Foo</h1><p>"+one+"</p><p>"+two+"</p><p>"+three+"</p>")})
+
+	tests := []struct {
+		config     string
+		query      string
+		wantStatus int
+		wantSep    string
+	}{
+		{"", "", http.StatusOK, "\n\n"},
+		{"", "?separator=%0A", http.StatusOK, "\n"},
+		{"", "?separator=%0D%0A", http.StatusOK, "\r\n"},
+		{"", "?separator=%20", http.StatusOK, " "},
+		// Escapes work in queries as well as in the environment
+		{"", `?separator=\n`, http.StatusOK, "\n"},
+		{`\n`, "", http.StatusOK, "\n"},
+		{`\r\n\r\n`, "", http.StatusOK, "\r\n\r\n"},
+		// The query overrides CONTENT_SEPARATOR
+		{`\n`, "?separator=%20", http.StatusOK, " "},
+		{"", "?separator=%3Cbr%3E", http.StatusBadRequest, ""},
+		{"", "?separator=" + url.QueryEscape(strings.Repeat("\n", 5)), http.StatusBadRequest, ""},
+		{"", `?separator=\x00`, http.StatusBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+		setConfig(t, parserSettings(map[string]string{"CONTENT_SEPARATOR": tt.config}))
+		name := fmt.Sprintf("CONTENT_SEPARATOR=%q %s", tt.config, tt.query)
+
+		rec := request(t, "GET", "/api/article/Foo"+tt.query, nil)
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%s: status %d, want %d", name, rec.Code, tt.wantStatus)
+			continue
+		}
+		if tt.wantStatus != http.StatusOK {
+			continue
+		}
+		var article Article
+		if err := json.Unmarshal(rec.Body.Bytes(), &article); err != nil {
+			t.Fatal(err)
+		}
+		if want := one + tt.wantSep + two + tt.wantSep + three; article.Content != want {
+			t.Errorf("%s: content = %q, want %q", name, article.Content, want)
+		}
+	}
+
+	// An invalid CONTENT_SEPARATOR falls back to the default
+	if cfg := parserSettings(map[string]string{"CONTENT_SEPARATOR": "<hr>"}); cfg.ContentSeparator != defaultContentSeparator {
+		t.Errorf("CONTENT_SEPARATOR=<hr> gives %q", cfg.ContentSeparator)
+	}
+}
+
+func TestParseDenyPaths(t *testing.T) {
+	tests := []struct {
+		value   string
+		path    string
+		denied  bool
+		invalid bool
+	}{
+		{"", "/page/Foo", false, false},
+		{"Foo", "/page/Foo", true, false},
+		{"/page/Foo_Bar/", "page/Foo Bar", true, false},
+		{"/page/Foo", "/page/Foobar", false, false},
+		{`re:^/page/Secret_\d+$`, "/page/Secret_42", true, false},
+		{`re:^/page/Secret_\d+$`, "/page/Secret_Plans", false, false},
+		{"Foo, re:(unclosed", "", false, true},
+	}
+
+	for _, tt := range tests {
+		denylist, err := parseDenyPaths(tt.value)
+		if tt.invalid {
+			if err == nil {
+				t.Errorf("parseDenyPaths(%q) accepted an invalid pattern", tt.value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseDenyPaths(%q): %v", tt.value, err)
+			continue
+		}
+		if got := denylist.denies(tt.path); got != tt.denied {
+			t.Errorf("parseDenyPaths(%q).denies(%q) = %v, want %v", tt.value, tt.path, got, tt.denied)
+		}
+	}
+}
+
+func TestDenyPaths(t *testing.T) {
+	var fetched []string
+	var mu sync.Mutex
+	stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetched = append(fetched, r.URL.Path)
+		mu.Unlock()
+		if r.URL.Path == "/page/Alias" {
+			http.Redirect(w, r, "/page/Secret_1", http.StatusMovedPermanently)
+			return
+		}
+		pages{
+			"/page/Public":   articlePage("", "<h1>Public</h1><p>"+longParagraph+"</p>"),
+			"/page/Secret_1": articlePage("", "<h1>Secret</h1><p>"+longParagraph+"</p>"),
+			"/page/Blocked":  articlePage("", "<h1>Blocked</h1><p>"+longParagraph+"</p>"),
+		}.ServeHTTP(w, r)
+	}))
+	denylist, err := parseDenyPaths(`Blocked, re:^/page/Secret_\d+$`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setGlobal(t, &denyPaths, denylist)
+	resetWatches(t)
+
+	tests := []struct {
+		method  string
+		target  string
+		body    string
+		want    int
+		fetches bool
+	}{
+		{"GET", "/api/article/Public", "", http.StatusOK, true},
+		{"GET", "/api/article/Blocked", "", http.StatusForbidden, false},
+		{"GET", "/api/article/page/Blocked", "", http.StatusForbidden, false},
+		{"GET", "/api/article/Secret_1", "", http.StatusForbidden, false},
+		{"GET", "/api/summary/Blocked", "", http.StatusForbidden, false},
+		{"GET", "/api/exists/Blocked", "", http.StatusForbidden, false},
+		{"POST", "/api/watch", `{"path":"Blocked","webhook_url":"https://example.com/hook"}`, http.StatusForbidden, false},
+		// Only the page a redirect ends on shows it is blocked
+		{"GET", "/api/article/Alias", "", http.StatusForbidden, true},
+		{"GET", "/api/summary/Alias", "", http.StatusForbidden, true},
+		{"POST", "/api/watch", `{"path":"Alias","webhook_url":"https://example.com/hook"}`, http.StatusForbidden, true},
+	}
+
+	for _, tt := range tests {
+		resetState(t)
+		fetched = nil
+		rec := request(t, tt.method, tt.target, strings.NewReader(tt.body))
+		if rec.Code != tt.want {
+			t.Errorf("%s %s %s = %d, want %d", tt.method, tt.target, tt.body, rec.Code, tt.want)
+			continue
+		}
+		if tt.want == http.StatusForbidden {
+			if body := decodeError(t, rec); body.Code != codePathDenied || !strings.Contains(body.Message, "blocked") {
+				t.Errorf("%s %s %s: %+v", tt.method, tt.target, tt.body, body)
+			}
+		}
+		if (len(fetched) > 0) != tt.fetches {
+			t.Errorf("%s %s %s fetched %q upstream", tt.method, tt.target, tt.body, fetched)
+		}
+	}
+	if n := watches.count(); n != 0 {
+		t.Errorf("%d watches registered for blocked articles, want 0", n)
+	}
+}
+
+func TestArticleSummaryEndpoint(t *testing.T) {
+	short := "Too short to summarize anything."
+	stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/page/Broken" {
+			http.Error(w, "upstream failure", http.StatusInternalServerError)
+			return
+		}
+		pages{
+			"/page/Plain": articlePage("", "<h1>Plain</h1><p>"+short+"</p><p>"+longParagraph+"</p><p>Later "+longParagraph+"</p>"),
+			"/page/Meta": articlePage(`<meta property="og:description" content="From the og tag."><meta property="og:image" content="/images/lead.png">`,
+				"<h1>Meta</h1><p>"+longParagraph+"</p>"),
+			"/page/Image": articlePage("", `<h1>Image</h1><img src="/images/inline.jpg" width="600"><p>`+longParagraph+"</p>"),
+			"/page/Empty": `<html><head><title>Empty</title></head><body><article></article></body></html>`,
+		}.ServeHTTP(w, r)
+	}))
+
+	tests := []struct {
+		name     string
+		settings map[string]string
+	}{
+		{"Plain", nil},
+		{"Image", nil},
+		{"Meta", nil},
+		{"Meta", map[string]string{"SUMMARY_SOURCES": "og,content"}},
+		{"Plain", map[string]string{"SUMMARY_SOURCES": "meta,og,content", "MIN_SUMMARY_RUNES": "5"}},
+	}
+
+	for _, tt := range tests {
+		setConfig(t, parserSettings(tt.settings))
+		resetState(t)
+
+		// The summary endpoint answers with the fields of the full article
+		rec := request(t, "GET", "/api/article/"+tt.name, nil)
+		var article Article
+		if err := json.Unmarshal(rec.Body.Bytes(), &article); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("%s %v: article = %d %s", tt.name, tt.settings, rec.Code, rec.Body.String())
+		}
+		resetState(t)
+		rec = request(t, "GET", "/api/summary/"+tt.name, nil)
+		var summary ArticleSummary
+		if err := json.Unmarshal(rec.Body.Bytes(), &summary); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("%s %v: summary = %d %s", tt.name, tt.settings, rec.Code, rec.Body.String())
+		}
+
+		want := ArticleSummary{Title: article.Title, Summary: article.Summary, LeadImage: article.LeadImage, URL: article.URL}
+		if summary != want {
+			t.Errorf("%s %v: summary endpoint = %+v, article has %+v", tt.name, tt.settings, summary, want)
+		}
+		if summary.Summary == "" {
+			t.Errorf("%s %v: empty summary", tt.name, tt.settings)
+		}
+	}
+
+	// Failures match the full endpoint's status and code
+	setConfig(t, parserSettings(nil))
+	for _, name := range []string{"Missing", "Empty", "Broken"} {
+		resetState(t)
+		full := request(t, "GET", "/api/article/"+name, nil)
+		resetState(t)
+		rec := request(t, "GET", "/api/summary/"+name, nil)
+		if rec.Code != full.Code || decodeError(t, rec).Code != decodeError(t, full).Code {
+			t.Errorf("%s: summary = %d %s, article = %d %s", name, rec.Code, rec.Body.String(), full.Code, full.Body.String())
+		}
+		if name == "Missing" && rec.Code != http.StatusNotFound {
+			t.Errorf("%s: summary = %d, want 404", name, rec.Code)
+		}
+	}
+}
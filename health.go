@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+)
+
+const (
+	// upstreamCheckTTL is how long an upstream reachability result is reused
+	upstreamCheckTTL = 30 * time.Second
+	// upstreamCheckTimeout bounds a single reachability probe
+	upstreamCheckTimeout = 5 * time.Second
+)
+
+// Readiness check results
+const (
+	checkPass = "pass"
+	checkFail = "fail"
+)
+
+// HealthResponse represents health check response
+type HealthResponse struct {
+	Status    string `json:"status"`
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildTime string `json:"build_time,omitempty"`
+	Time      string `json:"time"`
+	// Upstream is the state of the Grokipedia circuit breaker: closed, open or half-open
+	Upstream string `json:"upstream"`
+}
+
+// LivenessResponse is the body of GET /livez
+type LivenessResponse struct {
+	Status string `json:"status"`
+}
+
+// VersionResponse is the body of GET /version
+type VersionResponse struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildTime string `json:"build_time,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+// ReadinessResponse is the body of GET /readyz and GET /health/ready
+type ReadinessResponse struct {
+	// Status is "ready", or "not_ready" when any check fails (served with 503)
+	Status          string `json:"status"`
+	ChromeAvailable bool   `json:"chrome_available"`
+	ChromeVersion   string `json:"chrome_version,omitempty"`
+	ChromeError     string `json:"chrome_error,omitempty"`
+	// ChromeCheckedAt is when Chrome was last launched; results are reused for 5 minutes
+	ChromeCheckedAt string `json:"chrome_checked_at"`
+	Upstream        string `json:"upstream"`
+	// Checks holds the outcome of each sub-check: chrome, upstream and circuit_breaker
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+// CheckResult is the outcome of one readiness check
+type CheckResult struct {
+	// Status is "pass" or "fail"
+	Status string `json:"status"`
+	// Detail describes the outcome, e.g. the Chrome version or the error
+	Detail    string `json:"detail,omitempty"`
+	CheckedAt string `json:"checked_at,omitempty"`
+}
+
+// upstreamCheck reports whether Grokipedia answers, for readiness checks
+var upstreamCheck = &upstreamChecker{probe: probeUpstream, ttl: upstreamCheckTTL}
+
+// upstreamStatus is the outcome of probing Grokipedia
+type upstreamStatus struct {
+	Reachable bool
+	Err       string
+	CheckedAt time.Time
+}
+
+// upstreamChecker probes Grokipedia at most once per ttl and caches the
+// outcome, like chromeChecker. probe is swappable so the check can run
+// without network access.
+type upstreamChecker struct {
+	probe func(ctx context.Context) error
+	ttl   time.Duration
+
+	mu   sync.Mutex
+	last upstreamStatus
+}
+
+// status returns the cached result, probing again once it is older than ttl
+func (c *upstreamChecker) status() upstreamStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.last.CheckedAt.IsZero() && time.Since(c.last.CheckedAt) < c.ttl {
+		return c.last
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), upstreamCheckTimeout)
+	defer cancel()
+
+	err := c.probe(ctx)
+	c.last = upstreamStatus{Reachable: err == nil, CheckedAt: time.Now()}
+	if err != nil {
+		c.last.Err = err.Error()
+		log.Printf("Grokipedia is not reachable: %v", err)
+	}
+
+	return c.last
+}
+
+// probeUpstream requests the Grokipedia home page. Any answer below 500
+// counts as reachable. The probe bypasses the circuit breaker, so it keeps
+// telling whether Grokipedia is back while the circuit is open.
+func probeUpstream(ctx context.Context) error {
+	req, err := newUpstreamRequest(ctx, baseURL+"/", "")
+	if err != nil {
+		return err
+	}
+
+	resp, err := upstreamClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// healthHandler serves GET /health, kept for compatibility: it always
+// answers 200 like /livez, with build information and the circuit state
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	response := HealthResponse{
+		Status:    "ok",
+		Version:   version,
+		Commit:    commit,
+		BuildTime: buildTime,
+		Time:      time.Now().Format(time.RFC3339),
+		Upstream:  upstreamBreaker.State(),
+	}
+	writeJSON(w, http.StatusOK, response, wantPretty(r))
+}
+
+// livenessHandler serves GET /livez. It checks nothing beyond the process
+// answering, so an orchestrator only restarts the server when it hangs.
+func livenessHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, LivenessResponse{Status: "ok"}, wantPretty(r))
+}
+
+// versionHandler reports which build is running. Unlike /health it carries
+// no state, so it answers the same however the server is doing.
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, VersionResponse{
+		Version:   version,
+		Commit:    commit,
+		BuildTime: buildTime,
+		GoVersion: runtime.Version(),
+	}, wantPretty(r))
+}
+
+// readinessHandler serves GET /readyz and GET /health/ready. The server is
+// ready when headless Chrome launches, Grokipedia answers and the upstream
+// circuit is not open; each check is reported in checks.
+func readinessHandler(w http.ResponseWriter, r *http.Request) {
+	chrome := chromeCheck.status()
+	upstream := upstreamCheck.status()
+	// Read the breaker once so the report cannot contradict itself
+	breaker := upstreamBreaker.State()
+	response := ReadinessResponse{
+		Status:          "ready",
+		ChromeAvailable: chrome.Available,
+		ChromeVersion:   chrome.Version,
+		ChromeError:     chrome.Err,
+		ChromeCheckedAt: chrome.CheckedAt.Format(time.RFC3339),
+		Upstream:        breaker,
+		Checks: map[string]CheckResult{
+			"chrome":          checkResult(chrome.Available, chrome.Version, chrome.Err, chrome.CheckedAt),
+			"upstream":        checkResult(upstream.Reachable, "reachable", upstream.Err, upstream.CheckedAt),
+			"circuit_breaker": checkResult(breaker != breakerOpen, breaker, breaker, time.Time{}),
+		},
+	}
+
+	status := http.StatusOK
+	for _, check := range response.Checks {
+		if check.Status != checkPass {
+			response.Status = "not_ready"
+			status = http.StatusServiceUnavailable
+			break
+		}
+	}
+	writeJSON(w, status, response, wantPretty(r))
+}
+
+// checkResult builds a CheckResult with passDetail or failDetail as its
+// detail. A zero checkedAt is left out, for checks evaluated on every request.
+func checkResult(ok bool, passDetail, failDetail string, checkedAt time.Time) CheckResult {
+	result := CheckResult{Status: checkPass, Detail: passDetail}
+	if !ok {
+		result = CheckResult{Status: checkFail, Detail: failDetail}
+	}
+	if !checkedAt.IsZero() {
+		result.CheckedAt = checkedAt.Format(time.RFC3339)
+	}
+	return result
+}
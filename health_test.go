@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthBuildInfo(t *testing.T) {
+	resetState(t)
+	setGlobal(t, &version, "v1.2.3")
+	setGlobal(t, &commit, "abc1234")
+	setGlobal(t, &buildTime, "2025-10-29T10:30:00Z")
+
+	rec := request(t, "GET", "/health", nil)
+	var body HealthResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("GET /health = %d %s", rec.Code, rec.Body.String())
+	}
+	if body.Version != "v1.2.3" || body.Commit != "abc1234" || body.BuildTime != "2025-10-29T10:30:00Z" {
+		t.Errorf("health build info = %+v", body)
+	}
+	if body.Status != "ok" || body.Upstream != breakerClosed {
+		t.Errorf("health status %q, upstream %q", body.Status, body.Upstream)
+	}
+}
+
+func TestVersion(t *testing.T) {
+	resetState(t)
+	setGlobal(t, &version, "v1.2.3")
+	setGlobal(t, &commit, "abc1234")
+	setGlobal(t, &buildTime, "2025-10-29T10:30:00Z")
+
+	// /version answers the same while the upstream is failing
+	upstreamBreaker = newTestBreaker(1)
+	upstreamBreaker.record(errors.New("upstream down"))
+	var health HealthResponse
+	if rec := request(t, "GET", "/health", nil); json.Unmarshal(rec.Body.Bytes(), &health) != nil || health.Upstream != breakerOpen {
+		t.Fatalf("GET /health with the circuit open = %d %s", rec.Code, rec.Body.String())
+	}
+
+	rec := request(t, "GET", "/version", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /version = %d %s", rec.Code, rec.Body.String())
+	}
+	var body map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"version":    "v1.2.3",
+		"commit":     "abc1234",
+		"build_time": "2025-10-29T10:30:00Z",
+		"go_version": runtime.Version(),
+	}
+	if !maps.Equal(body, want) {
+		t.Errorf("GET /version = %v, want %v", body, want)
+	}
+}
+
+func TestLoadBuildInfo(t *testing.T) {
+	// Values set through -ldflags are kept
+	setGlobal(t, &version, "v1.2.3")
+	setGlobal(t, &commit, "abc1234")
+	setGlobal(t, &buildTime, "2025-10-29T10:30:00Z")
+	loadBuildInfo()
+	if version != "v1.2.3" || commit != "abc1234" || buildTime != "2025-10-29T10:30:00Z" {
+		t.Errorf("after loadBuildInfo: version %q, commit %q, build time %q", version, commit, buildTime)
+	}
+
+	// Without them the version is never empty
+	version, commit, buildTime = "", "", ""
+	loadBuildInfo()
+	if version == "" {
+		t.Error("loadBuildInfo left the version empty")
+	}
+}
+
+func TestChromeChecker(t *testing.T) {
+	var launches atomic.Int32
+	fail := atomic.Bool{}
+	checker := &chromeChecker{ttl: 50 * time.Millisecond, launch: func(ctx context.Context) (string, error) {
+		launches.Add(1)
+		if _, ok := ctx.Deadline(); !ok {
+			t.Error("Chrome was launched without a timeout")
+		}
+		if fail.Load() {
+			return "", errors.New(`exec: "google-chrome": executable file not found in $PATH`)
+		}
+		return "HeadlessChrome/120.0.6099.109", nil
+	}}
+
+	first := checker.status()
+	if !first.Available || first.Version != "HeadlessChrome/120.0.6099.109" || first.Err != "" {
+		t.Errorf("status = %+v", first)
+	}
+	// Within the TTL the result is reused, even if Chrome has gone since
+	fail.Store(true)
+	if second := checker.status(); second != first || launches.Load() != 1 {
+		t.Errorf("second status = %+v after %d launches, want the cached result after 1", second, launches.Load())
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	third := checker.status()
+	if third.Available || third.Version != "" || !strings.Contains(third.Err, "not found") || launches.Load() != 2 {
+		t.Errorf("status after the TTL = %+v after %d launches", third, launches.Load())
+	}
+	if !third.CheckedAt.After(first.CheckedAt) {
+		t.Error("CheckedAt did not move on with the new launch")
+	}
+}
+
+func TestReadinessReportsChrome(t *testing.T) {
+	resetState(t)
+	setGlobal(t, &upstreamCheck, &upstreamChecker{ttl: time.Minute, probe: func(ctx context.Context) error { return nil }})
+
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+	}{
+		{"available", nil, http.StatusOK},
+		{"missing", errors.New("chrome failed to start"), http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		setGlobal(t, &chromeCheck, &chromeChecker{ttl: time.Minute, launch: func(ctx context.Context) (string, error) {
+			if tt.err != nil {
+				return "", tt.err
+			}
+			return "HeadlessChrome/120.0", nil
+		}})
+
+		rec := request(t, "GET", "/health/ready", nil)
+		var body ReadinessResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Code != tt.wantStatus || body.ChromeAvailable != (tt.err == nil) {
+			t.Errorf("%s: GET /health/ready = %d, chrome_available %v", tt.name, rec.Code, body.ChromeAvailable)
+		}
+		if tt.err == nil && body.ChromeVersion != "HeadlessChrome/120.0" {
+			t.Errorf("%s: chrome_version = %q", tt.name, body.ChromeVersion)
+		}
+		if tt.err != nil && body.ChromeError != tt.err.Error() {
+			t.Errorf("%s: chrome_error = %q", tt.name, body.ChromeError)
+		}
+		if _, err := time.Parse(time.RFC3339, body.ChromeCheckedAt); err != nil {
+			t.Errorf("%s: chrome_checked_at %q: %v", tt.name, body.ChromeCheckedAt, err)
+		}
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	tests := []struct {
+		name        string
+		chromeErr   error
+		upstreamErr error
+		openCircuit bool
+		wantStatus  int
+		wantChecks  map[string]string
+	}{
+		{"healthy", nil, nil, false, http.StatusOK, map[string]string{"chrome": checkPass, "upstream": checkPass, "circuit_breaker": checkPass}},
+		{"no chrome", errors.New("chrome failed to start"), nil, false, http.StatusServiceUnavailable, map[string]string{"chrome": checkFail, "upstream": checkPass, "circuit_breaker": checkPass}},
+		{"upstream down", nil, errors.New("status 502"), false, http.StatusServiceUnavailable, map[string]string{"chrome": checkPass, "upstream": checkFail, "circuit_breaker": checkPass}},
+		{"circuit open", nil, nil, true, http.StatusServiceUnavailable, map[string]string{"chrome": checkPass, "upstream": checkPass, "circuit_breaker": checkFail}},
+	}
+
+	for _, tt := range tests {
+		resetState(t)
+		setGlobal(t, &chromeCheck, &chromeChecker{ttl: time.Minute, launch: func(ctx context.Context) (string, error) {
+			return "HeadlessChrome/120.0", tt.chromeErr
+		}})
+		setGlobal(t, &upstreamCheck, &upstreamChecker{ttl: time.Minute, probe: func(ctx context.Context) error { return tt.upstreamErr }})
+		if tt.openCircuit {
+			upstreamBreaker = newTestBreaker(1)
+			upstreamBreaker.record(errors.New("upstream failure"))
+		}
+
+		for _, path := range []string{"/readyz", "/health/ready"} {
+			rec := request(t, "GET", path, nil)
+			var body ReadinessResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			wantBody := "ready"
+			if tt.wantStatus != http.StatusOK {
+				wantBody = "not_ready"
+			}
+			if rec.Code != tt.wantStatus || body.Status != wantBody {
+				t.Errorf("%s: GET %s = %d %q, want %d %q", tt.name, path, rec.Code, body.Status, tt.wantStatus, wantBody)
+			}
+			got := make(map[string]string)
+			for name, check := range body.Checks {
+				got[name] = check.Status
+				if check.Status == checkFail && check.Detail == "" {
+					t.Errorf("%s: failed %s check has no detail", tt.name, name)
+				}
+			}
+			if !maps.Equal(got, tt.wantChecks) {
+				t.Errorf("%s: checks = %v, want %v", tt.name, got, tt.wantChecks)
+			}
+		}
+
+		// Liveness and the old health route do not depend on the checks
+		for _, path := range []string{"/livez", "/health"} {
+			if rec := request(t, "GET", path, nil); rec.Code != http.StatusOK {
+				t.Errorf("%s: GET %s = %d, want 200", tt.name, path, rec.Code)
+			}
+		}
+	}
+}
+
+func TestUpstreamChecker(t *testing.T) {
+	var probes atomic.Int32
+	checker := &upstreamChecker{ttl: 50 * time.Millisecond, probe: func(ctx context.Context) error {
+		probes.Add(1)
+		if _, ok := ctx.Deadline(); !ok {
+			t.Error("upstream was probed without a timeout")
+		}
+		return nil
+	}}
+
+	// Results are reused within the ttl
+	for range 3 {
+		if status := checker.status(); !status.Reachable {
+			t.Errorf("status = %+v", status)
+		}
+	}
+	if n := probes.Load(); n != 1 {
+		t.Errorf("%d probes within the ttl, want 1", n)
+	}
+	time.Sleep(60 * time.Millisecond)
+	checker.status()
+	if n := probes.Load(); n != 2 {
+		t.Errorf("%d probes after the ttl, want 2", n)
+	}
+
+	// The real probe counts any answer below 500 as reachable
+	for status, want := range map[int]bool{http.StatusOK: true, http.StatusNotFound: true, http.StatusServiceUnavailable: false} {
+		stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(status) }))
+		if err := probeUpstream(context.Background()); (err == nil) != want {
+			t.Errorf("upstream answering %d: probe = %v", status, err)
+		}
+	}
+}
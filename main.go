@@ -1,443 +1,5402 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
 	"context"
+	_ "embed"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math"
+	"mime"
+	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/http/pprof"
+	"net/netip"
+	"net/url"
 	"os"
+	"os/signal"
+	"reflect"
+	"regexp"
+	"runtime/debug"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode"
 	"unicode/utf8"
 
 	"github.com/PuerkitoBio/goquery"
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/fetch"
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/cdproto/page"
 	"github.com/chromedp/chromedp"
 	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
+	"golang.org/x/net/http/httpguts"
 )
 
 const (
 	defaultBaseURL = "https://grokipedia.com"
 	defaultPort    = "8080"
+
+	defaultUserAgent = "Grokipedia-API-Client/1.0"
+
+	defaultMaxConcurrentSearches = 3
+
+	defaultMaxRequestBytes = 1 << 20  // 1MB
+	defaultMaxFetchBytes   = 10 << 20 // 10MB
+	// searchQueueTimeout is how long a search waits for a free browser slot
+	searchQueueTimeout = 10 * time.Second
+	// defaultSearchTimeout is the SEARCH_TIMEOUT default
+	defaultSearchTimeout = 30 * time.Second
+	// defaultSearchMaxRetries is the SEARCH_MAX_RETRIES default
+	defaultSearchMaxRetries = 1
+	// defaultSearchRenderTimeout is the SEARCH_RENDER_TIMEOUT default
+	defaultSearchRenderTimeout = 10 * time.Second
+
+	// Screenshot viewport bounds in pixels. Full-page captures are capped at
+	// maxScreenshotHeight to keep very long articles from exhausting memory.
+	defaultScreenshotWidth   = 1280
+	minScreenshotWidth       = 320
+	maxScreenshotWidth       = 3840
+	screenshotViewportHeight = 800
+	maxScreenshotHeight      = 16384
+
+	// shutdownTimeout bounds how long in-flight requests may take to finish on shutdown
+	shutdownTimeout = 30 * time.Second
+
+	// defaultServerRequestTimeout is the SERVER_REQUEST_TIMEOUT default
+	defaultServerRequestTimeout = 60 * time.Second
+
+	// maxSuggestions is the number of titles returned by /api/suggest
+	maxSuggestions = 10
+
+	// maxBatchQueries caps the queries accepted by POST /api/search/batch
+	maxBatchQueries = 10
+
+	// maxEnrichConcurrency bounds the parallel page fetches made by ?enrich=
+	maxEnrichConcurrency = 5
+)
+
+// Fields that can be requested via the search ?enrich= parameter
+const (
+	enrichThumbnail = "thumbnail"
+	enrichSummary   = "summary"
 )
 
 var (
 	baseURL string
 	port    string
+	// listenAddr is the host:port the server binds to, from LISTEN_ADDR or ":"+PORT
+	listenAddr string
+
+	// routePrefix is the path every route is mounted under, from ROUTE_PREFIX,
+	// e.g. "/grok"; empty mounts them at the root
+	routePrefix string
+
+	// TLS is enabled when both files are set; httpRedirectPort optionally
+	// serves plain HTTP redirects to the HTTPS port
+	tlsCertFile      string
+	tlsKeyFile       string
+	httpRedirectPort string
+
+	// defaultLang is sent as Accept-Language when a request has no ?lang=
+	defaultLang string
+
+	// enablePprof mounts the net/http/pprof handlers under /debug/pprof/
+	enablePprof bool
+
+	userAgent     string
+	userAgentPool []string
+
+	// configFile holds overrides for the reloadable settings (CONFIG_FILE)
+	configFile string
+	// adminToken is the bearer token for /admin/ routes, which are only
+	// mounted when it is set (ADMIN_TOKEN)
+	adminToken string
+
+	// maxRequestBytes caps the size of request bodies
+	maxRequestBytes int64 = defaultMaxRequestBytes
+	// maxFetchBytes caps the decoded size of a page fetched from upstream (0 = unlimited)
+	maxFetchBytes int64 = defaultMaxFetchBytes
+
+	// serverRequestTimeout is the hard limit on handling one request (0 = none)
+	serverRequestTimeout = defaultServerRequestTimeout
+
+	// searchSlots is a semaphore bounding simultaneous headless searches
+	searchSlots chan struct{}
+
+	// trustedProxies are the peers whose X-Forwarded-For and X-Real-IP headers are believed (TRUSTED_PROXIES)
+	trustedProxies []netip.Prefix
+
+	// proxyURL routes upstream page fetches and headless Chrome through a proxy (HTTP_PROXY_URL)
+	proxyURL *url.URL
+	// extraRequestHeaders are added to every upstream request, by fetchHTML and
+	// headless Chrome alike (EXTRA_REQUEST_HEADERS)
+	extraRequestHeaders http.Header
+	// allowedHosts are the only hosts fetchHTML contacts (ALLOWED_HOSTS),
+	// by default just baseURL's
+	allowedHosts map[string]bool
+	// denyPaths are the article paths never served (DENY_PATHS)
+	denyPaths pathDenylist
+	// upstreamClient is shared by all upstream fetches, so their connections
+	// are pooled; it carries the proxy when one is configured. init builds it
+	// once the pool settings are read.
+	upstreamClient *http.Client
+	// Connection pool sizes of upstreamClient (UPSTREAM_MAX_IDLE_CONNS,
+	// UPSTREAM_MAX_IDLE_CONNS_PER_HOST, UPSTREAM_IDLE_CONN_TIMEOUT)
+	upstreamMaxIdleConns        = defaultUpstreamMaxIdleConns
+	upstreamMaxIdleConnsPerHost = defaultUpstreamMaxIdleConnsPerHost
+	upstreamIdleConnTimeout     = defaultUpstreamIdleConnTimeout
+
+	// chromeFlags are extra command-line flags for headless Chrome (CHROME_FLAGS)
+	chromeFlags []chromeFlag
+	// chromeExecPath points at a specific Chrome binary instead of the one found on PATH
+	chromeExecPath string
+
+	// searchBlockResources skips images, fonts, media and stylesheets during headless search
+	searchBlockResources = true
+	// articleIDPath is the Grokipedia path that redirects an article ID to its page;
+	// "{id}" is replaced with the requested ID
+	articleIDPath = "/id/{id}"
+	// articleRevisionURL builds the URL of an article revision from "{url}", the
+	// page URL, and "{revision}"; empty when Grokipedia exposes no revisions
+	articleRevisionURL string
+	// searchTimeout bounds a single headless search run once it has a slot (SEARCH_TIMEOUT)
+	searchTimeout = defaultSearchTimeout
+	// searchMaxRetries is how often a failed headless search is rerun in a fresh browser
+	searchMaxRetries = defaultSearchMaxRetries
+	// searchRenderTimeout bounds how long a headless search waits for results to render
+	searchRenderTimeout = defaultSearchRenderTimeout
+	// searchSnippetMin and searchSnippetMax bound search snippets: the first
+	// paragraph longer than searchSnippetMin characters is cut to searchSnippetMax
+	searchSnippetMin = defaultSearchSnippetMin
+	searchSnippetMax = defaultSearchSnippetMax
+	// searchMaxScan caps how many result items are read from a search page,
+	// duplicates included, while collecting unique results
+	searchMaxScan = defaultSearchMaxScan
+	// searchStrategy picks how searchArticles reaches Grokipedia (SEARCH_STRATEGY)
+	searchStrategy = strategyAuto
+	// userAgentSeq advances through userAgentPool on every outbound request
+	userAgentSeq atomic.Uint64
+)
+
+// Build metadata, injected at build time with
+// -ldflags "-X main.version=... -X main.commit=... -X main.buildTime=...".
+// Anything left empty is filled from the module build info in loadBuildInfo.
+var (
+	version   string
+	commit    string
+	buildTime string
+)
+
+// openAPISpec is the OpenAPI 3 document served at /openapi.json.
+// Keep it in sync with the response structs below.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// swaggerUIPage renders openAPISpec with Swagger UI loaded from a CDN
+const swaggerUIPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>Grokipedia API Docs</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+  <script>
+    window.onload = () => {
+      window.ui = SwaggerUIBundle({ url: "openapi.json", dom_id: "#swagger-ui" });
+    };
+  </script>
+</body>
+</html>
+`
+
+var (
+	// ErrArticleNotFound is returned when Grokipedia has no page at the requested path
+	ErrArticleNotFound = errors.New("article not found")
+	// ErrEmptyContent is returned when a page was fetched but no article content could be parsed
+	ErrEmptyContent = errors.New("article has no parseable content")
+	// ErrInvalidPath is returned for article paths that are URLs, traverse upwards or leave baseURL's host
+	ErrInvalidPath = errors.New("invalid article path")
+	// ErrSearchBusy is returned when no search slot frees up within searchQueueTimeout
+	ErrSearchBusy = errors.New("too many concurrent searches")
+	// ErrHostNotAllowed is returned for upstream requests to hosts missing from ALLOWED_HOSTS
+	ErrHostNotAllowed = errors.New("host not allowed")
+	// ErrPageTooLarge is returned when an upstream page exceeds MAX_FETCH_BYTES
+	ErrPageTooLarge = errors.New("upstream page too large")
 )
 
+// DisambiguationError is returned by getArticle when the path resolves to a
+// disambiguation page listing several possible articles
+type DisambiguationError struct {
+	Title   string
+	URL     string
+	Options []DisambiguationOption
+}
+
+func (e *DisambiguationError) Error() string {
+	return fmt.Sprintf("%s is a disambiguation page with %d options", e.URL, len(e.Options))
+}
+
+// DisambiguationOption is one of the articles a disambiguation page links to
+type DisambiguationOption struct {
+	Title string `json:"title"`
+	URL   string `json:"url"`
+}
+
+// DisambiguationResponse is sent with 300 Multiple Choices for disambiguation pages
+type DisambiguationResponse struct {
+	Disambiguation bool                   `json:"disambiguation"`
+	Title          string                 `json:"title"`
+	Options        []DisambiguationOption `json:"options"`
+}
+
 // Article represents a Grokipedia article
 type Article struct {
 	Title       string   `json:"title"`
 	URL         string   `json:"url"`
+	Slug        string   `json:"slug,omitempty"`
 	Content     string   `json:"content"`
 	Summary     string   `json:"summary"`
 	Categories  []string `json:"categories,omitempty"`
 	LastUpdated string   `json:"last_updated,omitempty"`
+	Redirected  bool     `json:"redirected,omitempty"`
+	Truncated   bool     `json:"truncated,omitempty"`
+	Language    string   `json:"language,omitempty"`
+
+	// LastUpdatedRelative describes LastUpdated relative to now, e.g. "3 days ago" (?relative_time=true)
+	LastUpdatedRelative string `json:"last_updated_relative,omitempty"`
+
+	// ReadingTimeSeconds estimates the time to read Content at READING_WPM;
+	// ReadingTime is the same rounded for display, e.g. "5 min read"
+	ReadingTimeSeconds int    `json:"reading_time_seconds,omitempty"`
+	ReadingTime        string `json:"reading_time,omitempty"`
+
+	// ContentHash is the hex sha256 of the full parsed content with
+	// whitespace collapsed, and ContentLength its size in bytes. Both
+	// describe the article as parsed, before max_bytes or a separator is
+	// applied, so clients can compare fetches without storing the content.
+	ContentHash   string `json:"content_hash,omitempty"`
+	ContentLength int    `json:"content_length,omitempty"`
+
+	// CategoryLinks pairs each linked category with its absolute page URL;
+	// Categories keeps the plain names
+	CategoryLinks []SearchResult `json:"category_links,omitempty"`
+
+	// LeadImage is the absolute URL of the article's main image, for thumbnails
+	LeadImage string `json:"lead_image,omitempty"`
+
+	// Alternates maps the language of each alternate version declared with
+	// <link rel="alternate" hreflang> to its absolute URL
+	Alternates map[string]string `json:"alternates,omitempty"`
+
+	// RevisionID is the revision requested with ?revision=, empty for the latest
+	RevisionID string `json:"revision_id,omitempty"`
+
+	// Infobox holds the key facts from the article's sidebar, label to value
+	Infobox map[string]string `json:"infobox,omitempty"`
+
+	// Formulas is the LaTeX source of each formula in Content, in order (INCLUDE_MATH=true)
+	Formulas []string `json:"formulas,omitempty"`
+
+	// ParseWarnings lists the fallbacks the parser had to take, so clients can
+	// tell a degraded extraction from a normal one (see the warn* constants)
+	ParseWarnings []string `json:"parse_warnings,omitempty"`
+
+	Sections []Section `json:"sections,omitempty"`
+
+	// Blocks are the text blocks the parser read, content is built from them (?debug_blocks=true)
+	Blocks []Block `json:"blocks,omitempty"`
+
+	// Timing breaks down how long the request took (?timing=true)
+	Timing *Timing `json:"timing,omitempty"`
+
+	// RelatedArticles are the links listed under a "See also" or "Related" heading
+	RelatedArticles []SearchResult `json:"related_articles,omitempty"`
+
+	InternalLinks []string `json:"internal_links,omitempty"`
+	ExternalLinks []string `json:"external_links,omitempty"`
+	AnchorLinks   []string `json:"anchor_links,omitempty"`
 }
 
+// Parse warnings reported in Article.ParseWarnings
+const (
+	warnNoArticleRoot    = "article root not found, used full-document fallback"
+	warnEmptyArticleRoot = "article root had no content, used full-document fallback"
+	// warnArticleRootFallback names the selector of ARTICLE_ROOT_SELECTORS
+	// used when the first one did not find the article
+	warnArticleRootFallback = "article root found by fallback selector %q"
+	// warnFallbackSummary names the summary source used when the content,
+	// listed ahead of it in SUMMARY_SOURCES, had no summary paragraph
+	warnFallbackSummary = "no summary paragraph found, used %s"
+	warnNoSummary       = "no summary extracted"
+)
+
+// Section groups the paragraphs that follow a heading in an article.
+// Text before the first heading is collected in a section with Level 0 and no heading.
+type Section struct {
+	Heading    string   `json:"heading"`
+	Level      int      `json:"level"`
+	Paragraphs []string `json:"paragraphs"`
+}
+
+// Block is one element of text the parser found in an article: its node
+// type (p, li, h2, span, math, ...) and text. Skipped gives the reason a
+// block was left out of the content. With INCLUDE_MATH, Formulas holds the
+// LaTeX of the formulas in the block, which appear in Text between $ or $$.
+type Block struct {
+	Type     string   `json:"type"`
+	Text     string   `json:"text"`
+	Skipped  string   `json:"skipped,omitempty"`
+	Formulas []string `json:"formulas,omitempty"`
+}
+
+// Reasons reported in Block.Skipped
+const (
+	skipTooShort  = "too short"
+	skipDuplicate = "duplicate"
+)
+
 // SearchResult represents a search result
 type SearchResult struct {
-	Title   string `json:"title"`
-	URL     string `json:"url"`
-	Snippet string `json:"snippet"`
+	Title     string `json:"title"`
+	URL       string `json:"url"`
+	Snippet   string `json:"snippet"`
+	Thumbnail string `json:"thumbnail,omitempty"`
+	Summary   string `json:"summary,omitempty"`
+	// Score is the relevance score used for ordering, only sent with ?include_score=true
+	Score *float64 `json:"score,omitempty"`
+}
+
+// ArticleRequest is the body accepted by POST /api/article
+type ArticleRequest struct {
+	Path string `json:"path"`
+}
+
+// BatchSearchRequest is the body accepted by POST /api/search/batch
+type BatchSearchRequest struct {
+	Queries []string `json:"queries"`
+}
+
+// BatchSearchResult holds the outcome of one query in a batch search.
+// Error is set instead of Results when that query failed.
+type BatchSearchResult struct {
+	Query   string         `json:"query"`
+	Count   int            `json:"count"`
+	Results []SearchResult `json:"results,omitempty"`
+	Error   *ErrorResponse `json:"error,omitempty"`
 }
 
-// ErrorResponse represents an error response
+// ErrorResponse represents an error response. Code is one of the stable
+// code* values below, for clients to branch on; Message is for humans and
+// may change wording.
 type ErrorResponse struct {
 	Error   string `json:"error"`
+	Code    string `json:"code"`
 	Message string `json:"message"`
 }
 
-// HealthResponse represents health check response
-type HealthResponse struct {
-	Status  string `json:"status"`
-	Version string `json:"version"`
-	Time    string `json:"time"`
+// Machine-readable error codes reported in ErrorResponse.Code
+const (
+	codeInvalidRequest      = "INVALID_REQUEST"
+	codeInvalidPath         = "INVALID_PATH"
+	codeNotAcceptable       = "NOT_ACCEPTABLE"
+	codePayloadTooLarge     = "PAYLOAD_TOO_LARGE"
+	codeArticleNotFound     = "ARTICLE_NOT_FOUND"
+	codeWatchNotFound       = "WATCH_NOT_FOUND"
+	codeWatchLimitReached   = "WATCH_LIMIT_REACHED"
+	codeEmptyContent        = "EMPTY_CONTENT"
+	codeSearchFailed        = "SEARCH_FAILED"
+	codeSearchBusy          = "SEARCH_BUSY"
+	codeHostNotAllowed      = "HOST_NOT_ALLOWED"
+	codePathDenied          = "PATH_DENIED"
+	codeUnauthorized        = "UNAUTHORIZED"
+	codeRateLimited         = "RATE_LIMITED"
+	codeUpstreamError       = "UPSTREAM_ERROR"
+	codeUpstreamTimeout     = "UPSTREAM_TIMEOUT"
+	codeUpstreamUnavailable = "UPSTREAM_UNAVAILABLE"
+	codeUpstreamTooLarge    = "UPSTREAM_TOO_LARGE"
+	codeRequestTimeout      = "REQUEST_TIMEOUT"
+	codeInternalError       = "INTERNAL_ERROR"
+)
+
+// setRetryAfter passes the Retry-After of an upstream rate limit on to the client
+func setRetryAfter(w http.ResponseWriter, err error) {
+	var rateLimit *RateLimitError
+	if errors.As(err, &rateLimit) && rateLimit.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(rateLimit.RetryAfter.Seconds()))))
+	}
 }
 
-// fetchHTML fetches HTML content from a URL
-func fetchHTML(urlStr string) (*goquery.Document, error) {
-	client := &http.Client{
-		Timeout: 30 * time.Second,
+// errorCode maps the sentinel errors to their code, or returns fallback
+// for errors without one of their own
+func errorCode(err error, fallback string) string {
+	var netErr net.Error
+	var rateLimit *RateLimitError
+	switch {
+	case errors.As(err, &rateLimit):
+		return codeRateLimited
+	case errors.Is(err, ErrArticleNotFound):
+		return codeArticleNotFound
+	case errors.Is(err, ErrInvalidPath):
+		return codeInvalidPath
+	case errors.Is(err, ErrEmptyContent):
+		return codeEmptyContent
+	case errors.Is(err, ErrSearchBusy):
+		return codeSearchBusy
+	case errors.Is(err, ErrCircuitOpen):
+		return codeUpstreamUnavailable
+	case errors.Is(err, ErrHostNotAllowed):
+		return codeHostNotAllowed
+	case errors.Is(err, ErrPageTooLarge):
+		return codeUpstreamTooLarge
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return codeUpstreamTimeout
 	}
+	return fallback
+}
 
-	req, err := http.NewRequest("GET", urlStr, nil)
-	if err != nil {
-		return nil, err
+// upstreamErrorStatus is the status for a failed article fetch without a
+// more specific answer: 504 when Grokipedia timed out, 502 otherwise
+func upstreamErrorStatus(err error) int {
+	if errorCode(err, codeUpstreamError) == codeUpstreamTimeout {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// fetchHTML fetches HTML content from a URL. lang, or DEFAULT_LANG when
+// empty, is sent as the Accept-Language header.
+// Calls are refused with ErrCircuitOpen while the upstream circuit is open.
+func fetchHTML(ctx context.Context, urlStr, lang string) (*goquery.Document, error) {
+	doc, _, err := fetchPage(ctx, urlStr, lang)
+	return doc, err
+}
+
+// fetchPage is fetchHTML that also returns the page as fetched, decoded to UTF-8
+func fetchPage(ctx context.Context, urlStr, lang string) (doc *goquery.Document, raw []byte, err error) {
+	ctx, span := tracer.Start(ctx, "fetchHTML",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("http.url", urlStr)),
+	)
+	defer func() {
+		if err != nil {
+			recordError(span, err)
+		}
+		span.End()
+	}()
+
+	// Not an upstream failure, so checked before the breaker sees the request
+	if err := checkAllowedHost(urlStr); err != nil {
+		return nil, nil, err
 	}
 
-	req.Header.Set("User-Agent", "Grokipedia-API-Client/1.0")
+	if err := upstreamBreaker.allow(); err != nil {
+		return nil, nil, err
+	}
+	defer func() { upstreamBreaker.record(err) }()
 
-	resp, err := client.Do(req)
+	req, err := newUpstreamRequest(ctx, urlStr, lang)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("failed to fetch page: status code %d", resp.StatusCode)
+	if timing := timingFrom(ctx); timing != nil {
+		sent := time.Now()
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), timing.clientTrace(sent)))
+		defer timing.addFetch(sent)
 	}
 
-	doc, err := goquery.NewDocumentFromReader(resp.Body)
+	resp, err := upstreamClient.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	defer resp.Body.Close()
 
-	return doc, nil
-}
+	span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
 
-// getArticle fetches and parses a Grokipedia article
-func getArticle(articlePath string) (*Article, error) {
-	// Ensure the path starts with /
-	if !strings.HasPrefix(articlePath, "/") {
-		articlePath = "/" + articlePath
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil, fmt.Errorf("%w: %s", ErrArticleNotFound, urlStr)
 	}
 
-	fullURL := baseURL + articlePath
-	log.Printf("Fetching article from URL: %s", fullURL)
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return nil, nil, &RateLimitError{RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("failed to fetch page: status code %d", resp.StatusCode)
+	}
+
+	// Refuse a declared oversized page up front; cappedReader catches the
+	// rest, including compressed pages that only grow large once decoded
+	if maxFetchBytes > 0 && resp.ContentLength > maxFetchBytes {
+		return nil, nil, fmt.Errorf("%w: %s is %d bytes, over the %d byte limit", ErrPageTooLarge, urlStr, resp.ContentLength, maxFetchBytes)
+	}
 
-	doc, err := fetchHTML(fullURL)
+	decoded, err := decodedBody(resp)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	if maxFetchBytes > 0 {
+		decoded = &cappedReader{r: decoded, left: maxFetchBytes, limit: maxFetchBytes}
+	}
+	body, err := utf8Body(decoded, resp.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, nil, err
 	}
 
-	article := &Article{
-		URL: fullURL,
+	if raw, err = io.ReadAll(body); err != nil {
+		return nil, nil, err
+	}
+	doc, err = goquery.NewDocumentFromReader(bytes.NewReader(raw))
+	if err != nil {
+		return nil, nil, err
 	}
 
-	// Extract title
-	article.Title = doc.Find("h1").First().Text()
-	if article.Title == "" {
-		article.Title = doc.Find("title").First().Text()
+	// Record the final URL after any HTTP redirects
+	doc.Url = resp.Request.URL
+
+	return doc, raw, nil
+}
+
+// cappedReader reads from r like io.LimitReader, but fails with
+// ErrPageTooLarge instead of stopping quietly once more than limit bytes
+// arrive, so a cut-off page is never parsed as if it were complete
+type cappedReader struct {
+	r     io.Reader
+	left  int64
+	limit int64
+}
+
+func (c *cappedReader) Read(p []byte) (int, error) {
+	if c.left < 0 {
+		return 0, fmt.Errorf("%w: more than %d bytes", ErrPageTooLarge, c.limit)
+	}
+	// Read one byte past the limit to tell a page of exactly limit bytes
+	// from a longer one
+	if int64(len(p)) > c.left+1 {
+		p = p[:c.left+1]
 	}
+	n, err := c.r.Read(p)
+	c.left -= int64(n)
+	if c.left < 0 {
+		return 0, fmt.Errorf("%w: more than %d bytes", ErrPageTooLarge, c.limit)
+	}
+	return n, err
+}
 
-	// Extract main content, walking the rendered article structure
-	var contentParts []string
-	lastLine := ""
+// charsetSniffBytes is how much of a page is inspected for a <meta charset>
+const charsetSniffBytes = 1024
 
-	addContent := func(sel *goquery.Selection, candidateForSummary bool) {
-		clean := sel.Clone()
-		clean.Find("button, svg, style, script").Remove()
+// metaCharsetPattern spots a charset declared in the page's <meta> tags
+var metaCharsetPattern = regexp.MustCompile(`(?i)<meta[^>]+charset`)
 
-		text := strings.TrimSpace(clean.Text())
-		if text == "" {
-			return
+// decodedBody returns the body of an upstream response with its
+// Content-Encoding undone. The transport asks for gzip on its own and
+// decompresses the answer, so there is only work left here when
+// EXTRA_REQUEST_HEADERS sets Accept-Encoding: gzip and deflate are then
+// decoded here, and other encodings are refused rather than parsed as HTML.
+func decodedBody(resp *http.Response) (io.Reader, error) {
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	switch encoding {
+	case "", "identity":
+		return resp.Body, nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(resp.Body)
+	case "deflate":
+		// "deflate" should be zlib-wrapped, but some servers send raw DEFLATE
+		buffered := bufio.NewReader(resp.Body)
+		if head, err := buffered.Peek(2); err == nil && head[0]&0x0f == 8 && (uint16(head[0])<<8|uint16(head[1]))%31 == 0 {
+			return zlib.NewReader(buffered)
 		}
+		return flate.NewReader(buffered), nil
+	default:
+		return nil, fmt.Errorf("unsupported Content-Encoding %q", encoding)
+	}
+}
 
-		text = strings.Join(strings.Fields(text), " ")
-		if utf8.RuneCountInString(text) < 3 {
-			return
-		}
+// utf8Body returns body transcoded to UTF-8. The charset comes from the
+// Content-Type header, a byte order mark or a <meta charset> tag, in that
+// order; pages declaring none are taken to be UTF-8 already.
+func utf8Body(body io.Reader, contentType string) (io.Reader, error) {
+	buffered := bufio.NewReaderSize(body, charsetSniffBytes)
+	head, err := buffered.Peek(charsetSniffBytes)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
 
-		if text == lastLine {
-			return
-		}
+	enc, name, certain := charset.DetermineEncoding(head, contentType)
+	// DetermineEncoding guesses windows-1252 for undeclared non-UTF-8 bytes;
+	// the HTML default does not suit Grokipedia, which serves UTF-8
+	if !certain && name == "windows-1252" && !metaCharsetPattern.Match(head) {
+		return buffered, nil
+	}
+	if name == "utf-8" {
+		return buffered, nil
+	}
 
-		contentParts = append(contentParts, text)
-		lastLine = text
+	return enc.NewDecoder().Reader(buffered), nil
+}
 
-		if candidateForSummary && article.Summary == "" && utf8.RuneCountInString(text) > 50 {
-			article.Summary = text
-		}
+// checkAllowedHost refuses URLs whose host is not in ALLOWED_HOSTS. It is a
+// last line of defence behind the path validation in articleURL. Entries
+// without a port match the host on any port.
+func checkAllowedHost(urlStr string) error {
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return err
 	}
 
-	processContent := func(root *goquery.Selection) {
-		root.Find("*").Each(func(i int, s *goquery.Selection) {
-			nodeName := goquery.NodeName(s)
+	host := strings.ToLower(u.Host)
+	if allowedHosts[host] || allowedHosts[strings.ToLower(u.Hostname())] {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrHostNotAllowed, u.Host)
+}
 
-			switch nodeName {
-			case "h2", "h3", "h4", "h5", "h6", "blockquote", "pre", "p", "li":
-				addContent(s, nodeName == "p" || nodeName == "blockquote")
-			case "span":
-				classAttr, _ := s.Attr("class")
-				if strings.Contains(classAttr, "katex") || strings.Contains(classAttr, "sr-only") {
-					return
-				}
+const (
+	defaultUpstreamMaxIdleConns        = 100
+	defaultUpstreamMaxIdleConnsPerHost = 16
+	defaultUpstreamIdleConnTimeout     = 90 * time.Second
+)
 
-				if strings.Contains(classAttr, "break-words") || strings.Contains(classAttr, "leading-7") {
-					addContent(s, true)
-				}
-			}
-		})
+// newUpstreamClient builds the client for upstream fetches. Its transport
+// keeps idle connections to reuse across fetches, up to the UPSTREAM_*
+// pool sizes, and negotiates HTTP/2 where the server offers it.
+func newUpstreamClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = upstreamMaxIdleConns
+	transport.MaxIdleConnsPerHost = upstreamMaxIdleConnsPerHost
+	transport.IdleConnTimeout = upstreamIdleConnTimeout
+	transport.ForceAttemptHTTP2 = true
+	// Ask for gzip and decompress it transparently; see decodedBody
+	transport.DisableCompression = false
+	if proxyURL != nil {
+		transport.Proxy = http.ProxyURL(proxyURL)
 	}
 
-	articleRoot := doc.Find("article")
-	if articleRoot.Length() == 0 {
-		articleRoot = doc.Find("main")
+	return &http.Client{
+		Timeout:       30 * time.Second,
+		Transport:     transport,
+		CheckRedirect: checkRedirectHost,
 	}
-	if articleRoot.Length() > 0 {
-		processContent(articleRoot)
+}
+
+// checkRedirectHost is the http.Client CheckRedirect of upstream requests:
+// redirects must stay on allowed hosts too
+func checkRedirectHost(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
 	}
+	return checkAllowedHost(req.URL.String())
+}
 
-	if len(contentParts) == 0 {
-		processContent(doc.Selection)
+// newUpstreamRequest builds a GET request to Grokipedia carrying the
+// User-Agent and Accept-Language (lang, or DEFAULT_LANG when empty)
+func newUpstreamRequest(ctx context.Context, urlStr, lang string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", urlStr, nil)
+	if err != nil {
+		return nil, err
 	}
 
-	article.Content = strings.Join(contentParts, "\n\n")
+	req.Header.Set("User-Agent", nextUserAgent())
 
-	// Fall back to meta description for summary if needed
-	if article.Summary == "" {
-		if desc, ok := doc.Find(`meta[name="description"]`).Attr("content"); ok {
-			desc = strings.TrimSpace(desc)
-			if desc != "" {
-				article.Summary = desc
-			}
-		}
+	if lang == "" {
+		lang = defaultLang
+	}
+	if lang != "" {
+		req.Header.Set("Accept-Language", lang)
 	}
 
-	if article.Summary == "" {
-		if ogDesc, ok := doc.Find(`meta[property="og:description"]`).Attr("content"); ok {
-			ogDesc = strings.TrimSpace(ogDesc)
-			if ogDesc != "" {
-				article.Summary = ogDesc
-			}
-		}
+	// Configured headers win over the defaults above
+	for name, values := range extraRequestHeaders {
+		req.Header[name] = append([]string(nil), values...)
 	}
 
-	// Capture last updated timestamp if provided
-	if modified, ok := doc.Find(`meta[property="article:modified_time"]`).Attr("content"); ok {
-		modified = strings.TrimSpace(modified)
-		if modified != "" {
-			article.LastUpdated = modified
-		}
+	return req, nil
+}
+
+// parseExtraHeaders parses EXTRA_REQUEST_HEADERS: "Name: Value" pairs, one
+// per line, or separated by semicolons when the value has no newlines. Use
+// the newline form for values containing semicolons, such as several cookies.
+func parseExtraHeaders(value string) (http.Header, error) {
+	sep := ";"
+	if strings.Contains(value, "\n") {
+		sep = "\n"
 	}
 
-	// Extract categories if available
-	doc.Find(".categories a, .category a").Each(func(i int, s *goquery.Selection) {
-		category := strings.TrimSpace(s.Text())
-		if category != "" {
-			article.Categories = append(article.Categories, category)
+	headers := make(http.Header)
+	for _, entry := range strings.Split(value, sep) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
 		}
-	})
 
-	return article, nil
-}
-
-// searchArticles searches for articles on Grokipedia using headless Chrome
-// This function uses chromedp to execute JavaScript and get real-time search results
-func searchArticles(query string) ([]SearchResult, error) {
-	log.Printf("Starting headless browser search for: %s", query)
+		name, val, ok := strings.Cut(entry, ":")
+		name, val = strings.TrimSpace(name), strings.TrimSpace(val)
+		if !ok || !httpguts.ValidHeaderFieldName(name) {
+			return nil, fmt.Errorf("invalid header %q: want \"Name: Value\"", entry)
+		}
+		if !httpguts.ValidHeaderFieldValue(val) {
+			return nil, fmt.Errorf("invalid value for header %s", name)
+		}
+		headers.Add(name, val)
+	}
 
-	// Create allocator options with headless mode
-	opts := append(chromedp.DefaultExecAllocatorOptions[:],
-		chromedp.Flag("headless", true),
-		chromedp.Flag("disable-gpu", true),
-		chromedp.Flag("no-sandbox", true),
-		chromedp.Flag("disable-dev-shm-usage", true),
-	)
+	return headers, nil
+}
 
-	allocCtx, cancel := chromedp.NewExecAllocator(context.Background(), opts...)
-	defer cancel()
+// setExtraHeaders sends EXTRA_REQUEST_HEADERS with every request of a
+// browser tab; it does nothing when none are configured
+func setExtraHeaders() chromedp.Action {
+	if len(extraRequestHeaders) == 0 {
+		return chromedp.ActionFunc(func(context.Context) error { return nil })
+	}
 
-	// Create Chrome context
-	ctx, cancel := chromedp.NewContext(allocCtx, chromedp.WithLogf(log.Printf))
-	defer cancel()
+	headers := make(network.Headers, len(extraRequestHeaders))
+	for name, values := range extraRequestHeaders {
+		headers[name] = strings.Join(values, ", ")
+	}
+	return network.SetExtraHTTPHeaders(headers)
+}
 
-	// Set timeout (30 seconds should be enough)
-	ctx, cancel = context.WithTimeout(ctx, 30*time.Second)
-	defer cancel()
+// existsScanBytes is how much of a page articleExists reads to spot soft 404s
+const existsScanBytes = 64 << 10
 
-	searchURL := fmt.Sprintf("%s/search?q=%s", baseURL, query)
-	log.Printf("Navigating to: %s", searchURL)
+// notFoundTitlePattern matches the titles of "not found" pages served with status 200
+var notFoundTitlePattern = regexp.MustCompile(`(?i)\b(404|not found|does not exist)\b`)
 
-	var results []SearchResult
-	var htmlContent string
+// articleExists checks whether pageURL is a real article without parsing
+// the whole page. It returns the upstream status code; 404 and 410 mean the
+// article does not exist, as does a 200 page titled like a "not found" page.
+func articleExists(ctx context.Context, pageURL string) (exists bool, status int, err error) {
+	ctx, span := tracer.Start(ctx, "articleExists",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("http.url", pageURL)),
+	)
+	defer func() {
+		if err != nil {
+			recordError(span, err)
+		}
+		span.End()
+	}()
 
-	// Run chromedp tasks
-	err := chromedp.Run(ctx,
-		// Navigate to search page
-		chromedp.Navigate(searchURL),
+	if err := checkAllowedHost(pageURL); err != nil {
+		return false, 0, err
+	}
 
-		// Wait for search results container to appear
-		chromedp.WaitVisible(`main`, chromedp.ByQuery),
+	if err := upstreamBreaker.allow(); err != nil {
+		return false, 0, err
+	}
+	defer func() { upstreamBreaker.record(err) }()
 
-		// Wait a bit for JavaScript to render results
-		chromedp.Sleep(3*time.Second),
+	req, err := newUpstreamRequest(ctx, pageURL, "")
+	if err != nil {
+		return false, 0, err
+	}
 
-		// Get HTML for debugging
-		chromedp.OuterHTML(`main`, &htmlContent, chromedp.ByQuery),
+	resp, err := upstreamClient.Do(req)
+	if err != nil {
+		return false, 0, err
+	}
+	defer resp.Body.Close()
 
-		// Extract search results using JavaScript
-		chromedp.Evaluate(`
-			(function() {
-				const results = [];
-				const seen = new Set(); // Track unique titles to avoid duplicates
-
-				// Find all search result items (they're in divs with cursor-pointer class)
-				const items = document.querySelectorAll('main div.cursor-pointer');
-
-				console.log('Found ' + items.length + ' search result items');
-
-				items.forEach(item => {
-					// Find the title span
-					const titleSpan = item.querySelector('span.line-clamp-1 span');
-					if (!titleSpan) return;
-
-					const title = titleSpan.textContent.trim();
-					if (!title || seen.has(title)) return; // Skip duplicates
-
-					seen.add(title);
-
-					// Construct the page URL from the title
-					// Convert title to URL slug (replace spaces with underscores)
-					const slug = title.replace(/ /g, '_');
-					const url = 'https://grokipedia.com/page/' + encodeURIComponent(slug);
-
-					// Try to find snippet/description
-					let snippet = '';
-					const paragraphs = item.querySelectorAll('p');
-					for (let p of paragraphs) {
-						const text = p.textContent.trim();
-						if (text && text.length > 20) {
-							snippet = text.substring(0, 200);
-							break;
-						}
-					}
+	span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
 
-					results.push({
-						title: title,
-						url: url,
-						snippet: snippet || 'No description available'
-					});
-				});
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusGone:
+		return false, resp.StatusCode, nil
+	case http.StatusTooManyRequests:
+		return false, resp.StatusCode, &RateLimitError{RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())}
+	default:
+		return false, resp.StatusCode, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
 
-				return results.slice(0, 20); // Return top 20 unique results
-			})();
-		`, &results),
-	)
+	decoded, err := decodedBody(resp)
+	if err != nil {
+		return false, resp.StatusCode, err
+	}
+	body, err := utf8Body(io.LimitReader(decoded, existsScanBytes), resp.Header.Get("Content-Type"))
+	if err != nil {
+		return false, resp.StatusCode, err
+	}
 
+	doc, err := goquery.NewDocumentFromReader(body)
 	if err != nil {
-		log.Printf("Headless browser error: %v", err)
-		return nil, fmt.Errorf("headless browser search failed: %w", err)
+		return false, resp.StatusCode, err
 	}
 
-	log.Printf("HTML content length: %d bytes", len(htmlContent))
-	log.Printf("Found %d search results for query: %s", len(results), query)
+	title := strings.TrimSpace(doc.Find("h1").First().Text())
+	if title == "" {
+		title = strings.TrimSpace(doc.Find("title").First().Text())
+	}
+	if title == "" || notFoundTitlePattern.MatchString(title) {
+		return false, resp.StatusCode, nil
+	}
 
-	return results, nil
+	return true, resp.StatusCode, nil
 }
 
-// Handlers
+// nextUserAgent returns the User-Agent for the next outbound request,
+// rotating through USER_AGENT_POOL when one is configured
+func nextUserAgent() string {
+	if len(userAgentPool) == 0 {
+		return userAgent
+	}
+
+	i := userAgentSeq.Add(1) - 1
+	return userAgentPool[i%uint64(len(userAgentPool))]
+}
+
+// normalizePath converts the various spellings of an article path
+// ("Foo Bar", "foo_bar", "/page/Foo_Bar") into a "/page/..." path
+func normalizePath(articlePath string) string {
+	articlePath = strings.TrimSpace(articlePath)
+	articlePath = strings.ReplaceAll(articlePath, " ", "_")
+	articlePath = strings.Trim(articlePath, "/")
 
-func healthHandler(w http.ResponseWriter, r *http.Request) {
-	response := HealthResponse{
-		Status:  "ok",
-		Version: "1.0.0",
-		Time:    time.Now().Format(time.RFC3339),
+	// A bare title has no path segments of its own
+	if articlePath != "" && !strings.Contains(articlePath, "/") {
+		articlePath = "page/" + articlePath
 	}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+
+	return "/" + articlePath
 }
 
-func getArticleHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	articlePath := vars["path"]
+// schemePattern matches paths that start like an absolute URL ("https:/...",
+// also after the router has collapsed "//")
+var schemePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9+.-]*:/`)
 
-	if articlePath == "" {
-		sendError(w, http.StatusBadRequest, "Article path is required")
-		return
+// articleURL validates a client-supplied article path and returns its
+// absolute URL on baseURL. Full URLs, protocol-relative paths, "." and ".."
+// segments and control characters are rejected with ErrInvalidPath, so the
+// result always stays on the configured Grokipedia host.
+func articleURL(articlePath string) (string, error) {
+	raw := strings.TrimSpace(articlePath)
+	if schemePattern.MatchString(raw) || strings.HasPrefix(raw, "//") || strings.Contains(raw, "\\") {
+		return "", fmt.Errorf("%w: must be a path, not a URL", ErrInvalidPath)
+	}
+	for _, r := range raw {
+		if unicode.IsControl(r) {
+			return "", fmt.Errorf("%w: contains control characters", ErrInvalidPath)
+		}
+	}
+	for _, segment := range strings.Split(raw, "/") {
+		if decoded, err := url.PathUnescape(segment); err == nil {
+			segment = decoded
+		}
+		if segment == "." || segment == ".." {
+			return "", fmt.Errorf("%w: must not contain . or .. segments", ErrInvalidPath)
+		}
 	}
 
-	article, err := getArticle(articlePath)
+	base, err := url.Parse(baseURL)
 	if err != nil {
-		sendError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to fetch article: %v", err))
-		return
+		return "", err
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(article)
+	u := base.ResolveReference(&url.URL{Path: normalizePath(raw)})
+	if u.Scheme != base.Scheme || !strings.EqualFold(u.Host, base.Host) {
+		return "", fmt.Errorf("%w: resolves outside %s", ErrInvalidPath, base.Host)
+	}
+
+	return u.String(), nil
 }
 
-func searchHandler(w http.ResponseWriter, r *http.Request) {
-	query := r.URL.Query().Get("q")
-	if query == "" {
-		sendError(w, http.StatusBadRequest, "Search query parameter 'q' is required")
-		return
+// pathDenylist holds the article paths DENY_PATHS blocks: exact paths and
+// regular expressions, both compared with the path as normalizePath
+// spells it, e.g. "/page/Foo_Bar"
+type pathDenylist struct {
+	exact    map[string]bool
+	patterns []*regexp.Regexp
+}
+
+// parseDenyPaths parses a comma-separated list of article paths, in any
+// spelling normalizePath accepts, and regular expressions prefixed with "re:"
+func parseDenyPaths(value string) (pathDenylist, error) {
+	denylist := pathDenylist{exact: make(map[string]bool)}
+	for _, item := range splitList(value) {
+		if expr, ok := strings.CutPrefix(item, "re:"); ok {
+			pattern, err := regexp.Compile(expr)
+			if err != nil {
+				return pathDenylist{}, fmt.Errorf("pattern %q: %w", expr, err)
+			}
+			denylist.patterns = append(denylist.patterns, pattern)
+			continue
+		}
+		denylist.exact[normalizePath(item)] = true
 	}
+	return denylist, nil
+}
 
-	results, err := searchArticles(query)
-	if err != nil {
-		sendError(w, http.StatusInternalServerError, fmt.Sprintf("Search failed: %v", err))
-		return
+// denies reports whether the article at articlePath must not be served
+func (d pathDenylist) denies(articlePath string) bool {
+	articlePath = normalizePath(articlePath)
+	if d.exact[articlePath] {
+		return true
+	}
+	for _, pattern := range d.patterns {
+		if pattern.MatchString(articlePath) {
+			return true
+		}
 	}
+	return false
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]any{
-		"query":   query,
-		"count":   len(results),
-		"results": results,
-	})
+// titleSlug turns an article title into its URL-safe page slug: spaces
+// become underscores and everything else outside a path segment's safe
+// characters is percent-encoded
+func titleSlug(title string) string {
+	return url.PathEscape(strings.ReplaceAll(strings.TrimSpace(title), " ", "_"))
 }
 
-func sendError(w http.ResponseWriter, statusCode int, message string) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(statusCode)
-	json.NewEncoder(w).Encode(ErrorResponse{
-		Error:   http.StatusText(statusCode),
-		Message: message,
+// articleSlug returns the page slug of a Grokipedia article URL, the part
+// after /page/, re-encoded like titleSlug so equal pages get equal slugs.
+// URLs outside /page/ yield "".
+func articleSlug(pageURL string) string {
+	u, err := url.Parse(pageURL)
+	if err != nil {
+		return ""
+	}
+
+	slug, ok := strings.CutPrefix(u.Path, "/page/")
+	if !ok {
+		return ""
+	}
+	return titleSlug(strings.TrimSuffix(slug, "/"))
+}
+
+// metaRefreshURL returns the target of a client-side <meta http-equiv="refresh"> redirect
+func metaRefreshURL(doc *goquery.Document) string {
+	var target string
+	doc.Find("meta[http-equiv]").EachWithBreak(func(i int, s *goquery.Selection) bool {
+		equiv, _ := s.Attr("http-equiv")
+		if !strings.EqualFold(equiv, "refresh") {
+			return true
+		}
+
+		content, _ := s.Attr("content")
+		idx := strings.Index(strings.ToLower(content), "url=")
+		if idx == -1 {
+			return true
+		}
+
+		target = strings.Trim(strings.TrimSpace(content[idx+len("url="):]), `'"`)
+		return false
+	})
+
+	return resolveURL(doc.Url, target)
+}
+
+// canonicalURL returns the canonical URL advertised by the page (og:url),
+// falling back to the URL the document was finally served from
+func canonicalURL(doc *goquery.Document) string {
+	if ogURL, ok := doc.Find(`meta[property="og:url"]`).Attr("content"); ok {
+		if canonical := resolveURL(doc.Url, strings.TrimSpace(ogURL)); canonical != "" {
+			return canonical
+		}
+	}
+
+	if doc.Url != nil {
+		return doc.Url.String()
+	}
+
+	return ""
+}
+
+// resolveURL resolves ref against base, returning "" when ref is empty or invalid
+func resolveURL(base *url.URL, ref string) string {
+	if ref == "" {
+		return ""
+	}
+
+	u, err := url.Parse(ref)
+	if err != nil {
+		return ""
+	}
+
+	if base != nil {
+		u = base.ResolveReference(u)
+	}
+
+	return u.String()
+}
+
+// sameURL reports whether two URLs point at the same page, ignoring
+// differences in percent-encoding and trailing slashes
+func sameURL(a, b string) bool {
+	ua, errA := url.Parse(a)
+	ub, errB := url.Parse(b)
+	if errA != nil || errB != nil {
+		return a == b
+	}
+
+	return strings.EqualFold(ua.Host, ub.Host) &&
+		strings.TrimSuffix(ua.Path, "/") == strings.TrimSuffix(ub.Path, "/")
+}
+
+// isInternalURL reports whether u points at the configured Grokipedia host
+func isInternalURL(u *url.URL) bool {
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		return false
+	}
+
+	return strings.EqualFold(u.Host, base.Host)
+}
+
+// extractLinks collects the <a href> values inside root, resolving relative
+// links against base and splitting them into internal, external and
+// in-page anchor links. Each list is de-duplicated in document order.
+func extractLinks(root *goquery.Selection, base *url.URL) (internal, external, anchors []string) {
+	seen := make(map[string]bool)
+
+	root.Find("a[href]").Each(func(i int, s *goquery.Selection) {
+		href, _ := s.Attr("href")
+		href = strings.TrimSpace(href)
+		if href == "" || seen[href] {
+			return
+		}
+
+		if strings.HasPrefix(href, "#") {
+			if len(href) > 1 {
+				seen[href] = true
+				anchors = append(anchors, href)
+			}
+			return
+		}
+
+		u, err := url.Parse(href)
+		if err != nil {
+			return
+		}
+		if base != nil {
+			u = base.ResolveReference(u)
+		}
+
+		// Skip mailto:, javascript: and other non-web links
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return
+		}
+
+		link := u.String()
+		if seen[link] {
+			return
+		}
+		seen[href] = true
+		seen[link] = true
+
+		if isInternalURL(u) {
+			internal = append(internal, link)
+		} else {
+			external = append(external, link)
+		}
+	})
+
+	return internal, external, anchors
+}
+
+// relatedHeadingPattern matches the headings of "See also" style sections
+var relatedHeadingPattern = regexp.MustCompile(`(?i)^(see also|related(\s+(articles|topics|pages))?)$`)
+
+// extractRelated collects the links under "See also"/"Related" headings in
+// root, up to the next heading of the same or a higher level. Relative URLs
+// are resolved against base; in-page anchors are skipped.
+func extractRelated(root *goquery.Selection, base *url.URL) []SearchResult {
+	var related []SearchResult
+	seen := make(map[string]bool)
+	sectionLevel := 0
+
+	root.Find("*").Each(func(i int, s *goquery.Selection) {
+		switch nodeName := goquery.NodeName(s); nodeName {
+		case "h1", "h2", "h3", "h4", "h5", "h6":
+			level := int(nodeName[1] - '0')
+			heading := strings.TrimRight(strings.Join(strings.Fields(s.Text()), " "), ":")
+			if relatedHeadingPattern.MatchString(heading) {
+				sectionLevel = level
+			} else if sectionLevel > 0 && level <= sectionLevel {
+				sectionLevel = 0
+			}
+		case "a":
+			if sectionLevel == 0 {
+				return
+			}
+			href, _ := s.Attr("href")
+			href = strings.TrimSpace(href)
+			if href == "" || strings.HasPrefix(href, "#") {
+				return
+			}
+
+			link := resolveURL(base, href)
+			u, err := url.Parse(link)
+			if link == "" || err != nil || (u.Scheme != "http" && u.Scheme != "https") || seen[link] {
+				return
+			}
+			seen[link] = true
+
+			title := strings.Join(strings.Fields(s.Text()), " ")
+			if title == "" {
+				title = link
+			}
+			related = append(related, SearchResult{Title: title, URL: link})
+		}
+	})
+
+	return related
+}
+
+// summaryAbbreviations are words ending in "." that do not end a sentence
+var summaryAbbreviations = map[string]bool{
+	"mr.": true, "mrs.": true, "ms.": true, "dr.": true, "prof.": true,
+	"st.": true, "jr.": true, "sr.": true, "vs.": true, "etc.": true,
+	"e.g.": true, "i.e.": true, "inc.": true, "ltd.": true, "co.": true,
+	"no.": true, "approx.": true, "c.": true, "ca.": true, "u.s.": true,
+}
+
+// firstSentences returns the first n sentences of text. Known abbreviations
+// and single-letter initials ("J. R. R. Tolkien") are not treated as sentence ends.
+func firstSentences(text string, n int) string {
+	if n <= 0 {
+		return text
+	}
+
+	words := strings.Fields(text)
+	count := 0
+	for i, word := range words {
+		// Allow closing quotes and brackets after the terminator
+		trimmed := strings.TrimRight(word, `"')]”’`)
+		if trimmed == "" || !strings.ContainsAny(trimmed[len(trimmed)-1:], ".!?") {
+			continue
+		}
+
+		if strings.HasSuffix(trimmed, ".") {
+			isInitial := utf8.RuneCountInString(trimmed) == 2 && trimmed[0] >= 'A' && trimmed[0] <= 'Z'
+			if isInitial || summaryAbbreviations[strings.ToLower(trimmed)] {
+				continue
+			}
+		}
+
+		count++
+		if count == n {
+			return strings.Join(words[:i+1], " ")
+		}
+	}
+
+	return strings.Join(words, " ")
+}
+
+// truncateAtWord shortens text to at most maxChars runes, cutting at the last
+// word boundary and appending an ellipsis when anything was removed
+func truncateAtWord(text string, maxChars int) string {
+	if maxChars <= 0 || utf8.RuneCountInString(text) <= maxChars {
+		return text
+	}
+
+	runes := []rune(text)
+	// Leave room for the ellipsis
+	cut := string(runes[:max(maxChars-1, 0)])
+	if idx := strings.LastIndexAny(cut, " \t\n"); idx > 0 {
+		cut = cut[:idx]
+	}
+
+	return strings.TrimRight(cut, " ,;:-") + "…"
+}
+
+// truncateBytes shortens text to at most maxBytes bytes without splitting a
+// UTF-8 sequence, reporting whether anything was removed
+func truncateBytes(text string, maxBytes int) (string, bool) {
+	if maxBytes <= 0 || len(text) <= maxBytes {
+		return text, false
+	}
+
+	cut := maxBytes
+	for cut > 0 && !utf8.RuneStart(text[cut]) {
+		cut--
+	}
+
+	return text[:cut], true
+}
+
+// langPattern accepts BCP 47 style language tags such as "en", "pt-BR" or "zh-Hant-TW"
+var langPattern = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+
+// queryInt reads a non-negative integer query parameter, returning def when it is absent
+func queryInt(r *http.Request, name string, def int) (int, error) {
+	raw := r.URL.Query().Get(name)
+	if raw == "" {
+		return def, nil
+	}
+
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("query parameter '%s' must be a non-negative integer", name)
+	}
+
+	return n, nil
+}
+
+// parserConfig controls how getArticle finds content in the page markup.
+// Overriding it via env lets deployments follow markup changes without a rebuild.
+type parserConfig struct {
+	// ArticleRoots are the selectors tried, in order, for the element holding
+	// the article body (see findArticleRoot)
+	ArticleRoots []string
+	// Category selects the category links
+	Category string
+	// Infobox selects key-facts tables and definition lists inside the article root
+	Infobox string
+	// Boilerplate selects navigation, footers, cookie banners and other site
+	// chrome dropped before the content is walked
+	Boilerplate string
+	// ContentClasses are class substrings marking <span>s that hold article text
+	ContentClasses []string
+	// DedupWindow is how many of the last content lines a line is compared
+	// against to drop exact repeats; 0 keeps repeats
+	DedupWindow int
+	// ParallelExtraction runs the independent extraction passes of an
+	// article (content, infobox, links, categories, page metadata) in
+	// parallel goroutines instead of one after the other
+	ParallelExtraction bool
+	// IncludeMath keeps formulas in the content as their LaTeX source
+	// between $ (inline) or $$ (display) instead of dropping them
+	IncludeMath bool
+	// DedupFuzzy also drops content lines that differ from a recent line only in case or punctuation
+	DedupFuzzy bool
+	// MinContentRunes is the shortest text, in runes, kept in the content
+	MinContentRunes int
+	// MinSummaryRunes is the length a paragraph must exceed to become the summary
+	MinSummaryRunes int
+	// SummarySources are where the summary is taken from, in order of
+	// preference (see pageSummary)
+	SummarySources []string
+	// MaxCategories caps the categories returned, keeping the first in
+	// document order; 0 is unlimited
+	MaxCategories int
+	// MaxLinks caps each list of links returned (internal, external, anchor
+	// and related) the same way
+	MaxLinks int
+}
+
+// defaultBoilerplateSelector matches common site chrome: navigation, page
+// headers and footers, and cookie/consent banners
+const defaultBoilerplateSelector = `nav, header, footer, [role="navigation"], [role="banner"], [role="contentinfo"], ` +
+	`.cookie-banner, .cookie-consent, .cookie-notice, #cookie-banner, #cookie-consent, [aria-label*="cookie" i]`
+
+func defaultParserConfig() parserConfig {
+	return parserConfig{
+		ArticleRoots:   []string{"article", "main"},
+		Category:       ".categories a, .category a",
+		Infobox:        ".infobox, [class*=\"infobox\"]",
+		Boilerplate:    defaultBoilerplateSelector,
+		ContentClasses: []string{"break-words", "leading-7"},
+
+		DedupWindow:     1,
+		MinContentRunes: 3,
+		MinSummaryRunes: 50,
+		SummarySources:  []string{summaryFromContent, summaryFromMeta, summaryFromOG},
+	}
+}
+
+// loadParserConfig reads parser overrides through lookup, keeping the
+// defaults for anything unset
+func loadParserConfig(lookup configLookup) parserConfig {
+	cfg := defaultParserConfig()
+
+	// ARTICLE_ROOT_SELECTORS replaces the whole chain; the older
+	// SELECTOR_ARTICLE_ROOT only replaces its first entry
+	if v := splitList(lookup.get("ARTICLE_ROOT_SELECTORS")); len(v) > 0 {
+		cfg.ArticleRoots = v
+	} else if v := strings.TrimSpace(lookup.get("SELECTOR_ARTICLE_ROOT")); v != "" {
+		cfg.ArticleRoots[0] = v
+	}
+	if v := strings.TrimSpace(lookup.get("SELECTOR_CATEGORY")); v != "" {
+		cfg.Category = v
+	}
+	if v := strings.TrimSpace(lookup.get("SELECTOR_INFOBOX")); v != "" {
+		cfg.Infobox = v
+	}
+	// Set but empty disables boilerplate removal
+	if v, ok := lookup("SELECTOR_BOILERPLATE"); ok {
+		cfg.Boilerplate = strings.TrimSpace(v)
+	}
+	if v := splitList(lookup.get("SELECTOR_SUMMARY_CLASSES")); len(v) > 0 {
+		cfg.ContentClasses = v
+	}
+	cfg.DedupFuzzy = lookup.get("DEDUP_FUZZY") == "true"
+	cfg.IncludeMath = lookup.get("INCLUDE_MATH") == "true"
+	cfg.ParallelExtraction = lookup.get("PARALLEL_EXTRACTION") == "true"
+
+	if v := lookup.get("DEDUP_WINDOW"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > maxDedupWindow {
+			log.Printf("Invalid DEDUP_WINDOW %q (0-%d), using %d", v, maxDedupWindow, cfg.DedupWindow)
+		} else {
+			cfg.DedupWindow = n
+		}
+	}
+
+	if v := lookup.get("MIN_CONTENT_RUNES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Printf("Invalid MIN_CONTENT_RUNES %q, using %d", v, cfg.MinContentRunes)
+		} else {
+			cfg.MinContentRunes = n
+		}
+	}
+	if v := lookup.get("MIN_SUMMARY_RUNES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Printf("Invalid MIN_SUMMARY_RUNES %q, using %d", v, cfg.MinSummaryRunes)
+		} else {
+			cfg.MinSummaryRunes = n
+		}
+	}
+	if v := lookup.get("SUMMARY_SOURCES"); v != "" {
+		sources, err := parseSummarySources(v)
+		if err != nil {
+			log.Printf("Invalid SUMMARY_SOURCES %q: %v, using %s", v, err, strings.Join(cfg.SummarySources, ","))
+		} else {
+			cfg.SummarySources = sources
+		}
+	}
+	if v := lookup.get("MAX_CATEGORIES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Printf("Invalid MAX_CATEGORIES %q, using %d", v, cfg.MaxCategories)
+		} else {
+			cfg.MaxCategories = n
+		}
+	}
+	if v := lookup.get("MAX_LINKS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Printf("Invalid MAX_LINKS %q, using %d", v, cfg.MaxLinks)
+		} else {
+			cfg.MaxLinks = n
+		}
+	}
+
+	return cfg
+}
+
+// firstN returns the first n items, or all of them when n is 0
+func firstN[T any](items []T, n int) []T {
+	if n > 0 && len(items) > n {
+		return items[:n]
+	}
+	return items
+}
+
+// capArticleLists applies MAX_CATEGORIES and MAX_LINKS to an extracted article
+func (parser *parserConfig) capArticleLists(article *Article) {
+	article.Categories = firstN(article.Categories, parser.MaxCategories)
+	article.CategoryLinks = firstN(article.CategoryLinks, parser.MaxCategories)
+	article.InternalLinks = firstN(article.InternalLinks, parser.MaxLinks)
+	article.ExternalLinks = firstN(article.ExternalLinks, parser.MaxLinks)
+	article.AnchorLinks = firstN(article.AnchorLinks, parser.MaxLinks)
+	article.RelatedArticles = firstN(article.RelatedArticles, parser.MaxLinks)
+}
+
+// splitList splits a comma-separated value, dropping empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// hasAnyClass reports whether classAttr contains any of the given class substrings
+func hasAnyClass(classAttr string, classes []string) bool {
+	for _, class := range classes {
+		if strings.Contains(classAttr, class) {
+			return true
+		}
+	}
+	return false
+}
+
+// stripBoilerplate returns a copy of sel without the elements matching
+// parser.Boilerplate, leaving the document itself untouched
+func (parser *parserConfig) stripBoilerplate(sel *goquery.Selection) *goquery.Selection {
+	if parser.Boilerplate == "" {
+		return sel
+	}
+
+	clean := sel.Clone()
+	clean.Find(parser.Boilerplate).Remove()
+	return clean
+}
+
+// extractInfobox collects label/value pairs from the table rows and
+// definition lists of the infobox elements. The first value seen for a
+// label wins.
+func extractInfobox(infobox *goquery.Selection) map[string]string {
+	facts := make(map[string]string)
+	clean := func(s *goquery.Selection) string {
+		return strings.Join(strings.Fields(s.Text()), " ")
+	}
+	add := func(label, value string) {
+		label = strings.TrimSpace(strings.TrimSuffix(label, ":"))
+		if label == "" || value == "" {
+			return
+		}
+		if _, ok := facts[label]; !ok {
+			facts[label] = value
+		}
+	}
+
+	infobox.Find("tr").Each(func(i int, row *goquery.Selection) {
+		cells := row.Children().Filter("th, td")
+		if cells.Length() == 2 {
+			add(clean(cells.Eq(0)), clean(cells.Eq(1)))
+		}
+	})
+
+	infobox.Filter("dl").AddSelection(infobox.Find("dl")).Each(func(i int, list *goquery.Selection) {
+		label := ""
+		list.Children().Each(func(j int, item *goquery.Selection) {
+			switch goquery.NodeName(item) {
+			case "dt":
+				label = clean(item)
+			case "dd":
+				add(label, clean(item))
+			}
+		})
+	})
+
+	if len(facts) == 0 {
+		return nil
+	}
+	return facts
+}
+
+// maxDedupWindow bounds DEDUP_WINDOW, since every line is compared against the whole window
+const maxDedupWindow = 100
+
+// fuzzyDedupWindow is how many recent lines DEDUP_FUZZY compares against
+const fuzzyDedupWindow = 5
+
+// lineWindow is a ring buffer of the last few content lines, for dropping
+// lines that repeat one of them. A window of size 0 holds nothing.
+type lineWindow struct {
+	lines []string
+	next  int
+}
+
+func newLineWindow(size int) *lineWindow {
+	return &lineWindow{lines: make([]string, 0, size)}
+}
+
+// contains reports whether line is one of the lines in the window
+func (w *lineWindow) contains(line string) bool {
+	return slices.Contains(w.lines, line)
+}
+
+// add puts line in the window, replacing the oldest line when it is full
+func (w *lineWindow) add(line string) {
+	if cap(w.lines) == 0 {
+		return
+	}
+	if len(w.lines) < cap(w.lines) {
+		w.lines = append(w.lines, line)
+		return
+	}
+	w.lines[w.next] = line
+	w.next = (w.next + 1) % len(w.lines)
+}
+
+// dedupKey normalizes a content line for fuzzy duplicate detection by
+// lowercasing it and dropping punctuation and symbols
+func dedupKey(text string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(text) {
+		switch {
+		case unicode.IsLetter(r), unicode.IsDigit(r):
+			b.WriteRune(r)
+		case unicode.IsSpace(r):
+			b.WriteRune(' ')
+		}
+	}
+
+	return strings.Join(strings.Fields(b.String()), " ")
+}
+
+// lastUpdatedScanLimit is how many bytes from the top of the page are searched for a "Last updated" line
+const lastUpdatedScanLimit = 4000
+
+// lastUpdatedPattern matches "Last updated/edited/modified" followed by a date in one of the
+// formats listed in lastUpdatedLayouts
+var lastUpdatedPattern = regexp.MustCompile(`(?i)last\s*(?:updated|edited|modified)\s*(?:on|:)?\s*(` +
+	`\d{4}-\d{2}-\d{2}(?:[T ]\d{2}:\d{2}(?::\d{2})?(?:\.\d+)?(?:Z|[+-]\d{2}:\d{2})?)?` +
+	`|[A-Za-z]{3,9}\.? \d{1,2},? \d{4}` +
+	`|\d{1,2} [A-Za-z]{3,9}\.? \d{4}` +
+	`|\d{1,2}/\d{1,2}/\d{4})`)
+
+// lastUpdatedLayouts are the date formats accepted by lastUpdatedFromText
+var lastUpdatedLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02",
+	"January 2, 2006",
+	"January 2 2006",
+	"Jan 2, 2006",
+	"Jan 2 2006",
+	"Jan. 2, 2006",
+	"2 January 2006",
+	"2 Jan 2006",
+	"01/02/2006",
+}
+
+// lastUpdatedFromText finds a "Last updated <date>" phrase near the start of
+// text and returns the date normalized to RFC3339, or "" if none parses
+func lastUpdatedFromText(text string) string {
+	text = strings.Join(strings.Fields(text), " ")
+	if len(text) > lastUpdatedScanLimit {
+		text = text[:lastUpdatedScanLimit]
+	}
+
+	for _, match := range lastUpdatedPattern.FindAllStringSubmatch(text, -1) {
+		for _, layout := range lastUpdatedLayouts {
+			if t, err := time.Parse(layout, match[1]); err == nil {
+				return t.Format(time.RFC3339)
+			}
+		}
+	}
+
+	return ""
+}
+
+// clock is the time source for relative times; tests may replace it
+var clock = time.Now
+
+// parseLastUpdated parses a LastUpdated value, which is RFC3339 when it came
+// from the page text but may use any of lastUpdatedLayouts when taken from a meta tag
+func parseLastUpdated(value string) (time.Time, bool) {
+	for _, layout := range append([]string{time.RFC3339, "2006-01-02"}, lastUpdatedLayouts...) {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// defaultContentSeparator joins the parts of Article.Content as parsed and
+// cached. Parts never contain line breaks, so it can be swapped for another
+// separator when the article is served.
+const defaultContentSeparator = "\n\n"
+
+// contentSeparators are the separators CONTENT_SEPARATOR and ?separator= may choose
+var contentSeparators = []string{"\n\n", "\n", "\r\n\r\n", "\r\n", " "}
+
+// parseContentSeparator validates a content separator, given literally
+// (URL-decoded, in a query) or with \n and \r escapes (in the environment)
+func parseContentSeparator(value string) (string, error) {
+	if strings.Contains(value, `\`) {
+		unquoted, err := strconv.Unquote(`"` + value + `"`)
+		if err != nil {
+			return "", fmt.Errorf("invalid separator %q", value)
+		}
+		value = unquoted
+	}
+	if !slices.Contains(contentSeparators, value) {
+		return "", fmt.Errorf("separator %q is not one of \\n\\n, \\n, \\r\\n\\r\\n, \\r\\n or a space", value)
+	}
+	return value, nil
+}
+
+// joinContent rejoins content parsed with defaultContentSeparator with sep
+func joinContent(content, sep string) string {
+	if sep == defaultContentSeparator {
+		return content
+	}
+	return strings.ReplaceAll(content, defaultContentSeparator, sep)
+}
+
+// defaultReadingWPM is the reading speed assumed without READING_WPM
+const defaultReadingWPM = 200
+
+// readingTime estimates how long reading words words takes at wpm words
+// per minute: exactly, in seconds, and as "N min read" rounded to the
+// nearest minute, never below 1
+func readingTime(words, wpm int) (seconds int, human string) {
+	seconds = int(math.Ceil(float64(words) * 60 / float64(wpm)))
+	minutes := max(1, int(math.Round(float64(seconds)/60)))
+	return seconds, fmt.Sprintf("%d min read", minutes)
+}
+
+// relativeTime describes t relative to ref in the largest whole unit, e.g.
+// "5 minutes ago", "3 days ago" or "in 2 hours". Months count as 30 days
+// and years as 365.
+func relativeTime(t, ref time.Time) string {
+	d := ref.Sub(t)
+	future := d < 0
+	if future {
+		d = -d
+	}
+
+	var n int
+	var unit string
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		n, unit = int(d/time.Minute), "minute"
+	case d < 24*time.Hour:
+		n, unit = int(d/time.Hour), "hour"
+	case d < 30*24*time.Hour:
+		n, unit = int(d/(24*time.Hour)), "day"
+	case d < 365*24*time.Hour:
+		n, unit = int(d/(30*24*time.Hour)), "month"
+	default:
+		n, unit = int(d/(365*24*time.Hour)), "year"
+	}
+
+	if n != 1 {
+		unit += "s"
+	}
+	if future {
+		return fmt.Sprintf("in %d %s", n, unit)
+	}
+	return fmt.Sprintf("%d %s ago", n, unit)
+}
+
+// Disambiguation detection thresholds. A page counts as a disambiguation
+// page when it says "may refer to" and lists at least
+// minDisambiguationOptions short linked items with little other prose.
+const (
+	minDisambiguationOptions = 2
+	maxDisambiguationItem    = 200
+	maxDisambiguationProse   = 1500
+)
+
+var disambiguationPattern = regexp.MustCompile(`(?i)\bmay\s+(?:also\s+)?refer\s+to\b`)
+
+// minArticleRootRunes is how much text an element must hold to be taken as
+// the article root over the later selectors of ARTICLE_ROOT_SELECTORS
+const minArticleRootRunes = 200
+
+// findArticleRoot returns the element holding the article body. The selection
+// is empty when no selector of parser.ArticleRoots matches.
+func (parser *parserConfig) findArticleRoot(doc *goquery.Document) *goquery.Selection {
+	root, _ := parser.matchArticleRoot(doc)
+	return root
+}
+
+// matchArticleRoot tries parser.ArticleRoots in order and returns the first
+// match holding at least minArticleRootRunes of text, with its selector. When
+// every match is shorter, e.g. a stub article, the first match is used.
+func (parser *parserConfig) matchArticleRoot(doc *goquery.Document) (*goquery.Selection, string) {
+	var first *goquery.Selection
+	var firstSelector string
+	for _, selector := range parser.ArticleRoots {
+		root := doc.Find(selector)
+		if root.Length() == 0 {
+			continue
+		}
+		if utf8.RuneCountInString(strings.TrimSpace(root.Text())) >= minArticleRootRunes {
+			return root, selector
+		}
+		if first == nil {
+			first, firstSelector = root, selector
+		}
+	}
+	if first == nil {
+		return doc.FindNodes(), ""
+	}
+	return first, firstSelector
+}
+
+// isDisambiguation reports whether doc looks like a disambiguation page
+// rather than an article
+func (parser *parserConfig) isDisambiguation(doc *goquery.Document) bool {
+	root := parser.findArticleRoot(doc)
+	if root.Length() == 0 {
+		root = doc.Find("body")
+	}
+
+	if !disambiguationPattern.MatchString(root.Text()) {
+		return false
+	}
+
+	options := 0
+	root.Find("li").Each(func(i int, s *goquery.Selection) {
+		if s.Find("a[href]").Length() > 0 && utf8.RuneCountInString(strings.TrimSpace(s.Text())) <= maxDisambiguationItem {
+			options++
+		}
+	})
+
+	prose := 0
+	root.Find("p").Each(func(i int, s *goquery.Selection) {
+		prose += utf8.RuneCountInString(strings.TrimSpace(s.Text()))
+	})
+
+	return options >= minDisambiguationOptions && prose <= maxDisambiguationProse
+}
+
+// disambiguationOptions lists the first internal link of each list item on a
+// disambiguation page, de-duplicated in document order
+func (parser *parserConfig) disambiguationOptions(doc *goquery.Document) []DisambiguationOption {
+	root := parser.findArticleRoot(doc)
+	if root.Length() == 0 {
+		root = doc.Find("body")
+	}
+
+	var options []DisambiguationOption
+	seen := make(map[string]bool)
+
+	root.Find("li").Each(func(i int, s *goquery.Selection) {
+		s.Find("a[href]").EachWithBreak(func(j int, a *goquery.Selection) bool {
+			href, _ := a.Attr("href")
+			link := resolveURL(doc.Url, strings.TrimSpace(href))
+			u, err := url.Parse(link)
+			if link == "" || err != nil || !isInternalURL(u) || u.Path == "" || u.Path == "/" {
+				return true
+			}
+
+			if !seen[link] {
+				seen[link] = true
+				title := strings.Join(strings.Fields(a.Text()), " ")
+				if title == "" {
+					title = link
+				}
+				options = append(options, DisambiguationOption{Title: title, URL: link})
+			}
+			return false
+		})
+	})
+
+	return options
+}
+
+// fetchArticlePage fetches the page of an article, in the given revision
+// when one is set, following a client-side redirect. The returned Article
+// holds what the page identifies itself by: URL, slug, title and language.
+func fetchArticlePage(ctx context.Context, articlePath, lang, revision string) (*goquery.Document, *Article, error) {
+	fullURL, err := articleURL(articlePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	if revision != "" {
+		fullURL, err = revisionURL(fullURL, revision)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	log.Printf("Fetching article from URL: %s", fullURL)
+
+	doc, err := fetchHTML(ctx, fullURL, lang)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Follow a single client-side redirect, staying on the same host
+	if target := metaRefreshURL(doc); target != "" && !sameURL(target, fullURL) {
+		if targetURL, err := url.Parse(target); err == nil && doc.Url != nil && strings.EqualFold(targetURL.Host, doc.Url.Host) {
+			log.Printf("Following client-side redirect to: %s", target)
+			doc, err = fetchHTML(ctx, target, lang)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	article := &Article{
+		URL:        fullURL,
+		Language:   strings.TrimSpace(doc.Find("html").AttrOr("lang", "")),
+		RevisionID: revision,
+	}
+
+	// A revision's canonical URL is the latest version, which is not a redirect
+	if canonical := canonicalURL(doc); canonical != "" && revision == "" && !sameURL(canonical, fullURL) {
+		article.URL = canonical
+		article.Redirected = true
+	}
+
+	// Extract title
+	article.Title = doc.Find("h1").First().Text()
+	if article.Title == "" {
+		article.Title = doc.Find("title").First().Text()
+	}
+
+	// Pages served outside /page/ (e.g. an ID redirect that was not
+	// followed) get the slug search would build from the title
+	article.Slug = articleSlug(article.URL)
+	if article.Slug == "" {
+		article.Slug = titleSlug(article.Title)
+	}
+
+	return doc, article, nil
+}
+
+// contentBlocks walks a copy of root with site chrome removed and returns
+// its text blocks in document order: headings, paragraphs, list items,
+// quotes, preformatted text and the <span>s marked by ContentClasses, each
+// with its whitespace collapsed. The infobox is returned separately, so its
+// facts are left out.
+func (parser *parserConfig) contentBlocks(root *goquery.Selection) []Block {
+	var blocks []Block
+	parser.walkBlocks(root, func(block Block) bool {
+		blocks = append(blocks, block)
+		return true
+	})
+	return blocks
+}
+
+// walkBlocks passes the blocks contentBlocks returns to yield one at a
+// time, stopping early when yield returns false
+func (parser *parserConfig) walkBlocks(root *goquery.Selection, yield func(Block) bool) {
+	root = parser.stripBoilerplate(root)
+	infobox := root.Find(parser.Infobox)
+
+	root.Find("*").EachWithBreak(func(i int, s *goquery.Selection) bool {
+		if infobox.Length() > 0 && (infobox.IsSelection(s) || infobox.Contains(s.Get(0))) {
+			return true
+		}
+
+		nodeName := goquery.NodeName(s)
+		switch nodeName {
+		case "h2", "h3", "h4", "h5", "h6", "blockquote", "pre", "p", "li":
+		case "span":
+			classAttr, _ := s.Attr("class")
+			if parser.IncludeMath && hasAnyClass(classAttr, []string{"katex-display"}) && s.ParentsFiltered(textBlockSelector).Length() == 0 {
+				// Display formulas between paragraphs are blocks of their own
+				nodeName = "math"
+				break
+			}
+			if strings.Contains(classAttr, "katex") || strings.Contains(classAttr, "sr-only") || !hasAnyClass(classAttr, parser.ContentClasses) {
+				return true
+			}
+		default:
+			return true
+		}
+
+		clean := s.Clone()
+		clean.Find("button, svg, style, script").Remove()
+		var formulas []string
+		if parser.IncludeMath {
+			formulas = replaceMath(clean)
+		}
+		if text := strings.Join(strings.Fields(clean.Text()), " "); text != "" {
+			return yield(Block{Type: nodeName, Text: text, Formulas: formulas})
+		}
+		return true
+	})
+}
+
+// textBlockSelector matches the elements contentBlocks reads the text of as a whole
+const textBlockSelector = "h2, h3, h4, h5, h6, blockquote, pre, p, li"
+
+// mathSelector matches rendered formulas: KaTeX output, and MathML outside it
+const mathSelector = ".katex, math"
+
+// replaceMath replaces each formula in s with its LaTeX source between $,
+// or $$ for display formulas, and returns the sources in document order.
+// Formulas without a source are left as they are.
+func replaceMath(s *goquery.Selection) []string {
+	var formulas []string
+	// The MathML inside KaTeX output is handled with it
+	outermost := s.Find(mathSelector).FilterFunction(func(_ int, m *goquery.Selection) bool {
+		return m.ParentsFiltered(mathSelector).Length() == 0
+	})
+	outermost.Each(func(_ int, m *goquery.Selection) {
+		tex := formulaSource(m)
+		if tex == "" {
+			return
+		}
+
+		delim := "$"
+		if display, _ := m.Attr("display"); display == "block" || m.ParentsFiltered(".katex-display").Length() > 0 {
+			delim = "$$"
+		}
+		m.SetText(delim + tex + delim)
+		formulas = append(formulas, tex)
+	})
+	return formulas
+}
+
+// formulaSource returns the LaTeX behind a rendered formula: the TeX
+// annotation KaTeX embeds in its MathML, or a data-latex, data-tex or
+// MathML alttext attribute
+func formulaSource(m *goquery.Selection) string {
+	if annotation := m.Find(`annotation[encoding="application/x-tex"]`).First(); annotation.Length() > 0 {
+		return strings.TrimSpace(annotation.Text())
+	}
+	for _, attr := range []string{"data-latex", "data-tex", "alttext"} {
+		if v := strings.TrimSpace(m.AttrOr(attr, "")); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// buildContent returns the content lines of blocks and fills in the summary
+// and sections of article from them. Blocks left out of the content, for
+// being too short or repeating a recent line, are marked with the reason.
+func (parser *parserConfig) buildContent(article *Article, blocks []Block) []string {
+	var contentParts []string
+	// recentLines holds the last DEDUP_WINDOW lines, and recentKeys the
+	// dedupKey of the last fuzzyDedupWindow lines when DEDUP_FUZZY is on
+	recentLines := newLineWindow(parser.DedupWindow)
+	recentKeys := newLineWindow(fuzzyDedupWindow)
+
+	for i := range blocks {
+		block := &blocks[i]
+		text := block.Text
+
+		if utf8.RuneCountInString(text) < parser.MinContentRunes && block.Type != "math" {
+			block.Skipped = skipTooShort
+			continue
+		}
+		if recentLines.contains(text) {
+			block.Skipped = skipDuplicate
+			continue
+		}
+		if parser.DedupFuzzy {
+			if key := dedupKey(text); key != "" {
+				if recentKeys.contains(key) {
+					block.Skipped = skipDuplicate
+					continue
+				}
+				recentKeys.add(key)
+			}
+		}
+
+		contentParts = append(contentParts, text)
+		recentLines.add(text)
+		article.Formulas = append(article.Formulas, block.Formulas...)
+
+		switch block.Type {
+		case "h2", "h3", "h4", "h5", "h6":
+			article.Sections = append(article.Sections, Section{
+				Heading: text,
+				Level:   int(block.Type[1] - '0'),
+			})
+			continue
+		case "p", "blockquote", "span":
+			if article.Summary == "" && utf8.RuneCountInString(text) > parser.MinSummaryRunes {
+				article.Summary = text
+			}
+		}
+
+		// Bucket non-heading content under the most recent heading
+		if len(article.Sections) == 0 {
+			article.Sections = append(article.Sections, Section{})
+		}
+		current := &article.Sections[len(article.Sections)-1]
+		current.Paragraphs = append(current.Paragraphs, text)
+	}
+
+	return contentParts
+}
+
+// getArticle fetches and parses a Grokipedia article
+func getArticle(ctx context.Context, articlePath, lang, revision string) (*Article, error) {
+	doc, article, err := fetchArticlePage(ctx, articlePath, lang, revision)
+	if err != nil {
+		return nil, err
+	}
+	defer timingFrom(ctx).addParse(time.Now())
+	return parseArticle(doc, article, currentConfig())
+}
+
+// parseArticle fills in article, as fetchArticlePage returned it, with what
+// the parser of cfg extracts from doc
+func parseArticle(doc *goquery.Document, article *Article, cfg *runtimeConfig) (*Article, error) {
+	parser := &cfg.Parser
+
+	if parser.isDisambiguation(doc) {
+		if options := parser.disambiguationOptions(doc); len(options) >= minDisambiguationOptions {
+			return nil, &DisambiguationError{
+				Title:   strings.TrimSpace(article.Title),
+				URL:     article.URL,
+				Options: options,
+			}
+		}
+	}
+
+	articleRoot, rootSelector := parser.matchArticleRoot(doc)
+	if rootSelector != "" && rootSelector != parser.ArticleRoots[0] {
+		article.ParseWarnings = append(article.ParseWarnings, fmt.Sprintf(warnArticleRootFallback, rootSelector))
+	}
+	infoboxRoot := articleRoot
+	if infoboxRoot.Length() == 0 {
+		infoboxRoot = doc.Selection
+	}
+	// Links come from the article body
+	linkRoot := articleRoot
+	if linkRoot.Length() == 0 {
+		linkRoot = doc.Find("body")
+	}
+
+	// The passes only read doc: the content walk and the boilerplate
+	// stripping remove nodes from clones (see stripBoilerplate and
+	// walkBlocks), never from doc itself. Each also fills fields of article
+	// no other pass touches, so they may run side by side without a copy of
+	// the document each (PARALLEL_EXTRACTION).
+	var contentParts []string
+	runPasses(parser.ParallelExtraction,
+		func() { contentParts = parser.extractContent(article, doc, articleRoot) },
+		func() { article.Infobox = extractInfobox(infoboxRoot.Find(parser.Infobox)) },
+		func() {
+			article.InternalLinks, article.ExternalLinks, article.AnchorLinks = extractLinks(linkRoot, doc.Url)
+			article.RelatedArticles = extractRelated(linkRoot, doc.Url)
+		},
+		func() { article.Categories, article.CategoryLinks = parser.extractCategories(doc) },
+		func() {
+			article.LastUpdated = pageLastUpdated(doc, articleRoot)
+			article.LeadImage = leadImage(doc, articleRoot)
+			article.Alternates = languageAlternates(doc)
+		},
+	)
+
+	article.Content = strings.Join(contentParts, defaultContentSeparator)
+	if article.Content == "" {
+		return nil, fmt.Errorf("%w: %s", ErrEmptyContent, article.URL)
+	}
+	article.ReadingTimeSeconds, article.ReadingTime = readingTime(len(strings.Fields(article.Content)), cfg.ReadingWPM)
+
+	// Pick the summary from the first of SUMMARY_SOURCES that has one, and
+	// name the source used when the content was tried before it and had none
+	contentSummary := article.Summary
+	var source string
+	article.Summary, source = parser.pageSummary(doc, func() string { return contentSummary })
+	if source == "" {
+		article.ParseWarnings = append(article.ParseWarnings, warnNoSummary)
+	} else if content := slices.Index(parser.SummarySources, summaryFromContent); content >= 0 && content < slices.Index(parser.SummarySources, source) {
+		article.ParseWarnings = append(article.ParseWarnings, fmt.Sprintf(warnFallbackSummary, summarySourceNames[source]))
+	}
+
+	parser.capArticleLists(article)
+
+	article.ContentHash = contentHash(article.Content)
+	article.ContentLength = len(article.Content)
+
+	return article, nil
+}
+
+// extractContent returns the content lines of the article root, or of the
+// whole document when the root is missing or yields nothing, filling in the
+// blocks, summary, sections and formulas of article along the way
+func (parser *parserConfig) extractContent(article *Article, doc *goquery.Document, articleRoot *goquery.Selection) []string {
+	if articleRoot.Length() > 0 {
+		article.Blocks = parser.contentBlocks(articleRoot)
+		if contentParts := parser.buildContent(article, article.Blocks); len(contentParts) > 0 {
+			return contentParts
+		}
+		article.ParseWarnings = append(article.ParseWarnings, warnEmptyArticleRoot)
+	} else {
+		article.ParseWarnings = append(article.ParseWarnings, warnNoArticleRoot)
+	}
+
+	article.Blocks = parser.contentBlocks(doc.Selection)
+	return parser.buildContent(article, article.Blocks)
+}
+
+// runPasses runs the extraction passes of an article one after the other,
+// or each in a goroutine of its own when parallel is set. A panic in a pass
+// is raised again in the caller, where the recovery middleware sees it.
+func runPasses(parallel bool, passes ...func()) {
+	if !parallel {
+		for _, pass := range passes {
+			pass()
+		}
+		return
+	}
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	var panicked any
+	for _, pass := range passes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() {
+				if p := recover(); p != nil {
+					once.Do(func() { panicked = p })
+				}
+			}()
+			pass()
+		}()
+	}
+	wg.Wait()
+
+	if panicked != nil {
+		panic(panicked)
+	}
+}
+
+// getArticleMetadata fetches an article page like getArticle but reads only
+// its title, meta description, last update, lead image and categories,
+// skipping the content walk. The summary comes from the meta sources of
+// SUMMARY_SOURCES, so it is empty when the page has none.
+func getArticleMetadata(ctx context.Context, articlePath, lang, revision string) (*Article, error) {
+	doc, article, err := fetchArticlePage(ctx, articlePath, lang, revision)
+	if err != nil {
+		return nil, err
+	}
+
+	defer timingFrom(ctx).addParse(time.Now())
+	parser := &currentConfig().Parser
+	articleRoot := parser.findArticleRoot(doc)
+	article.Summary, _ = parser.pageSummary(doc, nil)
+	article.LastUpdated = pageLastUpdated(doc, articleRoot)
+	article.LeadImage = leadImage(doc, articleRoot)
+	article.Categories, article.CategoryLinks = parser.extractCategories(doc)
+	parser.capArticleLists(article)
+
+	return article, nil
+}
+
+// getArticleSummary fetches an article page like getArticle but reads only
+// its title, summary and lead image. The summary is the one getArticle
+// picks, but the content is only walked up to the summary paragraph, and
+// not at all when a meta source ahead of content in SUMMARY_SOURCES has one.
+func getArticleSummary(ctx context.Context, articlePath, lang string) (*Article, error) {
+	doc, article, err := fetchArticlePage(ctx, articlePath, lang, "")
+	if err != nil {
+		return nil, err
+	}
+
+	defer timingFrom(ctx).addParse(time.Now())
+	parser := &currentConfig().Parser
+	if parser.isDisambiguation(doc) {
+		if options := parser.disambiguationOptions(doc); len(options) >= minDisambiguationOptions {
+			return nil, &DisambiguationError{
+				Title:   strings.TrimSpace(article.Title),
+				URL:     article.URL,
+				Options: options,
+			}
+		}
+	}
+
+	// A page getArticle would reject as empty is an error here too, even
+	// when a meta tag carries a summary
+	if !parser.hasContent(doc) {
+		return nil, fmt.Errorf("%w: %s", ErrEmptyContent, article.URL)
+	}
+
+	article.Summary, _ = parser.pageSummary(doc, func() string { return parser.contentSummary(doc) })
+	article.LeadImage = leadImage(doc, parser.findArticleRoot(doc))
+
+	return article, nil
+}
+
+// contentSummary returns the paragraph buildContent would pick as the
+// summary, walking the content only up to it. Like getArticle, it reads the
+// whole document when the article root is missing or has no content.
+func (parser *parserConfig) contentSummary(doc *goquery.Document) string {
+	var summary string
+	hasContent := false
+	find := func(root *goquery.Selection) {
+		parser.walkBlocks(root, func(block Block) bool {
+			runes := utf8.RuneCountInString(block.Text)
+			if runes < parser.MinContentRunes && block.Type != "math" {
+				return true
+			}
+			hasContent = true
+			switch block.Type {
+			case "p", "blockquote", "span":
+				if runes > parser.MinSummaryRunes {
+					summary = block.Text
+					return false
+				}
+			}
+			return true
+		})
+	}
+
+	if root := parser.findArticleRoot(doc); root.Length() > 0 {
+		find(root)
+	}
+	if summary == "" && !hasContent {
+		find(doc.Selection)
+	}
+	return summary
+}
+
+// hasContent reports whether doc has a block getArticle would keep as
+// content, walking only up to the first one. Like getArticle, it reads the
+// whole document when the article root is missing or has no content.
+func (parser *parserConfig) hasContent(doc *goquery.Document) bool {
+	found := false
+	find := func(root *goquery.Selection) {
+		parser.walkBlocks(root, func(block Block) bool {
+			found = utf8.RuneCountInString(block.Text) >= parser.MinContentRunes || block.Type == "math"
+			return !found
+		})
+	}
+
+	if root := parser.findArticleRoot(doc); root.Length() > 0 {
+		find(root)
+	}
+	if !found {
+		find(doc.Selection)
+	}
+	return found
+}
+
+// Summary sources for SUMMARY_SOURCES
+const (
+	// summaryFromContent is the first content paragraph longer than MIN_SUMMARY_RUNES
+	summaryFromContent = "content"
+	// summaryFromMeta is the <meta name="description"> tag
+	summaryFromMeta = "meta"
+	// summaryFromOG is the <meta property="og:description"> tag
+	summaryFromOG = "og"
+)
+
+// summarySourceNames describes the meta summary sources in parse warnings
+var summarySourceNames = map[string]string{
+	summaryFromMeta: "meta description",
+	summaryFromOG:   "og:description",
+}
+
+// pageSummary returns the summary from the first of SUMMARY_SOURCES that
+// has one, and that source. contentSummary returns the summary taken from
+// the content; it is only called when that source is reached, and a nil
+// contentSummary skips it.
+func (parser *parserConfig) pageSummary(doc *goquery.Document, contentSummary func() string) (summary, source string) {
+	for _, source := range parser.SummarySources {
+		switch source {
+		case summaryFromContent:
+			if contentSummary != nil {
+				summary = contentSummary()
+			}
+		case summaryFromMeta:
+			summary = metaContent(doc, `meta[name="description"]`)
+		case summaryFromOG:
+			summary = metaContent(doc, `meta[property="og:description"]`)
+		}
+		if summary != "" {
+			return summary, source
+		}
+	}
+	return "", ""
+}
+
+// parseSummarySources parses SUMMARY_SOURCES, a comma-separated list of
+// summary sources in order of preference. Sources left out are never used.
+func parseSummarySources(value string) ([]string, error) {
+	var sources []string
+	for _, source := range splitList(strings.ToLower(value)) {
+		switch source {
+		case summaryFromContent, summaryFromMeta, summaryFromOG:
+		default:
+			return nil, fmt.Errorf("unknown source %q (want %s, %s or %s)", source, summaryFromContent, summaryFromMeta, summaryFromOG)
+		}
+		if !slices.Contains(sources, source) {
+			sources = append(sources, source)
+		}
+	}
+	if len(sources) == 0 {
+		return nil, errors.New("no sources listed")
+	}
+	return sources, nil
+}
+
+// pageLastUpdated returns the article:modified_time meta tag, or else a
+// visible "Last updated ..." line in the article root or the body
+func pageLastUpdated(doc *goquery.Document, articleRoot *goquery.Selection) string {
+	if modified := metaContent(doc, `meta[property="article:modified_time"]`); modified != "" {
+		return modified
+	}
+
+	for _, root := range []*goquery.Selection{articleRoot, doc.Find("body")} {
+		if root.Length() == 0 {
+			continue
+		}
+		if updated := lastUpdatedFromText(root.Text()); updated != "" {
+			return updated
+		}
+	}
+	return ""
+}
+
+// extractCategories returns the names of the categories matched by the
+// Category selector, and the linked ones with their absolute URLs
+func (parser *parserConfig) extractCategories(doc *goquery.Document) (names []string, links []SearchResult) {
+	doc.Find(parser.Category).Each(func(i int, s *goquery.Selection) {
+		category := strings.TrimSpace(s.Text())
+		if category == "" {
+			return
+		}
+		names = append(names, category)
+
+		href, _ := s.Attr("href")
+		link := resolveURL(doc.Url, strings.TrimSpace(href))
+		if u, err := url.Parse(link); link != "" && err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+			links = append(links, SearchResult{Title: category, URL: link})
+		}
+	})
+	return names, links
+}
+
+// metaContent returns the trimmed content of the first matching meta tag
+func metaContent(doc *goquery.Document, selector string) string {
+	content, _ := doc.Find(selector).First().Attr("content")
+	return strings.TrimSpace(content)
+}
+
+// minLeadImageSize is the smallest declared width or height, in pixels, of
+// an <img> that leadImage accepts; smaller ones are icons and decorations
+const minLeadImageSize = 100
+
+// languageAlternates collects the <link rel="alternate" hreflang> tags of a
+// page as language to absolute URL, including "x-default". Returns nil when
+// the page declares none.
+func languageAlternates(doc *goquery.Document) map[string]string {
+	var alternates map[string]string
+	doc.Find(`link[rel~="alternate"][hreflang]`).Each(func(_ int, link *goquery.Selection) {
+		lang := strings.TrimSpace(link.AttrOr("hreflang", ""))
+		href := resolveURL(doc.Url, strings.TrimSpace(link.AttrOr("href", "")))
+		if lang == "" || !(strings.HasPrefix(href, "http://") || strings.HasPrefix(href, "https://")) {
+			return
+		}
+
+		if alternates == nil {
+			alternates = make(map[string]string)
+		}
+		alternates[lang] = href
+	})
+	return alternates
+}
+
+// leadImage returns the article's main image: the og:image (or twitter:image)
+// meta tag, or else the first sizeable <img> inside root. Images without
+// declared dimensions count as sizeable. Returns "" when there is none.
+func leadImage(doc *goquery.Document, root *goquery.Selection) string {
+	for _, selector := range []string{`meta[property="og:image"]`, `meta[name="twitter:image"]`} {
+		if image := resolveURL(doc.Url, metaContent(doc, selector)); image != "" {
+			return image
+		}
+	}
+
+	var image string
+	root.Find("img").EachWithBreak(func(i int, s *goquery.Selection) bool {
+		for _, attr := range []string{"width", "height"} {
+			if v, ok := s.Attr(attr); ok {
+				if n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(v), "px")); err == nil && n < minLeadImageSize {
+					return true
+				}
+			}
+		}
+
+		src := strings.TrimSpace(s.AttrOr("src", ""))
+		if src == "" || strings.HasPrefix(src, "data:") {
+			src = strings.TrimSpace(s.AttrOr("data-src", ""))
+		}
+		link := resolveURL(doc.Url, src)
+		if u, err := url.Parse(link); link == "" || err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return true
+		}
+
+		image = link
+		return false
+	})
+
+	return image
+}
+
+// parseEnrichFields parses the comma-separated ?enrich= parameter
+func parseEnrichFields(raw string) (map[string]bool, error) {
+	fields := make(map[string]bool)
+
+	for _, field := range strings.Split(raw, ",") {
+		field = strings.ToLower(strings.TrimSpace(field))
+		switch field {
+		case "":
+			continue
+		case enrichThumbnail, enrichSummary:
+			fields[field] = true
+		default:
+			return nil, fmt.Errorf("unknown enrich field %q", field)
+		}
+	}
+
+	return fields, nil
+}
+
+// enrichSearchResults fills the requested lightweight fields of each result
+// from the article metadata, fetching the result pages concurrently on a
+// cache miss, or always with fresh. Failed fetches and results off the
+// Grokipedia host are logged and leave the result unchanged.
+func enrichSearchResults(ctx context.Context, results []SearchResult, fields map[string]bool, fresh bool) {
+	if len(fields) == 0 {
+		return
+	}
+
+	sem := make(chan struct{}, maxEnrichConcurrency)
+	var wg sync.WaitGroup
+
+	for i := range results {
+		wg.Add(1)
+		go func(result *SearchResult) {
+			defer wg.Done()
+
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			u, err := url.Parse(result.URL)
+			if err != nil || !isInternalURL(u) {
+				log.Printf("Not enriching search result %s: not a Grokipedia page", result.URL)
+				return
+			}
+
+			meta, _, _, err := cachedArticleMetadata(ctx, u.Path, "", "", fresh)
+			if err != nil {
+				log.Printf("Failed to enrich search result %s: %v", result.URL, err)
+				return
+			}
+
+			if fields[enrichThumbnail] {
+				result.Thumbnail = meta.LeadImage
+			}
+			if fields[enrichSummary] {
+				result.Summary = meta.Summary
+			}
+		}(&results[i])
+	}
+
+	wg.Wait()
+}
+
+// chromeFlag is a Chrome command-line switch; Value is true for bare switches
+type chromeFlag struct {
+	Name  string
+	Value any
+}
+
+// parseChromeFlags parses a comma- or space-separated list of "key=value"
+// and bare "key" switches, with or without the leading "--". "key=false"
+// removes a default switch such as no-sandbox.
+func parseChromeFlags(value string) []chromeFlag {
+	var flags []chromeFlag
+	fields := strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+	for _, field := range fields {
+		field = strings.TrimLeft(field, "-")
+		if field == "" {
+			continue
+		}
+		if name, val, ok := strings.Cut(field, "="); ok {
+			if b, err := strconv.ParseBool(val); err == nil {
+				flags = append(flags, chromeFlag{Name: name, Value: b})
+			} else {
+				flags = append(flags, chromeFlag{Name: name, Value: val})
+			}
+		} else {
+			flags = append(flags, chromeFlag{Name: field, Value: true})
+		}
+	}
+	return flags
+}
+
+// allocatorOptions returns the headless Chrome options, with CHROME_FLAGS
+// appended after the defaults so they can override them
+func allocatorOptions() []chromedp.ExecAllocatorOption {
+	opts := chromedp.DefaultExecAllocatorOptions[:]
+	for _, flag := range browserFlags() {
+		opts = append(opts, chromedp.Flag(flag.Name, flag.Value))
+	}
+	if chromeExecPath != "" {
+		opts = append(opts, chromedp.ExecPath(chromeExecPath))
+	}
+
+	return opts
+}
+
+// browserFlags returns the switches headless Chrome is started with on top
+// of chromedp's defaults. CHROME_FLAGS come last, so they win.
+func browserFlags() []chromeFlag {
+	flags := []chromeFlag{
+		{Name: "headless", Value: true},
+		{Name: "disable-gpu", Value: true},
+		{Name: "no-sandbox", Value: true},
+		{Name: "disable-dev-shm-usage", Value: true},
+		{Name: "user-agent", Value: nextUserAgent()},
+	}
+
+	// Chrome takes credentials through the auth challenge, not the proxy flag
+	if proxyURL != nil {
+		flags = append(flags, chromeFlag{Name: "proxy-server", Value: proxyURL.Scheme + "://" + proxyURL.Host})
+	}
+
+	return append(flags, chromeFlags...)
+}
+
+// newBrowserContext launches a headless Chrome and returns a tab context for it.
+// The returned cancel function closes the tab and shuts the browser down.
+func newBrowserContext(parent context.Context) (context.Context, context.CancelFunc) {
+	opts := allocatorOptions()
+
+	allocCtx, cancelAlloc := chromedp.NewExecAllocator(parent, opts...)
+
+	// Create Chrome context
+	ctx, cancelCtx := chromedp.NewContext(allocCtx, chromedp.WithLogf(log.Printf))
+
+	return ctx, func() {
+		cancelCtx()
+		cancelAlloc()
+	}
+}
+
+// renderArticlePDF loads the live article page in headless Chrome and prints it to PDF.
+// Like a browser search it holds a search slot for the whole render and goes
+// through the upstream circuit breaker.
+func renderArticlePDF(ctx context.Context, articleURL string) (pdf []byte, err error) {
+	release, err := acquireSearchSlot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	if err := upstreamBreaker.allow(); err != nil {
+		return nil, err
+	}
+	defer func() { upstreamBreaker.record(err) }()
+
+	log.Printf("Rendering PDF for: %s", articleURL)
+
+	ctx, cancel := newBrowserContext(ctx)
+	defer cancel()
+
+	ctx, cancel = context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	// Stylesheets matter for print, so nothing is blocked; this only handles proxy auth
+	interception, _ := enableInterception(ctx, false)
+
+	err = chromedp.Run(ctx,
+		interception,
+		setExtraHeaders(),
+		chromedp.Navigate(articleURL),
+		chromedp.WaitVisible(`main`, chromedp.ByQuery),
+		chromedp.ActionFunc(func(ctx context.Context) error {
+			buf, _, err := page.PrintToPDF().WithPrintBackground(true).Do(ctx)
+			pdf = buf
+			return err
+		}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("PDF rendering failed: %w", err)
+	}
+
+	return pdf, nil
+}
+
+// renderArticleScreenshot loads the live article page in headless Chrome and
+// captures it as a PNG at the given viewport width. The whole page is captured
+// up to maxScreenshotHeight; if that fails only the first viewport is returned.
+// Like renderArticlePDF it holds a search slot and goes through the circuit breaker.
+func renderArticleScreenshot(ctx context.Context, articleURL string, width int) (png []byte, err error) {
+	release, err := acquireSearchSlot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	if err := upstreamBreaker.allow(); err != nil {
+		return nil, err
+	}
+	defer func() { upstreamBreaker.record(err) }()
+
+	log.Printf("Capturing screenshot of: %s", articleURL)
+
+	ctx, cancel := newBrowserContext(ctx)
+	defer cancel()
+
+	ctx, cancel = context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	interception, _ := enableInterception(ctx, searchBlockResources)
+
+	var pageHeight int64
+	err = chromedp.Run(ctx,
+		interception,
+		setExtraHeaders(),
+		chromedp.EmulateViewport(int64(width), screenshotViewportHeight),
+		chromedp.Navigate(articleURL),
+		chromedp.WaitVisible(`main`, chromedp.ByQuery),
+		chromedp.Evaluate(`document.documentElement.scrollHeight`, &pageHeight),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("screenshot failed: %w", err)
+	}
+
+	height := min(max(pageHeight, screenshotViewportHeight), maxScreenshotHeight)
+
+	err = chromedp.Run(ctx,
+		chromedp.EmulateViewport(int64(width), height),
+		chromedp.CaptureScreenshot(&png),
+	)
+	if err == nil {
+		return png, nil
+	}
+
+	log.Printf("Full-page screenshot of %s failed, falling back to viewport: %v", articleURL, err)
+	err = chromedp.Run(ctx,
+		chromedp.EmulateViewport(int64(width), screenshotViewportHeight),
+		chromedp.CaptureScreenshot(&png),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("screenshot failed: %w", err)
+	}
+
+	return png, nil
+}
+
+// exportFilename derives a download filename from the last segment of an article path
+func exportFilename(articlePath, ext string) string {
+	name := articlePath[strings.LastIndex(articlePath, "/")+1:]
+	if unescaped, err := url.PathUnescape(name); err == nil {
+		name = unescaped
+	}
+	if name == "" {
+		name = "article"
+	}
+
+	return name + ext
+}
+
+// blockedResourceTypes are the resources not needed to render search results
+var blockedResourceTypes = map[network.ResourceType]bool{
+	network.ResourceTypeImage:      true,
+	network.ResourceTypeFont:       true,
+	network.ResourceTypeMedia:      true,
+	network.ResourceTypeStylesheet: true,
+}
+
+// noInterception stands in for enableInterception when nothing needs
+// intercepting, keeping chromedp task lists uniform
+var noInterception chromedp.Action = chromedp.ActionFunc(func(context.Context) error { return nil })
+
+// enableInterception installs a request interceptor on the browser tab in
+// ctx. With blockResources set it fails requests for blockedResourceTypes;
+// when HTTP_PROXY_URL carries credentials it answers the proxy's auth
+// challenge. Everything else is let through. The returned action must run
+// first to turn interception on; the counter reports how many requests were
+// blocked. When neither applies, noInterception is returned.
+func enableInterception(ctx context.Context, blockResources bool) (chromedp.Action, *atomic.Int64) {
+	blocked := &atomic.Int64{}
+
+	var proxyAuth *fetch.AuthChallengeResponse
+	if proxyURL != nil && proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		proxyAuth = &fetch.AuthChallengeResponse{
+			Response: fetch.AuthChallengeResponseResponseProvideCredentials,
+			Username: proxyURL.User.Username(),
+			Password: password,
+		}
+	}
+
+	if !blockResources && proxyAuth == nil {
+		return noInterception, blocked
+	}
+
+	chromedp.ListenTarget(ctx, func(ev interface{}) {
+		switch ev := ev.(type) {
+		case *fetch.EventRequestPaused:
+			// Respond outside the event loop so the listener never blocks it
+			go func() {
+				execCtx := cdp.WithExecutor(ctx, chromedp.FromContext(ctx).Target)
+
+				var err error
+				if blockResources && blockedResourceTypes[ev.ResourceType] {
+					blocked.Add(1)
+					err = fetch.FailRequest(ev.RequestID, network.ErrorReasonBlockedByClient).Do(execCtx)
+				} else {
+					err = fetch.ContinueRequest(ev.RequestID).Do(execCtx)
+				}
+
+				if err != nil && ctx.Err() == nil {
+					log.Printf("Failed to handle intercepted request: %v", err)
+				}
+			}()
+		case *fetch.EventAuthRequired:
+			go func() {
+				execCtx := cdp.WithExecutor(ctx, chromedp.FromContext(ctx).Target)
+
+				// Only proxy challenges get the proxy credentials
+				response := &fetch.AuthChallengeResponse{Response: fetch.AuthChallengeResponseResponseDefault}
+				if proxyAuth != nil && ev.AuthChallenge.Source == fetch.AuthChallengeSourceProxy {
+					response = proxyAuth
+				}
+
+				if err := fetch.ContinueWithAuth(ev.RequestID, response).Do(execCtx); err != nil && ctx.Err() == nil {
+					log.Printf("Failed to answer auth challenge: %v", err)
+				}
+			}()
+		}
+	})
+
+	return fetch.Enable().WithHandleAuthRequests(proxyAuth != nil), blocked
+}
+
+// Relevance weights used by scoreResult
+const (
+	scoreTitleExact    = 100.0
+	scoreTitlePrefix   = 50.0
+	scoreTitleContains = 25.0
+	scoreTitleTokens   = 20.0
+	scoreSnippetTokens = 10.0
+)
+
+// scoreResult rates how well a search result matches query. An exact title
+// match weighs most, then a title prefix, then a title containing the query;
+// the share of query words found in the title and snippet is added on top.
+func scoreResult(query string, result SearchResult) float64 {
+	q := strings.ToLower(strings.TrimSpace(query))
+	title := strings.ToLower(strings.TrimSpace(result.Title))
+	if q == "" {
+		return 0
+	}
+
+	var score float64
+	switch {
+	case title == q:
+		score += scoreTitleExact
+	case strings.HasPrefix(title, q):
+		score += scoreTitlePrefix
+	case strings.Contains(title, q):
+		score += scoreTitleContains
+	}
+
+	tokens := strings.Fields(dedupKey(q))
+	if len(tokens) == 0 {
+		return score
+	}
+
+	titleWords := make(map[string]bool)
+	for _, word := range strings.Fields(dedupKey(result.Title)) {
+		titleWords[word] = true
+	}
+	snippetWords := make(map[string]bool)
+	for _, word := range strings.Fields(dedupKey(result.Snippet)) {
+		snippetWords[word] = true
+	}
+
+	var inTitle, inSnippet int
+	for _, token := range tokens {
+		if titleWords[token] {
+			inTitle++
+		}
+		if snippetWords[token] {
+			inSnippet++
+		}
+	}
+
+	score += scoreTitleTokens * float64(inTitle) / float64(len(tokens))
+	score += scoreSnippetTokens * float64(inSnippet) / float64(len(tokens))
+
+	return score
+}
+
+// rankResults scores each result against query and sorts them by descending
+// score. Equal scores keep their original page order.
+func rankResults(query string, results []SearchResult) {
+	for i := range results {
+		score := scoreResult(query, results[i])
+		results[i].Score = &score
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return *results[i].Score > *results[j].Score
+	})
+}
+
+// stripScores removes relevance scores from results that did not ask for them
+func stripScores(results []SearchResult) {
+	for i := range results {
+		results[i].Score = nil
+	}
+}
+
+// Progress stages reported by searchArticles
+const (
+	stageNavigating       = "navigating"
+	stageWaitingForRender = "waiting_for_render"
+	stageExtracting       = "extracting"
+	stageDone             = "done"
+)
+
+// acquireSearchSlot waits for a free slot in searchSlots. The returned
+// release function must be called once the browser work is finished.
+func acquireSearchSlot(ctx context.Context) (release func(), err error) {
+	timer := time.NewTimer(searchQueueTimeout)
+	defer timer.Stop()
+
+	select {
+	case searchSlots <- struct{}{}:
+		return func() { <-searchSlots }, nil
+	case <-timer.C:
+		return nil, ErrSearchBusy
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// searchErrorStatus maps a searchArticles error to an HTTP status code
+func searchErrorStatus(err error) int {
+	var rateLimit *RateLimitError
+	if errors.As(err, &rateLimit) {
+		return http.StatusTooManyRequests
+	}
+	if errors.Is(err, ErrSearchBusy) || errors.Is(err, ErrCircuitOpen) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// Search strategies accepted by SEARCH_STRATEGY
+const (
+	// strategyHTTP only parses the server-rendered search page
+	strategyHTTP = "http"
+	// strategyBrowser always renders the search page in headless Chrome
+	strategyBrowser = "browser"
+	// strategyAuto tries the HTTP path first and falls back to the browser
+	// when it finds nothing
+	strategyAuto = "auto"
+)
+
+// Bounds for the limit parameter of the search endpoints and for
+// SEARCH_MAX_SCAN. Extraction keeps up to maxSearchLimit unique results, so a
+// cached search can serve any limit.
+const (
+	defaultSearchLimit   = 20
+	maxSearchLimit       = 100
+	defaultSearchMaxScan = 200
+)
+
+// Bounds for SEARCH_SNIPPET_MIN and SEARCH_SNIPPET_MAX, in characters
+const (
+	defaultSearchSnippetMin = 20
+	defaultSearchSnippetMax = 200
+	maxSearchSnippetLimit   = 2000
+)
+
+// searchArticles searches for articles on Grokipedia according to SEARCH_STRATEGY.
+// Cancelling ctx stops the search; progress, if non-nil, is called as each stage starts.
+func searchArticles(ctx context.Context, query string, progress func(stage string)) (results []SearchResult, err error) {
+	ctx, span := tracer.Start(ctx, "searchArticles", trace.WithAttributes(
+		attribute.String("search.query", query),
+		attribute.String("search.strategy", searchStrategy),
+	))
+	defer func() {
+		if err != nil {
+			recordError(span, err)
+		}
+		span.End()
+	}()
+
+	key := searchCacheKey(query)
+	if cached, _, ok := searchCache.get(key); ok {
+		span.SetAttributes(attribute.Bool("search.cache_hit", true))
+		if progress != nil {
+			progress(stageDone)
+		}
+		// Callers strip scores and enrich results in place
+		return append([]SearchResult(nil), cached...), nil
+	}
+
+	switch searchStrategy {
+	case strategyHTTP:
+		results, err = searchHTTP(ctx, query)
+	case strategyAuto:
+		results, err = searchHTTP(ctx, query)
+		if err == nil && len(results) > 0 {
+			break
+		}
+		// An open circuit, a rate limit or a gone client would fail the browser too
+		var rateLimit *RateLimitError
+		if errors.Is(err, ErrCircuitOpen) || errors.As(err, &rateLimit) || ctx.Err() != nil {
+			return nil, err
+		}
+		if err != nil {
+			log.Printf("HTTP search for %q failed, falling back to headless browser: %v", query, err)
+		} else {
+			log.Printf("HTTP search for %q found no results, falling back to headless browser", query)
+		}
+		results, err = searchBrowser(ctx, query, progress)
+	default:
+		results, err = searchBrowser(ctx, query, progress)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rankResults(query, results)
+	span.SetAttributes(attribute.Int("search.result_count", len(results)))
+	searchCache.set(key, append([]SearchResult(nil), results...))
+
+	if progress != nil {
+		progress(stageDone)
+	}
+
+	return results, nil
+}
+
+// searchPageURL returns the Grokipedia search page URL for query
+func searchPageURL(query string) string {
+	return baseURL + "/search?" + url.Values{"q": {query}}.Encode()
+}
+
+// searchHTTP fetches the search page without a browser and extracts
+// whatever results the server rendered into it. Pages that build their
+// results with JavaScript yield an empty list rather than an error.
+func searchHTTP(ctx context.Context, query string) ([]SearchResult, error) {
+	start := time.Now()
+
+	doc, err := fetchHTML(ctx, searchPageURL(query), "")
+	if err != nil {
+		return nil, fmt.Errorf("http search failed: %w", err)
+	}
+
+	results := extractSearchResults(doc.Find("main"))
+	log.Printf("HTTP search for %q found %d results in %v", query, len(results), time.Since(start))
+
+	return results, nil
+}
+
+// extractSearchResults reads result items from a rendered search page. It
+// mirrors searchExtractScript: items are div.cursor-pointer blocks titled by
+// "span.line-clamp-1 span", the snippet is the first paragraph longer than
+// SEARCH_SNIPPET_MIN characters cut to SEARCH_SNIPPET_MAX, the URL comes from
+// the item's link (see searchResultURL), and results for a page already
+// listed are dropped: pages are told apart by URL, so distinct pages sharing
+// a title are all kept. At most SEARCH_MAX_SCAN items are read and at most
+// maxSearchLimit results kept.
+func extractSearchResults(root *goquery.Selection) []SearchResult {
+	results := []SearchResult{}
+	seen := make(map[string]bool)
+
+	root.Find("div.cursor-pointer").EachWithBreak(func(i int, item *goquery.Selection) bool {
+		if i >= searchMaxScan {
+			return false
+		}
+
+		title := strings.TrimSpace(item.Find("span.line-clamp-1 span").First().Text())
+		if title == "" {
+			return true
+		}
+
+		link := item.Find("a[href]").First()
+		if link.Length() == 0 {
+			link = item.Closest("a[href]")
+		}
+		pageURL := searchResultURL(link.AttrOr("href", ""), title)
+		if seen[pageURL] {
+			return true
+		}
+		seen[pageURL] = true
+
+		snippet := ""
+		item.Find("p").EachWithBreak(func(_ int, p *goquery.Selection) bool {
+			if runes := []rune(strings.TrimSpace(p.Text())); len(runes) > searchSnippetMin {
+				snippet = string(runes[:min(len(runes), searchSnippetMax)])
+				return false
+			}
+			return true
+		})
+		if snippet == "" {
+			snippet = "No description available"
+		}
+
+		results = append(results, SearchResult{
+			Title:   title,
+			URL:     pageURL,
+			Snippet: snippet,
+		})
+		return len(results) < maxSearchLimit
+	})
+
+	return results
+}
+
+// searchResultURL returns the article URL of a search result from the href
+// of its link, which may be relative. The slug is re-encoded like
+// articleSlug, so equal pages get equal URLs. Only when the result has no
+// link to an article page on baseURL's host is the URL built from the title,
+// which breaks for titles whose slug differs.
+func searchResultURL(href, title string) string {
+	base, err := url.Parse(baseURL)
+	if err == nil && href != "" {
+		if u, err := url.Parse(resolveURL(base, strings.TrimSpace(href))); err == nil && strings.EqualFold(u.Host, base.Host) {
+			if slug := articleSlug(u.String()); slug != "" {
+				return baseURL + "/page/" + slug
+			}
+		}
+	}
+	return baseURL + "/page/" + titleSlug(title)
+}
+
+// uniqueSearchResults normalizes the URLs of results extracted by
+// searchExtractScript with searchResultURL and drops those for a page
+// already listed
+func uniqueSearchResults(results []SearchResult) []SearchResult {
+	unique := results[:0]
+	seen := make(map[string]bool, len(results))
+	for _, result := range results {
+		result.URL = searchResultURL(result.URL, result.Title)
+		if seen[result.URL] {
+			continue
+		}
+		seen[result.URL] = true
+		unique = append(unique, result)
+	}
+	return unique
+}
+
+// searchResultSelector matches the rendered result items on the search page
+const searchResultSelector = `main div.cursor-pointer`
+
+// searchRenderFallback is how long a search still waits when no result has
+// rendered within SEARCH_RENDER_TIMEOUT, for pages that render late or not at all
+const searchRenderFallback = time.Second
+
+// waitForSearchResults waits until the first search result is visible, or
+// for at most SEARCH_RENDER_TIMEOUT and then searchRenderFallback. Running
+// out of time is not an error: the page may simply have no results.
+func waitForSearchResults(query string) chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		start := time.Now()
+
+		waitCtx, cancel := context.WithTimeout(ctx, searchRenderTimeout)
+		defer cancel()
+
+		err := chromedp.WaitVisible(searchResultSelector, chromedp.ByQuery).Do(waitCtx)
+		if err == nil {
+			log.Printf("Search results for %q rendered in %v", query, time.Since(start))
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		log.Printf("No search results for %q rendered within %v", query, searchRenderTimeout)
+		return chromedp.Sleep(searchRenderFallback).Do(ctx)
+	})
+}
+
+// extractSearchResultsHTML parses the outer HTML of a search page's <main>
+// element, as captured from the browser, with extractSearchResults
+func extractSearchResultsHTML(html string) []SearchResult {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(html))
+	if err != nil {
+		return []SearchResult{}
+	}
+	return extractSearchResults(doc.Selection)
+}
+
+// searchExtractScript extracts search results inside the browser when
+// extractSearchResults finds none in the captured markup. It is called with
+// the minimum and maximum snippet length, the scan limit and the result
+// limit, so both extractors stay in step.
+const searchExtractScript = `
+	(function(minSnippet, maxSnippet, maxScan, maxResults) {
+		const results = [];
+		const seen = new Set(); // Track unique pages to avoid duplicates
+
+		// Find all search result items (they're in divs with cursor-pointer class)
+		const items = Array.from(document.querySelectorAll('main div.cursor-pointer')).slice(0, maxScan);
+
+		console.log('Scanning ' + items.length + ' search result items');
+
+		for (const item of items) {
+			if (results.length >= maxResults) break;
+
+			// Find the title span
+			const titleSpan = item.querySelector('span.line-clamp-1 span');
+			if (!titleSpan) continue;
+
+			const title = titleSpan.textContent.trim();
+			if (!title) continue;
+
+			// Use the result's own link; Go falls back to the title when there is none
+			const link = item.querySelector('a[href]') || item.closest('a[href]');
+			const url = link ? link.getAttribute('href') : '';
+
+			// Tell pages apart by link, so distinct pages sharing a title are kept
+			const key = url || 'title:' + title;
+			if (seen.has(key)) continue; // Skip duplicates
+			seen.add(key);
+
+			// Try to find snippet/description
+			let snippet = '';
+			const paragraphs = item.querySelectorAll('p');
+			for (let p of paragraphs) {
+				const text = p.textContent.trim();
+				const chars = Array.from(text);
+				if (text && chars.length > minSnippet) {
+					snippet = chars.slice(0, maxSnippet).join('');
+					break;
+				}
+			}
+
+			results.push({
+				title: title,
+				url: url,
+				snippet: snippet || 'No description available'
+			});
+		}
+
+		return results; // The top unique results
+	})`
+
+// searchBrowser searches for articles on Grokipedia using headless Chrome
+// This function uses chromedp to execute JavaScript and get real-time search results.
+// Cancelling ctx stops the browser; progress, if non-nil, is called as each stage starts.
+// At most MAX_CONCURRENT_SEARCHES run at once; others queue for a slot.
+// A run that fails for reasons other than a timeout or cancellation, such as
+// a crashed tab, is retried in a fresh browser up to SEARCH_MAX_RETRIES times.
+func searchBrowser(ctx context.Context, query string, progress func(stage string)) (results []SearchResult, err error) {
+	release, err := acquireSearchSlot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	if err := upstreamBreaker.allow(); err != nil {
+		return nil, err
+	}
+
+	for attempt := 0; ; attempt++ {
+		results, err = browserSearch(ctx, query, progress)
+		if err == nil || attempt >= searchMaxRetries || ctx.Err() != nil || errors.Is(err, context.DeadlineExceeded) {
+			break
+		}
+		log.Printf("Search for %q failed, retrying in a fresh browser (%d/%d): %v", query, attempt+1, searchMaxRetries, err)
+	}
+
+	upstreamBreaker.record(err)
+	if err != nil {
+		return nil, fmt.Errorf("headless browser search failed: %w", err)
+	}
+	return results, nil
+}
+
+// browserSearch runs one headless search for searchBrowser; tests replace
+// it to search without a real browser
+var browserSearch = searchBrowserOnce
+
+// searchBrowserOnce runs one headless search in a browser of its own, bounded by SEARCH_TIMEOUT
+func searchBrowserOnce(ctx context.Context, query string, progress func(stage string)) ([]SearchResult, error) {
+	log.Printf("Starting headless browser search for: %s", query)
+
+	// The browser lives under the caller's context, so a client disconnect
+	// shuts it down straight away instead of after searchTimeout
+	requestCtx := ctx
+
+	ctx, cancel := newBrowserContext(ctx)
+	defer cancel()
+
+	ctx, cancel = context.WithTimeout(ctx, searchTimeout)
+	defer cancel()
+
+	searchURL := searchPageURL(query)
+	log.Printf("Navigating to: %s", searchURL)
+
+	var results []SearchResult
+	var htmlContent string
+
+	// Interception is enabled first so no request slips through unhandled
+	interception, blocked := enableInterception(ctx, searchBlockResources)
+
+	start := time.Now()
+
+	// Each stage gets its own child span, ended when the next stage starts
+	var stageSpan trace.Span
+	defer func() {
+		if stageSpan != nil {
+			stageSpan.End()
+		}
+	}()
+
+	report := func(stage string) chromedp.Action {
+		return chromedp.ActionFunc(func(context.Context) error {
+			if stageSpan != nil {
+				stageSpan.End()
+			}
+			_, stageSpan = tracer.Start(ctx, "search."+stage)
+
+			if progress != nil {
+				progress(stage)
+			}
+			return nil
+		})
+	}
+
+	// Run chromedp tasks
+	err := chromedp.Run(ctx,
+		interception,
+		setExtraHeaders(),
+
+		// Navigate to search page
+		report(stageNavigating),
+		chromedp.Navigate(searchURL),
+
+		// Wait for search results container to appear
+		report(stageWaitingForRender),
+		chromedp.WaitVisible(`main`, chromedp.ByQuery),
+
+		// Wait for JavaScript to render the results themselves
+		waitForSearchResults(query),
+
+		// Capture the rendered results for extraction in Go
+		report(stageExtracting),
+		chromedp.OuterHTML(`main`, &htmlContent, chromedp.ByQuery),
+	)
+
+	if err == nil {
+		results = extractSearchResultsHTML(htmlContent)
+		if len(results) == 0 {
+			// Fall back to extracting in the page, in case the captured markup misses something
+			err = chromedp.Run(ctx,
+				chromedp.Evaluate(fmt.Sprintf("%s(%d, %d, %d, %d)", searchExtractScript, searchSnippetMin, searchSnippetMax, searchMaxScan, maxSearchLimit), &results),
+			)
+			if err == nil && len(results) > 0 {
+				log.Printf("Go extraction found no results for %q, JavaScript extraction found %d", query, len(results))
+				// Normalize URLs the same way as the Go extractor, which may
+				// reveal more duplicates
+				results = uniqueSearchResults(results)
+			}
+		}
+	}
+
+	if err != nil {
+		switch {
+		case errors.Is(requestCtx.Err(), context.Canceled):
+			log.Printf("Search for %q cancelled: client disconnected", query)
+		case errors.Is(ctx.Err(), context.DeadlineExceeded):
+			log.Printf("Search for %q timed out", query)
+			// Report the timeout even if chromedp surfaced a different error
+			if !errors.Is(err, context.DeadlineExceeded) {
+				err = fmt.Errorf("%w: %v", context.DeadlineExceeded, err)
+			}
+		default:
+			log.Printf("Headless browser error: %v", err)
+		}
+		return nil, err
+	}
+
+	log.Printf("HTML content length: %d bytes", len(htmlContent))
+	log.Printf("Found %d search results for query: %s", len(results), query)
+
+	// Only the count of blocked requests is known here; the time saved shows
+	// up by comparing durations against runs with SEARCH_BLOCK_RESOURCES=false
+	if searchBlockResources {
+		log.Printf("Search completed in %v with %d image/font/media/stylesheet requests blocked", time.Since(start), blocked.Load())
+	} else {
+		log.Printf("Search completed in %v without resource blocking", time.Since(start))
+	}
+
+	return results, nil
+}
+
+// suggestTitles returns up to limit article titles for a search-as-you-type prefix.
+// Titles starting with the prefix are listed first, keeping search order otherwise.
+func suggestTitles(ctx context.Context, prefix string, limit int) ([]string, error) {
+	results, err := searchArticles(ctx, prefix, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	lowerPrefix := strings.ToLower(prefix)
+	var prefixed, others []string
+	for _, result := range results {
+		if strings.HasPrefix(strings.ToLower(result.Title), lowerPrefix) {
+			prefixed = append(prefixed, result.Title)
+		} else {
+			others = append(others, result.Title)
+		}
+	}
+
+	suggestions := append(prefixed, others...)
+	if len(suggestions) > limit {
+		suggestions = suggestions[:limit]
+	}
+
+	return suggestions, nil
+}
+
+// jsonFieldNames returns the JSON keys of the exported fields of struct v
+func jsonFieldNames(v any) map[string]bool {
+	names := make(map[string]bool)
+	t := reflect.TypeOf(v)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		names[name] = true
+	}
+	return names
+}
+
+// unknownFields returns the entries of fields that are not JSON keys of struct v
+func unknownFields(fields []string, v any) []string {
+	known := jsonFieldNames(v)
+	var unknown []string
+	for _, f := range fields {
+		if !known[f] {
+			unknown = append(unknown, f)
+		}
+	}
+	return unknown
+}
+
+// projectFields marshals v and keeps only the listed top-level keys.
+// Unknown fields are left out, and so are empty (omitted) ones unless
+// fullSchema is set.
+func projectFields(v any, fields []string, fullSchema bool) (map[string]json.RawMessage, error) {
+	marshal := json.Marshal
+	if fullSchema {
+		marshal = marshalFullSchema
+	}
+	data, err := marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, err
+	}
+
+	projected := make(map[string]json.RawMessage, len(fields))
+	for _, f := range fields {
+		if value, ok := all[f]; ok {
+			projected[f] = value
+		}
+	}
+	return projected, nil
+}
+
+// marshalFullSchema encodes struct v like json.Marshal, but also writes the
+// fields tagged omitempty when they are empty, so every key is always
+// present: nil slices as [] and nil maps as {}, everything else as its zero
+// value. Nested values are encoded by json.Marshal as usual.
+func marshalFullSchema(v any) ([]byte, error) {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	if rv.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("full schema encoding needs a struct, got %s", rv.Kind())
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	t := rv.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		value := rv.Field(i)
+		var data []byte
+		switch {
+		case value.Kind() == reflect.Slice && value.IsNil():
+			data = []byte("[]")
+		case value.Kind() == reflect.Map && value.IsNil():
+			data = []byte("{}")
+		default:
+			var err error
+			if data, err = json.Marshal(value.Interface()); err != nil {
+				return nil, err
+			}
+		}
+
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(name)
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(data)
+	}
+	buf.WriteByte('}')
+
+	return buf.Bytes(), nil
+}
+
+// Handlers
+
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
+
+func docsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, swaggerUIPage)
+}
+
+func getArticleHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	articlePath := vars["path"]
+
+	if articlePath == "" {
+		sendError(w, http.StatusBadRequest, codeInvalidRequest, "Article path is required")
+		return
+	}
+
+	pageURL, err := articleURL(articlePath)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, errorCode(err, codeInvalidPath), err.Error())
+		return
+	}
+	articlePath = normalizePath(articlePath)
+	if denyPaths.denies(articlePath) {
+		sendError(w, http.StatusForbidden, codePathDenied, fmt.Sprintf("Article %s is blocked on this server", articlePath))
+		return
+	}
+
+	cfg := currentConfig()
+	maxChars, err := queryInt(r, "summary_max_chars", cfg.SummaryMaxChars)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+
+	sentences, err := queryInt(r, "summary_sentences", 0)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+
+	maxBytes, err := queryInt(r, "max_bytes", cfg.ContentMaxBytes)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+
+	separator := cfg.ContentSeparator
+	if v := r.URL.Query().Get("separator"); v != "" {
+		if separator, err = parseContentSeparator(v); err != nil {
+			sendError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+			return
+		}
+	}
+
+	structured := r.URL.Query().Get("structured") == "true"
+	relative := r.URL.Query().Get("relative_time") == "true"
+	fullSchema := r.URL.Query().Get("full_schema") == "true"
+	debugBlocks := r.URL.Query().Get("debug_blocks") == "true"
+
+	fields := splitList(r.URL.Query().Get("fields"))
+	if r.URL.Query().Get("strict") == "true" {
+		if unknown := unknownFields(fields, Article{}); len(unknown) > 0 {
+			sendError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Unknown fields: %s", strings.Join(unknown, ", ")))
+			return
+		}
+	}
+
+	lang := r.URL.Query().Get("lang")
+	if lang != "" && !langPattern.MatchString(lang) {
+		sendError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Invalid language tag %q", lang))
+		return
+	}
+
+	revision := r.URL.Query().Get("revision")
+	if revision != "" {
+		if !revisionPattern.MatchString(revision) {
+			sendError(w, http.StatusBadRequest, codeInvalidRequest, "Revision must be 1-128 letters, digits, '.', '-' or '_'")
+			return
+		}
+		if articleRevisionURL == "" {
+			// Serve the latest version, telling the client the revision was ignored
+			w.Header().Set("X-Revision", "unavailable")
+			revision = ""
+		} else {
+			pageURL, err = revisionURL(pageURL, revision)
+			if err != nil {
+				sendError(w, http.StatusBadRequest, errorCode(err, codeInvalidPath), err.Error())
+				return
+			}
+		}
+	}
+
+	// The representation depends on Accept when ?format= is absent
+	w.Header().Add("Vary", "Accept")
+
+	format, err := negotiateFormat(r)
+	if err != nil {
+		if errors.Is(err, errNotAcceptable) {
+			sendError(w, http.StatusNotAcceptable, codeNotAcceptable, err.Error())
+		} else {
+			sendError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		}
+		return
+	}
+
+	switch format {
+	case formatPDF:
+		exportArticlePDF(w, r, articlePath, pageURL)
+		return
+	case formatHTML:
+		exportArticleHTML(w, r, pageURL, lang)
+		return
+	case formatPNG:
+		width, err := queryInt(r, "width", defaultScreenshotWidth)
+		if err != nil || width < minScreenshotWidth || width > maxScreenshotWidth {
+			sendError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Query parameter 'width' must be between %d and %d", minScreenshotWidth, maxScreenshotWidth))
+			return
+		}
+		exportArticleScreenshot(w, r, articlePath, pageURL, width)
+		return
+	}
+
+	// HEAD and ?meta_only=true skip the content walk
+	metaOnly := format == formatJSON && (r.Method == http.MethodHead || r.URL.Query().Get("meta_only") == "true")
+
+	fetch := cachedArticle
+	if metaOnly {
+		fetch = cachedArticleMetadata
+	}
+	ctx := r.Context()
+	var timing *requestTiming
+	if r.URL.Query().Get("timing") == "true" {
+		ctx, timing = withTiming(ctx)
+	}
+	fresh := wantFresh(r)
+	article, storedAt, hit, err := fetch(ctx, articlePath, lang, revision, fresh)
+	if err != nil {
+		sendArticleError(w, r, err)
+		return
+	}
+
+	// A redirect, or an ID lookup, may have led to a blocked page
+	if u, err := url.Parse(article.URL); err == nil && u.Path != articlePath && denyPaths.denies(u.Path) {
+		sendError(w, http.StatusForbidden, codePathDenied, fmt.Sprintf("Article %s is blocked on this server", normalizePath(u.Path)))
+		return
+	}
+
+	setXCache(w, hit, fresh)
+	setCacheHeaders(w, storedAt)
+
+	if metaOnly {
+		if updated, ok := parseLastUpdated(article.LastUpdated); ok {
+			w.Header().Set("Last-Modified", updated.UTC().Format(http.TimeFormat))
+		}
+	}
+
+	recordFetchedArticle(articlePath, article)
+
+	if timing != nil {
+		article.Timing = timing.result(hit)
+		w.Header().Set("Server-Timing", serverTiming(article.Timing))
+	}
+
+	// Summary controls only ever shorten the summary, never the content
+	article.Summary = truncateAtWord(firstSentences(article.Summary, sentences), maxChars)
+	article.Content, article.Truncated = truncateBytes(joinContent(article.Content, separator), maxBytes)
+
+	switch format {
+	case formatText:
+		// The content is already cut to max_bytes
+		streamArticle(w, article, "text/plain; charset=utf-8", 0, writeArticleText)
+		return
+	case formatMarkdown:
+		streamArticle(w, article, "text/markdown; charset=utf-8", maxBytes, writeArticleMarkdown)
+		return
+	}
+
+	// Sections duplicate the content, so they are only sent when asked for
+	if !structured {
+		article.Sections = nil
+	}
+	if !debugBlocks {
+		article.Blocks = nil
+	}
+
+	if relative {
+		if updated, ok := parseLastUpdated(article.LastUpdated); ok {
+			article.LastUpdatedRelative = relativeTime(updated, clock())
+		}
+	}
+
+	if len(fields) == 0 {
+		writeArticleJSON(w, article, wantPretty(r), fullSchema)
+		return
+	}
+
+	projected, err := projectFields(article, fields, fullSchema)
+	if err != nil {
+		sendError(w, http.StatusInternalServerError, errorCode(err, codeInternalError), fmt.Sprintf("Failed to encode article: %v", err))
+		return
+	}
+	writeJSON(w, http.StatusOK, projected, wantPretty(r))
+}
+
+// sendArticleError answers an article request whose fetch failed: 300 with
+// the options of a disambiguation page, otherwise the status and code err
+// calls for
+func sendArticleError(w http.ResponseWriter, r *http.Request, err error) {
+	var disambig *DisambiguationError
+	var rateLimit *RateLimitError
+	switch {
+	case errors.As(err, &disambig):
+		writeJSON(w, http.StatusMultipleChoices, DisambiguationResponse{
+			Disambiguation: true,
+			Title:          disambig.Title,
+			Options:        disambig.Options,
+		}, wantPretty(r))
+	case errors.Is(err, ErrArticleNotFound):
+		sendError(w, http.StatusNotFound, codeArticleNotFound, "Article not found")
+	case errors.Is(err, ErrCircuitOpen):
+		sendError(w, http.StatusServiceUnavailable, codeUpstreamUnavailable, "Grokipedia is failing, requests are paused; try again later")
+	case errors.Is(err, ErrEmptyContent):
+		sendError(w, http.StatusBadGateway, codeEmptyContent, "Article page contained no parseable content")
+	case errors.Is(err, ErrPageTooLarge):
+		sendError(w, http.StatusBadGateway, codeUpstreamTooLarge, fmt.Sprintf("Failed to fetch article: %v", err))
+	case errors.Is(err, ErrHostNotAllowed):
+		sendError(w, http.StatusForbidden, codeHostNotAllowed, fmt.Sprintf("Failed to fetch article: %v", err))
+	case errors.As(err, &rateLimit):
+		setRetryAfter(w, err)
+		sendError(w, http.StatusTooManyRequests, codeRateLimited, "Grokipedia is rate limiting requests; retry later")
+	default:
+		sendError(w, upstreamErrorStatus(err), errorCode(err, codeUpstreamError), fmt.Sprintf("Failed to fetch article: %v", err))
+	}
+}
+
+// ArticleSummary is the response of GET /api/summary/{path}
+type ArticleSummary struct {
+	Title     string `json:"title"`
+	Summary   string `json:"summary"`
+	LeadImage string `json:"lead_image,omitempty"`
+	URL       string `json:"url"`
+}
+
+// summaryHandler serves GET /api/summary/{path}: the title, summary and
+// lead image of an article for previews and link unfurling, without the
+// cost of extracting the full content
+func summaryHandler(w http.ResponseWriter, r *http.Request) {
+	articlePath := mux.Vars(r)["path"]
+	if articlePath == "" {
+		sendError(w, http.StatusBadRequest, codeInvalidRequest, "Article path is required")
+		return
+	}
+
+	if _, err := articleURL(articlePath); err != nil {
+		sendError(w, http.StatusBadRequest, errorCode(err, codeInvalidPath), err.Error())
+		return
+	}
+	articlePath = normalizePath(articlePath)
+	if denyPaths.denies(articlePath) {
+		sendError(w, http.StatusForbidden, codePathDenied, fmt.Sprintf("Article %s is blocked on this server", articlePath))
+		return
+	}
+
+	lang := r.URL.Query().Get("lang")
+	if lang != "" && !langPattern.MatchString(lang) {
+		sendError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Invalid language tag %q", lang))
+		return
+	}
+
+	fresh := wantFresh(r)
+	article, storedAt, hit, err := cachedArticleSummary(r.Context(), articlePath, lang, fresh)
+	if err != nil {
+		sendArticleError(w, r, err)
+		return
+	}
+
+	if u, err := url.Parse(article.URL); err == nil && u.Path != articlePath && denyPaths.denies(u.Path) {
+		sendError(w, http.StatusForbidden, codePathDenied, fmt.Sprintf("Article %s is blocked on this server", normalizePath(u.Path)))
+		return
+	}
+
+	setXCache(w, hit, fresh)
+	setCacheHeaders(w, storedAt)
+
+	writeJSON(w, http.StatusOK, ArticleSummary{
+		Title:     strings.TrimSpace(article.Title),
+		Summary:   article.Summary,
+		LeadImage: article.LeadImage,
+		URL:       article.URL,
+	}, wantPretty(r))
+}
+
+// postArticleHandler serves POST /api/article, taking the article path from
+// a JSON body instead of the URL for clients and proxies that mangle long
+// paths. Query parameters work as for GET /api/article/{path}.
+func postArticleHandler(w http.ResponseWriter, r *http.Request) {
+	var req ArticleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			sendError(w, http.StatusRequestEntityTooLarge, codePayloadTooLarge, fmt.Sprintf("Request body exceeds %d bytes", maxErr.Limit))
+			return
+		}
+		sendError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Invalid JSON body: %v", err))
+		return
+	}
+
+	articlePath := strings.TrimSpace(req.Path)
+	if articlePath == "" {
+		sendError(w, http.StatusBadRequest, codeInvalidRequest, "Field 'path' is required")
+		return
+	}
+
+	getArticleHandler(w, mux.SetURLVars(r, map[string]string{"path": articlePath}))
+}
+
+// revisionPattern accepts the revision IDs of ?revision=
+var revisionPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,128}$`)
+
+// revisionURL returns the URL of revision of the article at pageURL, built
+// from ARTICLE_REVISION_URL. Like article paths, it must stay on baseURL's host.
+func revisionURL(pageURL, revision string) (string, error) {
+	raw := strings.NewReplacer("{url}", pageURL, "{revision}", revision).Replace(articleRevisionURL)
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", fmt.Errorf("%w: bad revision URL: %v", ErrInvalidPath, err)
+	}
+	base, _ := url.Parse(baseURL)
+	u = base.ResolveReference(u)
+	if !strings.EqualFold(u.Host, base.Host) {
+		return "", fmt.Errorf("%w: revision URL resolves outside %s", ErrInvalidPath, base.Host)
+	}
+	return u.String(), nil
+}
+
+// articleIDPattern accepts the numeric or hash IDs used by GET /api/article/id/{id}
+var articleIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,128}$`)
+
+// articleByIDHandler resolves an article ID through ARTICLE_ID_PATH and
+// serves it like getArticleHandler. Grokipedia redirects the ID URL to the
+// article page, so the response carries the resolved url, slug and title.
+func articleByIDHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if !articleIDPattern.MatchString(id) {
+		sendError(w, http.StatusBadRequest, codeInvalidRequest, "Article ID must be 1-128 letters, digits, '-' or '_'")
+		return
+	}
+
+	articlePath := strings.ReplaceAll(articleIDPath, "{id}", id)
+	log.Printf("Resolving article ID %s via %s", id, articlePath)
+
+	getArticleHandler(w, mux.SetURLVars(r, map[string]string{"path": articlePath}))
+}
+
+// fetchByURLHandler serves GET /api/fetch?url=, taking a full Grokipedia
+// article URL instead of a path. The URL must be http(s) on a host in
+// ALLOWED_HOSTS; its path is then served like getArticleHandler, fetched
+// from baseURL, with the same query parameters.
+func fetchByURLHandler(w http.ResponseWriter, r *http.Request) {
+	raw := strings.TrimSpace(r.URL.Query().Get("url"))
+	if raw == "" {
+		sendError(w, http.StatusBadRequest, codeInvalidRequest, "Query parameter 'url' is required")
+		return
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		sendError(w, http.StatusBadRequest, codeInvalidRequest, "Query parameter 'url' must be an absolute http(s) URL")
+		return
+	}
+	if err := checkAllowedHost(u.String()); err != nil {
+		sendError(w, http.StatusBadRequest, codeHostNotAllowed, fmt.Sprintf("URL is not on an allowed host: %s", u.Host))
+		return
+	}
+	if strings.Trim(u.Path, "/") == "" {
+		sendError(w, http.StatusBadRequest, codeInvalidPath, "URL has no article path")
+		return
+	}
+
+	getArticleHandler(w, mux.SetURLVars(r, map[string]string{"path": u.Path}))
+}
+
+// existsHandler reports whether an article exists without fetching and parsing all of it
+func existsHandler(w http.ResponseWriter, r *http.Request) {
+	articlePath := mux.Vars(r)["path"]
+	if articlePath == "" {
+		sendError(w, http.StatusBadRequest, codeInvalidRequest, "Article path is required")
+		return
+	}
+
+	pageURL, err := articleURL(articlePath)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, errorCode(err, codeInvalidPath), err.Error())
+		return
+	}
+	if denyPaths.denies(normalizePath(articlePath)) {
+		sendError(w, http.StatusForbidden, codePathDenied, fmt.Sprintf("Article %s is blocked on this server", normalizePath(articlePath)))
+		return
+	}
+
+	exists, status, err := articleExists(r.Context(), pageURL)
+	if err != nil {
+		var rateLimit *RateLimitError
+		if errors.As(err, &rateLimit) {
+			setRetryAfter(w, err)
+			sendError(w, http.StatusTooManyRequests, codeRateLimited, "Grokipedia is rate limiting requests; retry later")
+			return
+		}
+		if errors.Is(err, ErrCircuitOpen) {
+			sendError(w, http.StatusServiceUnavailable, codeUpstreamUnavailable, "Grokipedia is failing, requests are paused; try again later")
+			return
+		}
+		sendError(w, upstreamErrorStatus(err), errorCode(err, codeUpstreamError), fmt.Sprintf("Failed to check article: %v", err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"exists": exists,
+		"status": status,
+		"url":    pageURL,
+	}, wantPretty(r))
+}
+
+// searchLimit reads the limit query parameter, the number of results returned
+func searchLimit(r *http.Request) (int, error) {
+	limit, err := queryInt(r, "limit", defaultSearchLimit)
+	if err != nil || limit < 1 || limit > maxSearchLimit {
+		return 0, fmt.Errorf("query parameter 'limit' must be between 1 and %d", maxSearchLimit)
+	}
+	return limit, nil
+}
+
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query().Get("q")
+	if query == "" {
+		sendError(w, http.StatusBadRequest, codeInvalidRequest, "Search query parameter 'q' is required")
+		return
+	}
+
+	enrichFields, err := parseEnrichFields(r.URL.Query().Get("enrich"))
+	if err != nil {
+		sendError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Invalid enrich parameter: %v", err))
+		return
+	}
+
+	limit, err := searchLimit(r)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+
+	results, err := searchArticles(r.Context(), query, nil)
+	if err != nil {
+		setRetryAfter(w, err)
+		sendError(w, searchErrorStatus(err), errorCode(err, codeSearchFailed), fmt.Sprintf("Search failed: %v", err))
+		return
+	}
+	results = results[:min(len(results), limit)]
+
+	enrichSearchResults(r.Context(), results, enrichFields, wantFresh(r))
+
+	if r.URL.Query().Get("include_score") != "true" {
+		stripScores(results)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"query":   query,
+		"count":   len(results),
+		"results": results,
+	}, wantPretty(r))
+}
+
+// batchSearchHandler runs several searches at once. Each query takes its own
+// search slot, so MAX_CONCURRENT_SEARCHES still bounds the browsers running;
+// a failed query gets an error entry without failing the rest.
+// The batch itself starts no more searches than there are slots, so its own
+// queries never time out waiting on each other.
+func batchSearchHandler(w http.ResponseWriter, r *http.Request) {
+	var req BatchSearchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			sendError(w, http.StatusRequestEntityTooLarge, codePayloadTooLarge, fmt.Sprintf("Request body exceeds %d bytes", maxErr.Limit))
+			return
+		}
+		sendError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Invalid JSON body: %v", err))
+		return
+	}
+
+	if len(req.Queries) == 0 {
+		sendError(w, http.StatusBadRequest, codeInvalidRequest, "Field 'queries' must contain at least one query")
+		return
+	}
+	if len(req.Queries) > maxBatchQueries {
+		sendError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("At most %d queries are allowed per batch", maxBatchQueries))
+		return
+	}
+
+	limit, err := searchLimit(r)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+
+	includeScore := r.URL.Query().Get("include_score") == "true"
+
+	batch := make([]BatchSearchResult, len(req.Queries))
+	running := make(chan struct{}, cap(searchSlots))
+	var wg sync.WaitGroup
+	for i, query := range req.Queries {
+		query = strings.TrimSpace(query)
+		batch[i].Query = query
+
+		if query == "" {
+			batch[i].Error = &ErrorResponse{
+				Error:   http.StatusText(http.StatusBadRequest),
+				Code:    codeInvalidRequest,
+				Message: "Query must not be empty",
+			}
+			continue
+		}
+
+		wg.Add(1)
+		go func(entry *BatchSearchResult) {
+			defer wg.Done()
+
+			running <- struct{}{}
+			defer func() { <-running }()
+
+			results, err := searchArticles(r.Context(), entry.Query, nil)
+			if err != nil {
+				status := searchErrorStatus(err)
+				entry.Error = &ErrorResponse{
+					Error:   http.StatusText(status),
+					Code:    errorCode(err, codeSearchFailed),
+					Message: fmt.Sprintf("Search failed: %v", err),
+				}
+				return
+			}
+			results = results[:min(len(results), limit)]
+
+			if !includeScore {
+				stripScores(results)
+			}
+			entry.Count = len(results)
+			entry.Results = results
+		}(&batch[i])
+	}
+	wg.Wait()
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"count":   len(batch),
+		"results": batch,
+	}, wantPretty(r))
+}
+
+// exportArticlePDF streams the rendered article page back as a PDF download
+func exportArticlePDF(w http.ResponseWriter, r *http.Request, articlePath, pageURL string) {
+	pdf, err := renderArticlePDF(r.Context(), pageURL)
+	if err != nil {
+		setRetryAfter(w, err)
+		sendError(w, searchErrorStatus(err), errorCode(err, codeInternalError), fmt.Sprintf("Failed to export article: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": exportFilename(articlePath, ".pdf"),
+	}))
+	w.Header().Set("Content-Length", strconv.Itoa(len(pdf)))
+	w.Write(pdf)
+}
+
+// exportArticleHTML returns the outer HTML of the article root (or <main>)
+// as fetched from Grokipedia, before any parsing or cleanup
+func exportArticleHTML(w http.ResponseWriter, r *http.Request, pageURL, lang string) {
+	doc, raw, err := fetchPage(r.Context(), pageURL, lang)
+	if err != nil {
+		var rateLimit *RateLimitError
+		switch {
+		case errors.Is(err, ErrArticleNotFound):
+			sendError(w, http.StatusNotFound, codeArticleNotFound, "Article not found")
+		case errors.As(err, &rateLimit):
+			setRetryAfter(w, err)
+			sendError(w, http.StatusTooManyRequests, codeRateLimited, "Grokipedia is rate limiting requests; retry later")
+		case errors.Is(err, ErrCircuitOpen):
+			sendError(w, http.StatusServiceUnavailable, codeUpstreamUnavailable, "Grokipedia is failing, requests are paused; try again later")
+		default:
+			sendError(w, upstreamErrorStatus(err), errorCode(err, codeUpstreamError), fmt.Sprintf("Failed to fetch article: %v", err))
+		}
+		return
+	}
+
+	root := currentConfig().Parser.findArticleRoot(doc)
+	if root.Length() == 0 {
+		sendError(w, http.StatusBadGateway, codeEmptyContent, "Article page has no element matching ARTICLE_ROOT_SELECTORS")
+		return
+	}
+
+	// Prefer the element's bytes as fetched; re-serialize only when they
+	// cannot be located
+	markup, ok := rawOuterHTML(raw, root.Nodes[0])
+	if !ok {
+		outer, err := goquery.OuterHtml(root.First())
+		if err != nil {
+			sendError(w, http.StatusInternalServerError, errorCode(err, codeInternalError), fmt.Sprintf("Failed to serialize article: %v", err))
+			return
+		}
+		markup = []byte(outer)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	// The markup is third-party; keep browsers from running its scripts on this origin
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Write(markup)
+}
+
+// rawOuterHTML returns the bytes of raw from the start tag of node, an
+// element of the document parsed from raw, through its end tag. node is
+// located as the n-th start tag of its name, which holds unless the parser
+// moved or duplicated such elements; false means it could not be found.
+func rawOuterHTML(raw []byte, node *html.Node) ([]byte, bool) {
+	if node.Type != html.ElementNode {
+		return nil, false
+	}
+
+	top := node
+	for top.Parent != nil {
+		top = top.Parent
+	}
+	// index is how many elements named like node precede it in document order
+	index, found := 0, false
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		for c := n.FirstChild; c != nil && !found; c = c.NextSibling {
+			if c == node {
+				found = true
+				return
+			}
+			if c.Type == html.ElementNode && c.Data == node.Data {
+				index++
+			}
+			walk(c)
+		}
+	}
+	walk(top)
+	if !found {
+		return nil, false
+	}
+
+	z := html.NewTokenizer(bytes.NewReader(raw))
+	offset, begin, depth, seen := 0, 0, 0, 0
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			return nil, false
+		}
+		start := offset
+		offset += len(z.Raw())
+
+		if tt != html.StartTagToken && tt != html.EndTagToken && tt != html.SelfClosingTagToken {
+			continue
+		}
+		name, _ := z.TagName()
+		if string(name) != node.Data {
+			continue
+		}
+
+		switch {
+		case depth > 0 && tt == html.StartTagToken:
+			depth++
+		case depth > 0 && tt == html.EndTagToken:
+			if depth--; depth == 0 {
+				return raw[begin:offset], true
+			}
+		case tt == html.EndTagToken:
+		case seen < index:
+			seen++
+		case tt == html.SelfClosingTagToken:
+			return raw[start:offset], true
+		default:
+			begin, depth = start, 1
+		}
+	}
+}
+
+// Article response formats, chosen with ?format= or the Accept header
+const (
+	formatJSON     = "json"
+	formatText     = "text"
+	formatMarkdown = "markdown"
+	formatHTML     = "html"
+	formatPDF      = "pdf"
+	formatPNG      = "png"
+)
+
+// errNotAcceptable is returned by negotiateFormat when Accept allows no format we produce
+var errNotAcceptable = errors.New("none of the accepted media types can be produced; use application/json, text/plain, text/markdown, text/html, application/pdf or image/png")
+
+// formatMediaTypes lists the article formats with the media type each is
+// served as, in order of preference when a wildcard matches several of them:
+// cheap text formats before the ones needing headless Chrome
+var formatMediaTypes = []struct {
+	format    string
+	mediaType string
+}{
+	{formatJSON, "application/json"},
+	{formatText, "text/plain"},
+	{formatMarkdown, "text/markdown"},
+	{formatHTML, "text/html"},
+	{formatPDF, "application/pdf"},
+	{formatPNG, "image/png"},
+}
+
+// acceptRange is one media range of an Accept header
+type acceptRange struct {
+	mediaType string
+	q         float64
+}
+
+// parseAccept parses the media ranges of an Accept header, skipping
+// malformed ones
+func parseAccept(accept string) []acceptRange {
+	var ranges []acceptRange
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil || !strings.Contains(mediaType, "/") {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil || q < 0 || q > 1 {
+				continue
+			}
+		}
+		ranges = append(ranges, acceptRange{mediaType: mediaType, q: q})
+	}
+	return ranges
+}
+
+// acceptQuality returns the quality ranges give mediaType: that of the most
+// specific range matching it, so "application/json;q=0, */*" excludes JSON.
+// index is the position of that range, -1 when none matches; exact reports
+// whether it names mediaType itself rather than a wildcard.
+func acceptQuality(ranges []acceptRange, mediaType string) (q float64, index int, exact bool) {
+	typ, _, _ := strings.Cut(mediaType, "/")
+	index, specificity := -1, -1
+	for i, r := range ranges {
+		s := -1
+		switch r.mediaType {
+		case mediaType:
+			s = 2
+		case typ + "/*":
+			s = 1
+		case "*/*":
+			s = 0
+		}
+		if s > specificity {
+			q, index, specificity = r.q, i, s
+		}
+	}
+	return q, index, specificity == 2
+}
+
+// negotiateFormat picks the article format for r. An explicit ?format=
+// wins; otherwise JSON is served whenever Accept allows it, unless
+// application/json is listed with a lower quality than another type we can
+// produce, so a browser's "text/html,...,*/*;q=0.8" still gets JSON. When
+// Accept excludes JSON the acceptable format with the highest quality wins,
+// ties going to the range listed first and then to the cheaper format.
+// Without an Accept header the format is JSON.
+func negotiateFormat(r *http.Request) (string, error) {
+	if format := r.URL.Query().Get("format"); format != "" {
+		switch format {
+		case formatJSON, formatText, formatMarkdown, formatHTML, formatPDF, formatPNG:
+			return format, nil
+		}
+		return "", fmt.Errorf("unsupported format %q", format)
+	}
+
+	ranges := parseAccept(r.Header.Get("Accept"))
+	if len(ranges) == 0 {
+		return formatJSON, nil
+	}
+
+	jsonQ, _, jsonExact := acceptQuality(ranges, "application/json")
+	if jsonQ > 0 && !jsonExact {
+		return formatJSON, nil
+	}
+
+	best, bestQ, bestIndex := "", 0.0, 0
+	for _, f := range formatMediaTypes {
+		q, index, _ := acceptQuality(ranges, f.mediaType)
+		if q <= 0 {
+			continue
+		}
+		// JSON, listed explicitly, only gives way to a strictly higher quality
+		if best == "" || q > bestQ || q == bestQ && best != formatJSON && index < bestIndex {
+			best, bestQ, bestIndex = f.format, q, index
+		}
+	}
+
+	if best == "" {
+		return "", errNotAcceptable
+	}
+	return best, nil
+}
+
+// exportArticleScreenshot returns the rendered article page as a PNG image
+func exportArticleScreenshot(w http.ResponseWriter, r *http.Request, articlePath, pageURL string, width int) {
+	png, err := renderArticleScreenshot(r.Context(), pageURL, width)
+	if err != nil {
+		setRetryAfter(w, err)
+		sendError(w, searchErrorStatus(err), errorCode(err, codeInternalError), fmt.Sprintf("Failed to capture article: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{
+		"filename": exportFilename(articlePath, ".png"),
+	}))
+	w.Header().Set("Content-Length", strconv.Itoa(len(png)))
+	w.Write(png)
+}
+
+func suggestHandler(w http.ResponseWriter, r *http.Request) {
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" {
+		sendError(w, http.StatusBadRequest, codeInvalidRequest, "Query parameter 'q' is required")
+		return
+	}
+
+	// Use the request context so superseded keystrokes stop their browser early
+	suggestions, err := suggestTitles(r.Context(), query, maxSuggestions)
+	if err != nil {
+		setRetryAfter(w, err)
+		sendError(w, searchErrorStatus(err), errorCode(err, codeSearchFailed), fmt.Sprintf("Suggest failed: %v", err))
+		return
+	}
+
+	if suggestions == nil {
+		suggestions = []string{}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"query":       query,
+		"suggestions": suggestions,
+	}, wantPretty(r))
+}
+
+// searchStreamHandler runs a search and reports its progress as Server-Sent Events
+func searchStreamHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query().Get("q")
+	if query == "" {
+		sendError(w, http.StatusBadRequest, codeInvalidRequest, "Search query parameter 'q' is required")
+		return
+	}
+
+	limit, err := searchLimit(r)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		sendError(w, http.StatusInternalServerError, codeInternalError, "Streaming is not supported")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	sendEvent := func(event string, data any) {
+		payload, err := json.Marshal(data)
+		if err != nil {
+			log.Printf("Failed to encode %s event: %v", event, err)
+			return
+		}
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload)
+		flusher.Flush()
+	}
+
+	// The request context is cancelled when the client disconnects,
+	// which in turn shuts down the headless browser
+	results, err := searchArticles(r.Context(), query, func(stage string) {
+		sendEvent("progress", map[string]string{"stage": stage})
+	})
+	if err != nil {
+		if r.Context().Err() != nil {
+			log.Printf("Search stream for %q cancelled by client", query)
+			return
+		}
+		sendEvent("error", ErrorResponse{
+			Error:   http.StatusText(searchErrorStatus(err)),
+			Code:    errorCode(err, codeSearchFailed),
+			Message: fmt.Sprintf("Search failed: %v", err),
+		})
+		return
+	}
+	results = results[:min(len(results), limit)]
+
+	if r.URL.Query().Get("include_score") != "true" {
+		stripScores(results)
+	}
+
+	sendEvent("results", map[string]any{
+		"query":   query,
+		"count":   len(results),
+		"results": results,
+	})
+}
+
+// writeJSON writes v as the JSON response body with the given status,
+// indented for reading when pretty is set
+func writeJSON(w http.ResponseWriter, status int, v any, pretty bool) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	enc := json.NewEncoder(w)
+	if pretty {
+		enc.SetIndent("", "  ")
+	}
+	if err := enc.Encode(v); err != nil {
+		log.Printf("Failed to write JSON response: %v", err)
+	}
+}
+
+// wantPretty reports whether a JSON response should be indented:
+// ?pretty=true/false when given, otherwise PRETTY_JSON
+func wantPretty(r *http.Request) bool {
+	if v := r.URL.Query().Get("pretty"); v != "" {
+		if pretty, err := strconv.ParseBool(v); err == nil {
+			return pretty
+		}
+	}
+	return currentConfig().PrettyJSON
+}
+
+// sendError writes an ErrorResponse. Errors follow PRETTY_JSON since most
+// call sites have no request at hand.
+func sendError(w http.ResponseWriter, statusCode int, code, message string) {
+	// Errors are never cached, even when they follow a successful fetch
+	w.Header().Del("Cache-Control")
+	w.Header().Del("Age")
+	writeJSON(w, statusCode, ErrorResponse{
+		Error:   http.StatusText(statusCode),
+		Code:    code,
+		Message: message,
+	}, currentConfig().PrettyJSON)
+}
+
+// CORS middleware
+func corsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+		// Cache-Control and Pragma let browser clients ask for a fresh
+		// fetch, and X-Cache tells them whether they got one
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Cache-Control, Pragma")
+		w.Header().Set("Access-Control-Expose-Headers", "X-Cache")
+
+		if r.Method == "OPTIONS" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientIP returns the address of the client behind r. Forwarding headers
+// are only believed when the connecting peer is in TRUSTED_PROXIES: then
+// X-Forwarded-For is read from the right, skipping further trusted proxies,
+// and X-Real-IP is used when that yields nothing. Otherwise the peer address
+// is returned, so clients cannot spoof their IP. The result is only used
+// for the request log.
+func clientIP(r *http.Request) string {
+	peer, err := parseClientIP(r.RemoteAddr)
+	if err != nil {
+		// Not an IP, e.g. a Unix socket; report what the listener gave
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			return host
+		}
+		return r.RemoteAddr
+	}
+	if !isTrustedProxy(peer) {
+		return peer.String()
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := parseClientIP(hops[i])
+		if err != nil {
+			// A garbled hop ends the chain we can vouch for
+			break
+		}
+		if !isTrustedProxy(addr) {
+			return addr.String()
+		}
+	}
+
+	if addr, err := parseClientIP(r.Header.Get("X-Real-IP")); err == nil {
+		return addr.String()
+	}
+
+	return peer.String()
+}
+
+// parseClientIP parses an address as found in RemoteAddr or a forwarding
+// header: IPv4 or IPv6, with or without a port ("203.0.113.7:4711",
+// "[2001:db8::1]:443") and with or without brackets ("[::1]"). IPv4-mapped
+// IPv6 addresses come back as IPv4 and zones are dropped, so one client
+// always yields the same address.
+func parseClientIP(value string) (netip.Addr, error) {
+	value = strings.TrimSpace(value)
+
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		if addrPort, portErr := netip.ParseAddrPort(value); portErr == nil {
+			addr, err = addrPort.Addr(), nil
+		} else if len(value) > 2 && value[0] == '[' && value[len(value)-1] == ']' {
+			addr, err = netip.ParseAddr(value[1 : len(value)-1])
+		}
+	}
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("invalid client IP %q", value)
+	}
+
+	return addr.Unmap().WithZone(""), nil
+}
+
+// isTrustedProxy reports whether addr falls within TRUSTED_PROXIES
+func isTrustedProxy(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedProxies parses a comma-separated list of CIDRs or single IPs
+func parseTrustedProxies(value string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, item := range splitList(value) {
+		if strings.Contains(item, "/") {
+			prefix, err := netip.ParsePrefix(item)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+
+		addr, err := netip.ParseAddr(item)
+		if err != nil {
+			return nil, err
+		}
+		addr = addr.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// Logging middleware
+func loggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		log.Printf("[%s] %s %s", r.Method, r.RequestURI, clientIP(r))
+		next.ServeHTTP(w, r)
+		log.Printf("Completed in %v", time.Since(start))
+	})
+}
+
+// Body size limit middleware
+func bodyLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch:
+			// Reject declared oversized bodies up front; MaxBytesReader catches
+			// chunked or understated ones while the handler reads
+			if r.ContentLength > maxRequestBytes {
+				sendError(w, http.StatusRequestEntityTooLarge, codePayloadTooLarge, fmt.Sprintf("Request body exceeds %d bytes", maxRequestBytes))
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, maxRequestBytes)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Timeout middleware. Handlers run with a context that expires after
+// SERVER_REQUEST_TIMEOUT, so fetches and headless searches under them are
+// cancelled; if the handler has not finished by then the client gets a 504
+// and anything it writes afterwards is discarded. Responses are buffered
+// until the handler returns, so the streaming search endpoint is exempt and
+// relies on its own search timeout. The pprof handlers are exempt as well:
+// CPU profiles and traces run for as long as ?seconds= asks.
+func timeoutMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if serverRequestTimeout <= 0 || r.URL.Path == routePrefix+"/api/search/stream" ||
+			enablePprof && strings.HasPrefix(r.URL.Path, routePrefix+"/debug/pprof/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), serverRequestTimeout)
+		defer cancel()
+
+		tw := &timeoutWriter{w: w, header: make(http.Header)}
+		done := make(chan struct{})
+		panicked := make(chan handlerPanic, 1)
+
+		go func() {
+			defer func() {
+				if rec := recover(); rec != nil {
+					panicked <- handlerPanic{value: rec, stack: debug.Stack()}
+				}
+			}()
+			next.ServeHTTP(tw, r.WithContext(ctx))
+			close(done)
+		}()
+
+		select {
+		case p := <-panicked:
+			// Re-panic on the serving goroutine so recoveryMiddleware sees it
+			panic(p.value)
+		case <-done:
+			tw.mu.Lock()
+			defer tw.mu.Unlock()
+
+			if tw.flushed {
+				w.Write(tw.buf.Bytes())
+				return
+			}
+			for key, values := range tw.header {
+				w.Header()[key] = values
+			}
+			if !tw.wroteHeader {
+				tw.status = http.StatusOK
+			}
+			w.WriteHeader(tw.status)
+			w.Write(tw.buf.Bytes())
+		case <-ctx.Done():
+			// Nobody waits on the abandoned handler any more; log a late panic
+			// here since recoveryMiddleware can no longer see it
+			go func() {
+				select {
+				case p := <-panicked:
+					if p.value != http.ErrAbortHandler {
+						log.Printf("Panic after timeout serving [%s] %s: %v\n%s", r.Method, r.RequestURI, p.value, p.stack)
+					}
+				case <-done:
+				}
+			}()
+
+			tw.mu.Lock()
+			defer tw.mu.Unlock()
+
+			tw.timedOut = true
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				log.Printf("[%s] %s timed out after %v", r.Method, r.RequestURI, serverRequestTimeout)
+				if tw.flushed {
+					// The status is already out; the response just ends here
+					return
+				}
+				sendError(w, http.StatusGatewayTimeout, codeRequestTimeout, fmt.Sprintf("Request did not complete within %v", serverRequestTimeout))
+			}
+		}
 	})
 }
 
-// CORS middleware
-func corsMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+// handlerPanic is a panic recovered from a handler run by timeoutMiddleware,
+// with the stack it was raised from
+type handlerPanic struct {
+	value any
+	stack []byte
+}
 
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
+// timeoutWriter buffers a handler's response for timeoutMiddleware. A
+// handler that flushes streams the rest of its response instead, giving up
+// the 504 on a later timeout.
+type timeoutWriter struct {
+	w      http.ResponseWriter
+	header http.Header
+
+	mu          sync.Mutex
+	buf         bytes.Buffer
+	status      int
+	wroteHeader bool
+	flushed     bool
+	timedOut    bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+func (tw *timeoutWriter) Write(p []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if !tw.wroteHeader {
+		tw.status = http.StatusOK
+		tw.wroteHeader = true
+	}
+	if tw.flushed {
+		return tw.w.Write(p)
+	}
+	return tw.buf.Write(p)
+}
+
+// Flush sends the status, headers and buffered body, after which writes go
+// straight to the client
+func (tw *timeoutWriter) Flush() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.timedOut {
+		return
+	}
+	if !tw.flushed {
+		for key, values := range tw.header {
+			tw.w.Header()[key] = values
 		}
+		if !tw.wroteHeader {
+			tw.status = http.StatusOK
+			tw.wroteHeader = true
+		}
+		tw.w.WriteHeader(tw.status)
+		tw.flushed = true
+	}
+	tw.w.Write(tw.buf.Bytes())
+	tw.buf.Reset()
 
-		next.ServeHTTP(w, r)
-	})
+	if flusher, ok := tw.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
 }
 
-// Logging middleware
-func loggingMiddleware(next http.Handler) http.Handler {
+func (tw *timeoutWriter) WriteHeader(status int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.timedOut || tw.wroteHeader {
+		return
+	}
+	tw.status = status
+	tw.wroteHeader = true
+}
+
+// Recovery middleware
+func recoveryMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-		log.Printf("[%s] %s %s", r.Method, r.RequestURI, r.RemoteAddr)
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+
+			// Deliberate aborts must keep propagating to net/http
+			if rec == http.ErrAbortHandler {
+				panic(rec)
+			}
+
+			requestID := r.Header.Get("X-Request-ID")
+			if requestID == "" {
+				requestID = "-"
+			}
+			log.Printf("Panic serving [%s] %s (request ID %s): %v\n%s", r.Method, r.RequestURI, requestID, rec, debug.Stack())
+
+			sendError(w, http.StatusInternalServerError, codeInternalError, "Internal server error")
+		}()
+
 		next.ServeHTTP(w, r)
-		log.Printf("Completed in %v", time.Since(start))
 	})
 }
 
+// httpsRedirectHandler redirects plain HTTP requests to the HTTPS server
+func httpsRedirectHandler(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
+
+// loadBuildInfo fills in build metadata not set via -ldflags from the
+// module and VCS info the go tool embeds, falling back to "dev"
+func loadBuildInfo() {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if version == "" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+			version = info.Main.Version
+		}
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if commit == "" {
+					commit = setting.Value
+				}
+			case "vcs.time":
+				if buildTime == "" {
+					buildTime = setting.Value
+				}
+			}
+		}
+	}
+
+	if version == "" {
+		version = "dev"
+	}
+}
+
+// resolveListenAddr returns the address to bind to. A non-empty addr
+// (LISTEN_ADDR) takes precedence over port, which binds all interfaces.
+func resolveListenAddr(addr, port string) (string, error) {
+	if addr == "" {
+		addr = ":" + port
+	}
+
+	_, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if n, err := strconv.Atoi(p); err != nil || n < 0 || n > 65535 {
+		return "", fmt.Errorf("invalid port %q in %q", p, addr)
+	}
+
+	return addr, nil
+}
+
+// parseRoutePrefix normalizes ROUTE_PREFIX to a path with a leading and no
+// trailing slash, so "grok/", "/grok" and "/grok/" all give "/grok". An empty
+// value or "/" gives "". Queries, fragments and mux patterns are rejected.
+func parseRoutePrefix(raw string) (string, error) {
+	prefix := strings.Trim(strings.TrimSpace(raw), "/")
+	if prefix == "" {
+		return "", nil
+	}
+	if strings.ContainsAny(prefix, "?#{} ") {
+		return "", fmt.Errorf("%q must be a plain path", raw)
+	}
+
+	u, err := url.Parse("/" + prefix)
+	if err != nil {
+		return "", err
+	}
+	for _, segment := range strings.Split(prefix, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return "", fmt.Errorf("%q has an empty, \".\" or \"..\" segment", raw)
+		}
+	}
+	return u.Path, nil
+}
+
+// withServerURL returns spec with its servers list pointing at prefix, so
+// Swagger UI and generated clients call the prefixed routes
+func withServerURL(spec []byte, prefix string) ([]byte, error) {
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(spec, &doc); err != nil {
+		return nil, err
+	}
+
+	servers, err := json.Marshal([]map[string]string{{"url": prefix + "/"}})
+	if err != nil {
+		return nil, err
+	}
+	doc["servers"] = servers
+
+	return json.MarshalIndent(doc, "", "  ")
+}
+
 func init() {
+	loadBuildInfo()
+
 	// Load configuration from environment variables
 	baseURL = os.Getenv("GROKIPEDIA_BASE_URL")
 	if baseURL == "" {
 		baseURL = defaultBaseURL
 	}
 
+	allowedHosts = make(map[string]bool)
+	if hosts := splitList(os.Getenv("ALLOWED_HOSTS")); len(hosts) > 0 {
+		for _, host := range hosts {
+			allowedHosts[strings.ToLower(host)] = true
+		}
+	} else if u, err := url.Parse(baseURL); err == nil {
+		allowedHosts[strings.ToLower(u.Host)] = true
+	}
+
 	port = os.Getenv("PORT")
 	if port == "" {
 		port = defaultPort
 	}
+
+	addr, err := resolveListenAddr(strings.TrimSpace(os.Getenv("LISTEN_ADDR")), port)
+	if err != nil {
+		log.Fatalf("Invalid listen address (LISTEN_ADDR/PORT): %v", err)
+	}
+	listenAddr = addr
+
+	prefix, err := parseRoutePrefix(os.Getenv("ROUTE_PREFIX"))
+	if err != nil {
+		log.Fatalf("Invalid ROUTE_PREFIX: %v", err)
+	}
+	routePrefix = prefix
+	if routePrefix != "" {
+		spec, err := withServerURL(openAPISpec, routePrefix)
+		if err != nil {
+			log.Fatalf("Failed to apply ROUTE_PREFIX to the OpenAPI spec: %v", err)
+		}
+		openAPISpec = spec
+	}
+	// Keep port in step with the bound address; the HTTPS redirect points at it
+	_, port, _ = net.SplitHostPort(listenAddr)
+
+	tlsCertFile = os.Getenv("TLS_CERT_FILE")
+	tlsKeyFile = os.Getenv("TLS_KEY_FILE")
+	httpRedirectPort = os.Getenv("HTTP_REDIRECT_PORT")
+
+	enablePprof = os.Getenv("ENABLE_PPROF") == "true"
+
+	defaultLang = os.Getenv("DEFAULT_LANG")
+	if defaultLang != "" && !langPattern.MatchString(defaultLang) {
+		log.Printf("Invalid DEFAULT_LANG %q, ignoring", defaultLang)
+		defaultLang = ""
+	}
+
+	userAgent = os.Getenv("USER_AGENT")
+	if userAgent == "" {
+		userAgent = defaultUserAgent
+	}
+
+	userAgentPool = splitList(os.Getenv("USER_AGENT_POOL"))
+
+	if v := os.Getenv("MAX_REQUEST_BYTES"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 1 {
+			log.Printf("Invalid MAX_REQUEST_BYTES %q, using %d", v, maxRequestBytes)
+		} else {
+			maxRequestBytes = n
+		}
+	}
+
+	if v := os.Getenv("MAX_FETCH_BYTES"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			log.Printf("Invalid MAX_FETCH_BYTES %q, using %d", v, maxFetchBytes)
+		} else {
+			maxFetchBytes = n
+		}
+	}
+
+	if v := os.Getenv("SERVER_REQUEST_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			log.Printf("Invalid SERVER_REQUEST_TIMEOUT %q, using %v", v, serverRequestTimeout)
+		} else {
+			serverRequestTimeout = d
+		}
+	}
+
+	maxSearches := defaultMaxConcurrentSearches
+	if v := os.Getenv("MAX_CONCURRENT_SEARCHES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Printf("Invalid MAX_CONCURRENT_SEARCHES %q, using %d", v, maxSearches)
+		} else {
+			maxSearches = n
+		}
+	}
+	searchSlots = make(chan struct{}, maxSearches)
+
+	configFile = os.Getenv("CONFIG_FILE")
+	adminToken = os.Getenv("ADMIN_TOKEN")
+	cfg, ignored, err := readRuntimeConfig()
+	if err != nil {
+		log.Fatalf("Invalid CONFIG_FILE: %v", err)
+	}
+	if len(ignored) > 0 {
+		log.Printf("CONFIG_FILE sets %s, which only the environment can set; ignoring", strings.Join(ignored, ", "))
+	}
+	activeConfig.Store(cfg)
+
+	if v := os.Getenv("FEED_SIZE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Printf("Invalid FEED_SIZE %q, using %d", v, feedSize)
+		} else {
+			feedSize = n
+		}
+	}
+
+	cacheTTL := defaultCacheTTL
+	if v := os.Getenv("CACHE_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			log.Printf("Invalid CACHE_TTL %q, using %v", v, cacheTTL)
+		} else {
+			cacheTTL = d
+		}
+	}
+
+	cacheMaxEntries := defaultCacheMaxEntries
+	if v := os.Getenv("CACHE_MAX_ENTRIES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Printf("Invalid CACHE_MAX_ENTRIES %q, using %d", v, cacheMaxEntries)
+		} else {
+			cacheMaxEntries = n
+		}
+	}
+
+	cacheDirMaxEntries := defaultCacheDirMaxEntries
+	if v := os.Getenv("CACHE_DIR_MAX_ENTRIES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Printf("Invalid CACHE_DIR_MAX_ENTRIES %q, using %d", v, cacheDirMaxEntries)
+		} else {
+			cacheDirMaxEntries = n
+		}
+	}
+
+	var cacheDirMaxBytes int64 = defaultCacheDirMaxBytes
+	if v := os.Getenv("CACHE_DIR_MAX_BYTES"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			log.Printf("Invalid CACHE_DIR_MAX_BYTES %q, using %d", v, cacheDirMaxBytes)
+		} else {
+			cacheDirMaxBytes = n
+		}
+	}
+
+	cacheDir := strings.TrimSpace(os.Getenv("CACHE_DIR"))
+	if err := configureCaches(cacheTTL, cacheMaxEntries, cacheDir, cacheDirMaxEntries, cacheDirMaxBytes); err != nil {
+		log.Printf("Invalid CACHE_DIR %q, caching in memory only: %v", cacheDir, err)
+		configureCaches(cacheTTL, cacheMaxEntries, "", 0, 0)
+	}
+
+	if v := os.Getenv("WATCH_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Printf("Invalid WATCH_INTERVAL %q, using %v", v, watchInterval)
+		} else {
+			watchInterval = d
+		}
+	}
+
+	if v := os.Getenv("MAX_WATCHES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Printf("Invalid MAX_WATCHES %q, using %d", v, maxWatches)
+		} else {
+			maxWatches = n
+		}
+	}
+
+	proxies, err := parseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
+	trustedProxies = proxies
+
+	denyPaths, err = parseDenyPaths(os.Getenv("DENY_PATHS"))
+	if err != nil {
+		log.Fatalf("Invalid DENY_PATHS: %v", err)
+	}
+
+	if v := os.Getenv("EXTRA_REQUEST_HEADERS"); v != "" {
+		headers, err := parseExtraHeaders(v)
+		if err != nil {
+			log.Fatalf("Invalid EXTRA_REQUEST_HEADERS: %v", err)
+		}
+		extraRequestHeaders = headers
+	}
+
+	if v := strings.TrimSpace(os.Getenv("HTTP_PROXY_URL")); v != "" {
+		u, err := url.Parse(v)
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5") {
+			log.Fatalf("Invalid HTTP_PROXY_URL %q: must be an http://, https:// or socks5:// URL", v)
+		}
+		proxyURL = u
+	}
+
+	if v := os.Getenv("UPSTREAM_MAX_IDLE_CONNS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Printf("Invalid UPSTREAM_MAX_IDLE_CONNS %q, using %d", v, upstreamMaxIdleConns)
+		} else {
+			upstreamMaxIdleConns = n
+		}
+	}
+	if v := os.Getenv("UPSTREAM_MAX_IDLE_CONNS_PER_HOST"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Printf("Invalid UPSTREAM_MAX_IDLE_CONNS_PER_HOST %q, using %d", v, upstreamMaxIdleConnsPerHost)
+		} else {
+			upstreamMaxIdleConnsPerHost = n
+		}
+	}
+	if v := os.Getenv("UPSTREAM_IDLE_CONN_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			log.Printf("Invalid UPSTREAM_IDLE_CONN_TIMEOUT %q, using %v", v, upstreamIdleConnTimeout)
+		} else {
+			upstreamIdleConnTimeout = d
+		}
+	}
+	upstreamClient = newUpstreamClient()
+
+	if v := os.Getenv("BREAKER_THRESHOLD"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Printf("Invalid BREAKER_THRESHOLD %q, using %d", v, upstreamBreaker.threshold)
+		} else {
+			upstreamBreaker.threshold = n
+		}
+	}
+
+	if v := os.Getenv("BREAKER_WINDOW"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Printf("Invalid BREAKER_WINDOW %q, using %v", v, upstreamBreaker.window)
+		} else {
+			upstreamBreaker.window = d
+		}
+	}
+
+	if v := os.Getenv("BREAKER_COOLDOWN"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Printf("Invalid BREAKER_COOLDOWN %q, using %v", v, upstreamBreaker.cooldown)
+		} else {
+			upstreamBreaker.cooldown = d
+		}
+	}
+
+	chromeFlags = parseChromeFlags(os.Getenv("CHROME_FLAGS"))
+	chromeExecPath = strings.TrimSpace(os.Getenv("CHROME_EXEC_PATH"))
+
+	if v := os.Getenv("SEARCH_BLOCK_RESOURCES"); v != "" {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Printf("Invalid SEARCH_BLOCK_RESOURCES %q, keeping default %v", v, searchBlockResources)
+		} else {
+			searchBlockResources = enabled
+		}
+	}
+
+	if v := strings.TrimSpace(os.Getenv("ARTICLE_REVISION_URL")); v != "" {
+		if !strings.Contains(v, "{revision}") {
+			log.Printf("Invalid ARTICLE_REVISION_URL %q (missing {revision}), revisions stay unavailable", v)
+		} else {
+			articleRevisionURL = v
+		}
+	}
+
+	if v := strings.TrimSpace(os.Getenv("ARTICLE_ID_PATH")); v != "" {
+		if !strings.Contains(v, "{id}") {
+			log.Printf("Invalid ARTICLE_ID_PATH %q (missing {id}), using %q", v, articleIDPath)
+		} else {
+			articleIDPath = v
+		}
+	}
+
+	if v := os.Getenv("SEARCH_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Printf("Invalid SEARCH_TIMEOUT %q, using %v", v, searchTimeout)
+		} else {
+			searchTimeout = d
+		}
+	}
+
+	if v := os.Getenv("SEARCH_MAX_RETRIES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Printf("Invalid SEARCH_MAX_RETRIES %q, using %d", v, searchMaxRetries)
+		} else {
+			searchMaxRetries = n
+		}
+	}
+
+	// A shortened SEARCH_TIMEOUT must still leave time to extract after rendering
+	if searchRenderTimeout >= searchTimeout {
+		searchRenderTimeout = searchTimeout / 2
+	}
+
+	if v := os.Getenv("SEARCH_RENDER_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 || d >= searchTimeout {
+			log.Printf("Invalid SEARCH_RENDER_TIMEOUT %q (must be below %v), using %v", v, searchTimeout, searchRenderTimeout)
+		} else {
+			searchRenderTimeout = d
+		}
+	}
+
+	if v := os.Getenv("SEARCH_SNIPPET_MAX"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxSearchSnippetLimit {
+			log.Printf("Invalid SEARCH_SNIPPET_MAX %q (1-%d), using %d", v, maxSearchSnippetLimit, searchSnippetMax)
+		} else {
+			searchSnippetMax = n
+		}
+	}
+
+	if v := os.Getenv("SEARCH_SNIPPET_MIN"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n >= searchSnippetMax {
+			log.Printf("Invalid SEARCH_SNIPPET_MIN %q (0-%d), using %d", v, searchSnippetMax-1, min(searchSnippetMin, searchSnippetMax-1))
+		} else {
+			searchSnippetMin = n
+		}
+	}
+	// A lowered maximum may fall below the default minimum
+	searchSnippetMin = min(searchSnippetMin, searchSnippetMax-1)
+
+	if v := os.Getenv("SEARCH_MAX_SCAN"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Printf("Invalid SEARCH_MAX_SCAN %q, using %d", v, searchMaxScan)
+		} else {
+			searchMaxScan = n
+		}
+	}
+
+	if v := strings.ToLower(strings.TrimSpace(os.Getenv("SEARCH_STRATEGY"))); v != "" {
+		switch v {
+		case strategyHTTP, strategyBrowser, strategyAuto:
+			searchStrategy = v
+		default:
+			log.Printf("Invalid SEARCH_STRATEGY %q, keeping default %q", v, searchStrategy)
+		}
+	}
 }
 
-func main() {
-	r := mux.NewRouter()
+// newRouter registers every route under prefix (see parseRoutePrefix);
+// requests outside it get a 404
+func newRouter(prefix string) *mux.Router {
+	root := mux.NewRouter()
+	root.Use(tracingMiddleware)
+
+	r := root
+	if prefix != "" {
+		r = root.PathPrefix(prefix).Subrouter()
+	}
 
 	// API routes
+	r.HandleFunc("/livez", livenessHandler).Methods("GET")
+	r.HandleFunc("/readyz", readinessHandler).Methods("GET")
 	r.HandleFunc("/health", healthHandler).Methods("GET")
-	r.HandleFunc("/api/article/{path:.*}", getArticleHandler).Methods("GET")
+	r.HandleFunc("/health/ready", readinessHandler).Methods("GET")
+	r.HandleFunc("/version", versionHandler).Methods("GET")
+	r.HandleFunc("/openapi.json", openAPIHandler).Methods("GET")
+	r.HandleFunc("/docs", docsHandler).Methods("GET")
+	r.HandleFunc("/feed.xml", feedHandler).Methods("GET")
+	r.HandleFunc("/api/stats", statsHandler).Methods("GET")
+	r.HandleFunc("/api/article", postArticleHandler).Methods("POST")
+	r.HandleFunc("/api/article/id/{id}", articleByIDHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/api/article/{path:.*}", getArticleHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/api/fetch", fetchByURLHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/api/summary/{path:.*}", summaryHandler).Methods("GET")
+	r.HandleFunc("/api/exists/{path:.*}", existsHandler).Methods("GET")
 	r.HandleFunc("/api/search", searchHandler).Methods("GET")
+	r.HandleFunc("/api/search/stream", searchStreamHandler).Methods("GET")
+	r.HandleFunc("/api/search/batch", batchSearchHandler).Methods("POST")
+	r.HandleFunc("/api/suggest", suggestHandler).Methods("GET")
+	// Watches make the server call out to arbitrary URLs, so they take the
+	// admin token when one is set
+	watchRoute := func(h http.HandlerFunc) http.HandlerFunc {
+		if adminToken != "" {
+			return requireAdmin(h)
+		}
+		return h
+	}
+	r.HandleFunc("/api/watch", watchRoute(createWatchHandler)).Methods("POST")
+	r.HandleFunc("/api/watch", watchRoute(listWatchesHandler)).Methods("GET")
+	r.HandleFunc("/api/watch/{id}", watchRoute(deleteWatchHandler)).Methods("DELETE")
+
+	// Profiling routes are opt-in; pprof.Index also serves the named profiles (heap, goroutine, ...)
+	if enablePprof {
+		r.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		r.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		r.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		r.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		r.PathPrefix("/debug/pprof/").HandlerFunc(pprof.Index)
+	}
+	if adminToken != "" {
+		r.HandleFunc("/admin/reload", requireAdmin(reloadHandler)).Methods("POST")
+	}
+
+	return root
+}
+
+func main() {
+	r := newRouter(routePrefix)
 
-	// Apply middleware
-	handler := corsMiddleware(loggingMiddleware(r))
+	// Apply middleware (recovery is outermost so it catches panics from everything else)
+	handler := recoveryMiddleware(corsMiddleware(loggingMiddleware(timeoutMiddleware(bodyLimitMiddleware(r)))))
 
-	log.Printf("Starting Grokipedia API server")
+	log.Printf("Starting Grokipedia API server %s", version)
 	log.Printf("Base URL: %s", baseURL)
-	log.Printf("Port: %s", port)
+	log.Printf("Listen address: %s", listenAddr)
+	if routePrefix != "" {
+		log.Printf("Route prefix: %s (endpoints below are relative to it)", routePrefix)
+	}
+	if proxyURL != nil {
+		log.Printf("Upstream proxy: %s", proxyURL.Redacted())
+	}
+	if len(userAgentPool) > 0 {
+		log.Printf("User-Agent pool: %d entries", len(userAgentPool))
+	} else {
+		log.Printf("User-Agent: %s", userAgent)
+	}
 	log.Printf("Endpoints:")
-	log.Printf("  GET /health - Health check")
+	log.Printf("  GET /livez - Liveness check")
+	log.Printf("  GET /readyz - Readiness check (Chrome, upstream, circuit breaker)")
+	log.Printf("  GET /health - Health check (alias of /livez with build info)")
+	log.Printf("  GET /health/ready - Readiness check (alias of /readyz)")
+	log.Printf("  GET /version - Build information")
+	log.Printf("  GET /openapi.json - OpenAPI 3 specification")
+	log.Printf("  GET /docs - Swagger UI")
+	log.Printf("  GET /feed.xml - RSS feed of recently fetched articles")
+	log.Printf("  GET /api/stats - Cache hit/miss statistics")
+	log.Printf("  POST /api/article - Get article by path from a JSON body")
+	log.Printf("  GET /api/article/id/{id} - Get article by Grokipedia ID")
 	log.Printf("  GET /api/article/{path} - Get article by path")
+	log.Printf("  GET /api/fetch?url={url} - Get article by full Grokipedia URL")
+	log.Printf("  GET /api/summary/{path} - Get an article's title, summary and lead image")
+	log.Printf("  GET /api/exists/{path} - Check whether an article exists")
 	log.Printf("  GET /api/search?q={query} - Search articles")
+	log.Printf("  GET /api/search/stream?q={query} - Search articles with progress events")
+	log.Printf("  POST /api/search/batch - Run several searches at once")
+	log.Printf("  GET /api/suggest?q={prefix} - Title suggestions")
+	log.Printf("  POST /api/watch - Watch an article for changes")
+	log.Printf("  GET /api/watch - List watched articles")
+	log.Printf("  DELETE /api/watch/{id} - Stop watching an article")
+	if enablePprof {
+		log.Printf("  GET /debug/pprof/ - Profiling (ENABLE_PPROF)")
+	}
+	if adminToken != "" {
+		log.Printf("  POST /admin/reload - Reload configuration (ADMIN_TOKEN)")
+	}
+
+	useTLS := tlsCertFile != "" && tlsKeyFile != ""
+	if (tlsCertFile != "") != (tlsKeyFile != "") {
+		log.Fatal("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+
+	shutdownTracing, err := initTracing(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to set up tracing: %v", err)
+	}
+
+	go runWatcher()
+	go runCacheSweeper()
+
+	// Surface a missing Chrome at startup rather than on the first search
+	go func() {
+		if chrome := chromeCheck.status(); chrome.Available {
+			log.Printf("Headless Chrome available: %s", chrome.Version)
+		}
+	}()
+
+	server := &http.Server{
+		Addr:    listenAddr,
+		Handler: handler,
+	}
+	servers := []*http.Server{server}
 
-	if err := http.ListenAndServe(":"+port, handler); err != nil {
-		log.Fatal(err)
+	serveErr := make(chan error, 2)
+	go func() {
+		if useTLS {
+			log.Printf("Serving HTTPS on %s", server.Addr)
+			serveErr <- server.ListenAndServeTLS(tlsCertFile, tlsKeyFile)
+		} else {
+			log.Printf("Serving HTTP on %s", server.Addr)
+			serveErr <- server.ListenAndServe()
+		}
+	}()
+
+	if useTLS && httpRedirectPort != "" {
+		redirectServer := &http.Server{
+			Addr:    ":" + httpRedirectPort,
+			Handler: http.HandlerFunc(httpsRedirectHandler),
+		}
+		servers = append(servers, redirectServer)
+
+		go func() {
+			log.Printf("Redirecting HTTP on %s to HTTPS", redirectServer.Addr)
+			serveErr <- redirectServer.ListenAndServe()
+		}()
+	}
+
+	// Wait for a termination signal, then let in-flight requests finish
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
+	select {
+	case err := <-serveErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	case sig := <-stop:
+		log.Printf("Received %v, shutting down", sig)
 	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("Shutdown of %s did not complete: %v", srv.Addr, err)
+		}
+	}
+
+	if err := shutdownTracing(ctx); err != nil {
+		log.Printf("Failed to flush traces: %v", err)
+	}
+
+	log.Printf("Server stopped")
 }
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setGlobal sets *p to v for the rest of the test
+func setGlobal[T any](t *testing.T, p *T, v T) {
+	t.Helper()
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
+
+// stubUpstream serves handler as Grokipedia for the rest of the test:
+// baseURL and ALLOWED_HOSTS point at it, and the caches, circuit breaker
+// and feed start out empty
+func stubUpstream(t *testing.T, handler http.Handler) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setGlobal(t, &baseURL, server.URL)
+	setGlobal(t, &allowedHosts, map[string]bool{strings.ToLower(u.Host): true})
+	resetState(t)
+
+	return server
+}
+
+// resetState gives the test empty caches, a closed circuit breaker and an
+// empty feed, putting the previous ones back afterwards
+func resetState(t *testing.T) {
+	t.Helper()
+	setGlobal(t, &articleCache, newCountedCache[Article](newMemoryCache[Article](defaultCacheTTL, defaultCacheMaxEntries), defaultCacheTTL, defaultCacheMaxEntries))
+	setGlobal(t, &searchCache, newCountedCache[[]SearchResult](newMemoryCache[[]SearchResult](defaultCacheTTL, defaultCacheMaxEntries), defaultCacheTTL, defaultCacheMaxEntries))
+	setGlobal(t, &upstreamBreaker, &circuitBreaker{
+		threshold: defaultBreakerThreshold,
+		window:    defaultBreakerWindow,
+		cooldown:  defaultBreakerCooldown,
+		state:     breakerClosed,
+	})
+	setGlobal(t, &recentArticles, &recentList{})
+}
+
+// setConfig makes cfg the active runtimeConfig for the rest of the test
+func setConfig(t *testing.T, cfg *runtimeConfig) {
+	t.Helper()
+	old := activeConfig.Load()
+	activeConfig.Store(cfg)
+	t.Cleanup(func() { activeConfig.Store(old) })
+}
+
+// parserSettings returns the default runtimeConfig with the parser
+// settings from env applied, as CONFIG_FILE would set them
+func parserSettings(env map[string]string) *runtimeConfig {
+	return loadRuntimeConfig(func(key string) (string, bool) {
+		v, ok := env[key]
+		return v, ok
+	})
+}
+
+// pages serves fixed HTML pages by path and 404 for anything else
+type pages map[string]string
+
+func (p pages) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	page, ok := p[r.URL.Path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(page))
+}
+
+// articlePage builds a minimal article page with the given head tags and
+// article body
+func articlePage(head, body string) string {
+	return `<!DOCTYPE html><html lang="en"><head><title>Test page</title>` + head +
+		`</head><body><article>` + body + `</article></body></html>`
+}
+
+// longParagraph is a paragraph long enough to become an article's summary
+const longParagraph = "The quick brown fox jumps over the lazy dog, and then it keeps running through the forest until nightfall."
+
+func serve(t *testing.T, handler http.Handler, req *http.Request) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestNormalizePath(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"Foo Bar", "/page/Foo_Bar"},
+		{"Foo_Bar", "/page/Foo_Bar"},
+		{"  Foo Bar  ", "/page/Foo_Bar"},
+		{"/Foo_Bar", "/page/Foo_Bar"},
+		{"page/Foo_Bar", "/page/Foo_Bar"},
+		{"/page/Foo_Bar", "/page/Foo_Bar"},
+		{"/page/Foo_Bar/", "/page/Foo_Bar"},
+		{"/page/Foo Bar", "/page/Foo_Bar"},
+		{"", "/"},
+	}
+
+	for _, tt := range tests {
+		if got := normalizePath(tt.in); got != tt.want {
+			t.Errorf("normalizePath(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestArticleURL(t *testing.T) {
+	setGlobal(t, &baseURL, "https://grokipedia.com")
+
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"Foo Bar", "https://grokipedia.com/page/Foo_Bar"},
+		{"foo_bar", "https://grokipedia.com/page/foo_bar"},
+		{"/page/Foo_Bar", "https://grokipedia.com/page/Foo_Bar"},
+		{"Café", "https://grokipedia.com/page/Caf%C3%A9"},
+		{"C++", "https://grokipedia.com/page/C++"},
+	}
+
+	for _, tt := range tests {
+		got, err := articleURL(tt.in)
+		if err != nil {
+			t.Errorf("articleURL(%q) returned error %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("articleURL(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestFetchArticlePageRedirect(t *testing.T) {
+	var server *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/page/Old_Name", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/page/New_Name", http.StatusMovedPermanently)
+	})
+	mux.HandleFunc("/page/Alias", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<html><head><meta http-equiv="refresh" content="0; url=/page/New_Name"></head></html>`))
+	})
+	mux.HandleFunc("/page/Canonical_Alias", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(articlePage(`<meta property="og:url" content="`+server.URL+`/page/New_Name">`, "<h1>New Name</h1>")))
+	})
+	mux.HandleFunc("/page/New_Name", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(articlePage("", "<h1>New Name</h1>")))
+	})
+	server = stubUpstream(t, mux)
+
+	tests := []struct {
+		path       string
+		wantURL    string
+		redirected bool
+	}{
+		{"New Name", "/page/New_Name", false},
+		{"/page/New_Name/", "/page/New_Name", false},
+		{"Old Name", "/page/New_Name", true},
+		{"Alias", "/page/New_Name", true},
+		{"Canonical_Alias", "/page/New_Name", true},
+	}
+
+	for _, tt := range tests {
+		_, article, err := fetchArticlePage(context.Background(), tt.path, "", "")
+		if err != nil {
+			t.Errorf("fetchArticlePage(%q) returned error %v", tt.path, err)
+			continue
+		}
+		if article.URL != server.URL+tt.wantURL || article.Redirected != tt.redirected {
+			t.Errorf("fetchArticlePage(%q) = URL %q, redirected %v; want %q, %v", tt.path, article.URL, article.Redirected, server.URL+tt.wantURL, tt.redirected)
+		}
+		if article.Slug != "New_Name" {
+			t.Errorf("fetchArticlePage(%q) slug = %q, want New_Name", tt.path, article.Slug)
+		}
+	}
+}
+
+func TestFetchArticlePageNotFound(t *testing.T) {
+	stubUpstream(t, pages{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, _, err := fetchArticlePage(ctx, "Missing", "", ""); !errors.Is(err, ErrArticleNotFound) {
+		t.Errorf("fetchArticlePage(Missing) error = %v, want ErrArticleNotFound", err)
+	}
+}
+
+// requireChrome skips the test when headless Chrome cannot be launched
+func requireChrome(t *testing.T) {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("skipping headless Chrome test in short mode")
+	}
+	if status := chromeCheck.status(); !status.Available {
+		t.Skipf("headless Chrome not available: %s", status.Err)
+	}
+}
+
+// writeSelfSignedCert writes a certificate for 127.0.0.1 and its key to
+// dir as PEM files, returning the certificate for clients to trust
+func writeSelfSignedCert(t *testing.T, dir string) (certFile, keyFile string, cert *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, cert
+}
+
+func TestServeTLS(t *testing.T) {
+	certFile, keyFile, cert := writeSelfSignedCert(t, t.TempDir())
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: newRouter("")}
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- server.ServeTLS(ln, certFile, keyFile) }()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+
+	resp, err := client.Get("https://" + ln.Addr().String() + "/livez")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.TLS == nil {
+		t.Errorf("GET https://.../livez = %d over TLS %v, want 200 over TLS", resp.StatusCode, resp.TLS != nil)
+	}
+
+	// Graceful shutdown stops the TLS server cleanly
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-serveErr; !errors.Is(err, http.ErrServerClosed) {
+		t.Errorf("ServeTLS returned %v after Shutdown, want http.ErrServerClosed", err)
+	}
+}
+
+func TestHTTPSRedirect(t *testing.T) {
+	tests := []struct {
+		port   string
+		target string
+		want   string
+	}{
+		{"443", "http://example.com/api/search?q=foo", "https://example.com/api/search?q=foo"},
+		{"443", "http://example.com:80/livez", "https://example.com/livez"},
+		{"8443", "http://example.com/livez", "https://example.com:8443/livez"},
+		{"8443", "http://[::1]:8080/livez", "https://[::1]:8443/livez"},
+	}
+
+	for _, tt := range tests {
+		setGlobal(t, &port, tt.port)
+		rec := serve(t, http.HandlerFunc(httpsRedirectHandler), httptest.NewRequest("GET", tt.target, nil))
+		if rec.Code != http.StatusMovedPermanently || rec.Header().Get("Location") != tt.want {
+			t.Errorf("PORT=%s GET %s = %d to %q, want 301 to %q", tt.port, tt.target, rec.Code, rec.Header().Get("Location"), tt.want)
+		}
+	}
+}
+
+func TestResolveListenAddr(t *testing.T) {
+	tests := []struct {
+		addr    string
+		port    string
+		want    string
+		wantErr bool
+	}{
+		{"", "8080", ":8080", false},
+		{"127.0.0.1:9000", "8080", "127.0.0.1:9000", false},
+		{"0.0.0.0:9000", "", "0.0.0.0:9000", false},
+		{"[::1]:9000", "8080", "[::1]:9000", false},
+		{"localhost:0", "8080", "localhost:0", false},
+		{"127.0.0.1", "8080", "", true},
+		{"127.0.0.1:http", "8080", "", true},
+		{"127.0.0.1:70000", "8080", "", true},
+		{"", "eighty", "", true},
+		{"", "", "", true},
+	}
+
+	for _, tt := range tests {
+		got, err := resolveListenAddr(tt.addr, tt.port)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("resolveListenAddr(%q, %q) = %q, %v, want %q (error %v)", tt.addr, tt.port, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestArticleURLRejectsEscapes(t *testing.T) {
+	setGlobal(t, &baseURL, "https://grokipedia.com")
+
+	tests := []string{
+		"//evil.com",
+		"//evil.com/page/Foo",
+		"https://evil.com",
+		"https://evil.com/page/Foo",
+		"http:/evil.com",
+		"javascript:/alert(1)",
+		"../etc/passwd",
+		"page/../../admin",
+		"page/%2e%2e/admin",
+		"page/./Foo",
+		"\\\\evil.com",
+		"page/Foo\r\nHost: evil.com",
+	}
+
+	for _, in := range tests {
+		if got, err := articleURL(in); !errors.Is(err, ErrInvalidPath) {
+			t.Errorf("articleURL(%q) = %q, %v, want ErrInvalidPath", in, got, err)
+		}
+	}
+}
+
+func TestSlugs(t *testing.T) {
+	titles := []struct {
+		title string
+		want  string
+	}{
+		{"Foo Bar", "Foo_Bar"},
+		{"  Foo Bar  ", "Foo_Bar"},
+		{"Café au lait", "Caf%C3%A9_au_lait"},
+		{"C++", "C++"},
+		{"AC/DC", "AC%2FDC"},
+		{"What? Why!", "What%3F_Why%21"},
+		{"100% Pure", "100%25_Pure"},
+	}
+	for _, tt := range titles {
+		if got := titleSlug(tt.title); got != tt.want {
+			t.Errorf("titleSlug(%q) = %q, want %q", tt.title, got, tt.want)
+		}
+	}
+
+	urls := []struct {
+		url  string
+		want string
+	}{
+		{"https://grokipedia.com/page/Foo_Bar", "Foo_Bar"},
+		{"https://grokipedia.com/page/Foo_Bar/", "Foo_Bar"},
+		{"https://grokipedia.com/page/Caf%C3%A9_au_lait", "Caf%C3%A9_au_lait"},
+		{"https://grokipedia.com/page/Café_au_lait", "Caf%C3%A9_au_lait"},
+		{"https://grokipedia.com/page/AC%2FDC", "AC%2FDC"},
+		{"https://grokipedia.com/page/Foo_Bar?rev=2#History", "Foo_Bar"},
+		{"https://grokipedia.com/id/12345", ""},
+		{"https://grokipedia.com/", ""},
+	}
+	for _, tt := range urls {
+		if got := articleSlug(tt.url); got != tt.want {
+			t.Errorf("articleSlug(%q) = %q, want %q", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestArticleSlug(t *testing.T) {
+	page := func(title string) string { return articlePage("", "<h1>"+title+"</h1><p>"+longParagraph+"</p>") }
+	stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/page/Old_Name":
+			http.Redirect(w, r, "/page/New_Name", http.StatusMovedPermanently)
+		case "/wiki/Elsewhere":
+			// Served outside /page/, so only the title names it
+			w.Write([]byte(page("AC/DC & Friends")))
+		default:
+			pages{
+				"/page/Café_au_lait": page("Café au lait"),
+				"/page/New_Name":     page("New Name"),
+				"/page/C++":          page("C++"),
+			}.ServeHTTP(w, r)
+		}
+	}))
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"Caf%C3%A9%20au%20lait", "Caf%C3%A9_au_lait"},
+		{"page/Caf%C3%A9_au_lait", "Caf%C3%A9_au_lait"},
+		{"C++", "C++"},
+		{"Old_Name", "New_Name"},
+		{"wiki/Elsewhere", "AC%2FDC_&_Friends"},
+	}
+
+	for _, tt := range tests {
+		rec := request(t, "GET", "/api/article/"+tt.path, nil)
+		var article Article
+		if err := json.Unmarshal(rec.Body.Bytes(), &article); err != nil || rec.Code != http.StatusOK {
+			t.Errorf("GET /api/article/%s = %d %s", tt.path, rec.Code, rec.Body.String())
+			continue
+		}
+		if article.Slug != tt.want {
+			t.Errorf("GET /api/article/%s: slug = %q, want %q", tt.path, article.Slug, tt.want)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// decodeError reads an ErrorResponse body, failing the test if it is not one
+func decodeError(t *testing.T, rec *httptest.ResponseRecorder) ErrorResponse {
+	t.Helper()
+	var body ErrorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("body %q is not an ErrorResponse: %v", rec.Body.String(), err)
+	}
+	return body
+}
+
+func TestRecoveryMiddleware(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/panic/string", func(w http.ResponseWriter, r *http.Request) { panic("boom") })
+	mux.HandleFunc("/panic/error", func(w http.ResponseWriter, r *http.Request) { panic(errors.New("boom")) })
+	mux.HandleFunc("/panic/nil-map", func(w http.ResponseWriter, r *http.Request) {
+		var m map[string]int
+		m["x"]++
+	})
+	mux.HandleFunc("/panic/abort", func(w http.ResponseWriter, r *http.Request) { panic(http.ErrAbortHandler) })
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, "ok") })
+
+	server := httptest.NewServer(recoveryMiddleware(mux))
+	defer server.Close()
+
+	for _, path := range []string{"/panic/string", "/panic/error", "/panic/nil-map"} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		var body ErrorResponse
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusInternalServerError || err != nil || body.Code != codeInternalError {
+			t.Errorf("GET %s = %d %+v (%v), want 500 with code %s", path, resp.StatusCode, body, err, codeInternalError)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("GET %s Content-Type = %q, want application/json", path, ct)
+		}
+	}
+
+	// A deliberate abort still drops the connection without a response
+	if resp, err := http.Get(server.URL + "/panic/abort"); err == nil {
+		resp.Body.Close()
+		t.Errorf("GET /panic/abort = %d, want the connection dropped", resp.StatusCode)
+	}
+
+	// The server keeps serving after the panics
+	resp, err := http.Get(server.URL + "/ok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /ok after panics = %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestBodyLimitMiddleware(t *testing.T) {
+	setGlobal(t, &maxRequestBytes, 64)
+	handler := bodyLimitMiddleware(newRouter(""))
+
+	oversized := `{"queries":["` + strings.Repeat("a", 100) + `"]}`
+	tests := []struct {
+		name          string
+		method        string
+		target        string
+		body          string
+		contentLength int64
+		wantStatus    int
+	}{
+		{"declared oversized", "POST", "/api/search/batch", oversized, int64(len(oversized)), http.StatusRequestEntityTooLarge},
+		{"chunked oversized", "POST", "/api/search/batch", oversized, -1, http.StatusRequestEntityTooLarge},
+		{"oversized article request", "POST", "/api/article", `{"path":"` + strings.Repeat("a", 100) + `"}`, -1, http.StatusRequestEntityTooLarge},
+		{"within the limit", "POST", "/api/search/batch", `{"queries":[]}`, 14, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+		req.ContentLength = tt.contentLength
+		rec := serve(t, handler, req)
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%s: %s %s = %d, want %d", tt.name, tt.method, tt.target, rec.Code, tt.wantStatus)
+			continue
+		}
+		if tt.wantStatus == http.StatusRequestEntityTooLarge {
+			if body := decodeError(t, rec); body.Code != codePayloadTooLarge {
+				t.Errorf("%s: code = %q, want %q", tt.name, body.Code, codePayloadTooLarge)
+			}
+		}
+	}
+
+	// Methods without a body are passed through untouched
+	var read int
+	passthrough := bodyLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		read = len(data)
+	}))
+	serve(t, passthrough, httptest.NewRequest("GET", "/", strings.NewReader(oversized)))
+	if read != len(oversized) {
+		t.Errorf("GET body read %d bytes, want all %d", read, len(oversized))
+	}
+}
+
+func TestTimeoutMiddleware(t *testing.T) {
+	setGlobal(t, &serverRequestTimeout, 20*time.Millisecond)
+	setGlobal(t, &routePrefix, "/v1")
+	slow := timeoutMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(60 * time.Millisecond)
+		fmt.Fprint(w, "done")
+	}))
+
+	tests := []struct {
+		name       string
+		target     string
+		pprof      bool
+		wantStatus int
+	}{
+		{"slow handler", "/v1/api/article/Foo", false, http.StatusGatewayTimeout},
+		{"streaming search", "/v1/api/search/stream?q=foo", false, http.StatusOK},
+		{"CPU profile", "/v1/debug/pprof/profile?seconds=1", true, http.StatusOK},
+		{"trace", "/v1/debug/pprof/trace", true, http.StatusOK},
+		{"profile with pprof off", "/v1/debug/pprof/profile", false, http.StatusGatewayTimeout},
+		{"profile outside the prefix", "/debug/pprof/profile", true, http.StatusGatewayTimeout},
+	}
+
+	for _, tt := range tests {
+		setGlobal(t, &enablePprof, tt.pprof)
+		rec := serve(t, slow, httptest.NewRequest("GET", tt.target, nil))
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%s: GET %s = %d, want %d", tt.name, tt.target, rec.Code, tt.wantStatus)
+			continue
+		}
+		if tt.wantStatus == http.StatusGatewayTimeout {
+			if body := decodeError(t, rec); body.Code != codeRequestTimeout {
+				t.Errorf("%s: code = %q, want %q", tt.name, body.Code, codeRequestTimeout)
+			}
+		} else if rec.Body.String() != "done" {
+			t.Errorf("%s: body = %q, want the handler's", tt.name, rec.Body.String())
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.0.0.0/8, 192.168.1.1, fd00::/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setGlobal(t, &trustedProxies, proxies)
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		realIP     string
+		want       string
+	}{
+		{"direct client", "203.0.113.7:4711", nil, "", "203.0.113.7"},
+		{"direct IPv6 client", "[::1]:1234", nil, "", "::1"},
+		{"bracketed forwarded IPv6 client", "10.1.2.3:80", []string{"[2001:db8::7]:5555 , 10.9.9.9"}, "", "2001:db8::7"},
+		{"untrusted peer spoofing X-Forwarded-For", "203.0.113.7:4711", []string{"198.51.100.1"}, "", "203.0.113.7"},
+		{"untrusted peer spoofing X-Real-IP", "203.0.113.7:4711", nil, "198.51.100.1", "203.0.113.7"},
+		{"trusted proxy", "10.1.2.3:80", []string{"198.51.100.1"}, "", "198.51.100.1"},
+		{"trusted single IP", "192.168.1.1:80", []string{"198.51.100.1"}, "", "198.51.100.1"},
+		{"untrusted neighbour of a trusted IP", "192.168.1.2:80", []string{"198.51.100.1"}, "", "192.168.1.2"},
+		{"spoofed entry left of the real client", "10.1.2.3:80", []string{"1.1.1.1, 198.51.100.1"}, "", "198.51.100.1"},
+		{"chain of trusted proxies", "10.1.2.3:80", []string{"198.51.100.1, 10.9.9.9", "192.168.1.1"}, "", "198.51.100.1"},
+		{"IPv6 proxy", "[fd00::1]:443", []string{"2001:db8::7"}, "", "2001:db8::7"},
+		{"only trusted hops", "10.1.2.3:80", []string{"10.9.9.9"}, "", "10.1.2.3"},
+		{"X-Real-IP from a trusted proxy", "10.1.2.3:80", nil, "198.51.100.1", "198.51.100.1"},
+		{"X-Forwarded-For over X-Real-IP", "10.1.2.3:80", []string{"198.51.100.1"}, "198.51.100.2", "198.51.100.1"},
+		{"garbled hop ends the chain", "10.1.2.3:80", []string{"198.51.100.1, garbage"}, "", "10.1.2.3"},
+		{"garbled hop falls back to X-Real-IP", "10.1.2.3:80", []string{"garbage"}, "198.51.100.2", "198.51.100.2"},
+		{"unix socket", "@", []string{"198.51.100.1"}, "", "@"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tt.remoteAddr
+		for _, value := range tt.forwarded {
+			req.Header.Add("X-Forwarded-For", value)
+		}
+		if tt.realIP != "" {
+			req.Header.Set("X-Real-IP", tt.realIP)
+		}
+		if got := clientIP(req); got != tt.want {
+			t.Errorf("%s: clientIP = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	// Without TRUSTED_PROXIES no forwarding header is believed
+	setGlobal(t, &trustedProxies, nil)
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.1.2.3:80"
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	if got := clientIP(req); got != "10.1.2.3" {
+		t.Errorf("clientIP without trusted proxies = %q, want the peer", got)
+	}
+}
+
+func TestParseClientIP(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string // "" when value is not an address
+	}{
+		{"203.0.113.7", "203.0.113.7"},
+		{"203.0.113.7:4711", "203.0.113.7"},
+		{" 203.0.113.7 ", "203.0.113.7"},
+		{"2001:db8::1", "2001:db8::1"},
+		{"[2001:db8::1]:443", "2001:db8::1"},
+		{"[::1]:1234", "::1"},
+		{"[::1]", "::1"},
+		{"fe80::1%eth0", "fe80::1"},
+		{"[fe80::1%eth0]:80", "fe80::1"},
+		// IPv4-mapped IPv6 is the IPv4 client it wraps
+		{"::ffff:203.0.113.7", "203.0.113.7"},
+		{"[::ffff:203.0.113.7]:80", "203.0.113.7"},
+		{"", ""},
+		{"garbage", ""},
+		{"[::1", ""},
+		{"203.0.113.7:http", ""},
+		// One hop at a time: clientIP splits forwarded chains
+		{"198.51.100.1, 10.9.9.9", ""},
+	}
+
+	for _, tt := range tests {
+		addr, err := parseClientIP(tt.value)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("parseClientIP(%q) = %v, want an error", tt.value, addr)
+			}
+			continue
+		}
+		if err != nil || addr.String() != tt.want {
+			t.Errorf("parseClientIP(%q) = %v, %v, want %s", tt.value, addr, err, tt.want)
+		}
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	prefixes, err := parseTrustedProxies(" 10.1.2.3/8, 192.168.1.1 ,::ffff:172.16.0.1, fd00::/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, prefix := range prefixes {
+		got = append(got, prefix.String())
+	}
+	if want := []string{"10.0.0.0/8", "192.168.1.1/32", "172.16.0.1/32", "fd00::/8"}; !slices.Equal(got, want) {
+		t.Errorf("parseTrustedProxies = %q, want %q", got, want)
+	}
+
+	for _, value := range []string{"10.0.0.0/33", "proxy.internal", "10.0.0"} {
+		if _, err := parseTrustedProxies(value); err == nil {
+			t.Errorf("parseTrustedProxies(%q) succeeded, want an error", value)
+		}
+	}
+}
+
+func TestCORSMiddleware(t *testing.T) {
+	var served int
+	handler := corsMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served++
+		w.Header().Set("X-Cache", "BYPASS")
+		w.Write([]byte("ok"))
+	}))
+
+	tests := []struct {
+		method string
+		want   int
+		served bool
+	}{
+		// A preflight is answered without reaching the handler
+		{"OPTIONS", http.StatusOK, false},
+		{"GET", http.StatusOK, true},
+		{"POST", http.StatusOK, true},
+	}
+
+	for _, tt := range tests {
+		served = 0
+		req := httptest.NewRequest(tt.method, "/api/article/Foo", nil)
+		req.Header.Set("Origin", "https://example.org")
+		if tt.method == "OPTIONS" {
+			req.Header.Set("Access-Control-Request-Method", "GET")
+			req.Header.Set("Access-Control-Request-Headers", "cache-control, pragma")
+		}
+		rec := serve(t, handler, req)
+
+		if rec.Code != tt.want || (served > 0) != tt.served {
+			t.Errorf("%s = %d, served %d times", tt.method, rec.Code, served)
+		}
+		if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+			t.Errorf("%s: Access-Control-Allow-Origin = %q", tt.method, got)
+		}
+		// Browsers may send the headers that ask for a fresh fetch ...
+		allowed := strings.Split(rec.Header().Get("Access-Control-Allow-Headers"), ", ")
+		for _, name := range []string{"Content-Type", "Cache-Control", "Pragma"} {
+			if !slices.Contains(allowed, name) {
+				t.Errorf("%s: Access-Control-Allow-Headers %q lacks %s", tt.method, allowed, name)
+			}
+		}
+		// ... and read whether they got one
+		if got := rec.Header().Get("Access-Control-Expose-Headers"); got != "X-Cache" {
+			t.Errorf("%s: Access-Control-Expose-Headers = %q, want X-Cache", tt.method, got)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// openAPIDoc is the part of an OpenAPI 3 document the tests check
+type openAPIDoc struct {
+	OpenAPI string `json:"openapi"`
+	Info    struct {
+		Title   string `json:"title"`
+		Version string `json:"version"`
+	} `json:"info"`
+	Servers []struct {
+		URL string `json:"url"`
+	} `json:"servers"`
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		Schemas map[string]struct {
+			Properties map[string]json.RawMessage `json:"properties"`
+		} `json:"schemas"`
+	} `json:"components"`
+}
+
+// refPattern matches the local references of an OpenAPI document
+var refPattern = regexp.MustCompile(`"\$ref":\s*"#/([^"]+)"`)
+
+func TestOpenAPISpec(t *testing.T) {
+	rec := request(t, "GET", "/openapi.json", nil)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("GET /openapi.json = %d %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+
+	var doc openAPIDoc
+	if err := json.Unmarshal(rec.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("spec is not valid JSON: %v", err)
+	}
+	if !strings.HasPrefix(doc.OpenAPI, "3.") || doc.Info.Title == "" || doc.Info.Version == "" || len(doc.Paths) == 0 {
+		t.Fatalf("spec lacks the required OpenAPI 3 fields: openapi %q, info %+v, %d paths", doc.OpenAPI, doc.Info, len(doc.Paths))
+	}
+
+	methods := map[string]bool{"get": true, "post": true, "put": true, "delete": true, "head": true, "options": true, "patch": true, "parameters": true}
+	for path, ops := range doc.Paths {
+		for method, op := range ops {
+			if !methods[method] {
+				t.Errorf("%s has unknown operation %q", path, method)
+				continue
+			}
+			var operation struct {
+				Responses map[string]json.RawMessage `json:"responses"`
+			}
+			if method != "parameters" && (json.Unmarshal(op, &operation) != nil || len(operation.Responses) == 0) {
+				t.Errorf("%s %s has no responses", method, path)
+			}
+		}
+	}
+
+	// Every reference must resolve
+	var raw map[string]any
+	json.Unmarshal(rec.Body.Bytes(), &raw)
+	for _, match := range refPattern.FindAllStringSubmatch(rec.Body.String(), -1) {
+		var node any = raw
+		for _, key := range strings.Split(match[1], "/") {
+			object, ok := node.(map[string]any)
+			if !ok {
+				node = nil
+				break
+			}
+			node = object[key]
+		}
+		if node == nil {
+			t.Errorf("reference #/%s does not resolve", match[1])
+		}
+	}
+}
+
+// TestOpenAPISchemasMatchStructs keeps the documented schemas in step with
+// the JSON the response structs produce
+func TestOpenAPISchemasMatchStructs(t *testing.T) {
+	var doc openAPIDoc
+	if err := json.Unmarshal(openAPISpec, &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	structs := map[string]any{
+		"Article":                Article{},
+		"ArticleRequest":         ArticleRequest{},
+		"ArticleSummary":         ArticleSummary{},
+		"SearchResult":           SearchResult{},
+		"BatchSearchRequest":     BatchSearchRequest{},
+		"BatchSearchResult":      BatchSearchResult{},
+		"ErrorResponse":          ErrorResponse{},
+		"HealthResponse":         HealthResponse{},
+		"LivenessResponse":       LivenessResponse{},
+		"VersionResponse":        VersionResponse{},
+		"ReadinessResponse":      ReadinessResponse{},
+		"CheckResult":            CheckResult{},
+		"Section":                Section{},
+		"Block":                  Block{},
+		"Timing":                 Timing{},
+		"DisambiguationResponse": DisambiguationResponse{},
+		"DisambiguationOption":   DisambiguationOption{},
+		"WatchRequest":           WatchRequest{},
+		"Watch":                  Watch{},
+		"WebhookPayload":         WebhookPayload{},
+		"CacheStats":             CacheStats{},
+		"StatsResponse":          StatsResponse{},
+		"ReloadResponse":         ReloadResponse{},
+	}
+
+	for name, v := range structs {
+		schema, ok := doc.Components.Schemas[name]
+		if !ok {
+			t.Errorf("schema %s is missing", name)
+			continue
+		}
+		documented := slices.Sorted(maps.Keys(schema.Properties))
+		actual := slices.Sorted(maps.Keys(jsonFieldNames(v)))
+		if !slices.Equal(documented, actual) {
+			t.Errorf("schema %s has properties %q, the struct encodes %q", name, documented, actual)
+		}
+	}
+}
+
+func TestOpenAPIServerURL(t *testing.T) {
+	spec, err := withServerURL(openAPISpec, "/grok")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var doc openAPIDoc
+	if err := json.Unmarshal(spec, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.Servers) != 1 || doc.Servers[0].URL != "/grok/" {
+		t.Errorf("servers = %+v, want /grok/", doc.Servers)
+	}
+	if len(doc.Paths) == 0 {
+		t.Error("paths were lost")
+	}
+}
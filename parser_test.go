@@ -0,0 +1,1454 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// parseFixture parses an HTML fixture as if it had been fetched from pageURL
+func parseFixture(t *testing.T, html, pageURL string) *goquery.Document {
+	t.Helper()
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(html))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pageURL != "" {
+		if doc.Url, err = url.Parse(pageURL); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return doc
+}
+
+const linksFixture = `<article>
+<p>See <a href="/page/Foo">Foo</a>, <a href="Bar">Bar</a> and <a href="https://grokipedia.com/page/Foo">Foo again</a>.</p>
+<p>Sources: <a href="https://example.com/source">a source</a>, <a href="http://example.org/">another</a>, <a href="https://example.com/source">the first again</a>.</p>
+<p>Jump to <a href="#history">History</a> or <a href="#history">History</a>, <a href="#">top</a>.</p>
+<p><a href="mailto:someone@example.com">Mail</a> <a href="javascript:void(0)">Script</a> <a href="">Empty</a></p>
+</article>`
+
+func TestExtractLinks(t *testing.T) {
+	setGlobal(t, &baseURL, "https://grokipedia.com")
+	doc := parseFixture(t, linksFixture, "https://grokipedia.com/page/Start")
+
+	internal, external, anchors := extractLinks(doc.Find("article"), doc.Url)
+
+	tests := []struct {
+		name string
+		got  []string
+		want []string
+	}{
+		{"internal", internal, []string{"https://grokipedia.com/page/Foo", "https://grokipedia.com/page/Bar"}},
+		{"external", external, []string{"https://example.com/source", "http://example.org/"}},
+		{"anchors", anchors, []string{"#history"}},
+	}
+	for _, tt := range tests {
+		if !slices.Equal(tt.got, tt.want) {
+			t.Errorf("%s links = %q, want %q", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestTruncateAtWord(t *testing.T) {
+	tests := []struct {
+		text     string
+		maxChars int
+		want     string
+	}{
+		{"The quick brown fox", 0, "The quick brown fox"},
+		{"The quick brown fox", 19, "The quick brown fox"},
+		{"The quick brown fox", 18, "The quick brown…"},
+		{"The quick brown fox", 12, "The quick…"},
+		{"The quick, brown fox", 12, "The quick…"},
+		{"Supercalifragilistic", 10, "Supercali…"},
+		{"Ünïcödé wörds hérè", 10, "Ünïcödé…"},
+	}
+
+	for _, tt := range tests {
+		got := truncateAtWord(tt.text, tt.maxChars)
+		if got != tt.want {
+			t.Errorf("truncateAtWord(%q, %d) = %q, want %q", tt.text, tt.maxChars, got, tt.want)
+		}
+		if tt.maxChars > 0 && utf8.RuneCountInString(got) > tt.maxChars {
+			t.Errorf("truncateAtWord(%q, %d) = %q is longer than the limit", tt.text, tt.maxChars, got)
+		}
+	}
+}
+
+func TestFirstSentences(t *testing.T) {
+	tests := []struct {
+		text string
+		n    int
+		want string
+	}{
+		{"One. Two. Three.", 0, "One. Two. Three."},
+		{"One. Two. Three.", 1, "One."},
+		{"One. Two. Three.", 2, "One. Two."},
+		{"One. Two. Three.", 5, "One. Two. Three."},
+		{"Is it? Yes! Done.", 2, "Is it? Yes!"},
+		{"Dr. Smith met Mr. Jones. They talked.", 1, "Dr. Smith met Mr. Jones."},
+		{"It uses e.g. tests, i.e. checks. More here.", 1, "It uses e.g. tests, i.e. checks."},
+		{"J. R. R. Tolkien wrote books. He was English.", 1, "J. R. R. Tolkien wrote books."},
+		{`He said "stop." Then left.`, 1, `He said "stop."`},
+		{"No terminator at all", 1, "No terminator at all"},
+	}
+
+	for _, tt := range tests {
+		if got := firstSentences(tt.text, tt.n); got != tt.want {
+			t.Errorf("firstSentences(%q, %d) = %q, want %q", tt.text, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestTruncateBytes(t *testing.T) {
+	tests := []struct {
+		text          string
+		maxBytes      int
+		want          string
+		wantTruncated bool
+	}{
+		{"hello", 0, "hello", false},
+		{"hello", 5, "hello", false},
+		{"hello", 4, "hell", true},
+		{"héllo", 2, "h", true},
+		{"héllo", 3, "hé", true},
+		{"日本語", 5, "日", true},
+		{"日本語", 6, "日本", true},
+		{"日本語", 2, "", true},
+	}
+
+	for _, tt := range tests {
+		got, truncated := truncateBytes(tt.text, tt.maxBytes)
+		if got != tt.want || truncated != tt.wantTruncated {
+			t.Errorf("truncateBytes(%q, %d) = %q, %v, want %q, %v", tt.text, tt.maxBytes, got, truncated, tt.want, tt.wantTruncated)
+		}
+		if !utf8.ValidString(got) {
+			t.Errorf("truncateBytes(%q, %d) = %q is not valid UTF-8", tt.text, tt.maxBytes, got)
+		}
+	}
+}
+
+// sectionsFixture is an article body; articlePage adds the <article> root
+const sectionsFixture = `<h1>Foo</h1>
+<p>Foo is a placeholder name.</p>
+<h2>History</h2>
+<p>It was first used in the 1930s.</p>
+<p>It spread through early computing.</p>
+<h3>Early use</h3>
+<ul><li>Military slang</li><li>Cartoons</li></ul>
+<h2>See also</h2>
+<p>Bar and baz.</p>`
+
+func TestSections(t *testing.T) {
+	stubUpstream(t, pages{"/page/Foo": articlePage("", sectionsFixture)})
+
+	article, err := getArticle(context.Background(), "Foo", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Section{
+		{Heading: "", Level: 0, Paragraphs: []string{"Foo is a placeholder name."}},
+		{Heading: "History", Level: 2, Paragraphs: []string{"It was first used in the 1930s.", "It spread through early computing."}},
+		{Heading: "Early use", Level: 3, Paragraphs: []string{"Military slang", "Cartoons"}},
+		{Heading: "See also", Level: 2, Paragraphs: []string{"Bar and baz."}},
+	}
+	if !slices.EqualFunc(article.Sections, want, func(a, b Section) bool {
+		return a.Heading == b.Heading && a.Level == b.Level && slices.Equal(a.Paragraphs, b.Paragraphs)
+	}) {
+		t.Errorf("sections = %+v, want %+v", article.Sections, want)
+	}
+
+	// Sections are only sent when asked for
+	for query, wantSections := range map[string]bool{"": false, "?structured=true": true} {
+		var body map[string]any
+		if err := json.Unmarshal(request(t, "GET", "/api/article/Foo"+query, nil).Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := body["sections"]; ok != wantSections {
+			t.Errorf("GET /api/article/Foo%s has sections = %v, want %v", query, ok, wantSections)
+		}
+	}
+}
+
+func TestLastUpdatedFromText(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"Last updated: 2024-03-05", "2024-03-05T00:00:00Z"},
+		{"Last edited 2024-03-05T14:30:00+02:00 by someone", "2024-03-05T14:30:00+02:00"},
+		{"last modified on March 5, 2024", "2024-03-05T00:00:00Z"},
+		{"Last updated Mar. 5, 2024", "2024-03-05T00:00:00Z"},
+		{"Last updated 5 March 2024", "2024-03-05T00:00:00Z"},
+		{"Last updated 03/05/2024", "2024-03-05T00:00:00Z"},
+		{"Last\n  updated:\n March 5 2024", "2024-03-05T00:00:00Z"},
+		// An unparseable match is skipped in favour of a later one
+		{"Last updated Smarch 5, 2024. Last edited 2024-03-06", "2024-03-06T00:00:00Z"},
+		{"Last updated 2024-13-45", ""},
+		{"Published March 5, 2024", ""},
+		{strings.Repeat("x", lastUpdatedScanLimit) + " Last updated 2024-03-05", ""},
+	}
+
+	for _, tt := range tests {
+		if got := lastUpdatedFromText(tt.text); got != tt.want {
+			t.Errorf("lastUpdatedFromText(%.40q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestPageLastUpdated(t *testing.T) {
+	tests := []struct {
+		name string
+		page string
+		want string
+	}{
+		{"meta tag wins", articlePage(`<meta property="article:modified_time" content="2024-01-01T00:00:00Z">`, "<p>Last updated March 5, 2024</p>"), "2024-01-01T00:00:00Z"},
+		{"article text", articlePage("", "<p class=\"meta\">Last updated March 5, 2024</p><p>"+longParagraph+"</p>"), "2024-03-05T00:00:00Z"},
+		{"outside the article", `<html><body><header>Last edited 5 Mar 2024</header><article><p>` + longParagraph + `</p></article></body></html>`, "2024-03-05T00:00:00Z"},
+		{"none", articlePage("", "<p>"+longParagraph+"</p>"), ""},
+	}
+
+	for _, tt := range tests {
+		doc := parseFixture(t, tt.page, "")
+		if got := pageLastUpdated(doc, doc.Find("article")); got != tt.want {
+			t.Errorf("%s: pageLastUpdated = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDedupKey(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"Hello, World!", "hello world"},
+		{"  hello   world  ", "hello world"},
+		{"HELLO - world...", "hello world"},
+		{"Café №5", "café 5"},
+		{"!!!", ""},
+	}
+
+	for _, tt := range tests {
+		if got := dedupKey(tt.text); got != tt.want {
+			t.Errorf("dedupKey(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestDedupFuzzy(t *testing.T) {
+	body := `<p>Share this article on social media.</p>
+<p>` + longParagraph + `</p>
+<p>SHARE this article on social media!</p>
+<p>share this article, on social media</p>
+<p>Share this article on social networks.</p>`
+	stubUpstream(t, pages{"/page/Foo": articlePage("", body)})
+
+	tests := []struct {
+		env  map[string]string
+		want []string
+	}{
+		{nil, []string{
+			"Share this article on social media.",
+			longParagraph,
+			"SHARE this article on social media!",
+			"share this article, on social media",
+			"Share this article on social networks.",
+		}},
+		// Near-duplicates collapse into the first; a different line is kept
+		{map[string]string{"DEDUP_FUZZY": "true"}, []string{
+			"Share this article on social media.",
+			longParagraph,
+			"Share this article on social networks.",
+		}},
+	}
+
+	for _, tt := range tests {
+		setConfig(t, parserSettings(tt.env))
+		article, err := getArticle(context.Background(), "Foo", "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Split(article.Content, defaultContentSeparator); !slices.Equal(got, tt.want) {
+			t.Errorf("%v: content = %q, want %q", tt.env, got, tt.want)
+		}
+	}
+}
+
+// customMarkupPage is a page laid out the way the SELECTOR_* overrides in
+// TestCustomSelectors expect, with none of the default markup
+const customMarkupPage = `<!DOCTYPE html><html lang="en"><head><title>Test page</title></head><body>
+<div id="content">
+<h1>Foo</h1>
+<span class="prose-text">Foo is a placeholder name used throughout computer programming examples.</span>
+<dl class="facts"><dt>Coined</dt><dd>1930s</dd></dl>
+</div>
+<div class="tags"><a href="/category/Placeholders">Placeholders</a></div>
+</body></html>`
+
+func TestCustomSelectors(t *testing.T) {
+	stubUpstream(t, pages{"/page/Foo": customMarkupPage})
+	setConfig(t, parserSettings(map[string]string{
+		"SELECTOR_ARTICLE_ROOT":    "#content",
+		"SELECTOR_CATEGORY":        ".tags a",
+		"SELECTOR_INFOBOX":         ".facts",
+		"SELECTOR_SUMMARY_CLASSES": "prose-text",
+	}))
+
+	article, err := getArticle(context.Background(), "Foo", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "Foo is a placeholder name used throughout computer programming examples."
+	if article.Title != "Foo" || article.Summary != want {
+		t.Errorf("title %q, summary %q, want Foo and %q", article.Title, article.Summary, want)
+	}
+	if !slices.Equal(article.Categories, []string{"Placeholders"}) {
+		t.Errorf("categories = %q, want [Placeholders]", article.Categories)
+	}
+	if article.Infobox["Coined"] != "1930s" {
+		t.Errorf("infobox = %v, want Coined: 1930s", article.Infobox)
+	}
+	if strings.Contains(article.Content, "1930s") {
+		t.Errorf("content %q repeats the infobox", article.Content)
+	}
+
+	// The default selectors find none of it
+	setConfig(t, parserSettings(nil))
+	resetState(t)
+	if article, err := getArticle(context.Background(), "Foo", "", ""); err == nil && (article.Summary == want || len(article.Categories) > 0) {
+		t.Errorf("default selectors parsed the custom markup: %+v", article)
+	}
+}
+
+const disambiguationFixture = `<h1>Mercury</h1>
+<p>Mercury may refer to:</p>
+<ul>
+<li><a href="/page/Mercury_(planet)">Mercury (planet)</a>, the closest planet to the Sun</li>
+<li><a href="/page/Mercury_(element)">Mercury (element)</a>, a chemical element</li>
+<li><a href="/page/Mercury_(mythology)">Mercury (mythology)</a>, a Roman god</li>
+<li><a href="https://example.com/mercury">Mercury</a>, an external site</li>
+</ul>`
+
+func TestIsDisambiguation(t *testing.T) {
+	parser := defaultParserConfig()
+	tests := []struct {
+		name string
+		body string
+		want bool
+	}{
+		{"disambiguation page", disambiguationFixture, true},
+		{"article", "<h1>Mercury (planet)</h1><p>" + longParagraph + "</p><ul><li><a href=\"/page/Sun\">Sun</a></li><li><a href=\"/page/Venus\">Venus</a></li></ul>", false},
+		{"phrase without options", "<h1>Mercury</h1><p>Mercury may refer to several things.</p><p>" + longParagraph + "</p>", false},
+		{"options in a long article", disambiguationFixture + "<p>" + strings.Repeat(longParagraph, 20) + "</p>", false},
+	}
+
+	for _, tt := range tests {
+		doc := parseFixture(t, articlePage("", tt.body), "https://grokipedia.com/page/Mercury")
+		if got := parser.isDisambiguation(doc); got != tt.want {
+			t.Errorf("%s: isDisambiguation = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDisambiguationResponse(t *testing.T) {
+	stubUpstream(t, pages{
+		"/page/Mercury":          articlePage("", disambiguationFixture),
+		"/page/Mercury_(planet)": articlePage("", "<h1>Mercury (planet)</h1><p>"+longParagraph+"</p>"),
+	})
+
+	rec := request(t, "GET", "/api/article/Mercury", nil)
+	if rec.Code != http.StatusMultipleChoices {
+		t.Fatalf("GET /api/article/Mercury = %d, want 300", rec.Code)
+	}
+	var body DisambiguationResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	var titles []string
+	for _, option := range body.Options {
+		titles = append(titles, option.Title)
+		if !strings.HasPrefix(option.URL, baseURL+"/page/Mercury_") {
+			t.Errorf("option URL %q is not an absolute Grokipedia URL", option.URL)
+		}
+	}
+	if want := []string{"Mercury (planet)", "Mercury (element)", "Mercury (mythology)"}; !body.Disambiguation || body.Title != "Mercury" || !slices.Equal(titles, want) {
+		t.Errorf("response = %+v, want options %q", body, want)
+	}
+
+	if rec := request(t, "GET", "/api/article/Mercury_(planet)", nil); rec.Code != http.StatusOK {
+		t.Errorf("GET /api/article/Mercury_(planet) = %d, want 200", rec.Code)
+	}
+}
+
+func TestExtractInfobox(t *testing.T) {
+	tests := []struct {
+		name string
+		html string
+		want map[string]string
+	}{
+		{"table", `<table class="infobox">
+<tr><th colspan="2">Ada Lovelace</th></tr>
+<tr><th>Born:</th><td> 10 December
+ 1815 </td></tr>
+<tr><th>Died</th><td>27 November 1852</td></tr>
+<tr><th>Known for</th><td>Analytical Engine</td></tr>
+</table>`, map[string]string{"Born": "10 December 1815", "Died": "27 November 1852", "Known for": "Analytical Engine"}},
+		{"definition list", `<dl class="infobox"><dt>Founded</dt><dd>1998</dd><dt>Founder </dt><dd>Someone</dd><dt>Headquarters</dt><dd>Earth</dd><dt>Empty</dt><dd></dd></dl>`,
+			map[string]string{"Founded": "1998", "Founder": "Someone", "Headquarters": "Earth"}},
+		{"first label wins", `<table class="infobox"><tr><th>Born</th><td>1815</td></tr><tr><th>Born</th><td>later</td></tr></table>`,
+			map[string]string{"Born": "1815"}},
+		{"no facts", `<table class="infobox"><tr><td>Just one cell</td></tr></table>`, nil},
+	}
+
+	for _, tt := range tests {
+		doc := parseFixture(t, tt.html, "")
+		if got := extractInfobox(doc.Find(".infobox")); !maps.Equal(got, tt.want) {
+			t.Errorf("%s: extractInfobox = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestArticleInfobox(t *testing.T) {
+	body := `<h1>Ada Lovelace</h1>
+<table class="infobox">
+<tr><th>Born</th><td>10 December 1815</td></tr>
+<tr><th>Died</th><td>27 November 1852</td></tr>
+<tr><th>Known for</th><td>Analytical Engine</td></tr>
+</table>
+<p>` + longParagraph + `</p>`
+	stubUpstream(t, pages{"/page/Ada_Lovelace": articlePage("", body)})
+
+	article, err := getArticle(context.Background(), "Ada_Lovelace", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"Born": "10 December 1815", "Died": "27 November 1852", "Known for": "Analytical Engine"}
+	if !maps.Equal(article.Infobox, want) {
+		t.Errorf("infobox = %v, want %v", article.Infobox, want)
+	}
+	// The facts are not repeated in the content
+	for _, value := range want {
+		if strings.Contains(article.Content, value) {
+			t.Errorf("content %q contains the infobox value %q", article.Content, value)
+		}
+	}
+	if !strings.Contains(article.Content, longParagraph) {
+		t.Errorf("content %q lost the paragraph", article.Content)
+	}
+}
+
+func TestExtractRelated(t *testing.T) {
+	setGlobal(t, &baseURL, "https://grokipedia.com")
+	html := `<article>
+<h2>History</h2>
+<p>See <a href="/page/Not_related">a link in the prose</a>.</p>
+<h2>See also:</h2>
+<ul>
+<li><a href="/page/Bar">Bar</a></li>
+<li><a href="Baz">Baz</a></li>
+<li><a href="https://example.com/qux"> Qux
+ elsewhere </a></li>
+<li><a href="/page/Bar">Bar again</a> <a href="#top">top</a> <a href="mailto:a@example.com">mail</a></li>
+</ul>
+<h3>Further reading</h3>
+<p><a href="/page/Nested">Nested under See also</a></p>
+<h2>References</h2>
+<p><a href="https://example.org/source">A source</a></p>
+</article>`
+	doc := parseFixture(t, html, "https://grokipedia.com/page/Foo")
+
+	want := []SearchResult{
+		{Title: "Bar", URL: "https://grokipedia.com/page/Bar"},
+		{Title: "Baz", URL: "https://grokipedia.com/page/Baz"},
+		{Title: "Qux elsewhere", URL: "https://example.com/qux"},
+		{Title: "Nested under See also", URL: "https://grokipedia.com/page/Nested"},
+	}
+	if got := extractRelated(doc.Find("article"), doc.Url); !slices.Equal(got, want) {
+		t.Errorf("related = %+v, want %+v", got, want)
+	}
+
+	// Without such a section there is nothing related
+	doc = parseFixture(t, `<article><h2>History</h2><p><a href="/page/Bar">Bar</a></p></article>`, "https://grokipedia.com/page/Foo")
+	if got := extractRelated(doc.Find("article"), doc.Url); got != nil {
+		t.Errorf("related without a See also section = %+v, want none", got)
+	}
+}
+
+func TestRawOuterHTML(t *testing.T) {
+	tests := []struct {
+		name     string
+		page     string
+		selector string
+		want     string
+	}{
+		{"verbatim markup",
+			`<html><body><article class=x data-n='1'>  <P>Unclosed <BR>line
+<img src=a.png></article></body></html>`,
+			"article", `<article class=x data-n='1'>  <P>Unclosed <BR>line
+<img src=a.png></article>`},
+		{"nested same tag",
+			`<div id="outer"><div id="root"><div>inner</div> tail</div></div>`,
+			"#root", `<div id="root"><div>inner</div> tail</div>`},
+		{"later occurrence",
+			`<main>menu</main><main id="content"><p>Body</p></main>`,
+			"#content", `<main id="content"><p>Body</p></main>`},
+		{"tags inside script are text",
+			`<article><script>var s = "</div><article>";</script><p>Body</p></article>`,
+			"article", `<article><script>var s = "</div><article>";</script><p>Body</p></article>`},
+	}
+
+	for _, tt := range tests {
+		doc := parseFixture(t, tt.page, "")
+		got, ok := rawOuterHTML([]byte(tt.page), doc.Find(tt.selector).Nodes[0])
+		if !ok || string(got) != tt.want {
+			t.Errorf("%s: rawOuterHTML = %q, %v, want %q", tt.name, got, ok, tt.want)
+		}
+	}
+
+	// An unclosed root cannot be cut out of the bytes
+	page := `<article><p>Never closed`
+	doc := parseFixture(t, page, "")
+	if got, ok := rawOuterHTML([]byte(page), doc.Find("article").Nodes[0]); ok {
+		t.Errorf("unclosed root: rawOuterHTML = %q, want not found", got)
+	}
+}
+
+func TestExportArticleHTML(t *testing.T) {
+	page := `<!DOCTYPE html><html><head><title>Foo</title></head><body><nav>Menu</nav>
+<article class=body data-x='1'><h1>Foo</h1>
+<P>First paragraph<BR>continued
+<p>Second &amp; last</article>
+<footer>Footer</footer></body></html>`
+	stubUpstream(t, pages{"/page/Foo": page, "/page/Unclosed": `<html><body><article><h1>Unclosed</h1><p>Text`})
+
+	rec := request(t, "GET", "/api/article/Foo?format=html", nil)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Fatalf("format=html = %d %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	want := page[strings.Index(page, "<article"):strings.Index(page, "\n<footer>")]
+	if rec.Body.String() != want {
+		t.Errorf("format=html body = %q, want the article bytes as fetched %q", rec.Body.String(), want)
+	}
+	if csp := rec.Header().Get("Content-Security-Policy"); csp != "sandbox" {
+		t.Errorf("Content-Security-Policy = %q, want sandbox", csp)
+	}
+
+	// Markup that cannot be located is re-serialized instead
+	rec = request(t, "GET", "/api/article/Unclosed?format=html", nil)
+	if want := "<article><h1>Unclosed</h1><p>Text</p></article>"; rec.Code != http.StatusOK || rec.Body.String() != want {
+		t.Errorf("format=html of an unclosed root = %d %q, want %q", rec.Code, rec.Body.String(), want)
+	}
+}
+
+const boilerplateFixture = `<main>
+<nav><ul><li><a href="/">Home</a> Navigation menu text</li></ul></nav>
+<header><p>Site header text</p></header>
+<div class="cookie-banner"><p>We use cookies to improve your experience.</p></div>
+<h1>Foo</h1>
+<p>` + longParagraph + `</p>
+<div role="navigation"><p>Previous article and next article links</p></div>
+<div class="custom-promo"><p>Subscribe to our newsletter today</p></div>
+<footer><p>Footer copyright text</p></footer>
+</main>`
+
+func TestBoilerplateRemoval(t *testing.T) {
+	stubUpstream(t, pages{"/page/Foo": articlePage("", boilerplateFixture)})
+	chrome := []string{"Navigation menu", "Site header", "cookies", "next article", "Footer copyright"}
+
+	tests := []struct {
+		name     string
+		settings map[string]string
+		excluded []string
+		included []string
+	}{
+		{"default blocklist", nil, chrome, []string{"newsletter"}},
+		{"custom blocklist", map[string]string{"SELECTOR_BOILERPLATE": "nav, footer, .custom-promo"}, []string{"Navigation menu", "Footer copyright", "newsletter"}, []string{"Site header", "cookies"}},
+		{"disabled", map[string]string{"SELECTOR_BOILERPLATE": ""}, nil, chrome},
+	}
+
+	for _, tt := range tests {
+		setConfig(t, parserSettings(tt.settings))
+		resetState(t)
+
+		article, err := getArticle(context.Background(), "Foo", "", "")
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !strings.Contains(article.Content, longParagraph) {
+			t.Errorf("%s: content lost the article text: %q", tt.name, article.Content)
+		}
+		for _, text := range tt.excluded {
+			if strings.Contains(article.Content, text) {
+				t.Errorf("%s: content includes %q: %q", tt.name, text, article.Content)
+			}
+		}
+		for _, text := range tt.included {
+			if !strings.Contains(article.Content, text) {
+				t.Errorf("%s: content is missing %q: %q", tt.name, text, article.Content)
+			}
+		}
+	}
+}
+
+const categoriesFixture = `<h1>Foo</h1><p>` + longParagraph + `</p>
+<div class="categories">
+<a href="/category/Placeholders">Placeholders</a>
+<a href="https://grokipedia.com/category/Metasyntactic_variables">Metasyntactic variables</a>
+<a href="../category/Programming">Programming</a>
+<a>Unlinked</a>
+<a href="javascript:void(0)">Scripted</a>
+<a href="/category/Empty"> </a>
+</div>`
+
+func TestExtractCategories(t *testing.T) {
+	doc := parseFixture(t, articlePage("", categoriesFixture), "https://grokipedia.com/page/Foo")
+	parser := defaultParserConfig()
+
+	names, links := parser.extractCategories(doc)
+
+	// Every named category is listed, linked or not
+	wantNames := []string{"Placeholders", "Metasyntactic variables", "Programming", "Unlinked", "Scripted"}
+	if !slices.Equal(names, wantNames) {
+		t.Errorf("categories = %q, want %q", names, wantNames)
+	}
+
+	// Only those with a web link get one, resolved against the page
+	wantLinks := []SearchResult{
+		{Title: "Placeholders", URL: "https://grokipedia.com/category/Placeholders"},
+		{Title: "Metasyntactic variables", URL: "https://grokipedia.com/category/Metasyntactic_variables"},
+		{Title: "Programming", URL: "https://grokipedia.com/category/Programming"},
+	}
+	if !slices.Equal(links, wantLinks) {
+		t.Errorf("category links = %+v, want %+v", links, wantLinks)
+	}
+
+	// Without links the richer list is left out of the JSON
+	doc = parseFixture(t, articlePage("", `<div class="categories"><a>Unlinked</a></div>`), "https://grokipedia.com/page/Foo")
+	names, links = parser.extractCategories(doc)
+	data, err := json.Marshal(Article{Categories: names, CategoryLinks: links})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "category_links") {
+		t.Errorf("article without category links serializes as %s", data)
+	}
+}
+
+// latin1 encodes s, which must only hold runes below U+0100, as ISO-8859-1
+func latin1(s string) string {
+	var b []byte
+	for _, r := range s {
+		b = append(b, byte(r))
+	}
+	return string(b)
+}
+
+func TestArticleCharset(t *testing.T) {
+	const title = "Café Ñandú"
+	const paragraph = "Le café crème est servi à la française, avec un croissant doré et beaucoup de soleil."
+	body := func(head string) string {
+		return "<html><head>" + head + "</head><body><article><h1>" + title + "</h1><p>" + paragraph + "</p></article></body></html>"
+	}
+
+	tests := []struct {
+		name        string
+		contentType string
+		page        string
+	}{
+		{"Content-Type charset", "text/html; charset=ISO-8859-1", latin1(body(""))},
+		{"meta charset", "text/html", latin1(body(`<meta charset="iso-8859-1">`))},
+		{"meta http-equiv", "text/html", latin1(body(`<meta http-equiv="Content-Type" content="text/html; charset=windows-1252">`))},
+		{"header over meta", "text/html; charset=iso-8859-1", latin1(body(`<meta charset="utf-8">`))},
+		{"undeclared UTF-8", "text/html", body("")},
+		{"declared UTF-8", "text/html; charset=utf-8", body("")},
+	}
+
+	for _, tt := range tests {
+		stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", tt.contentType)
+			w.Write([]byte(tt.page))
+		}))
+
+		article, err := getArticle(context.Background(), "Foo", "", "")
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if article.Title != title || article.Content != paragraph {
+			t.Errorf("%s: title %q, content %q", tt.name, article.Title, article.Content)
+		}
+		if !utf8.ValidString(article.Content) {
+			t.Errorf("%s: content is not valid UTF-8", tt.name)
+		}
+	}
+}
+
+func TestMinimumLengths(t *testing.T) {
+	const medium = "Rust is a language focused on safety and speed, with no GC."
+	stubUpstream(t, pages{"/page/Languages": articlePage("", `<h1>Languages</h1>
+<p>`+medium+`</p>
+<p>`+longParagraph+`</p>
+<ul><li>C</li><li>Go</li><li>Rust</li><li>Haskell</li></ul>`)})
+
+	tests := []struct {
+		name        string
+		settings    map[string]string
+		wantItems   []string
+		wantSummary string
+	}{
+		{"defaults", nil, []string{"Rust", "Haskell"}, medium},
+		{"raised content minimum", map[string]string{"MIN_CONTENT_RUNES": "5"}, []string{"Haskell"}, medium},
+		{"no content minimum", map[string]string{"MIN_CONTENT_RUNES": "0"}, []string{"C", "Go", "Rust", "Haskell"}, medium},
+		{"raised summary minimum", map[string]string{"MIN_SUMMARY_RUNES": "80"}, []string{"Rust", "Haskell"}, longParagraph},
+		{"invalid values keep the defaults", map[string]string{"MIN_CONTENT_RUNES": "-1", "MIN_SUMMARY_RUNES": "many"}, []string{"Rust", "Haskell"}, medium},
+	}
+
+	for _, tt := range tests {
+		setConfig(t, parserSettings(tt.settings))
+		resetState(t)
+
+		article, err := getArticle(context.Background(), "Languages", "", "")
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		var items []string
+		for _, block := range strings.Split(article.Content, defaultContentSeparator) {
+			if block != medium && block != longParagraph {
+				items = append(items, block)
+			}
+		}
+		if !slices.Equal(items, tt.wantItems) {
+			t.Errorf("%s: list items in the content = %q, want %q", tt.name, items, tt.wantItems)
+		}
+		if article.Summary != tt.wantSummary {
+			t.Errorf("%s: summary = %q, want %q", tt.name, article.Summary, tt.wantSummary)
+		}
+	}
+}
+
+func TestRelativeTime(t *testing.T) {
+	ref := time.Date(2025, 6, 15, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		ago  time.Duration
+		want string
+	}{
+		{0, "just now"},
+		{59 * time.Second, "just now"},
+		{time.Minute, "1 minute ago"},
+		{45 * time.Minute, "45 minutes ago"},
+		{time.Hour, "1 hour ago"},
+		{23*time.Hour + 59*time.Minute, "23 hours ago"},
+		{24 * time.Hour, "1 day ago"},
+		{3 * 24 * time.Hour, "3 days ago"},
+		{29 * 24 * time.Hour, "29 days ago"},
+		{30 * 24 * time.Hour, "1 month ago"},
+		{200 * 24 * time.Hour, "6 months ago"},
+		{365 * 24 * time.Hour, "1 year ago"},
+		{3 * 365 * 24 * time.Hour, "3 years ago"},
+		{-2 * time.Hour, "in 2 hours"},
+		{-24 * time.Hour, "in 1 day"},
+	}
+
+	for _, tt := range tests {
+		if got := relativeTime(ref.Add(-tt.ago), ref); got != tt.want {
+			t.Errorf("relativeTime(%v ago) = %q, want %q", tt.ago, got, tt.want)
+		}
+	}
+}
+
+func TestArticleRelativeTime(t *testing.T) {
+	stubUpstream(t, pages{
+		"/page/Dated":     articlePage(`<meta property="article:modified_time" content="2025-06-12T12:00:00Z">`, "<h1>Dated</h1><p>"+longParagraph+"</p>"),
+		"/page/Undated":   articlePage("", "<h1>Undated</h1><p>"+longParagraph+"</p>"),
+		"/page/Malformed": articlePage(`<meta property="article:modified_time" content="sometime last week">`, "<h1>Malformed</h1><p>"+longParagraph+"</p>"),
+	})
+	setGlobal(t, &clock, func() time.Time { return time.Date(2025, 6, 15, 12, 0, 0, 0, time.UTC) })
+
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"/api/article/Dated?relative_time=true", "3 days ago"},
+		{"/api/article/Dated", ""},
+		{"/api/article/Undated?relative_time=true", ""},
+		{"/api/article/Malformed?relative_time=true", ""},
+	}
+
+	for _, tt := range tests {
+		rec := request(t, "GET", tt.target, nil)
+		var article Article
+		if err := json.Unmarshal(rec.Body.Bytes(), &article); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("GET %s = %d %s", tt.target, rec.Code, rec.Body.String())
+		}
+		if article.LastUpdatedRelative != tt.want {
+			t.Errorf("GET %s: last_updated_relative = %q, want %q", tt.target, article.LastUpdatedRelative, tt.want)
+		}
+	}
+}
+
+func TestLeadImage(t *testing.T) {
+	const icon = `<img src="/icons/edit.svg" width="16" height="16">`
+	tests := []struct {
+		name string
+		head string
+		body string
+		want string
+	}{
+		{"og:image", `<meta property="og:image" content="/images/hero.jpg">`, icon + `<img src="/images/body.jpg">`, "https://grokipedia.com/images/hero.jpg"},
+		{"absolute og:image", `<meta property="og:image" content="https://cdn.example.com/hero.jpg">`, "", "https://cdn.example.com/hero.jpg"},
+		{"twitter:image", `<meta name="twitter:image" content="hero.png">`, "", "https://grokipedia.com/page/hero.png"},
+		{"first sizeable img", "", icon + `<img src="/images/small.png" width="80px"><img src="../images/body.jpg" width="640">`, "https://grokipedia.com/images/body.jpg"},
+		{"lazy-loaded img", "", `<img src="data:image/gif;base64,R0lGODlhAQABAAAAACw=" data-src="/images/lazy.jpg">`, "https://grokipedia.com/images/lazy.jpg"},
+		{"only icons", "", icon + `<img src="javascript:alert(1)">`, ""},
+		{"no image", "", "", ""},
+	}
+
+	for _, tt := range tests {
+		doc := parseFixture(t, articlePage(tt.head, "<h1>Foo</h1>"+tt.body+"<p>"+longParagraph+"</p>"), "https://grokipedia.com/page/Foo")
+		if got := leadImage(doc, doc.Find("article")); got != tt.want {
+			t.Errorf("%s: leadImage = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	// Images outside the article root are not the article's
+	doc := parseFixture(t, `<html><body><header><img src="/logo.png"></header><article><p>`+longParagraph+`</p></article></body></html>`, "https://grokipedia.com/page/Foo")
+	if got := leadImage(doc, doc.Find("article")); got != "" {
+		t.Errorf("leadImage picked %q from outside the article", got)
+	}
+
+	// lead_image is left out of the JSON when there is none
+	stubUpstream(t, pages{
+		"/page/Pictured":   articlePage(`<meta property="og:image" content="/images/hero.jpg">`, "<h1>Pictured</h1><p>"+longParagraph+"</p>"),
+		"/page/Unpictured": articlePage("", "<h1>Unpictured</h1><p>"+longParagraph+"</p>"),
+	})
+	for path, want := range map[string]string{"Pictured": baseURL + "/images/hero.jpg", "Unpictured": ""} {
+		rec := request(t, "GET", "/api/article/"+path, nil)
+		var body map[string]any
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		got, present := body["lead_image"]
+		if want == "" && present || want != "" && got != want {
+			t.Errorf("%s: lead_image = %v (present %v), want %q", path, got, present, want)
+		}
+	}
+}
+
+func TestLanguageAlternates(t *testing.T) {
+	tests := []struct {
+		name string
+		head string
+		want map[string]string
+	}{
+		{
+			"two alternates",
+			`<link rel="alternate" hreflang="fr" href="/fr/page/Foo"><link rel="alternate" hreflang="de" href="https://de.grokipedia.com/page/Foo">`,
+			map[string]string{"fr": "https://grokipedia.com/fr/page/Foo", "de": "https://de.grokipedia.com/page/Foo"},
+		},
+		{
+			"x-default and relative paths",
+			`<link rel="alternate" hreflang="x-default" href="Foo"><link rel="canonical" href="/page/Foo"><link rel="alternate" type="application/rss+xml" href="/feed">`,
+			map[string]string{"x-default": "https://grokipedia.com/page/Foo"},
+		},
+		{"unusable links", `<link rel="alternate" hreflang="" href="/page/Foo"><link rel="alternate" hreflang="es" href="javascript:alert(1)">`, nil},
+		{"none", "", nil},
+	}
+
+	for _, tt := range tests {
+		doc := parseFixture(t, articlePage(tt.head, "<h1>Foo</h1><p>"+longParagraph+"</p>"), "https://grokipedia.com/page/Foo")
+		if got := languageAlternates(doc); !maps.Equal(got, tt.want) || (tt.want == nil) != (got == nil) {
+			t.Errorf("%s: languageAlternates = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// alternates are filled in by getArticle and left out of the JSON when absent
+	stubUpstream(t, pages{
+		"/page/Translated":   articlePage(tests[0].head, "<h1>Translated</h1><p>"+longParagraph+"</p>"),
+		"/page/Untranslated": articlePage("", "<h1>Untranslated</h1><p>"+longParagraph+"</p>"),
+	})
+	for path, want := range map[string]map[string]string{
+		"Translated":   {"fr": baseURL + "/fr/page/Foo", "de": "https://de.grokipedia.com/page/Foo"},
+		"Untranslated": nil,
+	} {
+		rec := request(t, "GET", "/api/article/"+path, nil)
+		var body struct {
+			Alternates map[string]string `json:"alternates"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if !maps.Equal(body.Alternates, want) || strings.Contains(rec.Body.String(), `"alternates"`) != (want != nil) {
+			t.Errorf("%s: alternates = %v, want %v", path, body.Alternates, want)
+		}
+	}
+}
+
+func TestParseWarnings(t *testing.T) {
+	const body = "<h1>Foo</h1><p>" + longParagraph + "</p>"
+	const list = "<h1>Foo</h1><ul><li>" + longParagraph + "</li></ul>"
+	const description = `<meta name="description" content="Foo is a placeholder name.">`
+	stubUpstream(t, pages{
+		"/page/Clean":       articlePage(description, body),
+		"/page/NoRoot":      `<html><body><div>` + body + `</div></body></html>`,
+		"/page/EmptyRoot":   `<html><body><article><span>Share</span></article><div>` + body + `</div></body></html>`,
+		"/page/MainRoot":    `<html><body><main>` + body + `</main></body></html>`,
+		"/page/MetaSummary": articlePage(description, list),
+		"/page/NoSummary":   articlePage("", list),
+	})
+
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{"Clean", nil},
+		{"NoRoot", []string{warnNoArticleRoot}},
+		{"EmptyRoot", []string{warnEmptyArticleRoot}},
+		{"MainRoot", []string{fmt.Sprintf(warnArticleRootFallback, "main")}},
+		{"MetaSummary", []string{fmt.Sprintf(warnFallbackSummary, "meta description")}},
+		{"NoSummary", []string{warnNoSummary}},
+	}
+
+	for _, tt := range tests {
+		article, err := getArticle(context.Background(), tt.path, "", "")
+		if err != nil {
+			t.Errorf("%s: %v", tt.path, err)
+			continue
+		}
+		if !slices.Equal(article.ParseWarnings, tt.want) {
+			t.Errorf("%s: warnings = %q, want %q", tt.path, article.ParseWarnings, tt.want)
+		}
+		// The content is still extracted, just from further afield
+		if !strings.Contains(article.Content, longParagraph) {
+			t.Errorf("%s: content = %q", tt.path, article.Content)
+		}
+	}
+
+	// Clean extractions leave the field out of the JSON
+	for path, want := range map[string]bool{"Clean": false, "NoRoot": true} {
+		rec := request(t, "GET", "/api/article/"+path, nil)
+		if got := strings.Contains(rec.Body.String(), `"parse_warnings"`); got != want {
+			t.Errorf("%s: parse_warnings present %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestArticleListCaps(t *testing.T) {
+	var links strings.Builder
+	for i := range 6 {
+		fmt.Fprintf(&links, `<a href="/page/Internal_%d">Internal</a> <a href="https://example.com/%d">External</a> <a href="#note-%d">Note</a> `, i, i, i)
+	}
+	stubUpstream(t, pages{"/page/Foo": articlePage("", categoriesFixture+"<p>"+links.String()+"</p>")})
+
+	prefix := func(list []string, n int) []string {
+		return list[:min(len(list), n)]
+	}
+	uncapped, err := getArticle(context.Background(), "Foo", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uncapped.Categories) != 5 || len(uncapped.InternalLinks) < 6 || len(uncapped.ExternalLinks) < 6 || len(uncapped.AnchorLinks) < 6 {
+		t.Fatalf("fixture extracted to %d categories, %d/%d/%d links", len(uncapped.Categories), len(uncapped.InternalLinks), len(uncapped.ExternalLinks), len(uncapped.AnchorLinks))
+	}
+
+	tests := []struct {
+		maxCategories string
+		maxLinks      string
+		wantCats      int
+		wantLinks     int
+	}{
+		// 0 is unlimited
+		{"0", "0", len(uncapped.Categories), len(uncapped.InternalLinks)},
+		{"2", "3", 2, 3},
+		{"1", "0", 1, len(uncapped.InternalLinks)},
+		// Caps above the counts change nothing
+		{"50", "50", len(uncapped.Categories), len(uncapped.InternalLinks)},
+	}
+
+	for _, tt := range tests {
+		setConfig(t, parserSettings(map[string]string{"MAX_CATEGORIES": tt.maxCategories, "MAX_LINKS": tt.maxLinks}))
+		article, err := getArticle(context.Background(), "Foo", "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		name := fmt.Sprintf("MAX_CATEGORIES=%s MAX_LINKS=%s", tt.maxCategories, tt.maxLinks)
+		// The first ones in document order are kept
+		if !slices.Equal(article.Categories, prefix(uncapped.Categories, tt.wantCats)) {
+			t.Errorf("%s: categories = %q", name, article.Categories)
+		}
+		if !slices.Equal(article.CategoryLinks, uncapped.CategoryLinks[:min(len(uncapped.CategoryLinks), tt.wantCats)]) {
+			t.Errorf("%s: category links = %v", name, article.CategoryLinks)
+		}
+		if !slices.Equal(article.InternalLinks, prefix(uncapped.InternalLinks, tt.wantLinks)) {
+			t.Errorf("%s: internal links = %q", name, article.InternalLinks)
+		}
+		if !slices.Equal(article.ExternalLinks, prefix(uncapped.ExternalLinks, tt.wantLinks)) {
+			t.Errorf("%s: external links = %q", name, article.ExternalLinks)
+		}
+		if !slices.Equal(article.AnchorLinks, prefix(uncapped.AnchorLinks, tt.wantLinks)) {
+			t.Errorf("%s: anchor links = %q", name, article.AnchorLinks)
+		}
+	}
+}
+
+func TestDebugBlocks(t *testing.T) {
+	const body = `<h1>Foo</h1>
+<p>` + longParagraph + `</p>
+<p>Too short.</p>
+<h2>Early history of the name <button>edit</button></h2>
+<p>` + longParagraph + `</p>
+<ul><li>Foo was first used at MIT in the 1960s, along with bar.</li></ul>
+<blockquote>Foo and bar are the canonical metasyntactic variables.</blockquote>
+<pre>foo := bar() // a common example in code samples</pre>
+<table class="infobox"><tr><th>Type</th><td>Placeholder name for things</td></tr></table>`
+	stubUpstream(t, pages{"/page/Foo": articlePage("", body)})
+	setConfig(t, parserSettings(map[string]string{"MIN_CONTENT_RUNES": "20", "DEDUP_WINDOW": "10"}))
+
+	rec := request(t, "GET", "/api/article/Foo?debug_blocks=true", nil)
+	var article Article
+	if err := json.Unmarshal(rec.Body.Bytes(), &article); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("GET ?debug_blocks=true = %d %s", rec.Code, rec.Body.String())
+	}
+
+	want := []Block{
+		{Type: "p", Text: longParagraph},
+		{Type: "p", Text: "Too short.", Skipped: skipTooShort},
+		{Type: "h2", Text: "Early history of the name"},
+		{Type: "p", Text: longParagraph, Skipped: skipDuplicate},
+		{Type: "li", Text: "Foo was first used at MIT in the 1960s, along with bar."},
+		{Type: "blockquote", Text: "Foo and bar are the canonical metasyntactic variables."},
+		{Type: "pre", Text: "foo := bar() // a common example in code samples"},
+	}
+	if !slices.EqualFunc(article.Blocks, want, func(a, b Block) bool {
+		return a.Type == b.Type && a.Text == b.Text && a.Skipped == b.Skipped && slices.Equal(a.Formulas, b.Formulas)
+	}) {
+		t.Errorf("blocks:\n%+v\nwant:\n%+v", article.Blocks, want)
+	}
+
+	// The content is the blocks that were not skipped
+	var kept []string
+	for _, block := range article.Blocks {
+		if block.Skipped == "" {
+			kept = append(kept, block.Text)
+		}
+	}
+	if article.Content != strings.Join(kept, defaultContentSeparator) {
+		t.Errorf("content does not match the kept blocks:\n%q", article.Content)
+	}
+
+	// Blocks are only sent when asked for
+	if rec := request(t, "GET", "/api/article/Foo", nil); strings.Contains(rec.Body.String(), `"blocks"`) {
+		t.Error("blocks sent without ?debug_blocks=true")
+	}
+}
+
+func TestSummarySources(t *testing.T) {
+	const meta = `<meta name="description" content="From the meta description.">`
+	const og = `<meta property="og:description" content="From og:description.">`
+	const list = "<h1>Foo</h1><ul><li>" + longParagraph + "</li></ul>"
+	stubUpstream(t, pages{
+		"/page/All":       articlePage(meta+og, "<h1>Foo</h1><p>"+longParagraph+"</p>"),
+		"/page/MetaAndOG": articlePage(meta+og, list),
+		"/page/OGOnly":    articlePage(og, list),
+	})
+
+	tests := []struct {
+		sources     string
+		path        string
+		wantSummary string
+		wantWarning string
+	}{
+		// Every source has a summary, so the order alone decides
+		{"content,meta,og", "All", longParagraph, ""},
+		{"meta,og,content", "All", "From the meta description.", ""},
+		{"og,content", "All", "From og:description.", ""},
+		// Without a summary paragraph the next source is used, and named
+		{"content,meta,og", "MetaAndOG", "From the meta description.", "no summary paragraph found, used meta description"},
+		{"content,og,meta", "MetaAndOG", "From og:description.", "no summary paragraph found, used og:description"},
+		{"content,meta,og", "OGOnly", "From og:description.", "no summary paragraph found, used og:description"},
+		// A meta source preferred over the content is no fallback
+		{"og,content", "OGOnly", "From og:description.", ""},
+		{"meta,content,og", "OGOnly", "From og:description.", "no summary paragraph found, used og:description"},
+		{"meta", "OGOnly", "", warnNoSummary},
+	}
+
+	for _, tt := range tests {
+		setConfig(t, parserSettings(map[string]string{"SUMMARY_SOURCES": tt.sources}))
+		article, err := getArticle(context.Background(), tt.path, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		name := tt.sources + " " + tt.path
+		if article.Summary != tt.wantSummary {
+			t.Errorf("%s: summary = %q, want %q", name, article.Summary, tt.wantSummary)
+		}
+		var wantWarnings []string
+		if tt.wantWarning != "" {
+			wantWarnings = []string{tt.wantWarning}
+		}
+		if !slices.Equal(article.ParseWarnings, wantWarnings) {
+			t.Errorf("%s: warnings = %q, want %q", name, article.ParseWarnings, wantWarnings)
+		}
+
+		// The summary endpoint picks the same source
+		summary, err := getArticleSummary(context.Background(), tt.path, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if summary.Summary != tt.wantSummary {
+			t.Errorf("%s: getArticleSummary summary = %q, want %q", name, summary.Summary, tt.wantSummary)
+		}
+	}
+}
+
+func TestParseSummarySources(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []string
+		wantErr bool
+	}{
+		{"content,meta,og", []string{"content", "meta", "og"}, false},
+		{" OG , Meta ", []string{"og", "meta"}, false},
+		{"meta,meta,content", []string{"meta", "content"}, false},
+		{"meta,twitter", nil, true},
+		{" , ", nil, true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseSummarySources(tt.value)
+		if !slices.Equal(got, tt.want) || (err != nil) != tt.wantErr {
+			t.Errorf("parseSummarySources(%q) = %q, %v, want %q, error %v", tt.value, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestReadingTime(t *testing.T) {
+	tests := []struct {
+		words       int
+		wpm         int
+		wantSeconds int
+		wantHuman   string
+	}{
+		// Short articles still take a minute
+		{0, 200, 0, "1 min read"},
+		{1, 200, 1, "1 min read"},
+		{50, 200, 15, "1 min read"},
+		{200, 200, 60, "1 min read"},
+		// Minutes are rounded to the nearest, seconds up
+		{299, 200, 90, "2 min read"},
+		{290, 200, 87, "1 min read"},
+		{1000, 200, 300, "5 min read"},
+		{1000, 250, 240, "4 min read"},
+		{12345, 200, 3704, "62 min read"},
+	}
+
+	for _, tt := range tests {
+		seconds, human := readingTime(tt.words, tt.wpm)
+		if seconds != tt.wantSeconds || human != tt.wantHuman {
+			t.Errorf("readingTime(%d, %d) = %d, %q, want %d, %q", tt.words, tt.wpm, seconds, human, tt.wantSeconds, tt.wantHuman)
+		}
+	}
+}
+
+func TestArticleReadingTime(t *testing.T) {
+	// longParagraph has 19 words, the filler paragraph 10
+	stubUpstream(t, pages{
+		"/page/Short": articlePage("", "<h1>Short</h1><p>"+longParagraph+"</p>"),
+		"/page/Long":  articlePage("", "<h1>Long</h1>"+strings.Repeat("<p>"+longParagraph+"</p><p>Another paragraph of ten words, so lines are not deduplicated.</p>", 50)),
+	})
+
+	tests := []struct {
+		path        string
+		wpm         string
+		wantSeconds int
+		wantHuman   string
+	}{
+		{"Short", "", 6, "1 min read"},
+		{"Long", "", 435, "7 min read"},
+		{"Long", "100", 870, "15 min read"},
+	}
+
+	for _, tt := range tests {
+		// Cached articles keep the reading time they were parsed with
+		resetState(t)
+		setConfig(t, parserSettings(map[string]string{"READING_WPM": tt.wpm}))
+		rec := request(t, "GET", "/api/article/"+tt.path, nil)
+		var body struct {
+			ReadingTimeSeconds int    `json:"reading_time_seconds"`
+			ReadingTime        string `json:"reading_time"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("GET /api/article/%s = %d %s", tt.path, rec.Code, rec.Body.String())
+		}
+		if body.ReadingTimeSeconds != tt.wantSeconds || body.ReadingTime != tt.wantHuman {
+			t.Errorf("%s at %q wpm: %d seconds, %q, want %d, %q", tt.path, tt.wpm, body.ReadingTimeSeconds, body.ReadingTime, tt.wantSeconds, tt.wantHuman)
+		}
+	}
+}
+
+func TestLineWindow(t *testing.T) {
+	w := newLineWindow(2)
+	w.add("a")
+	w.add("b")
+	if !w.contains("a") || !w.contains("b") {
+		t.Error("window of 2 lost a line before it was full")
+	}
+	// The oldest line makes room for the newest
+	w.add("c")
+	w.add("d")
+	if w.contains("a") || w.contains("b") || !w.contains("c") || !w.contains("d") {
+		t.Errorf("window after a, b, c, d = %q, want c and d", w.lines)
+	}
+
+	// A window of 0 never holds anything
+	empty := newLineWindow(0)
+	empty.add("a")
+	if empty.contains("a") {
+		t.Error("window of 0 remembered a line")
+	}
+}
+
+func TestDedupWindow(t *testing.T) {
+	const a, b, c = "Share this article with friends.", "First paragraph of real content.", "Second paragraph of real content."
+	paragraphs := func(lines ...string) string {
+		return "<h1>Foo</h1><p>" + strings.Join(lines, "</p><p>") + "</p>"
+	}
+	stubUpstream(t, pages{
+		"/page/TwoBack":   articlePage("", paragraphs(a, b, a, c)),
+		"/page/ThreeBack": articlePage("", paragraphs(a, b, c, a)),
+		"/page/Adjacent":  articlePage("", paragraphs(b, b, c)),
+	})
+
+	tests := []struct {
+		path   string
+		window string
+		want   []string
+	}{
+		{"TwoBack", "1", []string{a, b, a, c}},
+		{"TwoBack", "2", []string{a, b, c}},
+		{"ThreeBack", "2", []string{a, b, c, a}},
+		{"ThreeBack", "3", []string{a, b, c}},
+		// The previous line is always compared
+		{"Adjacent", "", []string{b, c}},
+		{"Adjacent", "1", []string{b, c}},
+	}
+
+	for _, tt := range tests {
+		setConfig(t, parserSettings(map[string]string{"DEDUP_WINDOW": tt.window}))
+		article, err := getArticle(context.Background(), tt.path, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Split(article.Content, defaultContentSeparator); !slices.Equal(got, tt.want) {
+			t.Errorf("%s with DEDUP_WINDOW=%q: content lines %q, want %q", tt.path, tt.window, got, tt.want)
+		}
+	}
+}
+
+// katex renders tex the way KaTeX does: MathML with the source as an
+// annotation, and the visible HTML beside it
+func katex(tex, visible string) string {
+	return `<span class="katex"><span class="katex-mathml"><math><semantics><mrow><mi>` + visible +
+		`</mi></mrow><annotation encoding="application/x-tex">` + tex + `</annotation></semantics></math></span>` +
+		`<span class="katex-html" aria-hidden="true"><span class="mord">` + visible + `</span></span></span>`
+}
+
+func TestIncludeMath(t *testing.T) {
+	body := `<h1>Mass–energy equivalence</h1>
+<p>The formula ` + katex("E = mc^2", "E=mc2") + ` relates mass and energy in special relativity.</p>
+<span class="katex-display">` + katex(`\int_0^1 x\,dx = \frac{1}{2}`, "∫x dx=1/2") + `</span>
+<p>Some pages mark formulas up as <math alttext="a^2 + b^2 = c^2"><mi>a</mi></math> MathML instead, or as <span data-latex="\pi r^2">πr²</span>.</p>`
+	stubUpstream(t, pages{"/page/Math": articlePage("", body)})
+
+	tests := []struct {
+		includeMath  string
+		wantContent  []string
+		wantFormulas []string
+	}{
+		{
+			"true",
+			[]string{
+				"The formula $E = mc^2$ relates mass and energy in special relativity.",
+				`$$\int_0^1 x\,dx = \frac{1}{2}$$`,
+				"Some pages mark formulas up as $a^2 + b^2 = c^2$ MathML instead, or as πr².",
+			},
+			[]string{"E = mc^2", `\int_0^1 x\,dx = \frac{1}{2}`, "a^2 + b^2 = c^2"},
+		},
+		{"false", nil, nil},
+	}
+
+	for _, tt := range tests {
+		setConfig(t, parserSettings(map[string]string{"INCLUDE_MATH": tt.includeMath}))
+		article, err := getArticle(context.Background(), "Math", "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if tt.wantContent != nil {
+			if got := strings.Split(article.Content, defaultContentSeparator); !slices.Equal(got, tt.wantContent) {
+				t.Errorf("INCLUDE_MATH=%s: content lines\n%q\nwant\n%q", tt.includeMath, got, tt.wantContent)
+			}
+		} else if strings.Contains(article.Content, "$") || strings.Contains(article.Content, `\int`) {
+			t.Errorf("INCLUDE_MATH=%s: LaTeX in content %q", tt.includeMath, article.Content)
+		}
+		if !slices.Equal(article.Formulas, tt.wantFormulas) {
+			t.Errorf("INCLUDE_MATH=%s: formulas %q, want %q", tt.includeMath, article.Formulas, tt.wantFormulas)
+		}
+	}
+}
+
+// largeArticle returns an article page with the given number of sections,
+// each with a few paragraphs, a list and internal and external links
+func largeArticle(sections int) string {
+	var b strings.Builder
+	b.WriteString(`<html lang="en"><head><title>Large - Grokipedia</title><meta property="og:image" content="/images/large.jpg"></head><body><article><h1>Large</h1>`)
+	b.WriteString(`<table class="infobox"><tr><th>Sections</th><td>` + fmt.Sprint(sections) + `</td></tr></table>`)
+	for i := range sections {
+		fmt.Fprintf(&b, `<h2>Section %d</h2>`, i)
+		for j := range 3 {
+			fmt.Fprintf(&b, `<p>Paragraph %d of section %d links <a href="/page/Topic_%d">topic %d</a> and <a href="https://example.com/%d">a source</a>. %s</p>`, j, i, i, i, i, longParagraph)
+		}
+		fmt.Fprintf(&b, `<ul><li>First point of section %d</li><li>Second point of section %d</li></ul>`, i, i)
+	}
+	b.WriteString(`<div class="categories"><a href="/category/Large">Large</a></div></article><footer><p>Footer</p></footer></body></html>`)
+	return b.String()
+}
+
+func TestParallelExtraction(t *testing.T) {
+	fixtures := map[string]string{
+		"full":    readFixture(t, "article_full.html"),
+		"minimal": readFixture(t, "article_minimal.html"),
+		"large":   largeArticle(50),
+		// No article root, so the content pass adds a warning and reads the body
+		"no root": `<html><head><title>Loose</title></head><body><h1>Loose</h1><p>` + longParagraph + `</p><a href="/page/Other">Other</a></body></html>`,
+	}
+	settings := map[string]string{"MIN_CONTENT_RUNES": "20", "DEDUP_WINDOW": "10"}
+
+	for name, html := range fixtures {
+		doc := parseFixture(t, html, "https://grokipedia.com/page/"+name)
+		parse := func(parallel bool) *Article {
+			t.Helper()
+			settings["PARALLEL_EXTRACTION"] = strconv.FormatBool(parallel)
+			article, err := parseArticle(doc, &Article{URL: doc.Url.String(), Title: name}, parserSettings(settings))
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			return article
+		}
+
+		serial := parse(false)
+		// Several rounds give the race detector and the scheduler a chance
+		// to catch passes that touch the same data
+		for range 10 {
+			if parallel := parse(true); !reflect.DeepEqual(parallel, serial) {
+				t.Fatalf("%s: parallel extraction differs:\n%+v\nserial:\n%+v", name, parallel, serial)
+			}
+		}
+		// Every pass ran on the shared document without changing it
+		if again := parse(false); !reflect.DeepEqual(again, serial) {
+			t.Errorf("%s: extraction changed the document", name)
+		}
+	}
+}
+
+func TestRunPassesPanic(t *testing.T) {
+	for _, parallel := range []bool{false, true} {
+		func() {
+			defer func() {
+				if p := recover(); p != "boom" {
+					t.Errorf("parallel %v: recovered %v, want boom", parallel, p)
+				}
+			}()
+			runPasses(parallel, func() {}, func() { panic("boom") })
+		}()
+	}
+}
+
+func BenchmarkExtraction(b *testing.B) {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(largeArticle(200)))
+	if err != nil {
+		b.Fatal(err)
+	}
+	doc.Url, _ = url.Parse("https://grokipedia.com/page/Large")
+
+	for _, parallel := range []bool{false, true} {
+		name := "sequential"
+		if parallel {
+			name = "parallel"
+		}
+		cfg := parserSettings(map[string]string{"PARALLEL_EXTRACTION": strconv.FormatBool(parallel)})
+		b.Run(name, func(b *testing.B) {
+			for range b.N {
+				if _, err := parseArticle(doc, &Article{URL: doc.Url.String()}, cfg); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestArticleRootSelectors(t *testing.T) {
+	long := "<p>" + longParagraph + "</p><p>Again, " + longParagraph + "</p>"
+	const teaser = "<p>Read the full story below, it is worth it.</p>"
+	const chain = "#content, .article-body, main"
+
+	tests := []struct {
+		name     string
+		settings map[string]string
+		body     string
+		want     string // text the content must start with
+		warnings []string
+	}{
+		{"first selector", map[string]string{"ARTICLE_ROOT_SELECTORS": chain},
+			`<nav>` + teaser + `</nav><div id="content">` + long + `</div>`, longParagraph, nil},
+		// A match with too little text gives way to a later one
+		{"later selector", map[string]string{"ARTICLE_ROOT_SELECTORS": chain},
+			`<div id="content">` + teaser + `</div><div class="article-body">` + long + `</div>`, longParagraph,
+			[]string{fmt.Sprintf(warnArticleRootFallback, ".article-body")}},
+		{"last selector", map[string]string{"ARTICLE_ROOT_SELECTORS": chain},
+			`<article>` + teaser + `</article><main>` + long + `</main>`, longParagraph,
+			[]string{fmt.Sprintf(warnArticleRootFallback, "main")}},
+		// When every match is short, the first one is used
+		{"short matches", map[string]string{"ARTICLE_ROOT_SELECTORS": chain},
+			`<main>` + teaser + `</main><div id="content"><p>` + longParagraph + `</p></div>`, longParagraph, nil},
+		// Selectors outside the chain are not consulted, not even the defaults
+		{"no match", map[string]string{"ARTICLE_ROOT_SELECTORS": chain},
+			`<article>` + long + `</article>`, longParagraph, []string{warnNoArticleRoot}},
+		// SELECTOR_ARTICLE_ROOT only replaces the head of the default chain
+		{"legacy setting", map[string]string{"SELECTOR_ARTICLE_ROOT": "#content"},
+			`<div id="content">` + teaser + `</div><main>` + long + `</main>`, longParagraph,
+			[]string{fmt.Sprintf(warnArticleRootFallback, "main")}},
+	}
+
+	for _, tt := range tests {
+		doc := parseFixture(t, "<html><body>"+tt.body+"</body></html>", "https://grokipedia.com/page/Foo")
+		tt.settings["MIN_CONTENT_RUNES"] = "20"
+		article, err := parseArticle(doc, &Article{URL: doc.Url.String()}, parserSettings(tt.settings))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !strings.HasPrefix(article.Content, tt.want) || strings.Contains(article.Content, "Read the full story") {
+			t.Errorf("%s: content = %q", tt.name, article.Content)
+		}
+		if !slices.Equal(article.ParseWarnings, tt.warnings) {
+			t.Errorf("%s: warnings = %q, want %q", tt.name, article.ParseWarnings, tt.warnings)
+		}
+	}
+}
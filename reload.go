@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// runtimeConfig is the part of the configuration POST /admin/reload can
+// change without a restart: the parser and the defaults of article
+// responses. It is never modified once stored; a reload swaps in a new one.
+type runtimeConfig struct {
+	// Parser holds the selectors and switches getArticle uses to extract content
+	Parser parserConfig
+	// SummaryMaxChars is the default ?summary_max_chars= limit (0 = unlimited)
+	SummaryMaxChars int
+	// ContentMaxBytes is the default ?max_bytes= limit for Article.Content (0 = unlimited)
+	ContentMaxBytes int
+	// ContentSeparator joins the parts of Article.Content in responses (CONTENT_SEPARATOR)
+	ContentSeparator string
+	// ReadingWPM is the reading speed, in words per minute, behind Article.ReadingTime (READING_WPM)
+	ReadingWPM int
+	// PrettyJSON indents JSON responses unless a request sets ?pretty=false
+	PrettyJSON bool
+}
+
+var (
+	// activeConfig is the runtimeConfig in effect. Code that reads several
+	// settings takes one snapshot with currentConfig, so a reload in the
+	// middle of a request never mixes old and new values.
+	activeConfig atomic.Pointer[runtimeConfig]
+	// reloadMu keeps concurrent reloads from racing to store their config
+	reloadMu sync.Mutex
+)
+
+// currentConfig returns the runtimeConfig in effect
+func currentConfig() *runtimeConfig {
+	return activeConfig.Load()
+}
+
+// configLookup reads one setting, like os.LookupEnv
+type configLookup func(key string) (string, bool)
+
+// get returns the setting, or "" when it is unset
+func (lookup configLookup) get(key string) string {
+	v, _ := lookup(key)
+	return v
+}
+
+// readRuntimeConfig reads the reloadable settings from the environment, with
+// the values in CONFIG_FILE, when set, taking precedence. Invalid values are
+// logged and replaced by their defaults; only an unreadable file is an error.
+// ignored lists, sorted, the keys CONFIG_FILE sets that are not reloadable
+// settings, such as CACHE_TTL, which only the environment at startup can set.
+func readRuntimeConfig() (cfg *runtimeConfig, ignored []string, err error) {
+	if configFile == "" {
+		return loadRuntimeConfig(os.LookupEnv), nil, nil
+	}
+	values, err := readConfigFile(configFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Every key loadRuntimeConfig asks for is reloadable, so the keys of
+	// the file it never asked for are the ones it could not apply
+	used := make(map[string]bool)
+	cfg = loadRuntimeConfig(func(key string) (string, bool) {
+		used[key] = true
+		if v, ok := values[key]; ok {
+			return v, true
+		}
+		return os.LookupEnv(key)
+	})
+	for key := range values {
+		if !used[key] {
+			ignored = append(ignored, key)
+		}
+	}
+	slices.Sort(ignored)
+	return cfg, ignored, nil
+}
+
+// readConfigFile parses a file of KEY=VALUE lines, the format of
+// .env.example. Blank lines and lines starting with # are skipped, and a
+// value may be wrapped in single or double quotes.
+func readConfigFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("%s:%d: expected KEY=VALUE", path, n)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		values[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// loadRuntimeConfig builds a runtimeConfig from the settings lookup finds,
+// keeping the defaults for anything unset or invalid
+func loadRuntimeConfig(lookup configLookup) *runtimeConfig {
+	cfg := &runtimeConfig{
+		Parser:           loadParserConfig(lookup),
+		ContentSeparator: defaultContentSeparator,
+		ReadingWPM:       defaultReadingWPM,
+	}
+
+	if v := lookup.get("SUMMARY_MAX_CHARS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Printf("Invalid SUMMARY_MAX_CHARS %q, summaries will not be truncated", v)
+		} else {
+			cfg.SummaryMaxChars = n
+		}
+	}
+
+	if v := lookup.get("CONTENT_MAX_BYTES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Printf("Invalid CONTENT_MAX_BYTES %q, content will not be truncated", v)
+		} else {
+			cfg.ContentMaxBytes = n
+		}
+	}
+
+	if v := lookup.get("CONTENT_SEPARATOR"); v != "" {
+		sep, err := parseContentSeparator(v)
+		if err != nil {
+			log.Printf("Invalid CONTENT_SEPARATOR: %v, using %q", err, cfg.ContentSeparator)
+		} else {
+			cfg.ContentSeparator = sep
+		}
+	}
+
+	if v := lookup.get("READING_WPM"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Printf("Invalid READING_WPM %q, using %d", v, cfg.ReadingWPM)
+		} else {
+			cfg.ReadingWPM = n
+		}
+	}
+
+	if v := lookup.get("PRETTY_JSON"); v != "" {
+		pretty, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Printf("Invalid PRETTY_JSON %q, using compact JSON", v)
+		} else {
+			cfg.PrettyJSON = pretty
+		}
+	}
+
+	return cfg
+}
+
+// ReloadResponse reports a successful configuration reload
+type ReloadResponse struct {
+	Status     string `json:"status"`
+	ConfigFile string `json:"config_file,omitempty"`
+	ReloadedAt string `json:"reloaded_at"`
+	// IgnoredKeys are the keys in CONFIG_FILE that only take effect on a restart
+	IgnoredKeys []string `json:"ignored_keys,omitempty"`
+}
+
+// requireAdmin wraps a handler so it only runs for requests carrying
+// ADMIN_TOKEN as a bearer token
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			sendError(w, http.StatusUnauthorized, codeUnauthorized, "A valid admin token is required")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// reloadHandler re-reads the reloadable settings and swaps them in. Requests
+// already running finish with the config they started with.
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	cfg, ignored, err := readRuntimeConfig()
+	if err != nil {
+		sendError(w, http.StatusInternalServerError, codeInternalError, fmt.Sprintf("Failed to read CONFIG_FILE, keeping the current config: %v", err))
+		return
+	}
+	activeConfig.Store(cfg)
+	log.Printf("Configuration reloaded")
+	if len(ignored) > 0 {
+		log.Printf("CONFIG_FILE sets %s, which need a restart; ignoring", strings.Join(ignored, ", "))
+	}
+
+	writeJSON(w, http.StatusOK, ReloadResponse{
+		Status:      "reloaded",
+		ConfigFile:  configFile,
+		ReloadedAt:  time.Now().UTC().Format(time.RFC3339),
+		IgnoredKeys: ignored,
+	}, wantPretty(r))
+}
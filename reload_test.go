@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestReload(t *testing.T) {
+	stubUpstream(t, pages{"/page/Foo": articlePage("", "<h1>Foo</h1><p>"+longParagraph+"</p>")})
+	setConfig(t, parserSettings(nil))
+	setGlobal(t, &adminToken, "s3cret")
+	path := filepath.Join(t.TempDir(), "grokipedia-api.env")
+	setGlobal(t, &configFile, path)
+
+	reload := func(token string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/admin/reload", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		return serve(t, newRouter(""), req)
+	}
+	summary := func() string {
+		t.Helper()
+		rec := request(t, "GET", "/api/article/Foo", nil)
+		var article Article
+		if err := json.Unmarshal(rec.Body.Bytes(), &article); err != nil {
+			t.Fatalf("GET /api/article/Foo = %d %s", rec.Code, rec.Body.String())
+		}
+		return article.Summary
+	}
+	writeConfig := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := summary(); got != longParagraph {
+		t.Fatalf("summary before the reload = %q", got)
+	}
+
+	writeConfig("# reloadable\nSUMMARY_MAX_CHARS=20\n\n# startup only\nCACHE_TTL=1h\nUSER_AGENT=\"other\"\n")
+	if rec := reload("wrong"); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("reload with a wrong token = %d", rec.Code)
+	}
+	if got := summary(); got != longParagraph {
+		t.Errorf("summary after a refused reload = %q", got)
+	}
+
+	rec := reload("s3cret")
+	var resp ReloadResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("reload = %d %s", rec.Code, rec.Body.String())
+	}
+	if resp.Status != "reloaded" || resp.ConfigFile != path {
+		t.Errorf("reload response = %+v", resp)
+	}
+	// Settings only read at startup are reported rather than silently dropped
+	if want := []string{"CACHE_TTL", "USER_AGENT"}; !slices.Equal(resp.IgnoredKeys, want) {
+		t.Errorf("ignored_keys = %q, want %q", resp.IgnoredKeys, want)
+	}
+	// New requests see the new setting
+	if got := summary(); got == longParagraph || utf8.RuneCountInString(got) > 20 {
+		t.Errorf("summary after the reload = %q, want at most 20 characters", got)
+	}
+
+	// A file that cannot be parsed leaves the current settings in place
+	writeConfig("SUMMARY_MAX_CHARS\n")
+	if rec := reload("s3cret"); rec.Code != http.StatusInternalServerError {
+		t.Errorf("reload of a broken file = %d", rec.Code)
+	}
+	if got := currentConfig().SummaryMaxChars; got != 20 {
+		t.Errorf("SummaryMaxChars after a failed reload = %d, want 20", got)
+	}
+
+	// With only reloadable keys there is nothing to report
+	writeConfig("SUMMARY_MAX_CHARS=0\nSELECTOR_CATEGORY=.tags a\n")
+	rec = reload("s3cret")
+	resp = ReloadResponse{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || rec.Code != http.StatusOK || resp.IgnoredKeys != nil {
+		t.Errorf("reload = %d %s", rec.Code, rec.Body.String())
+	}
+	if got := summary(); got != longParagraph {
+		t.Errorf("summary after resetting SUMMARY_MAX_CHARS = %q", got)
+	}
+}
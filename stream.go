@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// streamFlushBytes is how much of a streamed response is written between flushes
+const streamFlushBytes = 32 << 10
+
+// flushWriter flushes the response every streamFlushBytes, so large bodies
+// reach the client while they are still being written
+type flushWriter struct {
+	w       io.Writer
+	flusher http.Flusher
+	pending int
+}
+
+func newFlushWriter(w http.ResponseWriter) *flushWriter {
+	flusher, _ := w.(http.Flusher)
+	return &flushWriter{w: w, flusher: flusher}
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	fw.pending += n
+	if fw.pending >= streamFlushBytes {
+		fw.Flush()
+	}
+	return n, err
+}
+
+// Flush sends everything written so far
+func (fw *flushWriter) Flush() {
+	if fw.flusher != nil && fw.pending > 0 {
+		fw.flusher.Flush()
+	}
+	fw.pending = 0
+}
+
+// byteLimitWriter passes on at most limit bytes, never splitting a character
+// of a single Write, and silently drops the rest. A limit of 0 is unlimited.
+type byteLimitWriter struct {
+	w         io.Writer
+	limit     int
+	written   int
+	truncated bool
+}
+
+func (lw *byteLimitWriter) Write(p []byte) (int, error) {
+	if lw.limit <= 0 {
+		return lw.w.Write(p)
+	}
+	if lw.truncated {
+		return len(p), nil
+	}
+
+	chunk := p
+	if room := lw.limit - lw.written; len(chunk) > room {
+		cut := room
+		for cut > 0 && !utf8.RuneStart(chunk[cut]) {
+			cut--
+		}
+		chunk = chunk[:cut]
+		lw.truncated = true
+	}
+
+	n, err := lw.w.Write(chunk)
+	lw.written += n
+	if err != nil {
+		return n, err
+	}
+	return len(p), nil
+}
+
+// writeArticleJSON writes article as the JSON response like writeJSON, but
+// streams its content in chunks after the rest of the document is encoded,
+// so the largest field is never copied into the encoder's buffer. With
+// fullSchema, empty fields are written instead of omitted (see
+// marshalFullSchema). Once the status is sent, a failed write can only cut
+// the response short; it is logged instead.
+func writeArticleJSON(w http.ResponseWriter, article *Article, pretty, fullSchema bool) {
+	// HTML parsing never yields NUL characters, so "\u0000" only marks the content
+	shell := *article
+	shell.Content = "\x00"
+
+	marshal := json.Marshal
+	if fullSchema {
+		marshal = marshalFullSchema
+	}
+	data, err := marshal(shell)
+	if err != nil {
+		sendError(w, http.StatusInternalServerError, codeInternalError, "Failed to encode article")
+		return
+	}
+
+	var buf bytes.Buffer
+	if pretty {
+		json.Indent(&buf, data, "", "  ")
+	} else {
+		buf.Write(data)
+	}
+	buf.WriteByte('\n')
+	head, tail, _ := bytes.Cut(buf.Bytes(), []byte(`"\u0000"`))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	fw := newFlushWriter(w)
+	_, err = fw.Write(head)
+	if err == nil {
+		err = writeJSONString(fw, article.Content)
+	}
+	if err == nil {
+		_, err = fw.Write(tail)
+	}
+	if err != nil {
+		log.Printf("Article response for %s cut short: %v", article.URL, err)
+	}
+	fw.Flush()
+}
+
+// writeJSONString writes s as a quoted JSON string, escaping it in chunks of
+// about streamFlushBytes that end on character boundaries
+func writeJSONString(w io.Writer, s string) error {
+	if _, err := io.WriteString(w, `"`); err != nil {
+		return err
+	}
+
+	for len(s) > 0 {
+		cut := min(len(s), streamFlushBytes)
+		for cut < len(s) && !utf8.RuneStart(s[cut]) {
+			cut++
+		}
+
+		quoted, err := json.Marshal(s[:cut])
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(quoted[1 : len(quoted)-1]); err != nil {
+			return err
+		}
+		s = s[cut:]
+	}
+
+	_, err := io.WriteString(w, `"`)
+	return err
+}
+
+// streamArticle writes a text rendering of article through a flushWriter,
+// cut to maxBytes when it is positive. Errors after the first byte can only
+// be logged.
+func streamArticle(w http.ResponseWriter, article *Article, contentType string, maxBytes int, render func(io.Writer, *Article) error) {
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+
+	fw := newFlushWriter(w)
+	if err := render(&byteLimitWriter{w: fw, limit: maxBytes}, article); err != nil {
+		log.Printf("Article response for %s cut short: %v", article.URL, err)
+	}
+	fw.Flush()
+}
+
+// writeArticleText renders an article as plain text: the title, a blank
+// line and the content
+func writeArticleText(w io.Writer, article *Article) error {
+	for _, part := range []string{strings.TrimSpace(article.Title), "\n\n", article.Content, "\n"} {
+		if _, err := io.WriteString(w, part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeArticleMarkdown renders an article as Markdown with one heading per
+// section, falling back to the plain content when it has no sections. Each
+// block is written as soon as it is rendered.
+func writeArticleMarkdown(w io.Writer, article *Article) error {
+	if _, err := io.WriteString(w, "# "+strings.TrimSpace(article.Title)+"\n"); err != nil {
+		return err
+	}
+
+	if len(article.Sections) == 0 {
+		_, err := io.WriteString(w, "\n"+article.Content+"\n")
+		return err
+	}
+
+	for _, section := range article.Sections {
+		if section.Heading != "" {
+			// The article title is the only level-1 heading
+			level := min(max(section.Level, 2), 6)
+			if _, err := io.WriteString(w, "\n"+strings.Repeat("#", level)+" "+section.Heading+"\n"); err != nil {
+				return err
+			}
+		}
+		for _, paragraph := range section.Paragraphs {
+			if _, err := io.WriteString(w, "\n"+paragraph+"\n"); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
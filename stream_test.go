@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestArticleStreaming(t *testing.T) {
+	var body strings.Builder
+	var paragraphs []string
+	for i := range 2000 {
+		paragraph := fmt.Sprintf("Paragraph %d. %s", i, longParagraph)
+		paragraphs = append(paragraphs, paragraph)
+		fmt.Fprintf(&body, "<p>%s</p>", paragraph)
+	}
+	stubUpstream(t, pages{"/page/Large": articlePage("", "<h1>Large</h1>"+body.String())})
+
+	want, err := getArticle(context.Background(), "Large", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(want.Content) < 4*streamFlushBytes {
+		t.Fatalf("fixture content is only %d bytes, too small to stream in several chunks", len(want.Content))
+	}
+
+	server := httptest.NewServer(timeoutMiddleware(newRouter("")))
+	defer server.Close()
+
+	for _, format := range []string{formatJSON, formatText, formatMarkdown} {
+		resp, err := http.Get(server.URL + "/api/article/Large?format=" + format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("format=%s: %d, %v", format, resp.StatusCode, err)
+		}
+		// A streamed response has no length known up front
+		if resp.ContentLength != -1 {
+			t.Errorf("format=%s: Content-Length %d, want a streamed response", format, resp.ContentLength)
+		}
+
+		switch format {
+		case formatJSON:
+			var article Article
+			if err := json.Unmarshal(data, &article); err != nil {
+				t.Fatalf("format=json: %v", err)
+			}
+			if article.Content != want.Content || article.Title != "Large" {
+				t.Errorf("format=json: got %d bytes of content titled %q, want %d", len(article.Content), article.Title, len(want.Content))
+			}
+		case formatText:
+			if got := string(data); got != "Large\n\n"+want.Content+"\n" {
+				t.Errorf("format=text: got %d bytes, want the %d byte content", len(got), len(want.Content))
+			}
+		case formatMarkdown:
+			for _, paragraph := range paragraphs {
+				if !bytes.Contains(data, []byte("\n"+paragraph+"\n")) {
+					t.Errorf("format=markdown is missing %q", paragraph[:14])
+				}
+			}
+		}
+	}
+}
+
+func TestWriteJSONString(t *testing.T) {
+	tests := []string{
+		"",
+		`quotes " and \ backslashes, <tags> & control` + "\x01\n",
+		// Multi-byte characters straddling the chunk boundary
+		strings.Repeat("x", streamFlushBytes-1) + "é" + strings.Repeat("€", streamFlushBytes),
+		strings.Repeat("😀", 3*streamFlushBytes/4+1),
+	}
+
+	for _, s := range tests {
+		var buf bytes.Buffer
+		if err := writeJSONString(&buf, s); err != nil {
+			t.Fatal(err)
+		}
+		want, _ := json.Marshal(s)
+		if !bytes.Equal(buf.Bytes(), want) {
+			t.Errorf("writeJSONString of %d bytes differs from json.Marshal", len(s))
+		}
+	}
+}
+
+func TestByteLimitWriter(t *testing.T) {
+	tests := []struct {
+		limit         int
+		writes        []string
+		want          string
+		wantTruncated bool
+	}{
+		{0, []string{"héllo", " wörld"}, "héllo wörld", false},
+		{13, []string{"héllo", " wörld"}, "héllo wörld", false},
+		{8, []string{"héllo", " wörld"}, "héllo w", true},
+		// A character that does not fit whole is left out
+		{9, []string{"héllo", " wörld"}, "héllo w", true},
+		{10, []string{"héllo", " wörld"}, "héllo wö", true},
+		{2, []string{"héllo"}, "h", true},
+	}
+
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		lw := &byteLimitWriter{w: &buf, limit: tt.limit}
+		for _, s := range tt.writes {
+			// Dropped bytes still count as written, so renderers carry on
+			if n, err := io.WriteString(lw, s); n != len(s) || err != nil {
+				t.Errorf("limit %d: Write(%q) = %d, %v", tt.limit, s, n, err)
+			}
+		}
+		if buf.String() != tt.want || lw.truncated != tt.wantTruncated {
+			t.Errorf("limit %d: wrote %q, truncated %v, want %q, %v", tt.limit, buf.String(), lw.truncated, tt.want, tt.wantTruncated)
+		}
+	}
+}
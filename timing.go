@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Timing breaks an article request down into phases for ?timing=true, in
+// milliseconds. DNS, connect and TLS are 0 when a pooled connection was
+// reused, and every upstream phase is 0 on a cache hit. FetchMs covers the
+// whole upstream request, from sending it to reading the page into a
+// document, and includes the phases before it.
+type Timing struct {
+	DNSMs       float64 `json:"dns_ms"`
+	ConnectMs   float64 `json:"connect_ms"`
+	TLSMs       float64 `json:"tls_ms"`
+	FirstByteMs float64 `json:"first_byte_ms"`
+	FetchMs     float64 `json:"fetch_ms"`
+	ParseMs     float64 `json:"parse_ms"`
+	TotalMs     float64 `json:"total_ms"`
+	Cache       string  `json:"cache"`
+}
+
+// requestTiming collects the phase durations of one request. Connection
+// attempts may report from other goroutines, hence the lock. Several
+// upstream requests, e.g. after a redirect, add up.
+type requestTiming struct {
+	mu    sync.Mutex
+	start time.Time
+
+	dns, connect, tls, firstByte, fetch, parse time.Duration
+}
+
+type timingKey struct{}
+
+// withTiming starts timing a request; fetchHTML and getArticle record their
+// phases into the returned context
+func withTiming(ctx context.Context) (context.Context, *requestTiming) {
+	t := &requestTiming{start: time.Now()}
+	return context.WithValue(ctx, timingKey{}, t), t
+}
+
+// timingFrom returns the requestTiming of ctx, or nil when the request is
+// not timed; addFetch and addParse do nothing on nil
+func timingFrom(ctx context.Context) *requestTiming {
+	t, _ := ctx.Value(timingKey{}).(*requestTiming)
+	return t
+}
+
+// add adds d to the phase *phase
+func (t *requestTiming) add(phase *time.Duration, d time.Duration) {
+	t.mu.Lock()
+	*phase += d
+	t.mu.Unlock()
+}
+
+// addFetch records an upstream request that started at start
+func (t *requestTiming) addFetch(start time.Time) {
+	if t != nil {
+		t.add(&t.fetch, time.Since(start))
+	}
+}
+
+// addParse records content extraction that started at start
+func (t *requestTiming) addParse(start time.Time) {
+	if t != nil {
+		t.add(&t.parse, time.Since(start))
+	}
+}
+
+// clientTrace returns the hooks that time the network phases of an
+// upstream request sent at sent
+func (t *requestTiming) clientTrace(sent time.Time) *httptrace.ClientTrace {
+	var dnsStart, connectStart, tlsStart time.Time
+	var mu sync.Mutex
+	started := func(at *time.Time) {
+		mu.Lock()
+		*at = time.Now()
+		mu.Unlock()
+	}
+	since := func(at *time.Time) time.Duration {
+		mu.Lock()
+		defer mu.Unlock()
+		return time.Since(*at)
+	}
+
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { started(&dnsStart) },
+		DNSDone:  func(httptrace.DNSDoneInfo) { t.add(&t.dns, since(&dnsStart)) },
+		ConnectStart: func(network, addr string) {
+			started(&connectStart)
+		},
+		ConnectDone: func(network, addr string, err error) {
+			t.add(&t.connect, since(&connectStart))
+		},
+		TLSHandshakeStart: func() { started(&tlsStart) },
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.add(&t.tls, since(&tlsStart))
+		},
+		GotFirstResponseByte: func() { t.add(&t.firstByte, time.Since(sent)) },
+	}
+}
+
+// result reports the phases recorded so far, with the total since withTiming
+func (t *requestTiming) result(hit bool) *Timing {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ms := func(d time.Duration) float64 {
+		return float64(d.Microseconds()) / 1000
+	}
+	timing := &Timing{
+		DNSMs:       ms(t.dns),
+		ConnectMs:   ms(t.connect),
+		TLSMs:       ms(t.tls),
+		FirstByteMs: ms(t.firstByte),
+		FetchMs:     ms(t.fetch),
+		ParseMs:     ms(t.parse),
+		TotalMs:     ms(time.Since(t.start)),
+		Cache:       "miss",
+	}
+	if hit {
+		timing.Cache = "hit"
+	}
+	return timing
+}
+
+// serverTiming formats timing as a Server-Timing header value, which
+// browser developer tools show next to the request
+func serverTiming(timing *Timing) string {
+	metrics := []struct {
+		name string
+		ms   float64
+	}{
+		{"dns", timing.DNSMs},
+		{"connect", timing.ConnectMs},
+		{"tls", timing.TLSMs},
+		{"ttfb", timing.FirstByteMs},
+		{"fetch", timing.FetchMs},
+		{"parse", timing.ParseMs},
+		{"total", timing.TotalMs},
+	}
+
+	parts := make([]string, 0, len(metrics)+1)
+	for _, m := range metrics {
+		parts = append(parts, fmt.Sprintf("%s;dur=%.3f", m.name, m.ms))
+	}
+	parts = append(parts, fmt.Sprintf(`cache;desc=%q`, timing.Cache))
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strconv"
+	"testing"
+)
+
+func TestArticleTiming(t *testing.T) {
+	stubUpstream(t, pages{"/page/Foo": articlePage("", "<h1>Foo</h1><p>"+longParagraph+"</p>")})
+
+	metric := regexp.MustCompile(`(\w+);dur=([^,]+)`)
+
+	tests := []struct {
+		name   string
+		target string
+		cache  string // "" when no timing is expected
+	}{
+		{"untimed", "/api/article/Foo", ""},
+		{"miss", "/api/article/Foo?timing=true&nocache=true", "miss"},
+		{"hit", "/api/article/Foo?timing=true", "hit"},
+	}
+
+	for _, tt := range tests {
+		rec := request(t, "GET", tt.target, nil)
+		var article Article
+		if err := json.Unmarshal(rec.Body.Bytes(), &article); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("%s: GET %s = %d %s", tt.name, tt.target, rec.Code, rec.Body.String())
+		}
+		header := rec.Header().Get("Server-Timing")
+
+		if tt.cache == "" {
+			if article.Timing != nil || header != "" {
+				t.Errorf("%s: timing %+v, Server-Timing %q", tt.name, article.Timing, header)
+			}
+			continue
+		}
+		timing := article.Timing
+		if timing == nil {
+			t.Fatalf("%s: no timing in %s", tt.name, rec.Body.String())
+		}
+		if timing.Cache != tt.cache {
+			t.Errorf("%s: cache = %q, want %q", tt.name, timing.Cache, tt.cache)
+		}
+
+		fields := map[string]float64{
+			"dns":     timing.DNSMs,
+			"connect": timing.ConnectMs,
+			"tls":     timing.TLSMs,
+			"ttfb":    timing.FirstByteMs,
+			"fetch":   timing.FetchMs,
+			"parse":   timing.ParseMs,
+			"total":   timing.TotalMs,
+		}
+		for name, ms := range fields {
+			if ms < 0 {
+				t.Errorf("%s: %s = %v, want non-negative", tt.name, name, ms)
+			}
+		}
+		if tt.cache == "miss" && (timing.FetchMs < timing.FirstByteMs || timing.TotalMs < timing.FetchMs) {
+			t.Errorf("%s: phases do not nest: %+v", tt.name, timing)
+		}
+		if tt.cache == "hit" && (timing.FetchMs != 0 || timing.ParseMs != 0) {
+			t.Errorf("%s: upstream phases on a cache hit: %+v", tt.name, timing)
+		}
+
+		// The header carries the same metrics
+		seen := make(map[string]bool)
+		for _, m := range metric.FindAllStringSubmatch(header, -1) {
+			ms, err := strconv.ParseFloat(m[2], 64)
+			if err != nil || ms < 0 {
+				t.Errorf("%s: Server-Timing %s;dur=%s", tt.name, m[1], m[2])
+			}
+			seen[m[1]] = true
+		}
+		for name := range fields {
+			if !seen[name] {
+				t.Errorf("%s: Server-Timing %q lacks %s", tt.name, header, name)
+			}
+		}
+		if want := `cache;desc="` + tt.cache + `"`; !regexp.MustCompile(regexp.QuoteMeta(want) + `$`).MatchString(header) {
+			t.Errorf("%s: Server-Timing %q does not end in %s", tt.name, header, want)
+		}
+	}
+}
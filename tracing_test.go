@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// recordSpans points tracer at an in-memory recorder for the rest of the test
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	t.Cleanup(func() { provider.Shutdown(context.Background()) })
+	setGlobal(t, &tracer, provider.Tracer(serviceName))
+
+	propagator := otel.GetTextMapPropagator()
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() { otel.SetTextMapPropagator(propagator) })
+
+	return recorder
+}
+
+// spanAttrs returns the attributes of span keyed by name
+func spanAttrs(span sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	attrs := make(map[attribute.Key]attribute.Value)
+	for _, kv := range span.Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+	return attrs
+}
+
+func TestArticleTracing(t *testing.T) {
+	stubUpstream(t, pages{"/page/Foo": articlePage("", "<h1>Foo</h1><p>"+longParagraph+"</p>")})
+	recorder := recordSpans(t)
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest("GET", "/api/article/Foo", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	if rec := serve(t, newRouter(""), req); rec.Code != http.StatusOK {
+		t.Fatalf("GET /api/article/Foo = %d", rec.Code)
+	}
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	server, ok := spans["GET /api/article/{path:.*}"]
+	if !ok {
+		t.Fatalf("no server span among %v", recorder.Ended())
+	}
+	fetch, ok := spans["fetchHTML"]
+	if !ok {
+		t.Fatal("no fetchHTML span")
+	}
+
+	if got := server.SpanContext().TraceID().String(); got != traceID {
+		t.Errorf("server span trace ID = %s, want the incoming %s", got, traceID)
+	}
+	if fetch.Parent().SpanID() != server.SpanContext().SpanID() {
+		t.Error("fetchHTML span is not a child of the server span")
+	}
+
+	attrs := spanAttrs(server)
+	if attrs["article.path"].AsString() != "Foo" || attrs["http.status_code"].AsInt64() != http.StatusOK {
+		t.Errorf("server span attributes = %v", server.Attributes())
+	}
+	if attrs := spanAttrs(fetch); attrs["http.status_code"].AsInt64() != http.StatusOK {
+		t.Errorf("fetchHTML span attributes = %v", fetch.Attributes())
+	}
+}
+
+func TestInitTracingWithoutExporter(t *testing.T) {
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+	propagator := otel.GetTextMapPropagator()
+	t.Cleanup(func() { otel.SetTextMapPropagator(propagator) })
+
+	shutdown, err := initTracing(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := shutdown(context.Background()); err != nil {
+		t.Errorf("shutdown = %v", err)
+	}
+	// Without an exporter spans are never recorded
+	if _, span := tracer.Start(context.Background(), "test"); span.IsRecording() {
+		t.Error("span is recording without an exporter")
+	}
+}
@@ -0,0 +1,658 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/chromedp/chromedp"
+)
+
+// headerRecorder serves page and records one request header of every request
+type headerRecorder struct {
+	name string
+	page string
+
+	mu     sync.Mutex
+	values []string
+}
+
+func (h *headerRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	h.values = append(h.values, r.Header.Get(h.name))
+	h.mu.Unlock()
+	w.Write([]byte(h.page))
+}
+
+func (h *headerRecorder) seen() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]string(nil), h.values...)
+}
+
+// resetUserAgentSeq restarts the User-Agent rotation for the test
+func resetUserAgentSeq(t *testing.T) {
+	old := userAgentSeq.Load()
+	userAgentSeq.Store(0)
+	t.Cleanup(func() { userAgentSeq.Store(old) })
+}
+
+func TestUserAgent(t *testing.T) {
+	tests := []struct {
+		name  string
+		agent string
+		pool  []string
+		want  []string
+	}{
+		{"configured", "TestAgent/1.0", nil, []string{"TestAgent/1.0", "TestAgent/1.0"}},
+		{"pool rotates", "TestAgent/1.0", []string{"A/1", "B/2", "C/3"}, []string{"A/1", "B/2", "C/3", "A/1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := &headerRecorder{name: "User-Agent", page: articlePage("", "<p>"+longParagraph+"</p>")}
+			server := stubUpstream(t, upstream)
+			setGlobal(t, &userAgent, tt.agent)
+			setGlobal(t, &userAgentPool, tt.pool)
+			resetUserAgentSeq(t)
+
+			for range tt.want {
+				if _, err := fetchHTML(context.Background(), server.URL+"/page/Foo", ""); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := upstream.seen(); !slices.Equal(got, tt.want) {
+				t.Errorf("User-Agent headers = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBrowserFlagsUserAgent(t *testing.T) {
+	setGlobal(t, &userAgent, "TestAgent/1.0")
+	setGlobal(t, &userAgentPool, nil)
+
+	if got := flagValue(browserFlags(), "user-agent"); got != "TestAgent/1.0" {
+		t.Errorf("user-agent flag = %v, want TestAgent/1.0", got)
+	}
+
+	setGlobal(t, &userAgentPool, []string{"A/1", "B/2"})
+	resetUserAgentSeq(t)
+	for _, want := range []string{"A/1", "B/2", "A/1"} {
+		if got := flagValue(browserFlags(), "user-agent"); got != want {
+			t.Errorf("user-agent flag = %v, want %s", got, want)
+		}
+	}
+}
+
+// flagValue returns the value Chrome ends up with for the named switch:
+// the last one given wins
+func flagValue(flags []chromeFlag, name string) any {
+	var value any
+	for _, flag := range flags {
+		if flag.Name == name {
+			value = flag.Value
+		}
+	}
+	return value
+}
+
+func TestArticleLanguage(t *testing.T) {
+	page := `<!DOCTYPE html><html lang="de-DE"><head><title>Test page</title></head><body><article><h1>Foo</h1><p>` + longParagraph + `</p></article></body></html>`
+
+	tests := []struct {
+		name        string
+		defaultLang string
+		query       string
+		wantHeader  string
+	}{
+		{"no language", "", "", ""},
+		{"default language", "fr", "", "fr"},
+		{"query parameter", "fr", "?lang=de-DE", "de-DE"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := &headerRecorder{name: "Accept-Language", page: page}
+			stubUpstream(t, upstream)
+			setGlobal(t, &defaultLang, tt.defaultLang)
+
+			rec := request(t, "GET", "/api/article/Foo"+tt.query, nil)
+			var article Article
+			if err := json.Unmarshal(rec.Body.Bytes(), &article); err != nil || rec.Code != http.StatusOK {
+				t.Fatalf("GET /api/article/Foo%s = %d %s", tt.query, rec.Code, rec.Body.String())
+			}
+			if got := upstream.seen(); !slices.Equal(got, []string{tt.wantHeader}) {
+				t.Errorf("Accept-Language headers = %q, want %q", got, tt.wantHeader)
+			}
+			if article.Language != "de-DE" {
+				t.Errorf("language = %q, want the page's lang attribute de-DE", article.Language)
+			}
+		})
+	}
+
+	if rec := request(t, "GET", "/api/article/Foo?lang=not+a+language", nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("GET /api/article/Foo?lang=not+a+language = %d, want 400", rec.Code)
+	}
+}
+
+func TestParseChromeFlags(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []chromeFlag
+	}{
+		{"", nil},
+		{"--disable-setuid-sandbox", []chromeFlag{{"disable-setuid-sandbox", true}}},
+		{"remote-debugging-port=9222, headless=false", []chromeFlag{{"remote-debugging-port", "9222"}, {"headless", false}}},
+		{" --lang=de  ,, --incognito ", []chromeFlag{{"lang", "de"}, {"incognito", true}}},
+	}
+
+	for _, tt := range tests {
+		if got := parseChromeFlags(tt.value); !slices.Equal(got, tt.want) {
+			t.Errorf("parseChromeFlags(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+// fakeChrome writes a script that records its command line to a file and
+// exits, standing in for Chrome so the allocator's arguments can be checked
+func fakeChrome(t *testing.T) (execPath string, args func() []string) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a POSIX shell")
+	}
+	dir := t.TempDir()
+	argsFile := filepath.Join(dir, "args")
+	execPath = filepath.Join(dir, "chrome")
+	script := "#!/bin/sh\nprintf '%s\\n' \"$@\" > " + argsFile + "\nexit 1\n"
+	if err := os.WriteFile(execPath, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	return execPath, func() []string {
+		data, err := os.ReadFile(argsFile)
+		if err != nil {
+			t.Fatalf("fake Chrome was not started: %v", err)
+		}
+		return strings.Fields(string(data))
+	}
+}
+
+func TestAllocatorOptions(t *testing.T) {
+	execPath, args := fakeChrome(t)
+	setGlobal(t, &chromeExecPath, execPath)
+	setGlobal(t, &chromeFlags, parseChromeFlags("--disable-setuid-sandbox, remote-debugging-port=9333 headless=false"))
+	setGlobal(t, &userAgent, "TestAgent/1.0")
+	setGlobal(t, &userAgentPool, nil)
+
+	ctx, cancel := newBrowserContext(context.Background())
+	defer cancel()
+	if err := chromedp.Run(ctx); err == nil {
+		t.Fatal("the fake Chrome started, want it to fail")
+	}
+
+	got := args()
+	for _, want := range []string{"--disable-setuid-sandbox", "--remote-debugging-port=9333", "--user-agent=TestAgent/1.0", "--no-sandbox"} {
+		if !slices.Contains(got, want) {
+			t.Errorf("Chrome arguments %q are missing %s", got, want)
+		}
+	}
+	// A flag set to false removes a default
+	if slices.Contains(got, "--headless") {
+		t.Errorf("Chrome arguments %q still contain --headless", got)
+	}
+}
+
+// recordingProxy is a forward HTTP proxy that serves page for every request
+// and records the URLs and Proxy-Authorization headers it was sent
+type recordingProxy struct {
+	page string
+
+	mu    sync.Mutex
+	urls  []string
+	auths []string
+}
+
+func (p *recordingProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	p.urls = append(p.urls, r.URL.String())
+	p.auths = append(p.auths, r.Header.Get("Proxy-Authorization"))
+	p.mu.Unlock()
+	w.Write([]byte(p.page))
+}
+
+func TestUpstreamProxy(t *testing.T) {
+	proxy := &recordingProxy{page: articlePage("", "<h1>Foo</h1><p>"+longParagraph+"</p>")}
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	viaProxy, _ := url.Parse(server.URL)
+	viaProxy.User = url.UserPassword("user", "secret")
+
+	// The upstream host does not exist; only the proxy can answer for it
+	setGlobal(t, &baseURL, "http://grokipedia.invalid")
+	setGlobal(t, &allowedHosts, map[string]bool{"grokipedia.invalid": true})
+	resetState(t)
+	setGlobal(t, &proxyURL, viaProxy)
+	setGlobal(t, &upstreamClient, newUpstreamClient())
+
+	article, err := getArticle(context.Background(), "Foo", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if article.Title != "Foo" {
+		t.Errorf("title = %q, want Foo", article.Title)
+	}
+
+	wantAuth := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:secret"))
+	if !slices.Equal(proxy.urls, []string{"http://grokipedia.invalid/page/Foo"}) || !slices.Equal(proxy.auths, []string{wantAuth}) {
+		t.Errorf("proxy saw %q with credentials %q, want the article URL with %q", proxy.urls, proxy.auths, wantAuth)
+	}
+
+	// Chrome gets the proxy without its credentials, which it answers through interception
+	if got := flagValue(browserFlags(), "proxy-server"); got != server.URL {
+		t.Errorf("proxy-server flag = %v, want %s", got, server.URL)
+	}
+}
+
+func TestCheckAllowedHost(t *testing.T) {
+	setGlobal(t, &allowedHosts, map[string]bool{"grokipedia.com": true, "wiki.example.com:8443": true})
+
+	tests := []struct {
+		url     string
+		allowed bool
+	}{
+		{"https://grokipedia.com/page/Foo", true},
+		{"https://GROKIPEDIA.com/page/Foo", true},
+		// Entries without a port allow any port
+		{"http://grokipedia.com:8080/page/Foo", true},
+		{"https://wiki.example.com:8443/page/Foo", true},
+		{"https://wiki.example.com/page/Foo", false},
+		{"https://evil.com/page/Foo", false},
+		{"https://grokipedia.com.evil.com/page/Foo", false},
+		{"http://127.0.0.1/admin", false},
+		{"/page/Foo", false},
+	}
+
+	for _, tt := range tests {
+		err := checkAllowedHost(tt.url)
+		if tt.allowed && err != nil {
+			t.Errorf("checkAllowedHost(%q) = %v, want it allowed", tt.url, err)
+		}
+		if !tt.allowed && !errors.Is(err, ErrHostNotAllowed) {
+			t.Errorf("checkAllowedHost(%q) = %v, want ErrHostNotAllowed", tt.url, err)
+		}
+	}
+}
+
+func TestFetchAllowedHosts(t *testing.T) {
+	var otherHits atomic.Int32
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		otherHits.Add(1)
+		w.Write([]byte(articlePage("", "<h1>Other</h1><p>"+longParagraph+"</p>")))
+	}))
+	defer other.Close()
+
+	stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/page/Away" {
+			http.Redirect(w, r, other.URL+"/page/Other", http.StatusFound)
+			return
+		}
+		w.Write([]byte(articlePage("", "<h1>Foo</h1><p>"+longParagraph+"</p>")))
+	}))
+
+	tests := []struct {
+		name    string
+		url     string
+		allowed bool
+	}{
+		{"upstream", baseURL + "/page/Foo", true},
+		{"other host", other.URL + "/page/Other", false},
+		// Redirects are checked too
+		{"redirect to other host", baseURL + "/page/Away", false},
+	}
+
+	for _, tt := range tests {
+		_, err := fetchHTML(context.Background(), tt.url, "")
+		if tt.allowed && err != nil {
+			t.Errorf("%s: fetchHTML = %v", tt.name, err)
+		}
+		if !tt.allowed && !errors.Is(err, ErrHostNotAllowed) {
+			t.Errorf("%s: fetchHTML = %v, want ErrHostNotAllowed", tt.name, err)
+		}
+	}
+	if otherHits.Load() != 0 {
+		t.Errorf("the host missing from ALLOWED_HOSTS got %d requests", otherHits.Load())
+	}
+
+	// A refused host is not an upstream failure
+	if err := upstreamBreaker.allow(); err != nil {
+		t.Errorf("breaker after refused hosts: %v", err)
+	}
+}
+
+func TestParseExtraHeaders(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    http.Header
+		wantErr bool
+	}{
+		{"", http.Header{}, false},
+		{"X-Token: abc; x-cdn-bypass: 1", http.Header{"X-Token": {"abc"}, "X-Cdn-Bypass": {"1"}}, false},
+		// Values may contain colons, and with newlines also semicolons
+		{"Cookie: a=1; b=2\nReferer: https://grokipedia.com/\n", http.Header{"Cookie": {"a=1; b=2"}, "Referer": {"https://grokipedia.com/"}}, false},
+		{"X-Tag: a; X-Tag: b", http.Header{"X-Tag": {"a", "b"}}, false},
+		{"X-Empty:", http.Header{"X-Empty": {""}}, false},
+		{"NoColon", nil, true},
+		{"Bad Name: value", nil, true},
+		{": value", nil, true},
+		{"X-Token: a\x00b", nil, true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseExtraHeaders(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseExtraHeaders(%q) error = %v, want error %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !maps.EqualFunc(got, tt.want, slices.Equal) {
+			t.Errorf("parseExtraHeaders(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestExtraRequestHeaders(t *testing.T) {
+	var mu sync.Mutex
+	var got http.Header
+	server := stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		got = r.Header.Clone()
+		mu.Unlock()
+		w.Write([]byte(articlePage("", "<p>"+longParagraph+"</p>")))
+	}))
+	headers, err := parseExtraHeaders("Authorization: Bearer secret\nCookie: session=1; cdn=bypass\nUser-Agent: Custom/1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setGlobal(t, &extraRequestHeaders, headers)
+	setGlobal(t, &userAgent, "TestAgent/1.0")
+	setGlobal(t, &userAgentPool, nil)
+
+	if _, err := fetchHTML(context.Background(), server.URL+"/page/Foo", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := map[string]string{
+		"Authorization": "Bearer secret",
+		"Cookie":        "session=1; cdn=bypass",
+		// Configured headers win over the built-in ones
+		"User-Agent": "Custom/1.0",
+	}
+	for name, value := range want {
+		if got.Get(name) != value || len(got.Values(name)) != 1 {
+			t.Errorf("%s = %q, want %q", name, got.Values(name), value)
+		}
+	}
+}
+
+// remoteAddrRecorder serves page and records the client address of every
+// request; requests over the same connection share one
+type remoteAddrRecorder struct {
+	page string
+
+	mu    sync.Mutex
+	addrs map[string]int
+}
+
+func (h *remoteAddrRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	if h.addrs == nil {
+		h.addrs = make(map[string]int)
+	}
+	h.addrs[r.RemoteAddr]++
+	h.mu.Unlock()
+	w.Write([]byte(h.page))
+}
+
+func (h *remoteAddrRecorder) connections() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.addrs)
+}
+
+func TestUpstreamConnectionReuse(t *testing.T) {
+	upstream := &remoteAddrRecorder{page: articlePage("", "<h1>Foo</h1><p>"+longParagraph+"</p>")}
+	server := stubUpstream(t, upstream)
+	setGlobal(t, &upstreamClient, newUpstreamClient())
+
+	for i := range 10 {
+		if _, err := fetchHTML(context.Background(), server.URL+"/page/Foo", ""); err != nil {
+			t.Fatalf("fetch %d: %v", i, err)
+		}
+	}
+	if n := upstream.connections(); n != 1 {
+		t.Errorf("10 sequential fetches opened %d connections, want 1", n)
+	}
+}
+
+func TestNewUpstreamClient(t *testing.T) {
+	setGlobal(t, &upstreamMaxIdleConns, 7)
+	setGlobal(t, &upstreamMaxIdleConnsPerHost, 3)
+	setGlobal(t, &upstreamIdleConnTimeout, 5*time.Second)
+
+	transport, ok := newUpstreamClient().Transport.(*http.Transport)
+	if !ok {
+		t.Fatal("upstream client has no *http.Transport")
+	}
+	if transport.MaxIdleConns != 7 || transport.MaxIdleConnsPerHost != 3 || transport.IdleConnTimeout != 5*time.Second {
+		t.Errorf("pool: %d idle, %d per host, %v timeout", transport.MaxIdleConns, transport.MaxIdleConnsPerHost, transport.IdleConnTimeout)
+	}
+	if !transport.ForceAttemptHTTP2 {
+		t.Error("HTTP/2 is not attempted")
+	}
+}
+
+func BenchmarkFetchHTML(b *testing.B) {
+	page := articlePage("", "<h1>Foo</h1><p>"+longParagraph+"</p>")
+	server := httptest.NewServer(pages{"/page/Foo": page})
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+	hosts := map[string]bool{u.Host: true}
+
+	// A client per fetch, without keep-alives, is the cost of not pooling
+	for _, bm := range []struct {
+		name     string
+		perFetch bool
+	}{
+		{"shared client", false},
+		{"client per fetch", true},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			oldClient, oldHosts, oldBreaker := upstreamClient, allowedHosts, upstreamBreaker
+			defer func() { upstreamClient, allowedHosts, upstreamBreaker = oldClient, oldHosts, oldBreaker }()
+			allowedHosts, upstreamBreaker = hosts, newTestBreaker(0)
+			upstreamClient = newUpstreamClient()
+
+			for range b.N {
+				if bm.perFetch {
+					upstreamClient = newUpstreamClient()
+					upstreamClient.Transport.(*http.Transport).DisableKeepAlives = true
+				}
+				if _, err := fetchHTML(context.Background(), server.URL+"/page/Foo", ""); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestFetchCompressed(t *testing.T) {
+	page := articlePage("", "<h1>Café</h1><p>"+strings.Repeat(longParagraph+" ", 200)+"</p>")
+	compress := func(encoding string) []byte {
+		var buf bytes.Buffer
+		var w io.WriteCloser
+		switch encoding {
+		case "gzip":
+			w = gzip.NewWriter(&buf)
+		case "deflate":
+			w = zlib.NewWriter(&buf)
+		case "raw deflate":
+			w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+		default:
+			return []byte(page)
+		}
+		w.Write([]byte(page))
+		w.Close()
+		return buf.Bytes()
+	}
+
+	tests := []struct {
+		name           string
+		acceptEncoding string // EXTRA_REQUEST_HEADERS Accept-Encoding, if any
+		encoding       string // what the stub sends
+		wantErr        bool
+	}{
+		// The transport asks for gzip and decodes it before fetchHTML sees it
+		{"transport gzip", "", "gzip", false},
+		{"identity", "", "", false},
+		// A configured Accept-Encoding leaves the decoding to decodedBody
+		{"configured gzip", "gzip", "gzip", false},
+		{"configured deflate", "deflate", "deflate", false},
+		{"configured raw deflate", "deflate", "raw deflate", false},
+		{"unsupported encoding", "br", "br", true},
+	}
+
+	for _, tt := range tests {
+		body := compress(tt.encoding)
+		var gotAccept string
+		server := stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			gotAccept = r.Header.Get("Accept-Encoding")
+			if tt.encoding != "" {
+				w.Header().Set("Content-Encoding", strings.TrimPrefix(tt.encoding, "raw "))
+			}
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write(body)
+		}))
+		var headers http.Header
+		if tt.acceptEncoding != "" {
+			headers = http.Header{"Accept-Encoding": {tt.acceptEncoding}}
+		}
+		setGlobal(t, &extraRequestHeaders, headers)
+
+		doc, err := fetchHTML(context.Background(), server.URL+"/page/Foo", "")
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: fetched a page in an unsupported encoding", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := doc.Find("h1").Text(); got != "Café" {
+			t.Errorf("%s: h1 = %q, want Café", tt.name, got)
+		}
+		if want := cmp.Or(tt.acceptEncoding, "gzip"); gotAccept != want {
+			t.Errorf("%s: Accept-Encoding = %q, want %q", tt.name, gotAccept, want)
+		}
+		if tt.encoding == "gzip" && len(body) >= len(page)/4 {
+			t.Errorf("%s: %d compressed bytes for a %d byte page", tt.name, len(body), len(page))
+		}
+	}
+}
+
+func TestFetchSizeLimit(t *testing.T) {
+	const limit = 64 << 10
+	page := articlePage("", "<h1>Foo</h1><p>"+longParagraph+"</p>")
+	padded := func(n int) []byte {
+		return []byte(page + "<!--" + strings.Repeat("x", n-len(page)-7) + "-->")
+	}
+	var bomb bytes.Buffer
+	zw := gzip.NewWriter(&bomb)
+	zw.Write(padded(100 * limit))
+	zw.Close()
+
+	tests := []struct {
+		name  string
+		limit int64
+		serve func(w http.ResponseWriter) int64 // returns the bytes it wrote
+		want  error
+	}{
+		{"under the limit", limit, func(w http.ResponseWriter) int64 {
+			n, _ := w.Write(padded(limit))
+			return int64(n)
+		}, nil},
+		// Streamed without a Content-Length, so only reading can tell
+		{"endless stream", limit, func(w http.ResponseWriter) int64 {
+			var written int64
+			chunk := []byte(strings.Repeat("<p>more</p>", 1000))
+			w.Write([]byte(page))
+			for written < 1000*limit {
+				n, err := w.Write(chunk)
+				written += int64(n)
+				if err != nil {
+					break
+				}
+				w.(http.Flusher).Flush()
+			}
+			return written
+		}, ErrPageTooLarge},
+		{"declared too large", limit, func(w http.ResponseWriter) int64 {
+			w.Header().Set("Content-Length", fmt.Sprint(2*limit))
+			n, _ := w.Write(padded(2 * limit))
+			return int64(n)
+		}, ErrPageTooLarge},
+		// Small on the wire, large once decoded
+		{"compressed", limit, func(w http.ResponseWriter) int64 {
+			w.Header().Set("Content-Encoding", "gzip")
+			n, _ := w.Write(bomb.Bytes())
+			return int64(n)
+		}, ErrPageTooLarge},
+		{"unlimited", 0, func(w http.ResponseWriter) int64 {
+			n, _ := w.Write(padded(2 * limit))
+			return int64(n)
+		}, nil},
+	}
+
+	for _, tt := range tests {
+		written := make(chan int64, 1)
+		server := stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			written <- tt.serve(w)
+		}))
+		setGlobal(t, &maxFetchBytes, tt.limit)
+
+		_, err := fetchHTML(context.Background(), server.URL+"/page/Foo", "")
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.want)
+		}
+		// The stream is cut off rather than read to the end
+		if n := <-written; tt.name == "endless stream" && n >= 1000*limit {
+			t.Errorf("%s: the server wrote all %d bytes", tt.name, n)
+		}
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultWatchInterval = 10 * time.Minute
+	defaultMaxWatches    = 100
+	webhookTimeout       = 10 * time.Second
+)
+
+// ErrWebhookTargetBlocked is returned when a webhook URL points at a
+// loopback, private, link-local or unspecified address
+var ErrWebhookTargetBlocked = errors.New("webhook target is not a public address")
+
+var (
+	// watchInterval is how often watched articles are re-fetched
+	watchInterval = defaultWatchInterval
+	// maxWatches caps the number of registered watches (MAX_WATCHES, 0 = unlimited)
+	maxWatches = defaultMaxWatches
+
+	watches = &watchStore{watches: make(map[string]*Watch)}
+
+	// webhookClient refuses to connect to non-public addresses. The check
+	// runs on the resolved address at dial time, so a hostname resolving to
+	// an internal service is caught too. Redirects are not followed, and no
+	// proxy is used since it would hide the real target.
+	webhookClient = &http.Client{
+		Timeout: webhookTimeout,
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{
+				Timeout: webhookTimeout,
+				Control: webhookDialControl,
+			}).DialContext,
+			TLSHandshakeTimeout: webhookTimeout,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+)
+
+// Watch is an article being monitored for content changes
+type Watch struct {
+	ID         string `json:"id"`
+	Path       string `json:"path"`
+	WebhookURL string `json:"webhook_url"`
+	CreatedAt  string `json:"created_at"`
+	LastHash   string `json:"last_hash"`
+	LastCheck  string `json:"last_checked,omitempty"`
+
+	lastSummary string
+}
+
+// WatchRequest is the body accepted by POST /api/watch
+type WatchRequest struct {
+	Path       string `json:"path"`
+	WebhookURL string `json:"webhook_url"`
+}
+
+// WebhookPayload is POSTed to a watch's webhook when its article changes
+type WebhookPayload struct {
+	WatchID    string `json:"watch_id"`
+	Path       string `json:"path"`
+	URL        string `json:"url"`
+	Title      string `json:"title"`
+	OldHash    string `json:"old_hash"`
+	NewHash    string `json:"new_hash"`
+	OldSummary string `json:"old_summary"`
+	NewSummary string `json:"new_summary"`
+	ChangedAt  string `json:"changed_at"`
+}
+
+// watchStore holds the registered watches in memory
+type watchStore struct {
+	mu      sync.Mutex
+	watches map[string]*Watch
+}
+
+// add registers w unless limit (0 = unlimited) watches already exist
+func (s *watchStore) add(w *Watch, limit int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if limit > 0 && len(s.watches) >= limit {
+		return false
+	}
+	s.watches[w.ID] = w
+	return true
+}
+
+func (s *watchStore) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.watches)
+}
+
+func (s *watchStore) remove(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.watches[id]
+	delete(s.watches, id)
+	return ok
+}
+
+// list returns copies of all watches ordered by creation time
+func (s *watchStore) list() []Watch {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := make([]Watch, 0, len(s.watches))
+	for _, w := range s.watches {
+		list = append(list, *w)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt < list[j].CreatedAt })
+
+	return list
+}
+
+// update records the result of a check, returning false if the watch was removed meanwhile
+func (s *watchStore) update(id, hash, summary string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w, ok := s.watches[id]
+	if !ok {
+		return false
+	}
+	w.LastHash = hash
+	w.lastSummary = summary
+	w.LastCheck = time.Now().Format(time.RFC3339)
+
+	return true
+}
+
+// contentHash returns the hex sha256 of an article's content with runs of
+// whitespace collapsed, so a change in line breaks or indentation alone
+// does not count as a change
+func contentHash(content string) string {
+	sum := sha256.Sum256([]byte(strings.Join(strings.Fields(content), " ")))
+	return hex.EncodeToString(sum[:])
+}
+
+// publicAddr reports whether addr may be a webhook target: anything but
+// loopback, private (RFC 1918 and fc00::/7), link-local (including the
+// 169.254.169.254 metadata service), multicast and unspecified addresses
+func publicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsValid() &&
+		!addr.IsLoopback() &&
+		!addr.IsPrivate() &&
+		!addr.IsLinkLocalUnicast() &&
+		!addr.IsLinkLocalMulticast() &&
+		!addr.IsInterfaceLocalMulticast() &&
+		!addr.IsMulticast() &&
+		!addr.IsUnspecified()
+}
+
+// webhookDialControl refuses connections to addresses publicAddr rejects
+func webhookDialControl(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	if !publicAddr(addr) {
+		return fmt.Errorf("%w: %s", ErrWebhookTargetBlocked, addr)
+	}
+	return nil
+}
+
+// redactWebhookURL keeps only the scheme and host of a webhook URL, since
+// its path and query often carry a secret
+func redactWebhookURL(webhookURL string) string {
+	u, err := url.Parse(webhookURL)
+	if err != nil {
+		return ""
+	}
+	return (&url.URL{Scheme: u.Scheme, Host: u.Host}).String()
+}
+
+// newWatchID returns a random identifier for a watch
+func newWatchID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// runWatcher re-checks every watched article each watchInterval
+func runWatcher() {
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for _, w := range watches.list() {
+			checkWatch(w)
+		}
+	}
+}
+
+// checkWatch re-fetches a watched article and notifies its webhook if the content hash changed
+func checkWatch(w Watch) {
+	// DENY_PATHS may have changed since the watch was created
+	if denyPaths.denies(w.Path) {
+		log.Printf("Watch %s: %s is blocked by DENY_PATHS, skipping", w.ID, w.Path)
+		return
+	}
+
+	article, err := getArticle(context.Background(), w.Path, "", "")
+	if err != nil {
+		log.Printf("Watch %s: failed to fetch %s: %v", w.ID, w.Path, err)
+		return
+	}
+	if u, err := url.Parse(article.URL); err == nil && u.Path != w.Path && denyPaths.denies(u.Path) {
+		log.Printf("Watch %s: %s redirected to %s, which is blocked by DENY_PATHS, skipping", w.ID, w.Path, normalizePath(u.Path))
+		return
+	}
+
+	hash := article.ContentHash
+	if !watches.update(w.ID, hash, article.Summary) || hash == w.LastHash {
+		return
+	}
+
+	log.Printf("Watch %s: %s changed, notifying %s", w.ID, w.Path, redactWebhookURL(w.WebhookURL))
+
+	payload := WebhookPayload{
+		WatchID:    w.ID,
+		Path:       w.Path,
+		URL:        article.URL,
+		Title:      article.Title,
+		OldHash:    w.LastHash,
+		NewHash:    hash,
+		OldSummary: w.lastSummary,
+		NewSummary: article.Summary,
+		ChangedAt:  time.Now().Format(time.RFC3339),
+	}
+	if err := sendWebhook(w.WebhookURL, payload); err != nil {
+		log.Printf("Watch %s: webhook failed: %v", w.ID, err)
+	}
+}
+
+// sendWebhook POSTs payload as JSON to webhookURL
+func sendWebhook(webhookURL string, payload WebhookPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	resp, err := webhookClient.Post(webhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned status code %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// Handlers
+
+func createWatchHandler(w http.ResponseWriter, r *http.Request) {
+	var req WatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			sendError(w, http.StatusRequestEntityTooLarge, codePayloadTooLarge, fmt.Sprintf("Request body exceeds %d bytes", maxErr.Limit))
+			return
+		}
+		sendError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Invalid JSON body: %v", err))
+		return
+	}
+
+	if req.Path == "" {
+		sendError(w, http.StatusBadRequest, codeInvalidRequest, "Field 'path' is required")
+		return
+	}
+
+	hook, err := url.Parse(req.WebhookURL)
+	if err != nil || (hook.Scheme != "http" && hook.Scheme != "https") || hook.Host == "" {
+		sendError(w, http.StatusBadRequest, codeInvalidRequest, "Field 'webhook_url' must be an absolute http(s) URL")
+		return
+	}
+	// Hostnames are checked when the webhook is called; literal addresses
+	// can be refused straight away
+	if addr, err := netip.ParseAddr(strings.Trim(hook.Hostname(), "[]")); err == nil && !publicAddr(addr) {
+		sendError(w, http.StatusBadRequest, codeInvalidRequest, "Field 'webhook_url' must not point at a loopback, private or link-local address")
+		return
+	}
+
+	if maxWatches > 0 && watches.count() >= maxWatches {
+		sendError(w, http.StatusConflict, codeWatchLimitReached, fmt.Sprintf("At most %d watches can be registered", maxWatches))
+		return
+	}
+
+	if _, err := articleURL(req.Path); err != nil {
+		sendError(w, http.StatusBadRequest, errorCode(err, codeInvalidPath), err.Error())
+		return
+	}
+
+	path := normalizePath(req.Path)
+	if denyPaths.denies(path) {
+		sendError(w, http.StatusForbidden, codePathDenied, fmt.Sprintf("Article %s is blocked on this server", path))
+		return
+	}
+
+	// Fetch once up front to validate the path and record the baseline hash
+	article, err := getArticle(r.Context(), path, "", "")
+	if err != nil {
+		if errors.Is(err, ErrArticleNotFound) {
+			sendError(w, http.StatusNotFound, codeArticleNotFound, "Article not found")
+			return
+		}
+		sendError(w, upstreamErrorStatus(err), errorCode(err, codeUpstreamError), fmt.Sprintf("Failed to fetch article: %v", err))
+		return
+	}
+	// A redirect may have led to a blocked page
+	if u, err := url.Parse(article.URL); err == nil && u.Path != path && denyPaths.denies(u.Path) {
+		sendError(w, http.StatusForbidden, codePathDenied, fmt.Sprintf("Article %s is blocked on this server", normalizePath(u.Path)))
+		return
+	}
+
+	id, err := newWatchID()
+	if err != nil {
+		sendError(w, http.StatusInternalServerError, codeInternalError, "Failed to create watch")
+		return
+	}
+
+	watch := &Watch{
+		ID:          id,
+		Path:        path,
+		WebhookURL:  hook.String(),
+		CreatedAt:   time.Now().Format(time.RFC3339Nano),
+		LastHash:    article.ContentHash,
+		LastCheck:   time.Now().Format(time.RFC3339),
+		lastSummary: article.Summary,
+	}
+	if !watches.add(watch, maxWatches) {
+		sendError(w, http.StatusConflict, codeWatchLimitReached, fmt.Sprintf("At most %d watches can be registered", maxWatches))
+		return
+	}
+
+	log.Printf("Watch %s: watching %s every %v", id, path, watchInterval)
+
+	writeJSON(w, http.StatusCreated, watch, wantPretty(r))
+}
+
+// listWatchesHandler lists the watches with their webhook URLs redacted
+func listWatchesHandler(w http.ResponseWriter, r *http.Request) {
+	list := watches.list()
+	for i := range list {
+		list[i].WebhookURL = redactWebhookURL(list[i].WebhookURL)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"interval": watchInterval.String(),
+		"count":    len(list),
+		"watches":  list,
+	}, wantPretty(r))
+}
+
+func deleteWatchHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if !watches.remove(id) {
+		sendError(w, http.StatusNotFound, codeWatchNotFound, "Watch not found")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
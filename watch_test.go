@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// resetWatches starts the test with no watches registered
+func resetWatches(t *testing.T) {
+	setGlobal(t, &watches, &watchStore{watches: make(map[string]*Watch)})
+}
+
+// webhookRecorder is a webhook endpoint recording the payloads it receives
+type webhookRecorder struct {
+	mu       sync.Mutex
+	payloads []WebhookPayload
+}
+
+func (h *webhookRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var payload WebhookPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.mu.Lock()
+	h.payloads = append(h.payloads, payload)
+	h.mu.Unlock()
+}
+
+func (h *webhookRecorder) received() []WebhookPayload {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]WebhookPayload(nil), h.payloads...)
+}
+
+func TestCheckWatch(t *testing.T) {
+	var content atomic.Value
+	content.Store("The original paragraph of the article, long enough to be its summary.")
+	stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pages{"/page/Foo": articlePage("", "<h1>Foo</h1><p>"+content.Load().(string)+"</p>")}.ServeHTTP(w, r)
+	}))
+	resetWatches(t)
+
+	hook := &webhookRecorder{}
+	hookServer := httptest.NewServer(hook)
+	defer hookServer.Close()
+	// The test webhook listens on loopback, which the real client refuses
+	setGlobal(t, &webhookClient, hookServer.Client())
+
+	baseline, err := getArticle(context.Background(), "/page/Foo", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	watches.add(&Watch{ID: "w1", Path: "/page/Foo", WebhookURL: hookServer.URL, LastHash: baseline.ContentHash, lastSummary: baseline.Summary}, 0)
+
+	steps := []struct {
+		name    string
+		content string
+		want    int
+	}{
+		{"unchanged content", "The original paragraph of the article, long enough to be its summary.", 0},
+		{"whitespace only", "The original   paragraph of the article,\nlong enough to be its summary.", 0},
+		{"changed content", "The updated paragraph of the article, long enough to be its summary.", 1},
+		{"changed again", "The final paragraph of the article, long enough to be its summary.", 2},
+	}
+
+	for _, step := range steps {
+		content.Store(step.content)
+		checkWatch(watches.list()[0])
+		if got := len(hook.received()); got != step.want {
+			t.Errorf("%s: %d webhook calls, want %d", step.name, got, step.want)
+		}
+	}
+
+	payloads := hook.received()
+	if len(payloads) != 2 {
+		t.Fatalf("%d webhook payloads, want 2", len(payloads))
+	}
+	first, second := payloads[0], payloads[1]
+	if first.WatchID != "w1" || first.Path != "/page/Foo" || first.Title != "Foo" {
+		t.Errorf("payload = %+v", first)
+	}
+	if first.OldSummary != steps[0].content || first.NewSummary != steps[2].content {
+		t.Errorf("payload summaries = %q -> %q", first.OldSummary, first.NewSummary)
+	}
+	if first.OldHash != baseline.ContentHash || second.OldHash != first.NewHash || second.NewHash == second.OldHash {
+		t.Errorf("payload hashes = %s -> %s -> %s, want them to start at the baseline %s", first.OldHash, first.NewHash, second.NewHash, baseline.ContentHash)
+	}
+
+	// Once DENY_PATHS covers the article, changes go unreported
+	denylist, err := parseDenyPaths("Foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setGlobal(t, &denyPaths, denylist)
+	content.Store("A blocked paragraph of the article, long enough to be its summary.")
+	checkWatch(watches.list()[0])
+	if got := len(hook.received()); got != 2 {
+		t.Errorf("blocked article: %d webhook calls, want 2", got)
+	}
+}
+
+func TestPublicAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"fd00::1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"224.0.0.1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:10.0.0.1", false},
+	}
+
+	for _, tt := range tests {
+		if got := publicAddr(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("publicAddr(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestWebhookClientRefusesInternalTargets(t *testing.T) {
+	var hits atomic.Int32
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { hits.Add(1) }))
+	defer internal.Close()
+
+	targets := []string{
+		internal.URL,
+		strings.Replace(internal.URL, "127.0.0.1", "localhost", 1),
+		"http://169.254.169.254/latest/meta-data/",
+		"http://0.0.0.0:1/",
+		"http://[::1]:1/",
+	}
+	for _, target := range targets {
+		err := sendWebhook(target, WebhookPayload{WatchID: "w1"})
+		if !errors.Is(err, ErrWebhookTargetBlocked) {
+			t.Errorf("sendWebhook(%s) error = %v, want ErrWebhookTargetBlocked", target, err)
+		}
+	}
+	if hits.Load() != 0 {
+		t.Errorf("the internal server received %d requests", hits.Load())
+	}
+}
+
+func TestWebhookRedirectNotFollowed(t *testing.T) {
+	var hits atomic.Int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { hits.Add(1) }))
+	defer target.Close()
+	redirector := httptest.NewServer(http.RedirectHandler(target.URL, http.StatusTemporaryRedirect))
+	defer redirector.Close()
+
+	// Keep the redirect policy but allow the loopback test servers
+	client := *webhookClient
+	client.Transport = nil
+	setGlobal(t, &webhookClient, &client)
+
+	if err := sendWebhook(redirector.URL, WebhookPayload{WatchID: "w1"}); err == nil {
+		t.Error("sendWebhook through a redirect succeeded, want an error")
+	}
+	if hits.Load() != 0 {
+		t.Errorf("the redirect target received %d requests", hits.Load())
+	}
+}
+
+func TestCreateWatch(t *testing.T) {
+	stubUpstream(t, pages{"/page/Foo": articlePage("", "<h1>Foo</h1><p>"+longParagraph+"</p>")})
+	resetWatches(t)
+	setGlobal(t, &maxWatches, 2)
+
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantCode   string
+	}{
+		{"not JSON", `{`, http.StatusBadRequest, codeInvalidRequest},
+		{"missing path", `{"webhook_url":"https://example.com/hook"}`, http.StatusBadRequest, codeInvalidRequest},
+		{"not http", `{"path":"Foo","webhook_url":"ftp://example.com/hook"}`, http.StatusBadRequest, codeInvalidRequest},
+		{"loopback", `{"path":"Foo","webhook_url":"http://127.0.0.1:8080/hook"}`, http.StatusBadRequest, codeInvalidRequest},
+		{"metadata service", `{"path":"Foo","webhook_url":"http://169.254.169.254/latest"}`, http.StatusBadRequest, codeInvalidRequest},
+		{"private IPv6", `{"path":"Foo","webhook_url":"http://[fd00::1]/hook"}`, http.StatusBadRequest, codeInvalidRequest},
+		{"unknown article", `{"path":"Missing","webhook_url":"https://example.com/hook"}`, http.StatusNotFound, codeArticleNotFound},
+		{"first", `{"path":"Foo","webhook_url":"https://example.com/hook?token=secret"}`, http.StatusCreated, ""},
+		{"second", `{"path":"Foo","webhook_url":"https://example.org/hook"}`, http.StatusCreated, ""},
+		{"over the limit", `{"path":"Foo","webhook_url":"https://example.net/hook"}`, http.StatusConflict, codeWatchLimitReached},
+	}
+
+	for _, tt := range tests {
+		rec := request(t, "POST", "/api/watch", strings.NewReader(tt.body))
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%s: POST /api/watch = %d, want %d", tt.name, rec.Code, tt.wantStatus)
+			continue
+		}
+		if tt.wantCode != "" {
+			if body := decodeError(t, rec); body.Code != tt.wantCode {
+				t.Errorf("%s: code = %q, want %q", tt.name, body.Code, tt.wantCode)
+			}
+		}
+	}
+
+	// The list hides everything but the scheme and host of the webhooks
+	rec := request(t, "GET", "/api/watch", nil)
+	if strings.Contains(rec.Body.String(), "secret") || strings.Contains(rec.Body.String(), "/hook") {
+		t.Errorf("GET /api/watch leaks webhook URLs: %s", rec.Body.String())
+	}
+	var list struct {
+		Watches []Watch `json:"watches"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Watches) != 2 || list.Watches[0].WebhookURL != "https://example.com" {
+		t.Errorf("watches = %+v", list.Watches)
+	}
+}
+
+func TestWatchRoutesRequireAdminToken(t *testing.T) {
+	resetWatches(t)
+	setGlobal(t, &adminToken, "s3cret")
+
+	tests := []struct {
+		method string
+		target string
+	}{
+		{"POST", "/api/watch"},
+		{"GET", "/api/watch"},
+		{"DELETE", "/api/watch/w1"},
+	}
+
+	for _, tt := range tests {
+		rec := request(t, tt.method, tt.target, strings.NewReader(`{}`))
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s %s without the token = %d, want 401", tt.method, tt.target, rec.Code)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/api/watch", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	if rec := serve(t, newRouter(""), req); rec.Code != http.StatusOK {
+		t.Errorf("GET /api/watch with the token = %d, want 200", rec.Code)
+	}
+}
+
+func TestContentHash(t *testing.T) {
+	// sha256 of "Foo bar.\nBaz." with its whitespace collapsed to "Foo bar. Baz."
+	const want = "934bdb429306de9c72024dd09f0a5101a8980d045e8273c950089a303f026fdb"
+
+	tests := []struct {
+		content string
+		same    bool
+	}{
+		{"Foo bar. Baz.", true},
+		{"Foo bar.\n\nBaz.", true},
+		{"  Foo\tbar.\r\n Baz.  ", true},
+		{"Foo bar. Baz!", false},
+		{"Foobar. Baz.", false},
+		{"", false},
+	}
+
+	reference := contentHash("Foo bar.\nBaz.")
+	if reference != want {
+		t.Errorf("contentHash = %s, want %s", reference, want)
+	}
+	for _, tt := range tests {
+		// The hash depends on nothing but the content
+		got := contentHash(tt.content)
+		if again := contentHash(tt.content); again != got {
+			t.Errorf("contentHash(%q) changed from %s to %s", tt.content, got, again)
+		}
+		if (got == reference) != tt.same {
+			t.Errorf("contentHash(%q) = %s, same as the reference %v, want %v", tt.content, got, got == reference, tt.same)
+		}
+	}
+}
+
+func TestArticleContentHash(t *testing.T) {
+	stubUpstream(t, pages{
+		"/page/Foo":      articlePage("", "<h1>Foo</h1><p>"+longParagraph+"</p><p>Second paragraph of the article.</p>"),
+		"/page/Indented": articlePage("", "<h1>Foo</h1>\n  <p>\n    "+strings.ReplaceAll(longParagraph, " ", "\n    ")+"\n  </p>\n  <p>Second   paragraph of the article.</p>"),
+		"/page/Edited":   articlePage("", "<h1>Foo</h1><p>"+longParagraph+"</p><p>Second paragraph of the edited article.</p>"),
+	})
+
+	fetch := func(target string) Article {
+		t.Helper()
+		resetState(t)
+		rec := request(t, "GET", target, nil)
+		var article Article
+		if err := json.Unmarshal(rec.Body.Bytes(), &article); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("GET %s = %d %s", target, rec.Code, rec.Body.String())
+		}
+		return article
+	}
+
+	foo := fetch("/api/article/Foo")
+	if foo.ContentHash != contentHash(foo.Content) || foo.ContentLength != len(foo.Content) {
+		t.Errorf("content_hash %s, content_length %d for %d bytes of content", foo.ContentHash, foo.ContentLength, len(foo.Content))
+	}
+
+	tests := []struct {
+		target string
+		same   bool
+	}{
+		{"/api/article/Foo", true},
+		// Different markup, same text
+		{"/api/article/Indented", true},
+		// Response options do not change the hash or the length
+		{"/api/article/Foo?max_bytes=20", true},
+		{"/api/article/Foo?separator=%0A", true},
+		{"/api/article/Edited", false},
+	}
+	for _, tt := range tests {
+		article := fetch(tt.target)
+		if (article.ContentHash == foo.ContentHash) != tt.same {
+			t.Errorf("GET %s: content_hash %s, want same as %s: %v", tt.target, article.ContentHash, foo.ContentHash, tt.same)
+		}
+		if tt.same && article.ContentLength != foo.ContentLength {
+			t.Errorf("GET %s: content_length %d, want %d", tt.target, article.ContentLength, foo.ContentLength)
+		}
+	}
+}